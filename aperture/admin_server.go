@@ -0,0 +1,729 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/motxx/aperture-lnproxy/aperture/adminrpc"
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
+	"github.com/motxx/aperture-lnproxy/aperture/auth"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
+	"github.com/motxx/aperture-lnproxy/aperture/freebie"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+	"github.com/motxx/aperture-lnproxy/aperture/pricer"
+	"github.com/motxx/aperture-lnproxy/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// adminGRPCPrefix is the prefix a gRPC request URI has when it is
+	// meant for the adminrpc server to be handled.
+	adminGRPCPrefix = "/adminrpc.Admin/"
+
+	// adminRESTPrefix is the prefix a REST request URI has when it is
+	// meant for the adminrpc server to be handled.
+	adminRESTPrefix = "/v1/aperture/admin/"
+
+	// defaultAdminMacaroonFilename is the default file name of the admin
+	// macaroon in the data directory.
+	defaultAdminMacaroonFilename = "admin.macaroon"
+
+	// defaultAdminRootKeyFilename is the default file name of the root key
+	// of the admin macaroon in the data directory.
+	defaultAdminRootKeyFilename = "admin.rootkey"
+
+	// adminMacaroonLocation is the location of the admin macaroon.
+	adminMacaroonLocation = "aperture"
+
+	// adminMacaroonID is the identifier of the admin macaroon.
+	adminMacaroonID = "admin"
+
+	// adminRootKeySize is the size of the root key of the admin macaroon.
+	adminRootKeySize = 32
+
+	// macaroonMetadataKey is the metadata field the hex encoded admin
+	// macaroon is expected in. REST clients set it through the
+	// Grpc-Metadata-Macaroon header.
+	macaroonMetadataKey = "macaroon"
+
+	// defaultListTokensLimit is the number of tokens returned by
+	// ListTokens if no limit is requested.
+	defaultListTokensLimit = 100
+
+	// challengerNone, challengerLnd and challengerLnproxy are the kinds of
+	// challengers reported by GetChallengerHealth.
+	challengerNone    = "none"
+	challengerLnd     = "lnd"
+	challengerLnproxy = "lnproxy"
+)
+
+// serviceManager gives access to the backend services of the running proxy.
+type serviceManager interface {
+	// Services returns the backend services that are currently proxied.
+	Services() []*proxy.Service
+
+	// ModifyServices replaces the backend services that are proxied with
+	// the ones returned by f, which is passed the current services.
+	// Changes are serialized, so f sees the result of the previous change.
+	ModifyServices(f func([]*proxy.Service) ([]*proxy.Service,
+		error)) error
+}
+
+// A compile time flag to ensure the Aperture satisfies the serviceManager
+// interface.
+var _ serviceManager = (*Aperture)(nil)
+
+// tokenStore is the part of the secrets store that is needed to inspect and
+// revoke issued L402s.
+type tokenStore interface {
+	// ListSecrets returns information about the issued L402s that match
+	// the given query.
+	ListSecrets(ctx context.Context,
+		query aperturedb.SecretsQuery) ([]aperturedb.SecretInfo, error)
+
+	// RevokeL402 revokes the L402 that corresponds to the given hash and
+	// records the revocation along with the given reason.
+	RevokeL402(ctx context.Context, idHash [sha256.Size]byte,
+		reason string) error
+
+	// ListRevocations returns information about at most limit revoked
+	// L402s, skipping the first offset ones.
+	ListRevocations(ctx context.Context, offset,
+		limit uint32) ([]aperturedb.RevocationInfo, error)
+}
+
+// A compile time flag to ensure the SecretsStore satisfies the tokenStore
+// interface.
+var _ tokenStore = (*aperturedb.SecretsStore)(nil)
+
+// relayStatusReporter is implemented by challengers that wrap invoices through
+// a pool of lnproxy relays.
+type relayStatusReporter interface {
+	// RelayStatus returns a snapshot of the health of the relays.
+	RelayStatus() []challenger.RelayStatus
+}
+
+// A compile time flag to ensure the LnproxyChallenger satisfies the
+// relayStatusReporter interface.
+var _ relayStatusReporter = (*challenger.LnproxyChallenger)(nil)
+
+// adminServer implements the admin API that manages a running aperture
+// instance. Every call must be authenticated with the admin macaroon.
+type adminServer struct {
+	adminrpc.UnimplementedAdminServer
+
+	services   serviceManager
+	tokens     tokenStore
+	challenger challenger.Challenger
+	rootKey    []byte
+}
+
+// A compile time flag to ensure the adminServer satisfies the
+// adminrpc.AdminServer interface.
+var _ adminrpc.AdminServer = (*adminServer)(nil)
+
+// newAdminServer creates a new admin server. The root key of the admin
+// macaroon and the macaroon itself are created if they don't exist yet. The
+// challenger may be nil if authentication is disabled.
+func newAdminServer(cfg *AdminConfig, services serviceManager,
+	tokens tokenStore, challenger challenger.Challenger) (*adminServer,
+	error) {
+
+	rootKey, created, err := loadAdminRootKey(cfg.RootKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new root key invalidates any existing admin macaroon, so we need
+	// to replace it.
+	if created || !fileExists(cfg.MacaroonPath) {
+		err := writeAdminMacaroon(cfg.MacaroonPath, rootKey)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Admin macaroon written to %v", cfg.MacaroonPath)
+	}
+
+	return &adminServer{
+		services:   services,
+		tokens:     tokens,
+		challenger: challenger,
+		rootKey:    rootKey,
+	}, nil
+}
+
+// loadAdminRootKey reads the root key of the admin macaroon from the given
+// path or creates a new one if the file doesn't exist. The boolean is true if
+// a new root key was created.
+func loadAdminRootKey(path string) ([]byte, bool, error) {
+	rootKey, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if len(rootKey) != adminRootKeySize {
+			return nil, false, fmt.Errorf("invalid admin root key "+
+				"in %v", path)
+		}
+
+		return rootKey, false, nil
+
+	case !os.IsNotExist(err):
+		return nil, false, err
+	}
+
+	rootKey = make([]byte, adminRootKeySize)
+	if _, err := rand.Read(rootKey); err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(path, rootKey, 0600); err != nil {
+		return nil, false, err
+	}
+
+	return rootKey, true, nil
+}
+
+// writeAdminMacaroon bakes the admin macaroon with the given root key and
+// writes it to the given path.
+func writeAdminMacaroon(path string, rootKey []byte) error {
+	mac, err := macaroon.New(
+		rootKey, []byte(adminMacaroonID), adminMacaroonLocation,
+		macaroon.LatestVersion,
+	)
+	if err != nil {
+		return err
+	}
+
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, macBytes, 0600)
+}
+
+// checkMacaroon makes sure the context of a call carries a valid admin
+// macaroon.
+func (s *adminServer) checkMacaroon(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing metadata")
+	}
+
+	values := md.Get(macaroonMetadataKey)
+	if len(values) != 1 {
+		return status.Errorf(codes.Unauthenticated, "expected 1 "+
+			"macaroon, got %d", len(values))
+	}
+
+	macBytes, err := hex.DecodeString(values[0])
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "macaroon must be "+
+			"hex encoded")
+	}
+
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid "+
+			"macaroon: %v", err)
+	}
+
+	if !bytes.Equal(mac.Id(), []byte(adminMacaroonID)) {
+		return status.Error(codes.Unauthenticated, "not an admin "+
+			"macaroon")
+	}
+
+	// The admin macaroon can't be attenuated, so any caveat is rejected.
+	err = mac.Verify(s.rootKey, func(caveat string) error {
+		return fmt.Errorf("unsupported caveat %q", caveat)
+	}, nil)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid "+
+			"macaroon: %v", err)
+	}
+
+	return nil
+}
+
+// unaryInterceptor rejects all calls that aren't authenticated with the admin
+// macaroon.
+func (s *adminServer) unaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if err := s.checkMacaroon(ctx); err != nil {
+		log.Warnf("Rejected admin call %v: %v", info.FullMethod, err)
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// ListServices returns the backend services that are currently proxied.
+func (s *adminServer) ListServices(_ context.Context,
+	_ *adminrpc.ListServicesRequest) (*adminrpc.ListServicesResponse,
+	error) {
+
+	services := s.services.Services()
+
+	rpcServices := make([]*adminrpc.Service, 0, len(services))
+	for _, service := range services {
+		rpcServices = append(rpcServices, marshalService(service))
+	}
+
+	return &adminrpc.ListServicesResponse{
+		Services: rpcServices,
+	}, nil
+}
+
+// AddService adds a new backend service.
+func (s *adminServer) AddService(_ context.Context,
+	req *adminrpc.AddServiceRequest) (*adminrpc.AddServiceResponse,
+	error) {
+
+	service, err := unmarshalService(req.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.modifyServices(func(
+		services []*proxy.Service) ([]*proxy.Service, error) {
+
+		if serviceIndex(services, service.Name) >= 0 {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"service %v already exists", service.Name)
+		}
+
+		return append(services, service), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Admin added service %v", service.Name)
+
+	return &adminrpc.AddServiceResponse{}, nil
+}
+
+// UpdateService replaces the backend service with the same name.
+func (s *adminServer) UpdateService(_ context.Context,
+	req *adminrpc.UpdateServiceRequest) (*adminrpc.UpdateServiceResponse,
+	error) {
+
+	service, err := unmarshalService(req.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.modifyServices(func(
+		services []*proxy.Service) ([]*proxy.Service, error) {
+
+		idx := serviceIndex(services, service.Name)
+		if idx < 0 {
+			return nil, status.Errorf(codes.NotFound, "service "+
+				"%v not found", service.Name)
+		}
+		services[idx] = service
+
+		return services, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Admin updated service %v", service.Name)
+
+	return &adminrpc.UpdateServiceResponse{}, nil
+}
+
+// RemoveService removes the backend service with the given name.
+func (s *adminServer) RemoveService(_ context.Context,
+	req *adminrpc.RemoveServiceRequest) (*adminrpc.RemoveServiceResponse,
+	error) {
+
+	err := s.modifyServices(func(
+		services []*proxy.Service) ([]*proxy.Service, error) {
+
+		idx := serviceIndex(services, req.Name)
+		if idx < 0 {
+			return nil, status.Errorf(codes.NotFound, "service "+
+				"%v not found", req.Name)
+		}
+
+		return append(services[:idx], services[idx+1:]...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Admin removed service %v", req.Name)
+
+	return &adminrpc.RemoveServiceResponse{}, nil
+}
+
+// modifyServices applies the change f makes to the current services. Errors
+// of f are returned as they are, the proxy rejecting the resulting services
+// is reported as an invalid argument.
+func (s *adminServer) modifyServices(
+	f func([]*proxy.Service) ([]*proxy.Service, error)) error {
+
+	err := s.services.ModifyServices(f)
+	if _, isStatus := status.FromError(err); err != nil && !isStatus {
+		return status.Errorf(codes.InvalidArgument, "unable to update "+
+			"services: %v", err)
+	}
+
+	return err
+}
+
+// ListTokens returns the L402s that were issued and match the given filters,
+// oldest first.
+func (s *adminServer) ListTokens(ctx context.Context,
+	req *adminrpc.ListTokensRequest) (*adminrpc.ListTokensResponse, error) {
+
+	query := aperturedb.SecretsQuery{
+		Service:       req.Service,
+		CreatedAfter:  unixTime(req.CreatedAfter),
+		CreatedBefore: unixTime(req.CreatedBefore),
+		SettledAfter:  unixTime(req.SettledAfter),
+		SettledBefore: unixTime(req.SettledBefore),
+		Offset:        req.Offset,
+		Limit:         req.Limit,
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultListTokensLimit
+	}
+
+	var err error
+	query.IDHash, err = parseHash("id hash", req.IdHash)
+	if err != nil {
+		return nil, err
+	}
+	query.PaymentHash, err = parseHash("payment hash", req.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+	tokenID, err := parseHash("token id", req.TokenId)
+	if err != nil {
+		return nil, err
+	}
+	if tokenID != nil {
+		id := lsat.TokenID(*tokenID)
+		query.TokenID = &id
+	}
+
+	secrets, err := s.tokens.ListSecrets(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*adminrpc.Token, 0, len(secrets))
+	for _, secret := range secrets {
+		tokens = append(tokens, marshalToken(secret))
+	}
+
+	return &adminrpc.ListTokensResponse{
+		Tokens: tokens,
+	}, nil
+}
+
+// RevokeToken revokes an issued L402 by removing its secret and records the
+// revocation.
+func (s *adminServer) RevokeToken(ctx context.Context,
+	req *adminrpc.RevokeTokenRequest) (*adminrpc.RevokeTokenResponse,
+	error) {
+
+	idHash, err := parseHash("id hash", req.IdHash)
+	switch {
+	case err != nil:
+		return nil, err
+
+	case idHash == nil:
+		return nil, status.Error(codes.InvalidArgument, "id hash "+
+			"required")
+	}
+
+	err = s.tokens.RevokeL402(ctx, *idHash, req.Reason)
+	if errors.Is(err, mint.ErrSecretNotFound) {
+		return nil, status.Errorf(codes.NotFound, "L402 with id hash "+
+			"%x not found", *idHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Admin revoked L402 with id hash %x: %v", *idHash,
+		req.Reason)
+
+	return &adminrpc.RevokeTokenResponse{}, nil
+}
+
+// ListRevocations returns the L402s that were revoked, oldest revocation
+// first.
+func (s *adminServer) ListRevocations(ctx context.Context,
+	req *adminrpc.ListRevocationsRequest) (*adminrpc.ListRevocationsResponse,
+	error) {
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultListTokensLimit
+	}
+
+	revocations, err := s.tokens.ListRevocations(ctx, req.Offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcRevocations := make([]*adminrpc.Revocation, 0, len(revocations))
+	for _, revocation := range revocations {
+		rpcRevocations = append(rpcRevocations, &adminrpc.Revocation{
+			Token:     marshalToken(revocation.SecretInfo),
+			RevokedAt: revocation.RevokedAt.Unix(),
+			Reason:    revocation.Reason,
+		})
+	}
+
+	return &adminrpc.ListRevocationsResponse{
+		Revocations: rpcRevocations,
+	}, nil
+}
+
+// GetChallengerHealth returns the health of the challenger.
+func (s *adminServer) GetChallengerHealth(_ context.Context,
+	_ *adminrpc.GetChallengerHealthRequest) (
+	*adminrpc.GetChallengerHealthResponse, error) {
+
+	switch c := s.challenger.(type) {
+	case nil:
+		return &adminrpc.GetChallengerHealthResponse{
+			Challenger: challengerNone,
+		}, nil
+
+	case relayStatusReporter:
+		relays := c.RelayStatus()
+		rpcRelays := make([]*adminrpc.RelayStatus, 0, len(relays))
+		for _, relay := range relays {
+			rpcRelay := &adminrpc.RelayStatus{
+				Url:     relay.URL,
+				Healthy: relay.Healthy,
+			}
+			if relay.LastError != nil {
+				rpcRelay.LastError = relay.LastError.Error()
+			}
+			if !relay.LastChecked.IsZero() {
+				rpcRelay.LastChecked = relay.LastChecked.Unix()
+			}
+
+			rpcRelays = append(rpcRelays, rpcRelay)
+		}
+
+		return &adminrpc.GetChallengerHealthResponse{
+			Challenger: challengerLnproxy,
+			Relays:     rpcRelays,
+		}, nil
+
+	default:
+		return &adminrpc.GetChallengerHealthResponse{
+			Challenger: challengerLnd,
+		}, nil
+	}
+}
+
+// serviceIndex returns the index of the service with the given name or -1 if
+// there is none.
+func serviceIndex(services []*proxy.Service, name string) int {
+	for i, service := range services {
+		if service.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// marshalService converts a backend service to its RPC representation.
+func marshalService(s *proxy.Service) *adminrpc.Service {
+	rpcService := &adminrpc.Service{
+		Name:         s.Name,
+		Address:      s.Address,
+		Protocol:     s.Protocol,
+		TlsCertPath:  s.TLSCertPath,
+		Auth:         string(s.Auth),
+		HostRegexp:   s.HostRegexp,
+		PathRegexp:   s.PathRegexp,
+		Headers:      copyMap(s.Headers),
+		Timeout:      s.Timeout,
+		Capabilities: s.Capabilities,
+		Constraints:  copyMap(s.Constraints),
+		Price:        s.Price,
+		DynamicPrice: &adminrpc.DynamicPrice{
+			Enabled:     s.DynamicPrice.Enabled,
+			GrpcAddress: s.DynamicPrice.GRPCAddress,
+			Insecure:    s.DynamicPrice.Insecure,
+			TlsCertPath: s.DynamicPrice.TLSCertPath,
+		},
+		AuthWhitelistPaths: append(
+			[]string(nil), s.AuthWhitelistPaths...,
+		),
+		DirectPay: s.DirectPay,
+		Lifetime:  s.Lifetime,
+	}
+
+	if s.OperatorFee != nil {
+		rpcService.OperatorFee = &adminrpc.OperatorFee{
+			BaseMsat: s.OperatorFee.BaseMsat,
+			Ppm:      s.OperatorFee.PPM,
+			MinMsat:  s.OperatorFee.MinMsat,
+			MaxMsat:  s.OperatorFee.MaxMsat,
+		}
+	}
+
+	if s.Freebie != nil {
+		rpcService.Freebie = &adminrpc.Freebie{
+			Store:      s.Freebie.Store,
+			WindowSecs: uint64(s.Freebie.Window / time.Second),
+			Ipv4Mask:   int32(s.Freebie.IPv4Mask),
+			Ipv6Mask:   int32(s.Freebie.IPv6Mask),
+		}
+	}
+
+	return rpcService
+}
+
+// unmarshalService converts the RPC representation of a backend service to a
+// new service that still needs to be prepared by the proxy.
+func unmarshalService(s *adminrpc.Service) (*proxy.Service, error) {
+	if s == nil || s.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "service "+
+			"name required")
+	}
+
+	service := &proxy.Service{
+		Name:               s.Name,
+		TLSCertPath:        s.TlsCertPath,
+		Address:            s.Address,
+		Protocol:           s.Protocol,
+		Auth:               auth.Level(s.Auth),
+		HostRegexp:         s.HostRegexp,
+		PathRegexp:         s.PathRegexp,
+		Headers:            copyMap(s.Headers),
+		Timeout:            s.Timeout,
+		Capabilities:       s.Capabilities,
+		Constraints:        copyMap(s.Constraints),
+		Price:              s.Price,
+		AuthWhitelistPaths: append([]string(nil), s.AuthWhitelistPaths...),
+		DirectPay:          s.DirectPay,
+		Lifetime:           s.Lifetime,
+	}
+
+	if s.DynamicPrice != nil {
+		service.DynamicPrice = pricer.Config{
+			Enabled:     s.DynamicPrice.Enabled,
+			GRPCAddress: s.DynamicPrice.GrpcAddress,
+			Insecure:    s.DynamicPrice.Insecure,
+			TLSCertPath: s.DynamicPrice.TlsCertPath,
+		}
+	}
+
+	if s.OperatorFee != nil {
+		service.OperatorFee = &fee.Policy{
+			BaseMsat: s.OperatorFee.BaseMsat,
+			PPM:      s.OperatorFee.Ppm,
+			MinMsat:  s.OperatorFee.MinMsat,
+			MaxMsat:  s.OperatorFee.MaxMsat,
+		}
+	}
+
+	if s.Freebie != nil {
+		service.Freebie = &freebie.Config{
+			Store:    s.Freebie.Store,
+			Window:   time.Duration(s.Freebie.WindowSecs) * time.Second,
+			IPv4Mask: int(s.Freebie.Ipv4Mask),
+			IPv6Mask: int(s.Freebie.Ipv6Mask),
+		}
+	}
+
+	return service, nil
+}
+
+// copyMap returns a copy of the given map, nil if it is empty.
+func copyMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+// marshalToken converts an issued L402 to its RPC representation.
+func marshalToken(secret aperturedb.SecretInfo) *adminrpc.Token {
+	token := &adminrpc.Token{
+		IdHash:      hex.EncodeToString(secret.IDHash[:]),
+		PaymentHash: hex.EncodeToString(secret.PaymentHash[:]),
+		CreatedAt:   secret.CreatedAt.Unix(),
+		Uses:        secret.Uses,
+		Service:     secret.Service,
+	}
+	if secret.SettledAt.Valid {
+		token.SettledAt = secret.SettledAt.Time.Unix()
+	}
+	if secret.TokenID != (lsat.TokenID{}) {
+		token.TokenId = hex.EncodeToString(secret.TokenID[:])
+	}
+
+	return token
+}
+
+// parseHash parses the given hex encoded hash. If it is empty, nil is
+// returned.
+func parseHash(name, hexHash string) (*[sha256.Size]byte, error) {
+	if hexHash == "" {
+		return nil, nil
+	}
+
+	hashBytes, err := hex.DecodeString(hexHash)
+	if err != nil || len(hashBytes) != sha256.Size {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %v "+
+			"%q", name, hexHash)
+	}
+
+	var hash [sha256.Size]byte
+	copy(hash[:], hashBytes)
+
+	return &hash, nil
+}
+
+// unixTime converts the given unix timestamp to a time, 0 being the zero time.
+func unixTime(timestamp int64) time.Time {
+	if timestamp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(timestamp, 0)
+}
@@ -0,0 +1,460 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/motxx/aperture-lnproxy/aperture/adminrpc"
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
+	"github.com/motxx/aperture-lnproxy/aperture/freebie"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+	"github.com/motxx/aperture-lnproxy/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockServiceManager is a serviceManager that rejects services without an
+// address.
+type mockServiceManager struct {
+	services []*proxy.Service
+}
+
+func (m *mockServiceManager) Services() []*proxy.Service {
+	return append([]*proxy.Service(nil), m.services...)
+}
+
+func (m *mockServiceManager) ModifyServices(
+	f func([]*proxy.Service) ([]*proxy.Service, error)) error {
+
+	services, err := f(m.Services())
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if service.Address == "" {
+			return errors.New("address required")
+		}
+	}
+	m.services = services
+
+	return nil
+}
+
+// mockTokenStore is a tokenStore that keeps its secrets in memory. Only the
+// service filter of queries is supported.
+type mockTokenStore struct {
+	secrets     []aperturedb.SecretInfo
+	revocations []aperturedb.RevocationInfo
+}
+
+func (m *mockTokenStore) ListSecrets(_ context.Context,
+	query aperturedb.SecretsQuery) ([]aperturedb.SecretInfo, error) {
+
+	var secrets []aperturedb.SecretInfo
+	for _, secret := range m.secrets {
+		if query.Service == "" || query.Service == secret.Service {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	if int(query.Offset) >= len(secrets) {
+		return nil, nil
+	}
+	end := int(query.Offset + query.Limit)
+	if end > len(secrets) {
+		end = len(secrets)
+	}
+
+	return secrets[query.Offset:end], nil
+}
+
+func (m *mockTokenStore) RevokeL402(_ context.Context,
+	idHash [sha256.Size]byte, reason string) error {
+
+	for i, secret := range m.secrets {
+		if secret.IDHash == idHash {
+			m.secrets = append(m.secrets[:i], m.secrets[i+1:]...)
+			m.revocations = append(
+				m.revocations, aperturedb.RevocationInfo{
+					SecretInfo: secret,
+					RevokedAt:  time.Now(),
+					Reason:     reason,
+				},
+			)
+
+			return nil
+		}
+	}
+
+	return mint.ErrSecretNotFound
+}
+
+func (m *mockTokenStore) ListRevocations(_ context.Context, offset,
+	limit uint32) ([]aperturedb.RevocationInfo, error) {
+
+	if int(offset) >= len(m.revocations) {
+		return nil, nil
+	}
+	end := int(offset + limit)
+	if end > len(m.revocations) {
+		end = len(m.revocations)
+	}
+
+	return m.revocations[offset:end], nil
+}
+
+// mockRelayChallenger is a challenger that reports the health of its relays.
+type mockRelayChallenger struct {
+	challenger.Challenger
+
+	relays []challenger.RelayStatus
+}
+
+func (m *mockRelayChallenger) RelayStatus() []challenger.RelayStatus {
+	return m.relays
+}
+
+// newTestAdminServer creates an admin server with its macaroon in a temporary
+// directory.
+func newTestAdminServer(t *testing.T, services serviceManager,
+	tokens tokenStore, c challenger.Challenger) (*adminServer,
+	*AdminConfig) {
+
+	dir := t.TempDir()
+	cfg := &AdminConfig{
+		MacaroonPath: filepath.Join(dir, defaultAdminMacaroonFilename),
+		RootKeyPath:  filepath.Join(dir, defaultAdminRootKeyFilename),
+	}
+
+	server, err := newAdminServer(cfg, services, tokens, c)
+	require.NoError(t, err)
+
+	return server, cfg
+}
+
+// macaroonContext returns a context that carries the given macaroon like a
+// call from a client would.
+func macaroonContext(t *testing.T, macBytes []byte) context.Context {
+	return metadata.NewIncomingContext(
+		context.Background(), metadata.Pairs(
+			macaroonMetadataKey, hex.EncodeToString(macBytes),
+		),
+	)
+}
+
+// requireCode makes sure the error is a gRPC status error with the given code.
+func requireCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+
+	require.Error(t, err)
+	require.Equal(t, code, status.Code(err))
+}
+
+// TestAdminMacaroon makes sure only calls with a valid admin macaroon are
+// accepted and that the macaroon stays valid across restarts.
+func TestAdminMacaroon(t *testing.T) {
+	server, cfg := newTestAdminServer(
+		t, &mockServiceManager{}, &mockTokenStore{}, nil,
+	)
+
+	macBytes, err := os.ReadFile(cfg.MacaroonPath)
+	require.NoError(t, err)
+	require.NoError(t, server.checkMacaroon(macaroonContext(t, macBytes)))
+
+	// A call without a macaroon is rejected.
+	err = server.checkMacaroon(context.Background())
+	requireCode(t, codes.Unauthenticated, err)
+
+	// A macaroon baked with another root key is rejected.
+	otherMac, err := macaroon.New(
+		make([]byte, adminRootKeySize), []byte(adminMacaroonID),
+		adminMacaroonLocation, macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	otherBytes, err := otherMac.MarshalBinary()
+	require.NoError(t, err)
+	err = server.checkMacaroon(macaroonContext(t, otherBytes))
+	requireCode(t, codes.Unauthenticated, err)
+
+	// The admin macaroon can't be attenuated.
+	mac := &macaroon.Macaroon{}
+	require.NoError(t, mac.UnmarshalBinary(macBytes))
+	require.NoError(t, mac.AddFirstPartyCaveat([]byte("ro")))
+	caveatBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+	err = server.checkMacaroon(macaroonContext(t, caveatBytes))
+	requireCode(t, codes.Unauthenticated, err)
+
+	// Restarting with the same root key accepts the same macaroon, even
+	// if the macaroon file was removed and baked again.
+	require.NoError(t, os.Remove(cfg.MacaroonPath))
+	restarted, err := newAdminServer(
+		cfg, &mockServiceManager{}, &mockTokenStore{}, nil,
+	)
+	require.NoError(t, err)
+	require.NoError(t, restarted.checkMacaroon(
+		macaroonContext(t, macBytes),
+	))
+
+	// A new root key invalidates the old macaroon.
+	require.NoError(t, os.Remove(cfg.RootKeyPath))
+	rotated, err := newAdminServer(
+		cfg, &mockServiceManager{}, &mockTokenStore{}, nil,
+	)
+	require.NoError(t, err)
+	err = rotated.checkMacaroon(macaroonContext(t, macBytes))
+	requireCode(t, codes.Unauthenticated, err)
+
+	newBytes, err := os.ReadFile(cfg.MacaroonPath)
+	require.NoError(t, err)
+	require.NoError(t, rotated.checkMacaroon(macaroonContext(t, newBytes)))
+}
+
+// TestAdminServices makes sure services can be listed, added, updated and
+// removed.
+func TestAdminServices(t *testing.T) {
+	ctx := context.Background()
+	services := &mockServiceManager{}
+	server, _ := newTestAdminServer(t, services, &mockTokenStore{}, nil)
+
+	service := &adminrpc.Service{
+		Name:     "test",
+		Address:  "localhost:9000",
+		Protocol: "http",
+		Auth:     "on",
+		Price:    10,
+	}
+	_, err := server.AddService(ctx, &adminrpc.AddServiceRequest{
+		Service: service,
+	})
+	require.NoError(t, err)
+
+	// A service name can only be used once.
+	_, err = server.AddService(ctx, &adminrpc.AddServiceRequest{
+		Service: service,
+	})
+	requireCode(t, codes.AlreadyExists, err)
+
+	// A service without a name is invalid.
+	_, err = server.AddService(ctx, &adminrpc.AddServiceRequest{
+		Service: &adminrpc.Service{Address: "localhost:9001"},
+	})
+	requireCode(t, codes.InvalidArgument, err)
+
+	// Services the proxy rejects are reported as invalid.
+	_, err = server.AddService(ctx, &adminrpc.AddServiceRequest{
+		Service: &adminrpc.Service{Name: "other"},
+	})
+	requireCode(t, codes.InvalidArgument, err)
+
+	resp, err := server.ListServices(ctx, &adminrpc.ListServicesRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Services, 1)
+	require.EqualValues(t, 10, resp.Services[0].Price)
+
+	// Update the price of the service.
+	service.Price = 20
+	_, err = server.UpdateService(ctx, &adminrpc.UpdateServiceRequest{
+		Service: service,
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 20, services.services[0].Price)
+
+	_, err = server.UpdateService(ctx, &adminrpc.UpdateServiceRequest{
+		Service: &adminrpc.Service{Name: "unknown"},
+	})
+	requireCode(t, codes.NotFound, err)
+
+	// Remove the service again.
+	_, err = server.RemoveService(ctx, &adminrpc.RemoveServiceRequest{
+		Name: "test",
+	})
+	require.NoError(t, err)
+	require.Empty(t, services.services)
+
+	_, err = server.RemoveService(ctx, &adminrpc.RemoveServiceRequest{
+		Name: "test",
+	})
+	requireCode(t, codes.NotFound, err)
+}
+
+// TestAdminServiceConversion makes sure a service survives the conversion to
+// its RPC representation and back.
+func TestAdminServiceConversion(t *testing.T) {
+	service := &proxy.Service{
+		Name:               "test",
+		TLSCertPath:        "/tls.cert",
+		Address:            "localhost:9000",
+		Protocol:           "https",
+		Auth:               "freebie 3",
+		HostRegexp:         ".*",
+		PathRegexp:         "^/test",
+		Headers:            map[string]string{"X-Test": "1"},
+		Timeout:            60,
+		Capabilities:       "read",
+		Constraints:        map[string]string{"valid_until": "1"},
+		Price:              10,
+		AuthWhitelistPaths: []string{"^/free"},
+		DirectPay:          true,
+		OperatorFee:        &fee.Policy{PPM: 1000, MinMsat: 10},
+		Lifetime:           "24h,10 uses",
+		Freebie: &freebie.Config{
+			Store:    freebie.StoreDB,
+			Window:   24 * time.Hour,
+			IPv4Mask: 24,
+			IPv6Mask: 56,
+		},
+	}
+	service.DynamicPrice.Enabled = true
+	service.DynamicPrice.GRPCAddress = "localhost:10000"
+
+	converted, err := unmarshalService(marshalService(service))
+	require.NoError(t, err)
+	require.Equal(t, service, converted)
+}
+
+// TestAdminTokens makes sure issued L402s can be listed and revoked.
+func TestAdminTokens(t *testing.T) {
+	ctx := context.Background()
+	settledAt := time.Unix(1700000000, 0)
+	tokens := &mockTokenStore{
+		secrets: []aperturedb.SecretInfo{{
+			IDHash:      [sha256.Size]byte{1},
+			PaymentHash: [sha256.Size]byte{2},
+			TokenID:     lsat.TokenID{4},
+			Service:     "service",
+			CreatedAt:   settledAt.Add(-time.Minute),
+			SettledAt: aperturedb.NullTime{
+				Time:  settledAt,
+				Valid: true,
+			},
+			Uses: 3,
+		}, {
+			IDHash:    [sha256.Size]byte{3},
+			Service:   "other",
+			CreatedAt: settledAt,
+		}},
+	}
+	server, _ := newTestAdminServer(t, &mockServiceManager{}, tokens, nil)
+
+	resp, err := server.ListTokens(ctx, &adminrpc.ListTokensRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Tokens, 2)
+	require.Equal(t, &adminrpc.Token{
+		IdHash:      hex.EncodeToString(tokens.secrets[0].IDHash[:]),
+		PaymentHash: hex.EncodeToString(tokens.secrets[0].PaymentHash[:]),
+		CreatedAt:   settledAt.Unix() - 60,
+		SettledAt:   settledAt.Unix(),
+		Uses:        3,
+		TokenId:     hex.EncodeToString(tokens.secrets[0].TokenID[:]),
+		Service:     "service",
+	}, resp.Tokens[0])
+	require.Zero(t, resp.Tokens[1].SettledAt)
+	require.Empty(t, resp.Tokens[1].TokenId)
+
+	resp, err = server.ListTokens(ctx, &adminrpc.ListTokensRequest{
+		Offset: 1,
+		Limit:  1,
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Tokens, 1)
+
+	resp, err = server.ListTokens(ctx, &adminrpc.ListTokensRequest{
+		Service: "other",
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Tokens, 1)
+	require.Equal(t, "other", resp.Tokens[0].Service)
+
+	// Hashes used as filters must be valid.
+	_, err = server.ListTokens(ctx, &adminrpc.ListTokensRequest{
+		TokenId: "xyz",
+	})
+	requireCode(t, codes.InvalidArgument, err)
+
+	// Only valid id hashes can be revoked.
+	_, err = server.RevokeToken(ctx, &adminrpc.RevokeTokenRequest{
+		IdHash: "00",
+	})
+	requireCode(t, codes.InvalidArgument, err)
+
+	_, err = server.RevokeToken(ctx, &adminrpc.RevokeTokenRequest{})
+	requireCode(t, codes.InvalidArgument, err)
+
+	_, err = server.RevokeToken(ctx, &adminrpc.RevokeTokenRequest{
+		IdHash: hex.EncodeToString(make([]byte, sha256.Size)),
+	})
+	requireCode(t, codes.NotFound, err)
+
+	idHash := resp.Tokens[0].IdHash
+	_, err = server.RevokeToken(ctx, &adminrpc.RevokeTokenRequest{
+		IdHash: idHash,
+		Reason: "leaked",
+	})
+	require.NoError(t, err)
+	require.Len(t, tokens.secrets, 1)
+
+	// The revocation is listed along with the L402 and its reason.
+	revocations, err := server.ListRevocations(
+		ctx, &adminrpc.ListRevocationsRequest{},
+	)
+	require.NoError(t, err)
+	require.Len(t, revocations.Revocations, 1)
+	require.Equal(t, idHash, revocations.Revocations[0].Token.IdHash)
+	require.Equal(t, "leaked", revocations.Revocations[0].Reason)
+	require.NotZero(t, revocations.Revocations[0].RevokedAt)
+}
+
+// TestAdminChallengerHealth makes sure the kind of challenger and the health
+// of its relays are reported.
+func TestAdminChallengerHealth(t *testing.T) {
+	ctx := context.Background()
+	req := &adminrpc.GetChallengerHealthRequest{}
+
+	server, _ := newTestAdminServer(
+		t, &mockServiceManager{}, &mockTokenStore{}, nil,
+	)
+	resp, err := server.GetChallengerHealth(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, challengerNone, resp.Challenger)
+
+	lastChecked := time.Unix(1700000000, 0)
+	server.challenger = &mockRelayChallenger{
+		relays: []challenger.RelayStatus{{
+			URL:     "http://relay1",
+			Healthy: true,
+		}, {
+			URL:         "http://relay2",
+			LastError:   errors.New("timeout"),
+			LastChecked: lastChecked,
+		}},
+	}
+	resp, err = server.GetChallengerHealth(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, challengerLnproxy, resp.Challenger)
+	require.Equal(t, []*adminrpc.RelayStatus{{
+		Url:     "http://relay1",
+		Healthy: true,
+	}, {
+		Url:         "http://relay2",
+		LastError:   "timeout",
+		LastChecked: lastChecked.Unix(),
+	}}, resp.Relays)
+
+	server.challenger = &challenger.LndChallenger{}
+	resp, err = server.GetChallengerHealth(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, challengerLnd, resp.Challenger)
+}
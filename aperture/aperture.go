@@ -27,9 +27,13 @@ import (
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/signal"
 	"github.com/lightningnetwork/lnd/tor"
+	"github.com/motxx/aperture-lnproxy/aperture/adminrpc"
 	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
 	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+	"github.com/motxx/aperture-lnproxy/aperture/freebie"
+	"github.com/motxx/aperture-lnproxy/aperture/lnc"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/mint"
 	"github.com/motxx/aperture-lnproxy/aperture/proxy"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -177,6 +181,18 @@ type Aperture struct {
 	torHTTPServer *http.Server
 	proxy         *proxy.Proxy
 	proxyCleanup  func()
+	secretsPruner *aperturedb.SecretsPruner
+	lncConn       *lnc.NodeConn
+
+	// freebiesPruner deletes the freebie counts of ended windows.
+	freebiesPruner *aperturedb.FreebiesPruner
+
+	// servicesMtx serializes changes to the services of the proxy.
+	servicesMtx sync.Mutex
+
+	// configServices are the services that were last loaded from the
+	// config file, keyed by their name.
+	configServices map[string]configService
 
 	wg   sync.WaitGroup
 	quit chan struct{}
@@ -219,38 +235,73 @@ func (a *Aperture) Start(errChan chan error) error {
 	}
 
 	var (
-		secretStore mint.SecretStore
-		onionStore  tor.OnionStore
+		secretStore   mint.SecretStore
+		tokens        tokenStore
+		onionStore    tor.OnionStore
+		freebieCounts freebie.CountStore
 	)
 
 	// Connect to the chosen database backend.
+	var db *aperturedb.BaseDB
 	switch a.cfg.DatabaseBackend {
 	case "postgres":
-		db, err := aperturedb.NewPostgresStore(a.cfg.Postgres)
+		postgresStore, err := aperturedb.NewPostgresStore(
+			a.cfg.Postgres,
+		)
 		if err != nil {
 			return fmt.Errorf("unable to connect to postgres: %v",
 				err)
 		}
-		a.db = db.DB
+		db = postgresStore.BaseDB
 
-		dbSecretTxer := aperturedb.NewTransactionExecutor(db,
-			func(tx *sql.Tx) aperturedb.SecretsDB {
-				return db.WithTx(tx)
-			},
-		)
-		secretStore = aperturedb.NewSecretsStore(dbSecretTxer)
-
-		dbOnionTxer := aperturedb.NewTransactionExecutor(db,
-			func(tx *sql.Tx) aperturedb.OnionDB {
-				return db.WithTx(tx)
-			},
-		)
-		onionStore = aperturedb.NewOnionStore(dbOnionTxer)
+	case "sqlite":
+		sqliteStore, err := aperturedb.NewSqliteStore(a.cfg.Sqlite)
+		if err != nil {
+			return fmt.Errorf("unable to open sqlite database: %v",
+				err)
+		}
+		db = sqliteStore.BaseDB
 
 	default:
 		return fmt.Errorf("unknown database backend: %s",
 			a.cfg.DatabaseBackend)
 	}
+	a.db = db.DB
+
+	// Both SQL backends share the same queries, so the stores don't
+	// depend on the backend in use.
+	dbSecretTxer := aperturedb.NewTransactionExecutor(db,
+		func(tx *sql.Tx) aperturedb.SecretsDB {
+			return db.WithTx(tx)
+		},
+	)
+	secrets := aperturedb.NewSecretsStore(dbSecretTxer)
+	secretStore = secrets
+	tokens = secrets
+
+	a.secretsPruner = aperturedb.NewSecretsPruner(
+		a.cfg.SecretsPruner, dbSecretTxer,
+	)
+	a.secretsPruner.Start()
+
+	dbOnionTxer := aperturedb.NewTransactionExecutor(db,
+		func(tx *sql.Tx) aperturedb.OnionDB {
+			return db.WithTx(tx)
+		},
+	)
+	onionStore = aperturedb.NewOnionStore(dbOnionTxer)
+
+	dbFreebieTxer := aperturedb.NewTransactionExecutor(db,
+		func(tx *sql.Tx) aperturedb.FreebieDB {
+			return db.WithTx(tx)
+		},
+	)
+	freebieCounts = aperturedb.NewFreebieStore(dbFreebieTxer)
+
+	a.freebiesPruner = aperturedb.NewFreebiesPruner(
+		a.cfg.SecretsPruner, dbFreebieTxer,
+	)
+	a.freebiesPruner.Start()
 
 	log.Infof("Using %v as database backend", a.cfg.DatabaseBackend)
 
@@ -263,12 +314,16 @@ func (a *Aperture) Start(errChan chan error) error {
 			}, nil
 		}
 
+		var (
+			client  challenger.InvoiceClient
+			ctxFunc = context.Background
+		)
 		switch {
 		case authCfg.LndHost != "":
 			log.Infof("Using lnd's authenticator config")
 
 			authCfg := a.cfg.Authenticator
-			client, err := lndclient.NewBasicClient(
+			client, err = lndclient.NewBasicClient(
 				authCfg.LndHost, authCfg.TLSPath,
 				authCfg.MacDir, authCfg.Network,
 				lndclient.MacFilename(
@@ -279,21 +334,108 @@ func (a *Aperture) Start(errChan chan error) error {
 				return err
 			}
 
-			a.challenger, err = challenger.NewLnproxyChallenger(
-				client, genInvoiceReq, secretStore, context.Background,
+		case authCfg.Passphrase != "":
+			log.Infof("Using lnc's authenticator config")
+
+			session, err := lnc.NewSession(
+				authCfg.Passphrase, authCfg.MailboxAddress,
+				authCfg.DevServer,
+			)
+			if err != nil {
+				return fmt.Errorf("unable to create lnc "+
+					"session: %w", err)
+			}
+
+			// The session is persisted, so the remote node only
+			// needs to be paired once.
+			dbLNCTxer := aperturedb.NewTransactionExecutor(db,
+				func(tx *sql.Tx) aperturedb.LNCSessionsDB {
+					return db.WithTx(tx)
+				},
+			)
+			a.lncConn, err = lnc.NewNodeConn(
+				session, aperturedb.NewLNCSessionsStore(dbLNCTxer),
 				errChan,
 			)
 			if err != nil {
-				return err
+				return fmt.Errorf("unable to connect to lnd "+
+					"using lnc: %w", err)
 			}
+			client = a.lncConn
+			ctxFunc = a.lncConn.CtxFunc
+
 		default:
-			return fmt.Errorf("no authenticator lndhost config provided")
+			return fmt.Errorf("no authenticator lndhost or lnc " +
+				"passphrase config provided")
+		}
+
+		// A brief outage of lnd doesn't take the paywall offline, the
+		// challenger subscribes to the invoice updates again. The
+		// indices of the processed invoice updates are persisted, so
+		// the challenger doesn't list all invoices on every start.
+		dbIndexTxer := aperturedb.NewTransactionExecutor(db,
+			func(tx *sql.Tx) aperturedb.InvoiceIndicesDB {
+				return db.WithTx(tx)
+			},
+		)
+		challengerOpts := []challenger.LndChallengerOption{
+			challenger.WithOutageBudget(authCfg.OutageBudget),
+			challenger.WithSettledInvoiceAge(
+				authCfg.SettledCacheAge,
+			),
+			challenger.WithSettlementPollInterval(
+				authCfg.SettlementPollInterval,
+			),
+			challenger.WithInvoiceIndexStore(
+				aperturedb.NewInvoiceIndicesStore(dbIndexTxer),
+			),
+		}
+
+		// Without any lnproxy relay, all services must be paid to the
+		// operator's node directly.
+		if !a.cfg.Lnproxy.Enabled() {
+			log.Infof("No lnproxy relay configured, only direct " +
+				"pay services are available")
+
+			a.challenger, err = challenger.NewLndChallenger(
+				client, genInvoiceReq, secretStore, ctxFunc,
+				errChan, challengerOpts...,
+			)
+		} else {
+			a.challenger, err = challenger.NewLnproxyChallenger(
+				client, genInvoiceReq, secretStore,
+				a.cfg.Lnproxy, ctxFunc, errChan,
+				challengerOpts...,
+			)
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The admin API manages the services of the proxy, so it is created
+	// before the proxy but only called once the proxy is serving.
+	var admin *adminServer
+	if a.cfg.Admin.Enabled {
+		admin, err = newAdminServer(
+			a.cfg.Admin, a, tokens, a.challenger,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create admin server: %w",
+				err)
+		}
+	}
+
+	// Remember the services as they are configured, before the proxy
+	// prepares them, so a reload can tell which of them changed.
+	a.configServices, err = newConfigServices(a.cfg.Services)
+	if err != nil {
+		return err
 	}
 
 	// Create the proxy and connect it to lnd.
 	a.proxy, a.proxyCleanup, err = createProxy(
-		a.cfg, a.challenger, secretStore,
+		a.cfg, a.challenger, secretStore, freebieCounts, admin,
 	)
 	if err != nil {
 		return err
@@ -350,6 +492,12 @@ func (a *Aperture) Start(errChan chan error) error {
 		}
 	}()
 
+	// Apply changes to the config file while we're running.
+	if a.cfg.configFile != "" {
+		a.wg.Add(1)
+		go a.watchConfig(a.cfg.configFile)
+	}
+
 	// If we need to listen over Tor as well, we'll set up the onion
 	// services now. We're not able to use TLS for onion services since they
 	// can't be verified, so we'll spin up an additional HTTP/2 server
@@ -388,9 +536,52 @@ func (a *Aperture) Start(errChan chan error) error {
 // configuration of backend services. This can be used to add or remove backends
 // at run time or enable/disable authentication on the fly.
 func (a *Aperture) UpdateServices(services []*proxy.Service) error {
+	a.servicesMtx.Lock()
+	defer a.servicesMtx.Unlock()
+
+	if err := a.validateServiceLifetimes(services); err != nil {
+		return err
+	}
+
 	return a.proxy.UpdateServices(services)
 }
 
+// ModifyServices replaces the backend services of the proxy with the ones
+// returned by f, which is passed the services currently in use. Changes are
+// serialized, so f always sees the result of the previous change.
+func (a *Aperture) ModifyServices(
+	f func([]*proxy.Service) ([]*proxy.Service, error)) error {
+
+	a.servicesMtx.Lock()
+	defer a.servicesMtx.Unlock()
+
+	services, err := f(a.proxy.Services())
+	if err != nil {
+		return err
+	}
+
+	if err := a.validateServiceLifetimes(services); err != nil {
+		return err
+	}
+
+	return a.proxy.UpdateServices(services)
+}
+
+// validateServiceLifetimes makes sure the secrets pruner can't delete the
+// secrets of L402s of the given services while they may still grant access.
+func (a *Aperture) validateServiceLifetimes(services []*proxy.Service) error {
+	if a.cfg.SecretsPruner == nil {
+		return nil
+	}
+
+	return a.cfg.SecretsPruner.ValidateLifetimes(serviceLifetimes(services))
+}
+
+// Services returns the backend services the proxy currently uses.
+func (a *Aperture) Services() []*proxy.Service {
+	return a.proxy.Services()
+}
+
 // Stop gracefully shuts down the Aperture service.
 func (a *Aperture) Stop() error {
 	var returnErr error
@@ -399,12 +590,28 @@ func (a *Aperture) Stop() error {
 		a.challenger.Stop()
 	}
 
+	// The challenger's invoice subscription runs over the LNC connection,
+	// so it must be closed after the challenger is stopped.
+	if a.lncConn != nil {
+		if err := a.lncConn.Stop(); err != nil {
+			log.Errorf("Error closing LNC connection: %v", err)
+			returnErr = err
+		}
+	}
+
 	// Stop everything that was started alongside the proxy, for example the
 	// gRPC and REST servers.
 	if a.proxyCleanup != nil {
 		a.proxyCleanup()
 	}
 
+	if a.secretsPruner != nil {
+		a.secretsPruner.Stop()
+	}
+	if a.freebiesPruner != nil {
+		a.freebiesPruner.Stop()
+	}
+
 	if a.etcdClient != nil {
 		if err := a.etcdClient.Close(); err != nil {
 			log.Errorf("Error terminating etcd client: %v", err)
@@ -482,6 +689,18 @@ func getConfig() (*Config, error) {
 		mustExist = true
 	}
 
+	if err := loadConfig(cfg, configFile, mustExist); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadConfig reads the given config file into the configuration that was
+// pre-parsed from the command line, then checks it for valid content. The
+// path of the config file is remembered if it exists, so it can be reloaded
+// later on.
+func loadConfig(cfg *Config, configFile string, mustExist bool) error {
 	// Read our config file, either from the custom path provided or our
 	// default location.
 	b, err := os.ReadFile(configFile)
@@ -490,25 +709,26 @@ func getConfig() (*Config, error) {
 	case err == nil:
 		err = yaml.Unmarshal(b, cfg)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		cfg.configFile = configFile
 
 	// If the error is unrelated to the existence of the file, we must
 	// always return it.
 	case !os.IsNotExist(err):
-		return nil, err
+		return err
 
 	// If we require that the config file exists and we got an error
 	// related to file existence, we must fail.
 	case mustExist && os.IsNotExist(err):
-		return nil, fmt.Errorf("config file: %v must exist: %w",
+		return fmt.Errorf("config file: %v must exist: %w",
 			configFile, err)
 	}
 
 	// Finally, parse the remaining command line options again to ensure
 	// they take precedence.
 	if _, err := flags.Parse(cfg); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Clean and expand our base dir, cert and macaroon paths.
@@ -520,6 +740,36 @@ func getConfig() (*Config, error) {
 		cfg.Authenticator.MacDir,
 	)
 
+	// Keep the admin macaroon and its root key in our data directory
+	// unless configured otherwise.
+	apertureDir := apertureDataDir
+	if cfg.BaseDir != "" {
+		apertureDir = cfg.BaseDir
+	}
+	if cfg.Admin.MacaroonPath == "" {
+		cfg.Admin.MacaroonPath = filepath.Join(
+			apertureDir, defaultAdminMacaroonFilename,
+		)
+	}
+	if cfg.Admin.RootKeyPath == "" {
+		cfg.Admin.RootKeyPath = filepath.Join(
+			apertureDir, defaultAdminRootKeyFilename,
+		)
+	}
+	cfg.Admin.MacaroonPath = lnd.CleanAndExpandPath(cfg.Admin.MacaroonPath)
+	cfg.Admin.RootKeyPath = lnd.CleanAndExpandPath(cfg.Admin.RootKeyPath)
+
+	// The SQLite database is kept in our data directory as well unless
+	// configured otherwise.
+	if cfg.Sqlite.DatabaseFileName == "" {
+		cfg.Sqlite.DatabaseFileName = filepath.Join(
+			apertureDir, defaultSqliteFilename,
+		)
+	}
+	cfg.Sqlite.DatabaseFileName = lnd.CleanAndExpandPath(
+		cfg.Sqlite.DatabaseFileName,
+	)
+
 	// Set default mailbox address if none is set.
 	if cfg.Authenticator.MailboxAddress == "" {
 		cfg.Authenticator.MailboxAddress = defaultMailboxAddress
@@ -528,10 +778,10 @@ func getConfig() (*Config, error) {
 	// Then check the configuration that we got from the config file, all
 	// required values need to be set at this point.
 	if err := cfg.validate(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return cfg, nil
+	return nil
 }
 
 // setupLogging parses the debug level and initializes the log file rotator.
@@ -732,15 +982,23 @@ func initTorListener(cfg *Config, store tor.OnionStore) (*tor.Controller,
 	return torController, nil
 }
 
-// createProxy creates the proxy with all the services it needs.
+// createProxy creates the proxy with all the services it needs. The admin API
+// is only served if an admin server is given.
 func createProxy(cfg *Config, challenger challenger.Challenger,
-	store mint.SecretStore) (*proxy.Proxy, func(), error) {
+	store mint.SecretStore, freebieCounts freebie.CountStore,
+	admin *adminServer) (*proxy.Proxy, func(), error) {
 
+	// The proxy is only created below, but the mint only looks up the
+	// lifetimes of its services when verifying requests it serves.
+	var prxy *proxy.Proxy
 	minter := mint.New(&mint.Config{
 		Challenger:     challenger,
 		Secrets:        store,
 		ServiceLimiter: newStaticServiceLimiter(cfg.Services),
 		Now:            time.Now,
+		ServiceLifetime: func(name string) *lsat.Lifetime {
+			return proxy.LifetimeOf(prxy.Services(), name)
+		},
 	})
 	authenticator := auth.NewLsatAuthenticator(minter, challenger)
 
@@ -772,6 +1030,21 @@ func createProxy(cfg *Config, challenger challenger.Challenger,
 		proxyCleanup = cleanup
 	}
 
+	if admin != nil {
+		adminServices, cleanup, err := createAdminServer(cfg, admin)
+		if err != nil {
+			proxyCleanup()
+			return nil, nil, err
+		}
+
+		localServices = append(localServices, adminServices...)
+		prevCleanup := proxyCleanup
+		proxyCleanup = func() {
+			cleanup()
+			prevCleanup()
+		}
+	}
+
 	// The static file server must be last since it will match all calls
 	// that make it to it.
 	localServices = append(localServices, proxy.NewLocalService(
@@ -780,7 +1053,9 @@ func createProxy(cfg *Config, challenger challenger.Challenger,
 		},
 	))
 
-	prxy, err := proxy.New(authenticator, cfg.Services, localServices...)
+	prxy, err := proxy.New(
+		authenticator, cfg.Services, freebieCounts, localServices...,
+	)
 	return prxy, proxyCleanup, err
 }
 
@@ -796,20 +1071,7 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 		}),
 	}
 
-	// Before we register both servers, we'll also ensure that the collector
-	// will export latency metrics for the histogram.
-	if cfg.Prometheus != nil && cfg.Prometheus.Enabled {
-		grpc_prometheus.EnableHandlingTimeHistogram()
-		serverOpts = append(
-			serverOpts,
-			grpc.ChainUnaryInterceptor(
-				grpc_prometheus.UnaryServerInterceptor,
-			),
-			grpc.ChainStreamInterceptor(
-				grpc_prometheus.StreamServerInterceptor,
-			),
-		)
-	}
+	serverOpts = append(serverOpts, prometheusServerOpts(cfg)...)
 
 	// Create a gRPC server for the hashmail server.
 	hashMailServer := newHashMailServer(hashMailServerConfig{
@@ -830,20 +1092,6 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 		grpc_prometheus.Register(hashMailGRPC)
 	}
 
-	// And a REST proxy for it as well.
-	// The default JSON marshaler of the REST proxy only sets OrigName to
-	// true, which instructs it to use the same field names as specified in
-	// the proto file and not switch to camel case. What we also want is
-	// that the marshaler prints all values, even if they are falsey.
-	customMarshalerOption := gateway.WithMarshalerOption(
-		gateway.MIMEWildcard, &gateway.JSONPb{
-			MarshalOptions: protojson.MarshalOptions{
-				UseProtoNames:   true,
-				EmitUnpopulated: true,
-			},
-		},
-	)
-
 	// We'll also create and start an accompanying proxy to serve clients
 	// through REST.
 	ctxc, cancel := context.WithCancel(context.Background())
@@ -852,24 +1100,10 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 		cancel()
 	}
 
-	// The REST proxy connects to our main listen address. If we're serving
-	// TLS, we don't care about the certificate being valid, as we issue it
-	// ourselves. If we are serving without TLS (for example when behind a
-	// load balancer), we need to connect to ourselves without using TLS as
-	// well.
-	restProxyTLSOpt := grpc.WithTransportCredentials(credentials.NewTLS(
-		&tls.Config{InsecureSkipVerify: true},
-	))
-	if cfg.Insecure {
-		restProxyTLSOpt = grpc.WithTransportCredentials(
-			insecure.NewCredentials(),
-		)
-	}
-
-	mux := gateway.NewServeMux(customMarshalerOption)
+	mux := gateway.NewServeMux(restMarshalerOption())
 	err := hashmailrpc.RegisterHashMailHandlerFromEndpoint(
 		ctxc, mux, cfg.ListenAddr, []grpc.DialOption{
-			restProxyTLSOpt,
+			restProxyTLSOpt(cfg),
 		},
 	)
 	if err != nil {
@@ -896,6 +1130,108 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	return localServices, proxyCleanup, nil
 }
 
+// createAdminServer creates the gRPC server for the admin API and an
+// additional REST proxy for that gRPC server. All calls to both must be
+// authenticated with the admin macaroon.
+func createAdminServer(cfg *Config, admin *adminServer) ([]proxy.LocalService,
+	func(), error) {
+
+	var localServices []proxy.LocalService
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(admin.unaryInterceptor),
+	}
+	serverOpts = append(serverOpts, prometheusServerOpts(cfg)...)
+
+	adminGRPC := grpc.NewServer(serverOpts...)
+	adminrpc.RegisterAdminServer(adminGRPC, admin)
+	localServices = append(localServices, proxy.NewLocalService(
+		adminGRPC, func(r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, adminGRPCPrefix)
+		}),
+	)
+
+	if cfg.Prometheus != nil && cfg.Prometheus.Enabled {
+		grpc_prometheus.Register(adminGRPC)
+	}
+
+	// The REST proxy calls the gRPC server through our main listen
+	// address, passing on the macaroon from the Grpc-Metadata-Macaroon
+	// header.
+	ctxc, cancel := context.WithCancel(context.Background())
+	mux := gateway.NewServeMux(restMarshalerOption())
+	err := adminrpc.RegisterAdminHandlerFromEndpoint(
+		ctxc, mux, cfg.ListenAddr, []grpc.DialOption{
+			restProxyTLSOpt(cfg),
+		},
+	)
+	if err != nil {
+		cancel()
+
+		return nil, nil, err
+	}
+
+	localServices = append(localServices, proxy.NewLocalService(
+		mux, func(r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, adminRESTPrefix)
+		},
+	))
+
+	return localServices, cancel, nil
+}
+
+// prometheusServerOpts returns the options that make a gRPC server export its
+// metrics if prometheus is enabled.
+func prometheusServerOpts(cfg *Config) []grpc.ServerOption {
+	if cfg.Prometheus == nil || !cfg.Prometheus.Enabled {
+		return nil
+	}
+
+	// Before we register the server, we'll also ensure that the collector
+	// will export latency metrics for the histogram.
+	grpc_prometheus.EnableHandlingTimeHistogram()
+
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			grpc_prometheus.UnaryServerInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			grpc_prometheus.StreamServerInterceptor,
+		),
+	}
+}
+
+// restMarshalerOption returns the JSON marshaler option of our REST proxies.
+// The default JSON marshaler of the REST proxy only sets OrigName to true,
+// which instructs it to use the same field names as specified in the proto
+// file and not switch to camel case. What we also want is that the marshaler
+// prints all values, even if they are falsey.
+func restMarshalerOption() gateway.ServeMuxOption {
+	return gateway.WithMarshalerOption(
+		gateway.MIMEWildcard, &gateway.JSONPb{
+			MarshalOptions: protojson.MarshalOptions{
+				UseProtoNames:   true,
+				EmitUnpopulated: true,
+			},
+		},
+	)
+}
+
+// restProxyTLSOpt returns the transport option our REST proxies use to connect
+// to our main listen address. If we're serving TLS, we don't care about the
+// certificate being valid, as we issue it ourselves. If we are serving without
+// TLS (for example when behind a load balancer), we need to connect to
+// ourselves without using TLS as well.
+func restProxyTLSOpt(cfg *Config) grpc.DialOption {
+	if cfg.Insecure {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(
+		&tls.Config{InsecureSkipVerify: true},
+	))
+}
+
 // cleanup closes the given server and shuts down the log rotator.
 func cleanup(server io.Closer, proxy io.Closer) {
 	if err := proxy.Close(); err != nil {
@@ -0,0 +1,186 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb/sqlc"
+	"github.com/motxx/aperture-lnproxy/aperture/freebie"
+)
+
+type (
+	// FreebieKey identifies the freebie count of a network for a service
+	// in a time window.
+	FreebieKey                        = sqlc.GetFreebieCountParams
+	IncrementFreebieCountParams       = sqlc.IncrementFreebieCountParams
+	DeleteFreebiesBeforeParams        = sqlc.DeleteFreebiesBeforeParams
+	DeleteExpiredFreebiesBeforeParams = sqlc.DeleteExpiredFreebiesBeforeParams
+)
+
+// FreebieDB is an interface that defines the set of operations that can be
+// executed against the freebie database.
+type FreebieDB interface {
+	// IncrementFreebieCount increments the freebie count for the given
+	// key, inserting it if it doesn't exist yet, and returns the new
+	// count.
+	IncrementFreebieCount(ctx context.Context,
+		arg IncrementFreebieCountParams) (int32, error)
+
+	// GetFreebieCount returns the freebie count for the given key.
+	GetFreebieCount(ctx context.Context, arg FreebieKey) (int32, error)
+
+	// DeleteFreebiesBefore deletes the freebie counts of a network for a
+	// service of all windows before the given one.
+	DeleteFreebiesBefore(ctx context.Context,
+		arg DeleteFreebiesBeforeParams) (int64, error)
+
+	// DeleteExpiredFreebiesBefore deletes up to the given number of
+	// freebie counts of all services and networks whose window ended
+	// before the given time.
+	DeleteExpiredFreebiesBefore(ctx context.Context,
+		arg DeleteExpiredFreebiesBeforeParams) (int64, error)
+}
+
+// FreebieDBTxOptions defines the set of db txn options the FreebieStore
+// understands.
+type FreebieDBTxOptions struct {
+	// readOnly governs if a read only transaction is needed or not.
+	readOnly bool
+}
+
+// ReadOnly returns true if the transaction should be read only.
+//
+// NOTE: This implements the TxOptions
+func (a *FreebieDBTxOptions) ReadOnly() bool {
+	return a.readOnly
+}
+
+// NewFreebieDBReadTx creates a new read transaction option set.
+func NewFreebieDBReadTx() FreebieDBTxOptions {
+	return FreebieDBTxOptions{
+		readOnly: true,
+	}
+}
+
+// BatchedFreebieDB is a version of the FreebieDB that's capable of batched
+// database operations.
+type BatchedFreebieDB interface {
+	FreebieDB
+
+	BatchedTx[FreebieDB]
+}
+
+// FreebieStore represents a storage backend for freebie counts.
+type FreebieStore struct {
+	db BatchedFreebieDB
+}
+
+// A compile time flag to ensure the FreebieStore satisfies the
+// freebie.CountStore interface.
+var _ freebie.CountStore = (*FreebieStore)(nil)
+
+// NewFreebieStore creates a new FreebieStore instance given a open
+// BatchedFreebieDB storage backend.
+func NewFreebieStore(db BatchedFreebieDB) *FreebieStore {
+	return &FreebieStore{
+		db: db,
+	}
+}
+
+// FreebieCount returns the number of free requests made to the given service
+// from the given network in the window starting at the given time.
+//
+// NOTE: This is part of the freebie.CountStore interface.
+func (f *FreebieStore) FreebieCount(ctx context.Context, service,
+	ipKey string, windowStart time.Time) (freebie.Count, error) {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var count int32
+	readOpts := NewFreebieDBReadTx()
+	err := f.db.ExecTx(ctxt, &readOpts, func(tx FreebieDB) error {
+		var err error
+		count, err = tx.GetFreebieCount(ctxt, FreebieKey{
+			Service:     service,
+			IpKey:       ipKey,
+			WindowStart: windowStart.UTC(),
+		})
+		if err == sql.ErrNoRows {
+			count = 0
+			return nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("unable to get freebie count for %v of "+
+			"service %v: %w", ipKey, service, err)
+	}
+
+	return toFreebieCount(count), nil
+}
+
+// IncrementFreebieCount atomically increments the number of free requests made
+// to the given service from the given network in the window starting at the
+// given time and returns the new count. The counts of earlier windows for the
+// same network are removed, the counts of other networks are deleted by the
+// FreebiesPruner once their window ended.
+//
+// NOTE: This is part of the freebie.CountStore interface.
+func (f *FreebieStore) IncrementFreebieCount(ctx context.Context, service,
+	ipKey string, windowStart, windowEnd time.Time) (freebie.Count, error) {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var count int32
+	var writeTxOpts FreebieDBTxOptions
+	err := f.db.ExecTx(ctxt, &writeTxOpts, func(tx FreebieDB) error {
+		_, err := tx.DeleteFreebiesBefore(
+			ctxt, DeleteFreebiesBeforeParams{
+				Service:     service,
+				IpKey:       ipKey,
+				WindowStart: windowStart.UTC(),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		count, err = tx.IncrementFreebieCount(
+			ctxt, IncrementFreebieCountParams{
+				Service:     service,
+				IpKey:       ipKey,
+				WindowStart: windowStart.UTC(),
+				WindowEnd: NullTime{
+					Time:  windowEnd.UTC(),
+					Valid: !windowEnd.IsZero(),
+				},
+			},
+		)
+
+		return err
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("unable to increment freebie count for "+
+			"%v of service %v: %w", ipKey, service, err)
+	}
+
+	return toFreebieCount(count), nil
+}
+
+// toFreebieCount converts a count from the database to a freebie count,
+// saturating at the maximum value instead of wrapping around.
+func toFreebieCount(count int32) freebie.Count {
+	if count > math.MaxUint16 {
+		return math.MaxUint16
+	}
+
+	return freebie.Count(count)
+}
@@ -0,0 +1,136 @@
+package aperturedb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// prunedFreebies counts the freebie counts deleted by the pruner.
+	prunedFreebies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "aperturedb",
+		Name:      "freebies_pruned_total",
+	})
+
+	// freebiesPruneErrors counts the runs of the freebies pruner that
+	// failed.
+	freebiesPruneErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "aperturedb",
+		Name:      "freebies_prune_errors_total",
+	})
+)
+
+// FreebiesPruner periodically deletes the freebie counts of all services and
+// networks whose time window ended. The counts of a network are otherwise only
+// removed when the same network makes a free request in a later window.
+type FreebiesPruner struct {
+	cfg   *SecretsPrunerConfig
+	db    BatchedFreebieDB
+	clock clock.Clock
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewFreebiesPruner creates a new pruner of the freebie counts in the given
+// database. It runs at the interval and with the batch size of the given
+// secrets pruner configuration.
+func NewFreebiesPruner(cfg *SecretsPrunerConfig,
+	db BatchedFreebieDB) *FreebiesPruner {
+
+	return &FreebiesPruner{
+		cfg:   cfg,
+		db:    db,
+		clock: clock.NewDefaultClock(),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Start runs the pruner in the background until it is stopped.
+func (p *FreebiesPruner) Start() {
+	if p.cfg.Disable {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := p.clock.TickAfter(0)
+		for {
+			select {
+			case <-ticker:
+				p.pruneWithTimeout()
+				ticker = p.clock.TickAfter(p.cfg.Interval)
+
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the pruner and waits for a running prune to finish.
+func (p *FreebiesPruner) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// pruneWithTimeout runs the pruner once and logs the result.
+func (p *FreebiesPruner) pruneWithTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+	defer cancel()
+
+	pruned, err := p.Prune(ctx)
+	if err != nil {
+		freebiesPruneErrors.Inc()
+		log.Errorf("Unable to prune freebie counts: %v", err)
+	}
+	if pruned > 0 {
+		log.Infof("Pruned %d expired freebie counts", pruned)
+	}
+}
+
+// Prune deletes the freebie counts whose window ended in batches and returns
+// the number of deleted counts.
+func (p *FreebiesPruner) Prune(ctx context.Context) (int64, error) {
+	cutoff := NullTime{Time: p.clock.Now().UTC(), Valid: true}
+	batchSize := clampInt32(p.cfg.BatchSize)
+
+	var total int64
+	for {
+		var deleted int64
+		var writeTxOpts FreebieDBTxOptions
+		err := p.db.ExecTx(ctx, &writeTxOpts, func(tx FreebieDB) error {
+			var err error
+			deleted, err = tx.DeleteExpiredFreebiesBefore(
+				ctx, DeleteExpiredFreebiesBeforeParams{
+					WindowEnd: cutoff,
+					Limit:     batchSize,
+				},
+			)
+			return err
+		})
+		if err != nil {
+			return total, fmt.Errorf("unable to delete expired "+
+				"freebie counts: %w", err)
+		}
+
+		total += deleted
+		prunedFreebies.Add(float64(deleted))
+
+		if deleted < int64(batchSize) {
+			return total, nil
+		}
+
+		select {
+		case <-p.quit:
+			return total, nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func newFreebieTxer(db *BaseDB) BatchedFreebieDB {
+	return NewTransactionExecutor(db,
+		func(tx *sql.Tx) FreebieDB {
+			return db.WithTx(tx)
+		},
+	)
+}
+
+func newFreebieStoreWithDB(db *BaseDB) *FreebieStore {
+	return NewFreebieStore(newFreebieTxer(db))
+}
+
+func TestFreebieDB(t *testing.T) {
+	ctx := context.Background()
+
+	// First, create a new test database.
+	db := NewTestDB(t)
+	store := newFreebieStoreWithDB(db.BaseDB)
+
+	window := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	nextWindow := window.Add(24 * time.Hour)
+
+	// Without any free request made, the count is zero.
+	count, err := store.FreebieCount(ctx, "service", "1.2.3.0/24", window)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// Each increment returns the new count.
+	for i := 1; i <= 3; i++ {
+		count, err = store.IncrementFreebieCount(
+			ctx, "service", "1.2.3.0/24", window, nextWindow,
+		)
+		require.NoError(t, err)
+		require.EqualValues(t, i, count)
+	}
+
+	count, err = store.FreebieCount(ctx, "service", "1.2.3.0/24", window)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+
+	// Counts are kept per service.
+	count, err = store.FreebieCount(ctx, "other", "1.2.3.0/24", window)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// A new window starts from zero and removes the previous one.
+	count, err = store.IncrementFreebieCount(
+		ctx, "service", "1.2.3.0/24", nextWindow,
+		nextWindow.Add(24*time.Hour),
+	)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+
+	count, err = store.FreebieCount(ctx, "service", "1.2.3.0/24", window)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+// TestFreebiesPruner makes sure the pruner deletes the counts of all services
+// and networks whose window ended in batches and keeps the counts of current
+// windows and the counts that are granted only once.
+func TestFreebiesPruner(t *testing.T) {
+	ctx := context.Background()
+
+	db := NewTestDB(t)
+	store := newFreebieStoreWithDB(db.BaseDB)
+
+	day := 24 * time.Hour
+	window := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	nextWindow := window.Add(day)
+
+	increment := func(service, ipKey string, start, end time.Time) {
+		_, err := store.IncrementFreebieCount(
+			ctx, service, ipKey, start, end,
+		)
+		require.NoError(t, err)
+	}
+
+	// Three networks of two services made free requests in the first
+	// window, one network in the next and one network of a service that
+	// grants the free requests only once.
+	increment("service", "1.2.3.0/24", window, nextWindow)
+	increment("service", "5.6.7.0/24", window, nextWindow)
+	increment("other", "1.2.3.0/24", window, window.Add(time.Hour))
+	increment("service", "8.8.8.0/24", nextWindow, nextWindow.Add(day))
+	increment("once", "1.2.3.0/24", time.Time{}, time.Time{})
+
+	cfg := &SecretsPrunerConfig{
+		Interval:     DefaultPruneInterval,
+		BatchSize:    2,
+		UnsettledAge: DefaultUnsettledSecretAge,
+	}
+	pruner := NewFreebiesPruner(cfg, newFreebieTxer(db.BaseDB))
+	testClock := clock.NewTestClock(window.Add(time.Minute))
+	pruner.clock = testClock
+
+	count := func(service, ipKey string, start time.Time) int {
+		c, err := store.FreebieCount(ctx, service, ipKey, start)
+		require.NoError(t, err)
+
+		return int(c)
+	}
+
+	// No window ended yet.
+	pruned, err := pruner.Prune(ctx)
+	require.NoError(t, err)
+	require.Zero(t, pruned)
+
+	// Once the first window ended, its counts are deleted in batches
+	// smaller than the number of counts.
+	testClock.SetTime(nextWindow.Add(time.Minute))
+	pruned, err = pruner.Prune(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, pruned)
+
+	require.Zero(t, count("service", "1.2.3.0/24", window))
+	require.Zero(t, count("service", "5.6.7.0/24", window))
+	require.Zero(t, count("other", "1.2.3.0/24", window))
+	require.Equal(t, 1, count("service", "8.8.8.0/24", nextWindow))
+	require.Equal(t, 1, count("once", "1.2.3.0/24", time.Time{}))
+
+	// Counts that are granted only once are never deleted.
+	testClock.SetTime(window.Add(365 * day))
+	pruned, err = pruner.Prune(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, pruned)
+	require.Equal(t, 1, count("once", "1.2.3.0/24", time.Time{}))
+}
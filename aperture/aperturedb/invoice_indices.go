@@ -0,0 +1,140 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb/sqlc"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+)
+
+type (
+	UpsertInvoiceIndicesParams = sqlc.UpsertInvoiceIndicesParams
+	InvoiceIndicesRow          = sqlc.GetInvoiceIndicesRow
+)
+
+// InvoiceIndicesDB is an interface that defines the set of operations that can
+// be executed against the invoice indices database.
+type InvoiceIndicesDB interface {
+	// UpsertInvoiceIndices stores the latest processed invoice indices,
+	// replacing the previous ones.
+	UpsertInvoiceIndices(ctx context.Context,
+		arg UpsertInvoiceIndicesParams) error
+
+	// GetInvoiceIndices returns the latest processed invoice indices.
+	GetInvoiceIndices(ctx context.Context) (InvoiceIndicesRow, error)
+}
+
+// InvoiceIndicesDBTxOptions defines the set of db txn options the
+// InvoiceIndicesStore understands.
+type InvoiceIndicesDBTxOptions struct {
+	// readOnly governs if a read only transaction is needed or not.
+	readOnly bool
+}
+
+// ReadOnly returns true if the transaction should be read only.
+//
+// NOTE: This implements the TxOptions
+func (a *InvoiceIndicesDBTxOptions) ReadOnly() bool {
+	return a.readOnly
+}
+
+// NewInvoiceIndicesDBReadTx creates a new read transaction option set.
+func NewInvoiceIndicesDBReadTx() InvoiceIndicesDBTxOptions {
+	return InvoiceIndicesDBTxOptions{
+		readOnly: true,
+	}
+}
+
+// BatchedInvoiceIndicesDB is a version of the InvoiceIndicesDB that's capable
+// of batched database operations.
+type BatchedInvoiceIndicesDB interface {
+	InvoiceIndicesDB
+
+	BatchedTx[InvoiceIndicesDB]
+}
+
+// InvoiceIndicesStore represents a storage backend for the indices of the
+// latest invoice updates the challenger processed.
+type InvoiceIndicesStore struct {
+	db    BatchedInvoiceIndicesDB
+	clock clock.Clock
+}
+
+// A compile time flag to ensure the InvoiceIndicesStore satisfies the
+// challenger.InvoiceIndexStore interface.
+var _ challenger.InvoiceIndexStore = (*InvoiceIndicesStore)(nil)
+
+// NewInvoiceIndicesStore creates a new InvoiceIndicesStore instance given a
+// open BatchedInvoiceIndicesDB storage backend.
+func NewInvoiceIndicesStore(db BatchedInvoiceIndicesDB) *InvoiceIndicesStore {
+	return &InvoiceIndicesStore{
+		db:    db,
+		clock: clock.NewDefaultClock(),
+	}
+}
+
+// InvoiceIndices returns the add and settle index of the latest processed
+// invoice updates. Both are zero if no indices were stored yet.
+//
+// NOTE: This is part of the challenger.InvoiceIndexStore interface.
+func (i *InvoiceIndicesStore) InvoiceIndices(ctx context.Context) (uint64,
+	uint64, error) {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var indices InvoiceIndicesRow
+	readOpts := NewInvoiceIndicesDBReadTx()
+	err := i.db.ExecTx(ctxt, &readOpts, func(tx InvoiceIndicesDB) error {
+		var err error
+		indices, err = tx.GetInvoiceIndices(ctxt)
+		if err == sql.ErrNoRows {
+			indices = InvoiceIndicesRow{}
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get invoice indices: %w",
+			err)
+	}
+
+	return uint64(indices.AddIndex), uint64(indices.SettleIndex), nil
+}
+
+// SetInvoiceIndices stores the add and settle index of the latest processed
+// invoice updates.
+//
+// NOTE: This is part of the challenger.InvoiceIndexStore interface.
+func (i *InvoiceIndicesStore) SetInvoiceIndices(ctx context.Context, addIndex,
+	settleIndex uint64) error {
+
+	if addIndex > math.MaxInt64 || settleIndex > math.MaxInt64 {
+		return fmt.Errorf("invoice indices %d and %d out of range",
+			addIndex, settleIndex)
+	}
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var writeTxOpts InvoiceIndicesDBTxOptions
+	err := i.db.ExecTx(ctxt, &writeTxOpts, func(tx InvoiceIndicesDB) error {
+		return tx.UpsertInvoiceIndices(
+			ctxt, UpsertInvoiceIndicesParams{
+				AddIndex:    int64(addIndex),
+				SettleIndex: int64(settleIndex),
+				UpdatedAt:   i.clock.Now().UTC(),
+			},
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set invoice indices: %w", err)
+	}
+
+	return nil
+}
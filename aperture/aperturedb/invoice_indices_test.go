@@ -0,0 +1,41 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestInvoiceIndicesStore makes sure the invoice indices are stored and
+// replaced correctly.
+func TestInvoiceIndicesStore(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	dbTxer := NewTransactionExecutor(db.BaseDB,
+		func(tx *sql.Tx) InvoiceIndicesDB {
+			return db.WithTx(tx)
+		},
+	)
+	store := NewInvoiceIndicesStore(dbTxer)
+
+	// Without any stored indices, we start from the beginning.
+	addIndex, settleIndex, err := store.InvoiceIndices(ctxt)
+	require.NoError(t, err)
+	require.Zero(t, addIndex)
+	require.Zero(t, settleIndex)
+
+	// Storing the indices twice replaces the first ones.
+	require.NoError(t, store.SetInvoiceIndices(ctxt, 3, 1))
+	require.NoError(t, store.SetInvoiceIndices(ctxt, 7, 5))
+
+	addIndex, settleIndex, err = store.InvoiceIndices(ctxt)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, addIndex)
+	require.EqualValues(t, 5, settleIndex)
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/lightningnetwork/lnd/clock"
 	"github.com/motxx/aperture-lnproxy/aperture/aperturedb/sqlc"
@@ -16,9 +18,22 @@ import (
 type (
 	// NewSecret is a struct that contains the parameters required to insert
 	// a new secret into the database.
-	NewSecret                       = sqlc.InsertSecretParams
-	SetSettledAtByPaymentHashParams = sqlc.SetSettledAtByPaymentHashParams
-	NullTime                        = sql.NullTime
+	NewSecret                          = sqlc.InsertSecretParams
+	SetSettledAtByPaymentHashParams    = sqlc.SetSettledAtByPaymentHashParams
+	IncrementSecretUsesParams          = sqlc.IncrementSecretUsesParams
+	ListSecretsParams                  = sqlc.ListSecretsParams
+	ListSecretsRow                     = sqlc.ListSecretsRow
+	GetSecretLifetimeByIdHashRow       = sqlc.GetSecretLifetimeByIdHashRow
+	InsertSecretRevocationParams       = sqlc.InsertSecretRevocationParams
+	GetSecretRevocationByIdHashRow     = sqlc.GetSecretRevocationByIdHashRow
+	ListSecretRevocationsParams        = sqlc.ListSecretRevocationsParams
+	SecretRevocation                   = sqlc.SecretRevocation
+	DeleteUnsettledSecretsBeforeParams = sqlc.DeleteUnsettledSecretsBeforeParams
+	DeleteSettledSecretsBeforeParams   = sqlc.DeleteSettledSecretsBeforeParams
+	DeleteExpiredSecretsBeforeParams   = sqlc.DeleteExpiredSecretsBeforeParams
+	GetSecretLifetimesByPaymentHashRow = sqlc.GetSecretLifetimesByPaymentHashRow
+	SetSecretExpiresAtParams           = sqlc.SetSecretExpiresAtParams
+	NullTime                           = sql.NullTime
 )
 
 // SecretsDB is an interface that defines the set of operations that can be
@@ -33,13 +48,124 @@ type SecretsDB interface {
 	// GetSecretByIdHash returns the secret that corresponds to the given hash.
 	GetSecretByIdHash(ctx context.Context, idHash []byte) ([]byte, error)
 
+	// GetSecretLifetimeByIdHash returns the service and the lifetime that
+	// were recorded with the secret that corresponds to the given hash.
+	GetSecretLifetimeByIdHash(ctx context.Context, idHash []byte) (GetSecretLifetimeByIdHashRow, error)
+
 	// GetSettledAtByPaymentHash returns the settled_at that corresponds to the given
 	// hash.
 	GetSettledAtByPaymentHash(ctx context.Context, paymentHash []byte) (NullTime, error)
 
+	// GetSecretLifetimesByPaymentHash returns the recorded lifetimes of the
+	// secrets of the given payment hash.
+	GetSecretLifetimesByPaymentHash(ctx context.Context, paymentHash []byte) ([]GetSecretLifetimesByPaymentHashRow, error)
+
+	// SetSecretExpiresAt sets the time the access of the L402 of the secret
+	// with the given id ends.
+	SetSecretExpiresAt(ctx context.Context, arg SetSecretExpiresAtParams) error
+
 	// DeleteSecretByIdHash removes the secret that corresponds to the given
 	// hash.
 	DeleteSecretByIdHash(ctx context.Context, idHash []byte) (int64, error)
+
+	// IncrementSecretUses increments the number of uses of the secret that
+	// corresponds to the given hash if it is below the given maximum and
+	// returns the new number of uses.
+	IncrementSecretUses(ctx context.Context, arg IncrementSecretUsesParams) (int32, error)
+
+	// ListSecrets returns a page of the secrets that match the given
+	// filters without the secret values, ordered by their creation.
+	ListSecrets(ctx context.Context, arg ListSecretsParams) ([]ListSecretsRow, error)
+
+	// InsertSecretRevocation records the revocation of a secret.
+	InsertSecretRevocation(ctx context.Context, arg InsertSecretRevocationParams) error
+
+	// GetSecretRevocationByIdHash returns when and why the secret that
+	// corresponds to the given hash was revoked.
+	GetSecretRevocationByIdHash(ctx context.Context, idHash []byte) (GetSecretRevocationByIdHashRow, error)
+
+	// ListSecretRevocations returns a page of all revocations, ordered by
+	// the time they were made.
+	ListSecretRevocations(ctx context.Context, arg ListSecretRevocationsParams) ([]SecretRevocation, error)
+
+	// DeleteUnsettledSecretsBefore deletes at most the given number of
+	// unsettled secrets created before the given time.
+	DeleteUnsettledSecretsBefore(ctx context.Context, arg DeleteUnsettledSecretsBeforeParams) (int64, error)
+
+	// DeleteSettledSecretsBefore deletes at most the given number of
+	// secrets without a recorded lifetime settled before the given time.
+	DeleteSettledSecretsBefore(ctx context.Context, arg DeleteSettledSecretsBeforeParams) (int64, error)
+
+	// DeleteExpiredSecretsBefore deletes at most the given number of
+	// secrets whose access ended before the given time.
+	DeleteExpiredSecretsBefore(ctx context.Context, arg DeleteExpiredSecretsBeforeParams) (int64, error)
+}
+
+// SecretInfo describes an issued L402 without revealing its secret.
+type SecretInfo struct {
+	// IDHash is the hash of the macaroon identifier of the L402.
+	IDHash [sha256.Size]byte
+
+	// PaymentHash is the payment hash of the invoice of the L402.
+	PaymentHash [sha256.Size]byte
+
+	// TokenID is the token ID of the L402. It is zero for L402s that were
+	// issued before token IDs were recorded.
+	TokenID lsat.TokenID
+
+	// Service is the name of the service the L402 was priced for.
+	Service string
+
+	// CreatedAt is the time the L402 was issued.
+	CreatedAt time.Time
+
+	// SettledAt is the time the invoice of the L402 was settled, if it
+	// was.
+	SettledAt NullTime
+
+	// Uses is the number of times a usage counted L402 was used.
+	Uses uint32
+}
+
+// SecretsQuery selects issued L402s. Filters that are not set match all L402s.
+type SecretsQuery struct {
+	// IDHash only matches the L402 with the given macaroon identifier
+	// hash.
+	IDHash *[sha256.Size]byte
+
+	// PaymentHash only matches the L402s of the given payment hash.
+	PaymentHash *[sha256.Size]byte
+
+	// TokenID only matches the L402 with the given token ID.
+	TokenID *lsat.TokenID
+
+	// Service only matches the L402s of the service with the given name.
+	Service string
+
+	// CreatedAfter and CreatedBefore only match the L402s issued in the
+	// window [CreatedAfter, CreatedBefore).
+	CreatedAfter, CreatedBefore time.Time
+
+	// SettledAfter and SettledBefore only match the L402s whose invoice
+	// was settled in the window [SettledAfter, SettledBefore).
+	SettledAfter, SettledBefore time.Time
+
+	// Offset is the number of matching L402s to skip.
+	Offset uint32
+
+	// Limit is the maximum number of L402s to return.
+	Limit uint32
+}
+
+// RevocationInfo describes an L402 that was revoked by the operator.
+type RevocationInfo struct {
+	SecretInfo
+
+	// RevokedAt is the time the L402 was revoked.
+	RevokedAt time.Time
+
+	// Reason is the reason the operator gave for the revocation.
+	Reason string
 }
 
 // SecretsTxOptions defines the set of db txn options the SecretsStore
@@ -87,9 +213,11 @@ func NewSecretsStore(db BatchedSecretsDB) *SecretsStore {
 }
 
 // NewSecret creates a new cryptographically random secret which is
-// keyed by the given hash.
+// keyed by the given hash of the L402's identifier. The name and the lifetime
+// of the given service are recorded along with it.
 func (s *SecretsStore) NewSecret(ctx context.Context,
-	idHash [sha256.Size]byte, paymentHash [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+	idHash [sha256.Size]byte, id *lsat.Identifier,
+	service lsat.Service) ([lsat.SecretSize]byte, error) {
 
 	var secret [lsat.SecretSize]byte
 	if _, err := rand.Read(secret[:]); err != nil {
@@ -99,10 +227,13 @@ func (s *SecretsStore) NewSecret(ctx context.Context,
 	var writeTxOpts SecretsDBTxOptions
 	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
 		_, err := tx.InsertSecret(ctx, NewSecret{
-			MacaroonIDHash: idHash[:],
-			PaymentHash:    paymentHash[:],
-			Secret:         secret[:],
-			CreatedAt:      s.clock.Now().UTC(),
+			MacaroonIDHash:  idHash[:],
+			PaymentHash:     id.PaymentHash[:],
+			TokenID:         id.TokenID[:],
+			Service:         service.Name,
+			Secret:          secret[:],
+			CreatedAt:       s.clock.Now().UTC(),
+			LifetimeSeconds: lifetimeSeconds(service.Lifetime),
 		})
 		if err != nil {
 			return err
@@ -120,7 +251,8 @@ func (s *SecretsStore) NewSecret(ctx context.Context,
 }
 
 // SetSettledAtByPaymentHash sets the settled_at time for the secret that
-// corresponds to the given hash.
+// corresponds to the given hash. The time the access of the L402 ends is set
+// along with it from the lifetime the L402 was minted with.
 func (s *SecretsStore) SetSettledAtByPaymentHash(ctx context.Context,
 	paymentHash [sha256.Size]byte, settledAt NullTime) error {
 
@@ -134,6 +266,22 @@ func (s *SecretsStore) SetSettledAtByPaymentHash(ctx context.Context,
 			return err
 		}
 
+		rows, err := tx.GetSecretLifetimesByPaymentHash(
+			ctx, paymentHash[:],
+		)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			err := tx.SetSecretExpiresAt(ctx, SetSecretExpiresAtParams{
+				ID:        row.ID,
+				ExpiresAt: expiresAt(settledAt, row.LifetimeSeconds),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
@@ -147,7 +295,8 @@ func (s *SecretsStore) SetSettledAtByPaymentHash(ctx context.Context,
 
 // GetSecret returns the cryptographically random secret that
 // corresponds to the given hash. If there is no secret, then
-// ErrSecretNotFound is returned.
+// ErrSecretNotFound is returned, or ErrSecretRevoked if the L402 was revoked
+// by the operator.
 func (s *SecretsStore) GetSecret(ctx context.Context,
 	idHash [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
 
@@ -157,7 +306,7 @@ func (s *SecretsStore) GetSecret(ctx context.Context,
 		secretRow, err := db.GetSecretByIdHash(ctx, idHash[:])
 		switch {
 		case err == sql.ErrNoRows:
-			return mint.ErrSecretNotFound
+			return secretNotFound(ctx, db, idHash)
 
 		case err != nil:
 			return err
@@ -176,6 +325,71 @@ func (s *SecretsStore) GetSecret(ctx context.Context,
 	return secret, nil
 }
 
+// GetSecretLifetime returns the name and the lifetime of the service that were
+// recorded along with the secret that corresponds to the given hash. The
+// lifetime is nil if the secret was created before lifetimes were recorded.
+func (s *SecretsStore) GetSecretLifetime(ctx context.Context,
+	idHash [sha256.Size]byte) (string, *lsat.Lifetime, error) {
+
+	var row GetSecretLifetimeByIdHashRow
+	readOpts := NewSecretsDBReadTx()
+	err := s.db.ExecTx(ctx, &readOpts, func(db SecretsDB) error {
+		var err error
+		row, err = db.GetSecretLifetimeByIdHash(ctx, idHash[:])
+		switch {
+		case err == sql.ErrNoRows:
+			return secretNotFound(ctx, db, idHash)
+
+		case err != nil:
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get lifetime of "+
+			"secret for hash(%x): %w", idHash, err)
+	}
+
+	if !row.LifetimeSeconds.Valid {
+		return row.Service, nil, nil
+	}
+
+	return row.Service, &lsat.Lifetime{
+		Duration: time.Duration(row.LifetimeSeconds.Int64) * time.Second,
+	}, nil
+}
+
+// lifetimeSeconds returns the duration of the given lifetime in seconds as it
+// is recorded with a secret. A duration that isn't a whole number of seconds
+// is rounded up, so the recorded lifetime is never shorter than the one the
+// L402 was minted with.
+func lifetimeSeconds(lifetime *lsat.Lifetime) sql.NullInt64 {
+	if lifetime == nil {
+		return sql.NullInt64{}
+	}
+
+	seconds := (lifetime.Duration + time.Second - 1) / time.Second
+
+	return sql.NullInt64{Int64: int64(seconds), Valid: true}
+}
+
+// expiresAt returns the time the access of an L402 with the given recorded
+// lifetime ends if it was settled at the given time. It is not set for
+// unsettled L402s and L402s without a time limit or a recorded lifetime.
+func expiresAt(settledAt NullTime, lifetimeSeconds sql.NullInt64) NullTime {
+	if !settledAt.Valid || !lifetimeSeconds.Valid ||
+		lifetimeSeconds.Int64 == 0 {
+
+		return NullTime{}
+	}
+
+	lifetime := time.Duration(lifetimeSeconds.Int64) * time.Second
+
+	return NullTime{Time: settledAt.Time.Add(lifetime), Valid: true}
+}
+
 // GetSettledAtByPaymentHash returns the settled_at time for the secret that
 // corresponds to the given hash.
 func (s *SecretsStore) GetSettledAtByPaymentHash(ctx context.Context,
@@ -234,3 +448,241 @@ func (s *SecretsStore) RevokeSecret(ctx context.Context,
 
 	return nil
 }
+
+// IncrementSecretUses atomically increments the number of times the L402 of
+// the secret that corresponds to the given hash was used and returns the new
+// number of uses. If the L402 was already used maxUses times,
+// mint.ErrUsesExhausted is returned.
+func (s *SecretsStore) IncrementSecretUses(ctx context.Context,
+	idHash [sha256.Size]byte, maxUses uint32) (uint32, error) {
+
+	if maxUses > math.MaxInt32 {
+		maxUses = math.MaxInt32
+	}
+
+	var uses int32
+	var writeTxOpts SecretsDBTxOptions
+	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
+		var err error
+		uses, err = tx.IncrementSecretUses(ctx, IncrementSecretUsesParams{
+			MacaroonIDHash: idHash[:],
+			Uses:           int32(maxUses),
+		})
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Nothing was updated, either because the secret doesn't
+		// exist or because all uses are used up.
+		_, err = tx.GetSecretByIdHash(ctx, idHash[:])
+		switch {
+		case err == sql.ErrNoRows:
+			return mint.ErrSecretNotFound
+
+		case err != nil:
+			return err
+		}
+
+		return mint.ErrUsesExhausted
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("unable to increment uses for hash(%x): %w",
+			idHash, err)
+	}
+
+	return uint32(uses), nil
+}
+
+// ListSecrets returns information about the issued L402s that match the given
+// query. The L402s are ordered by their creation.
+func (s *SecretsStore) ListSecrets(ctx context.Context,
+	query SecretsQuery) ([]SecretInfo, error) {
+
+	params := ListSecretsParams{
+		Service: sql.NullString{
+			String: query.Service,
+			Valid:  query.Service != "",
+		},
+		CreatedAfter:  nullTime(query.CreatedAfter),
+		CreatedBefore: nullTime(query.CreatedBefore),
+		SettledAfter:  nullTime(query.SettledAfter),
+		SettledBefore: nullTime(query.SettledBefore),
+		NumLimit:      clampInt32(query.Limit),
+		NumOffset:     clampInt32(query.Offset),
+	}
+	if query.IDHash != nil {
+		params.MacaroonIDHash = query.IDHash[:]
+	}
+	if query.PaymentHash != nil {
+		params.PaymentHash = query.PaymentHash[:]
+	}
+	if query.TokenID != nil {
+		params.TokenID = query.TokenID[:]
+	}
+
+	var secrets []SecretInfo
+	readOpts := NewSecretsDBReadTx()
+	err := s.db.ExecTx(ctx, &readOpts, func(db SecretsDB) error {
+		rows, err := db.ListSecrets(ctx, params)
+		if err != nil {
+			return err
+		}
+
+		secrets = make([]SecretInfo, 0, len(rows))
+		for _, row := range rows {
+			info := SecretInfo{
+				Service:   row.Service,
+				CreatedAt: row.CreatedAt,
+				SettledAt: row.SettledAt,
+				Uses:      uint32(row.Uses),
+			}
+			copy(info.IDHash[:], row.MacaroonIDHash)
+			copy(info.PaymentHash[:], row.PaymentHash)
+			copy(info.TokenID[:], row.TokenID)
+
+			secrets = append(secrets, info)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to list secrets: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// RevokeL402 revokes the L402 that corresponds to the given hash on behalf of
+// the operator. Its secret is removed, so it can't be used anymore, and the
+// revocation is recorded along with the given reason. If there is no secret,
+// then ErrSecretNotFound is returned.
+func (s *SecretsStore) RevokeL402(ctx context.Context,
+	idHash [sha256.Size]byte, reason string) error {
+
+	var writeTxOpts SecretsDBTxOptions
+	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
+		rows, err := tx.ListSecrets(ctx, ListSecretsParams{
+			MacaroonIDHash: idHash[:],
+			NumLimit:       1,
+		})
+		switch {
+		case err != nil:
+			return err
+
+		case len(rows) == 0:
+			return mint.ErrSecretNotFound
+		}
+
+		row := rows[0]
+		err = tx.InsertSecretRevocation(ctx, InsertSecretRevocationParams{
+			MacaroonIDHash: row.MacaroonIDHash,
+			PaymentHash:    row.PaymentHash,
+			TokenID:        row.TokenID,
+			Service:        row.Service,
+			CreatedAt:      row.CreatedAt,
+			SettledAt:      row.SettledAt,
+			Uses:           row.Uses,
+			RevokedAt:      s.clock.Now().UTC(),
+			Reason:         reason,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.DeleteSecretByIdHash(ctx, idHash[:])
+		return err
+	})
+
+	if err != nil {
+		return fmt.Errorf("unable to revoke L402 for hash(%x): %w",
+			idHash, err)
+	}
+
+	log.Infof("Revoked L402 with hash(%x): %v", idHash, reason)
+
+	return nil
+}
+
+// ListRevocations returns at most limit L402s that were revoked by the
+// operator, skipping the first offset ones. The revocations are ordered by the
+// time they were made.
+func (s *SecretsStore) ListRevocations(ctx context.Context, offset,
+	limit uint32) ([]RevocationInfo, error) {
+
+	var revocations []RevocationInfo
+	readOpts := NewSecretsDBReadTx()
+	err := s.db.ExecTx(ctx, &readOpts, func(db SecretsDB) error {
+		rows, err := db.ListSecretRevocations(
+			ctx, ListSecretRevocationsParams{
+				Limit:  clampInt32(limit),
+				Offset: clampInt32(offset),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		revocations = make([]RevocationInfo, 0, len(rows))
+		for _, row := range rows {
+			info := RevocationInfo{
+				SecretInfo: SecretInfo{
+					Service:   row.Service,
+					CreatedAt: row.CreatedAt,
+					SettledAt: row.SettledAt,
+					Uses:      uint32(row.Uses),
+				},
+				RevokedAt: row.RevokedAt,
+				Reason:    row.Reason,
+			}
+			copy(info.IDHash[:], row.MacaroonIDHash)
+			copy(info.PaymentHash[:], row.PaymentHash)
+			copy(info.TokenID[:], row.TokenID)
+
+			revocations = append(revocations, info)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to list revocations: %w", err)
+	}
+
+	return revocations, nil
+}
+
+// secretNotFound returns the error for a secret that doesn't exist, which is
+// ErrSecretRevoked if the operator revoked it.
+func secretNotFound(ctx context.Context, db SecretsDB,
+	idHash [sha256.Size]byte) error {
+
+	revocation, err := db.GetSecretRevocationByIdHash(ctx, idHash[:])
+	switch {
+	case err == sql.ErrNoRows:
+		return mint.ErrSecretNotFound
+
+	case err != nil:
+		return err
+	}
+
+	return fmt.Errorf("%w at %v: %v", mint.ErrSecretRevoked,
+		revocation.RevokedAt, revocation.Reason)
+}
+
+// nullTime returns the given time as a NullTime that is only valid if the time
+// is set.
+func nullTime(t time.Time) NullTime {
+	return NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// clampInt32 converts the given number to an int32, capping it at the maximum
+// value of an int32.
+func clampInt32(n uint32) int32 {
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+
+	return int32(n)
+}
@@ -0,0 +1,301 @@
+package aperturedb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultPruneInterval is the default time between two runs of the
+	// secrets pruner.
+	DefaultPruneInterval = 10 * time.Minute
+
+	// DefaultPruneBatchSize is the default maximum number of secrets that
+	// are deleted in one transaction.
+	DefaultPruneBatchSize = 1000
+
+	// DefaultUnsettledSecretAge is the default age after which unsettled
+	// secrets are deleted. It is twice the default expiry of lnd
+	// invoices, so the invoice of a secret has certainly expired.
+	DefaultUnsettledSecretAge = 48 * time.Hour
+
+	// pruneTimeout is the maximum time a single run of the pruner may
+	// take.
+	pruneTimeout = time.Minute
+)
+
+var (
+	// prunedSecrets counts the secrets deleted by the pruner, labeled by
+	// whether they were settled.
+	prunedSecrets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperturedb",
+		Name:      "secrets_pruned_total",
+	}, []string{"state"})
+
+	// pruneErrors counts the runs of the pruner that failed.
+	pruneErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "aperturedb",
+		Name:      "secrets_prune_errors_total",
+	})
+)
+
+// Collectors returns the prometheus collectors of the database so they can be
+// registered by the exporter.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prunedSecrets, pruneErrors, prunedFreebies,
+		freebiesPruneErrors,
+	}
+}
+
+// SecretsPrunerConfig is the configuration of the background job that deletes
+// the secrets that are not needed anymore.
+type SecretsPrunerConfig struct {
+	// Disable turns the pruner off. It also turns off the pruning of the
+	// freebie counts of ended windows, which runs at the same interval.
+	Disable bool `long:"disable" description:"Never delete any secrets or expired freebie counts."`
+
+	// Interval is the time between two runs of the pruner.
+	Interval time.Duration `long:"interval" description:"The time between two runs of the secrets pruner."`
+
+	// BatchSize is the maximum number of secrets deleted in one
+	// transaction.
+	BatchSize uint32 `long:"batchsize" description:"The maximum number of secrets deleted in one transaction."`
+
+	// UnsettledAge is the age after which the secrets of challenges that
+	// were never paid are deleted. It must be longer than the expiry of
+	// the invoices.
+	UnsettledAge time.Duration `long:"unsettledage" description:"The age after which the secrets of unpaid challenges are deleted, must be longer than the invoice expiry."`
+
+	// SettledAge is the time the secrets of paid L402s are kept after the
+	// lifetime they were minted with ended. L402s without a time limit
+	// are never deleted. The lifetime of L402s minted before lifetimes
+	// were recorded is unknown, their secrets are deleted SettledAge after
+	// settlement instead, so it must be at least the lifetime of every
+	// service. If zero, paid L402s are kept forever.
+	SettledAge time.Duration `long:"settledage" description:"The time the secrets of paid L402s are kept after their access lifetime ended. Secrets of L402s without a recorded lifetime are deleted this long after settlement, so it must be at least the lifetime of every service. 0 keeps them forever."`
+}
+
+// Validate checks the pruner configuration for valid values.
+func (c *SecretsPrunerConfig) Validate() error {
+	switch {
+	case c.Disable:
+		return nil
+
+	case c.Interval <= 0:
+		return fmt.Errorf("secrets pruner interval must be positive")
+
+	case c.BatchSize == 0:
+		return fmt.Errorf("secrets pruner batch size must be positive")
+
+	case c.UnsettledAge <= 0:
+		return fmt.Errorf("secrets pruner unsettled age must be " +
+			"positive")
+
+	case c.SettledAge < 0:
+		return fmt.Errorf("secrets pruner settled age must not be " +
+			"negative")
+	}
+
+	return nil
+}
+
+// ValidateLifetimes checks that the secrets of paid L402s without a recorded
+// lifetime, which are deleted SettledAge after settlement, can't be deleted
+// while they may still grant access to one of the services with the given
+// configured lifetimes. Services without a configured lifetime have the
+// default lifetime.
+func (c *SecretsPrunerConfig) ValidateLifetimes(
+	lifetimes map[string]*lsat.Lifetime) error {
+
+	if c.Disable || c.SettledAge == 0 {
+		return nil
+	}
+
+	for name, lifetime := range lifetimes {
+		if lifetime == nil {
+			lifetime = &lsat.DefaultLifetime
+		}
+
+		switch {
+		case lifetime.Duration == 0:
+			return fmt.Errorf("secrets pruner settled age can't "+
+				"be used with service %v, its L402s have no "+
+				"time limit", name)
+
+		case c.SettledAge < lifetime.Duration:
+			return fmt.Errorf("secrets pruner settled age %v is "+
+				"shorter than the lifetime %v of service %v",
+				c.SettledAge, lifetime.Duration, name)
+		}
+	}
+
+	return nil
+}
+
+// SecretsPruner periodically deletes the secrets of challenges that were never
+// paid and, optionally, the secrets of L402s whose access ended long ago.
+type SecretsPruner struct {
+	cfg   *SecretsPrunerConfig
+	db    BatchedSecretsDB
+	clock clock.Clock
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSecretsPruner creates a new pruner of the secrets in the given database.
+func NewSecretsPruner(cfg *SecretsPrunerConfig,
+	db BatchedSecretsDB) *SecretsPruner {
+
+	return &SecretsPruner{
+		cfg:   cfg,
+		db:    db,
+		clock: clock.NewDefaultClock(),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Start runs the pruner in the background until it is stopped.
+func (p *SecretsPruner) Start() {
+	if p.cfg.Disable {
+		return
+	}
+
+	log.Infof("Pruning unsettled secrets older than %v every %v",
+		p.cfg.UnsettledAge, p.cfg.Interval)
+	if p.cfg.SettledAge > 0 {
+		log.Infof("Pruning secrets of L402s whose lifetime ended more "+
+			"than %v ago", p.cfg.SettledAge)
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := p.clock.TickAfter(0)
+		for {
+			select {
+			case <-ticker:
+				p.pruneWithTimeout()
+				ticker = p.clock.TickAfter(p.cfg.Interval)
+
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the pruner and waits for a running prune to finish.
+func (p *SecretsPruner) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// pruneWithTimeout runs the pruner once and logs the result.
+func (p *SecretsPruner) pruneWithTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), pruneTimeout)
+	defer cancel()
+
+	unsettled, settled, err := p.Prune(ctx)
+	if err != nil {
+		pruneErrors.Inc()
+		log.Errorf("Unable to prune secrets: %v", err)
+	}
+	if unsettled > 0 || settled > 0 {
+		log.Infof("Pruned %d unsettled and %d settled secrets",
+			unsettled, settled)
+	}
+}
+
+// Prune deletes the secrets that are not needed anymore in batches and returns
+// the number of unsettled and settled secrets that were deleted.
+func (p *SecretsPruner) Prune(ctx context.Context) (int64, int64, error) {
+	now := p.clock.Now().UTC()
+
+	unsettled, err := p.pruneBatches(ctx, "unsettled",
+		func(tx SecretsDB) (int64, error) {
+			return tx.DeleteUnsettledSecretsBefore(
+				ctx, DeleteUnsettledSecretsBeforeParams{
+					CreatedAt: now.Add(-p.cfg.UnsettledAge),
+					Limit:     clampInt32(p.cfg.BatchSize),
+				},
+			)
+		},
+	)
+	if err != nil || p.cfg.SettledAge == 0 {
+		return unsettled, 0, err
+	}
+
+	cutoff := NullTime{Time: now.Add(-p.cfg.SettledAge), Valid: true}
+	expired, err := p.pruneBatches(ctx, "settled",
+		func(tx SecretsDB) (int64, error) {
+			return tx.DeleteExpiredSecretsBefore(
+				ctx, DeleteExpiredSecretsBeforeParams{
+					ExpiresAt: cutoff,
+					Limit:     clampInt32(p.cfg.BatchSize),
+				},
+			)
+		},
+	)
+	if err != nil {
+		return unsettled, expired, err
+	}
+
+	// The lifetime of L402s minted before lifetimes were recorded is
+	// unknown, they are deleted the settled age after settlement.
+	settled, err := p.pruneBatches(ctx, "settled",
+		func(tx SecretsDB) (int64, error) {
+			return tx.DeleteSettledSecretsBefore(
+				ctx, DeleteSettledSecretsBeforeParams{
+					SettledAt: cutoff,
+					Limit:     clampInt32(p.cfg.BatchSize),
+				},
+			)
+		},
+	)
+
+	return unsettled, expired + settled, err
+}
+
+// pruneBatches runs the given delete in separate transactions until a batch
+// deletes less than the batch size, so no transaction holds its locks for
+// long. The total number of deleted secrets is returned.
+func (p *SecretsPruner) pruneBatches(ctx context.Context, state string,
+	deleteBatch func(tx SecretsDB) (int64, error)) (int64, error) {
+
+	var total int64
+	for {
+		var deleted int64
+		var writeTxOpts SecretsDBTxOptions
+		err := p.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
+			var err error
+			deleted, err = deleteBatch(tx)
+			return err
+		})
+		if err != nil {
+			return total, fmt.Errorf("unable to delete %v secrets: "+
+				"%w", state, err)
+		}
+
+		total += deleted
+		prunedSecrets.WithLabelValues(state).Add(float64(deleted))
+
+		if deleted < int64(clampInt32(p.cfg.BatchSize)) {
+			return total, nil
+		}
+
+		select {
+		case <-p.quit:
+			return total, nil
+		default:
+		}
+	}
+}
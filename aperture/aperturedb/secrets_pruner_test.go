@@ -0,0 +1,237 @@
+package aperturedb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSecretsPruner makes sure the pruner deletes old unsettled secrets in
+// batches and settled secrets only if configured to.
+func TestSecretsPruner(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	dbTxer := NewTransactionExecutor(db.BaseDB,
+		func(tx *sql.Tx) SecretsDB {
+			return db.WithTx(tx)
+		},
+	)
+	store := NewSecretsStore(dbTxer)
+
+	now := time.Now()
+	testClock := clock.NewTestClock(now.Add(-3 * time.Hour))
+	store.clock = testClock
+
+	// Create five secrets three hours ago, settle one of them right away
+	// and create one more secret now.
+	newSecret := func(i byte) [sha256.Size]byte {
+		hash := [sha256.Size]byte{i}
+		_, err := store.NewSecret(ctxt, hash, &lsat.Identifier{
+			Version:     lsat.LatestVersion,
+			PaymentHash: hash,
+		}, lsat.Service{Name: "service"})
+		require.NoError(t, err)
+
+		return hash
+	}
+	for i := byte(1); i <= 5; i++ {
+		newSecret(i)
+	}
+	settled := [sha256.Size]byte{1}
+	err := store.SetSettledAtByPaymentHash(ctxt, settled, NullTime{
+		Time:  testClock.Now(),
+		Valid: true,
+	})
+	require.NoError(t, err)
+
+	testClock.SetTime(now)
+	fresh := newSecret(6)
+
+	cfg := &SecretsPrunerConfig{
+		Interval:     time.Minute,
+		BatchSize:    2,
+		UnsettledAge: time.Hour,
+	}
+	require.NoError(t, cfg.Validate())
+	pruner := NewSecretsPruner(cfg, dbTxer)
+	pruner.clock = testClock
+
+	// The four old unsettled secrets are deleted in batches, the settled
+	// and the fresh secret are kept.
+	unsettled, settledCount, err := pruner.Prune(ctxt)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, unsettled)
+	require.Zero(t, settledCount)
+
+	secrets, err := store.ListSecrets(ctxt, SecretsQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, secrets, 2)
+	require.Equal(t, settled, secrets[0].IDHash)
+	require.Equal(t, fresh, secrets[1].IDHash)
+
+	// With a settled age, the settled secret is deleted as well.
+	cfg.SettledAge = 2 * time.Hour
+	unsettled, settledCount, err = pruner.Prune(ctxt)
+	require.NoError(t, err)
+	require.Zero(t, unsettled)
+	require.EqualValues(t, 1, settledCount)
+
+	_, err = store.GetSecret(ctxt, settled)
+	require.ErrorIs(t, err, mint.ErrSecretNotFound)
+	_, err = store.GetSecret(ctxt, fresh)
+	require.NoError(t, err)
+}
+
+// TestSecretsPrunerLifetimes makes sure settled secrets are deleted the
+// settled age after the lifetime they were minted with ended, and the ones
+// without a recorded lifetime the settled age after settlement.
+func TestSecretsPrunerLifetimes(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	dbTxer := NewTransactionExecutor(db.BaseDB,
+		func(tx *sql.Tx) SecretsDB {
+			return db.WithTx(tx)
+		},
+	)
+	store := NewSecretsStore(dbTxer)
+
+	now := time.Now()
+	testClock := clock.NewTestClock(now.Add(-3 * time.Hour))
+	store.clock = testClock
+
+	// Create and settle secrets three hours ago with different lifetimes.
+	newSettledSecret := func(i byte,
+		lifetime *lsat.Lifetime) [sha256.Size]byte {
+
+		hash := [sha256.Size]byte{i}
+		_, err := store.NewSecret(ctxt, hash, &lsat.Identifier{
+			Version:     lsat.LatestVersion,
+			PaymentHash: hash,
+		}, lsat.Service{Name: "service", Lifetime: lifetime})
+		require.NoError(t, err)
+
+		err = store.SetSettledAtByPaymentHash(ctxt, hash, NullTime{
+			Time:  testClock.Now(),
+			Valid: true,
+		})
+		require.NoError(t, err)
+
+		return hash
+	}
+	expired := newSettledSecret(1, &lsat.Lifetime{Duration: time.Hour})
+	month := newSettledSecret(2, &lsat.Lifetime{
+		Duration: 30 * 24 * time.Hour,
+	})
+	forever := newSettledSecret(3, &lsat.Lifetime{})
+	legacy := newSettledSecret(4, nil)
+
+	testClock.SetTime(now)
+
+	cfg := &SecretsPrunerConfig{
+		Interval:     time.Minute,
+		BatchSize:    10,
+		UnsettledAge: time.Hour,
+		SettledAge:   time.Hour,
+	}
+	require.NoError(t, cfg.Validate())
+	pruner := NewSecretsPruner(cfg, dbTxer)
+	pruner.clock = testClock
+
+	// The secret whose lifetime ended two hours ago and the one without a
+	// recorded lifetime settled three hours ago are deleted. The secrets
+	// that still grant access are kept.
+	unsettled, settled, err := pruner.Prune(ctxt)
+	require.NoError(t, err)
+	require.Zero(t, unsettled)
+	require.EqualValues(t, 2, settled)
+
+	for _, hash := range [][sha256.Size]byte{expired, legacy} {
+		_, err = store.GetSecret(ctxt, hash)
+		require.ErrorIs(t, err, mint.ErrSecretNotFound)
+	}
+	for _, hash := range [][sha256.Size]byte{month, forever} {
+		_, err = store.GetSecret(ctxt, hash)
+		require.NoError(t, err)
+	}
+}
+
+// TestSecretsPrunerValidateLifetimes makes sure a settled age that could
+// delete the secrets of L402s that still grant access is rejected.
+func TestSecretsPrunerValidateLifetimes(t *testing.T) {
+	t.Parallel()
+
+	day := &lsat.Lifetime{Duration: 24 * time.Hour}
+	tests := []struct {
+		name       string
+		settledAge time.Duration
+		lifetimes  map[string]*lsat.Lifetime
+		expectErr  bool
+	}{
+		{
+			name:       "no settled age",
+			settledAge: 0,
+			lifetimes:  map[string]*lsat.Lifetime{"a": {}},
+		},
+		{
+			name:       "longer than all lifetimes",
+			settledAge: 7 * 24 * time.Hour,
+			lifetimes:  map[string]*lsat.Lifetime{"a": day, "b": nil},
+		},
+		{
+			name:       "shorter than a lifetime",
+			settledAge: 7 * 24 * time.Hour,
+			lifetimes: map[string]*lsat.Lifetime{
+				"a": {Duration: 30 * 24 * time.Hour},
+			},
+			expectErr: true,
+		},
+		{
+			name:       "shorter than the default lifetime",
+			settledAge: time.Minute,
+			lifetimes:  map[string]*lsat.Lifetime{"a": nil},
+			expectErr:  true,
+		},
+		{
+			name:       "forever",
+			settledAge: 7 * 24 * time.Hour,
+			lifetimes:  map[string]*lsat.Lifetime{"a": day, "b": {}},
+			expectErr:  true,
+		},
+		{
+			name:       "only uses",
+			settledAge: 7 * 24 * time.Hour,
+			lifetimes:  map[string]*lsat.Lifetime{"a": {Uses: 10}},
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &SecretsPrunerConfig{SettledAge: test.settledAge}
+			err := cfg.ValidateLifetimes(test.lifetimes)
+			if test.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/mint"
 	"github.com/stretchr/testify/require"
 )
@@ -46,7 +47,17 @@ func TestSecretDB(t *testing.T) {
 	require.ErrorIs(t, err, mint.ErrSecretNotFound)
 
 	// Create a new secret.
-	secret, err := store.NewSecret(ctxt, hash)
+	id := &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: hash,
+		TokenID:     lsat.TokenID(hash),
+	}
+	secret, err := store.NewSecret(ctxt, hash, id, lsat.Service{
+		Name: "service",
+		Lifetime: &lsat.Lifetime{
+			Duration: 90*time.Minute + time.Millisecond,
+		},
+	})
 	require.NoError(t, err)
 
 	// Get the secret from the db.
@@ -54,11 +65,154 @@ func TestSecretDB(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, secret, dbSecret)
 
+	// The lifetime is recorded in whole seconds, rounded up.
+	service, lifetime, err := store.GetSecretLifetime(ctxt, hash)
+	require.NoError(t, err)
+	require.Equal(t, "service", service)
+	require.Equal(t, &lsat.Lifetime{
+		Duration: 90*time.Minute + time.Second,
+	}, lifetime)
+
+	// The uses of the secret are counted up to the given maximum.
+	for i := uint32(1); i <= 2; i++ {
+		uses, err := store.IncrementSecretUses(ctxt, hash, 2)
+		require.NoError(t, err)
+		require.Equal(t, i, uses)
+	}
+	_, err = store.IncrementSecretUses(ctxt, hash, 2)
+	require.ErrorIs(t, err, mint.ErrUsesExhausted)
+
+	// The secret is listed without its value.
+	secrets, err := store.ListSecrets(ctxt, SecretsQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, secrets, 1)
+	require.Equal(t, hash, secrets[0].IDHash)
+	require.Equal(t, hash, secrets[0].PaymentHash)
+	require.Equal(t, id.TokenID, secrets[0].TokenID)
+	require.Equal(t, "service", secrets[0].Service)
+	require.False(t, secrets[0].SettledAt.Valid)
+	require.EqualValues(t, 2, secrets[0].Uses)
+
+	secrets, err = store.ListSecrets(ctxt, SecretsQuery{
+		Offset: 1, Limit: 10,
+	})
+	require.NoError(t, err)
+	require.Empty(t, secrets)
+
+	// The secret is found by each of the filters it matches, but not by
+	// the ones it doesn't.
+	now := time.Now()
+	matching := []SecretsQuery{
+		{IDHash: &hash},
+		{PaymentHash: &hash},
+		{TokenID: &id.TokenID},
+		{Service: "service"},
+		{CreatedAfter: now.Add(-time.Hour), CreatedBefore: now.Add(time.Hour)},
+	}
+	for _, query := range matching {
+		query.Limit = 10
+		secrets, err = store.ListSecrets(ctxt, query)
+		require.NoError(t, err)
+		require.Len(t, secrets, 1)
+	}
+
+	otherHash := [sha256.Size]byte{1}
+	otherID := lsat.TokenID(otherHash)
+	notMatching := []SecretsQuery{
+		{IDHash: &otherHash},
+		{PaymentHash: &otherHash},
+		{TokenID: &otherID},
+		{Service: "other"},
+		{CreatedAfter: now.Add(time.Hour)},
+		{CreatedBefore: now.Add(-time.Hour)},
+		{SettledAfter: now.Add(-time.Hour)},
+	}
+	for _, query := range notMatching {
+		query.Limit = 10
+		secrets, err = store.ListSecrets(ctxt, query)
+		require.NoError(t, err)
+		require.Empty(t, secrets)
+	}
+
+	// Once settled, the secret is found by its settlement time.
+	err = store.SetSettledAtByPaymentHash(ctxt, hash, NullTime{
+		Time: now, Valid: true,
+	})
+	require.NoError(t, err)
+	secrets, err = store.ListSecrets(ctxt, SecretsQuery{
+		SettledAfter:  now.Add(-time.Hour),
+		SettledBefore: now.Add(time.Hour),
+		Limit:         10,
+	})
+	require.NoError(t, err)
+	require.Len(t, secrets, 1)
+
 	// Revoke the secret.
 	err = store.RevokeSecret(ctxt, hash)
 	require.NoError(t, err)
 
+	secrets, err = store.ListSecrets(ctxt, SecretsQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, secrets)
+
 	// The secret should no longer exist.
 	_, err = store.GetSecret(ctxt, hash)
 	require.ErrorIs(t, err, mint.ErrSecretNotFound)
+
+	_, err = store.IncrementSecretUses(ctxt, hash, 2)
+	require.ErrorIs(t, err, mint.ErrSecretNotFound)
+}
+
+// TestRevokeL402 makes sure a revoked L402 is reported as revoked and the
+// revocation is recorded.
+func TestRevokeL402(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	store := newSecretsStoreWithDB(db.BaseDB)
+
+	hash := [sha256.Size]byte{}
+	_, err := rand.Read(hash[:])
+	require.NoError(t, err)
+
+	// Revoking an L402 that doesn't exist fails.
+	err = store.RevokeL402(ctxt, hash, "abuse")
+	require.ErrorIs(t, err, mint.ErrSecretNotFound)
+
+	id := &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: hash,
+		TokenID:     lsat.TokenID(hash),
+	}
+	_, err = store.NewSecret(ctxt, hash, id, lsat.Service{Name: "service"})
+	require.NoError(t, err)
+
+	err = store.RevokeL402(ctxt, hash, "abuse")
+	require.NoError(t, err)
+
+	// The secret is gone and reported as revoked.
+	_, err = store.GetSecret(ctxt, hash)
+	require.ErrorIs(t, err, mint.ErrSecretRevoked)
+	require.ErrorContains(t, err, "abuse")
+
+	secrets, err := store.ListSecrets(ctxt, SecretsQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, secrets)
+
+	// The revocation is recorded along with the L402.
+	revocations, err := store.ListRevocations(ctxt, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, revocations, 1)
+	require.Equal(t, hash, revocations[0].IDHash)
+	require.Equal(t, id.TokenID, revocations[0].TokenID)
+	require.Equal(t, "service", revocations[0].Service)
+	require.Equal(t, "abuse", revocations[0].Reason)
+	require.False(t, revocations[0].RevokedAt.IsZero())
+
+	// An L402 can only be revoked once.
+	err = store.RevokeL402(ctxt, hash, "abuse")
+	require.ErrorIs(t, err, mint.ErrSecretNotFound)
 }
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS freebies (
+    service TEXT NOT NULL,
+    ip_key TEXT NOT NULL,
+    window_start TIMESTAMP NOT NULL,
+    count INTEGER NOT NULL,
+    UNIQUE (service, ip_key, window_start)
+);
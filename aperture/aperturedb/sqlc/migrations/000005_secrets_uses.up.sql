@@ -0,0 +1 @@
+ALTER TABLE secrets ADD COLUMN uses INTEGER NOT NULL DEFAULT 0;
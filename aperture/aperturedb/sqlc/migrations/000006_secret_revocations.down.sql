@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS secret_revocations;
+
+DROP INDEX IF EXISTS secrets_created_at_idx;
+DROP INDEX IF EXISTS secrets_token_id_idx;
+
+ALTER TABLE secrets DROP COLUMN service;
+ALTER TABLE secrets DROP COLUMN token_id;
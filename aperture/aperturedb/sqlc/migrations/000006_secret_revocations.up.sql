@@ -0,0 +1,18 @@
+ALTER TABLE secrets ADD COLUMN token_id BLOB;
+ALTER TABLE secrets ADD COLUMN service TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS secrets_token_id_idx ON secrets (token_id);
+CREATE INDEX IF NOT EXISTS secrets_created_at_idx ON secrets (created_at);
+
+CREATE TABLE IF NOT EXISTS secret_revocations (
+    id INTEGER PRIMARY KEY,
+    macaroon_id_hash BLOB UNIQUE NOT NULL,
+    payment_hash BLOB NOT NULL,
+    token_id BLOB,
+    service TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    settled_at TIMESTAMP,
+    uses INTEGER NOT NULL,
+    revoked_at TIMESTAMP NOT NULL,
+    reason TEXT NOT NULL
+);
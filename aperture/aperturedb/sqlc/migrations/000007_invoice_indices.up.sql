@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS invoice_indices (
+    id INTEGER PRIMARY KEY,
+    add_index BIGINT NOT NULL,
+    settle_index BIGINT NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
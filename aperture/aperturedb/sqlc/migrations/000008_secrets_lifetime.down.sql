@@ -0,0 +1 @@
+ALTER TABLE secrets DROP COLUMN lifetime_seconds;
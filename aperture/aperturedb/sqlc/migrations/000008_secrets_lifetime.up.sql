@@ -0,0 +1,3 @@
+-- The lifetime in seconds the L402 was minted with, 0 means no time limit.
+-- It is NULL for L402s minted before lifetimes were recorded.
+ALTER TABLE secrets ADD COLUMN lifetime_seconds BIGINT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS secrets_expires_at_idx;
+ALTER TABLE secrets DROP COLUMN expires_at;
@@ -0,0 +1,5 @@
+-- The time the access of a paid L402 ends, set when its invoice is settled.
+-- It is NULL for L402s without a time limit or a recorded lifetime.
+ALTER TABLE secrets ADD COLUMN expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS secrets_expires_at_idx ON secrets (expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS freebies_window_end_idx;
+ALTER TABLE freebies DROP COLUMN window_end;
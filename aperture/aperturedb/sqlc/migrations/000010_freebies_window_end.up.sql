@@ -0,0 +1,7 @@
+-- The end of the time window a freebie count is kept for, so expired windows
+-- can be deleted without knowing the window of their service. It is NULL for
+-- counts that are granted only once and for counts recorded before the end
+-- was.
+ALTER TABLE freebies ADD COLUMN window_end TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS freebies_window_end_idx ON freebies (window_end);
@@ -9,6 +9,21 @@ import (
 	"time"
 )
 
+type Freebie struct {
+	Service     string
+	IpKey       string
+	WindowStart time.Time
+	Count       int32
+	WindowEnd   sql.NullTime
+}
+
+type InvoiceIndex struct {
+	ID          int32
+	AddIndex    int64
+	SettleIndex int64
+	UpdatedAt   time.Time
+}
+
 type LncSession struct {
 	ID                 int32
 	PassphraseWords    string
@@ -27,10 +42,28 @@ type Onion struct {
 }
 
 type Secret struct {
+	ID              int32
+	MacaroonIDHash  []byte
+	PaymentHash     []byte
+	Secret          []byte
+	SettledAt       sql.NullTime
+	CreatedAt       time.Time
+	Uses            int32
+	TokenID         []byte
+	Service         string
+	LifetimeSeconds sql.NullInt64
+	ExpiresAt       sql.NullTime
+}
+
+type SecretRevocation struct {
 	ID             int32
 	MacaroonIDHash []byte
 	PaymentHash    []byte
-	Secret         []byte
-	SettledAt      sql.NullTime
+	TokenID        []byte
+	Service        string
 	CreatedAt      time.Time
+	SettledAt      sql.NullTime
+	Uses           int32
+	RevokedAt      time.Time
+	Reason         string
 }
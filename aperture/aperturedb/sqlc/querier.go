@@ -10,17 +10,34 @@ import (
 )
 
 type Querier interface {
+	DeleteExpiredFreebiesBefore(ctx context.Context, arg DeleteExpiredFreebiesBeforeParams) (int64, error)
+	DeleteExpiredSecretsBefore(ctx context.Context, arg DeleteExpiredSecretsBeforeParams) (int64, error)
+	DeleteFreebiesBefore(ctx context.Context, arg DeleteFreebiesBeforeParams) (int64, error)
 	DeleteOnionPrivateKey(ctx context.Context) error
 	DeleteSecretByIdHash(ctx context.Context, macaroonIDHash []byte) (int64, error)
+	DeleteSettledSecretsBefore(ctx context.Context, arg DeleteSettledSecretsBeforeParams) (int64, error)
+	DeleteUnsettledSecretsBefore(ctx context.Context, arg DeleteUnsettledSecretsBeforeParams) (int64, error)
+	GetFreebieCount(ctx context.Context, arg GetFreebieCountParams) (int32, error)
+	GetInvoiceIndices(ctx context.Context) (GetInvoiceIndicesRow, error)
 	GetSecretByIdHash(ctx context.Context, macaroonIDHash []byte) ([]byte, error)
+	GetSecretLifetimeByIdHash(ctx context.Context, macaroonIDHash []byte) (GetSecretLifetimeByIdHashRow, error)
+	GetSecretLifetimesByPaymentHash(ctx context.Context, paymentHash []byte) ([]GetSecretLifetimesByPaymentHashRow, error)
+	GetSecretRevocationByIdHash(ctx context.Context, macaroonIDHash []byte) (GetSecretRevocationByIdHashRow, error)
 	GetSession(ctx context.Context, passphraseEntropy []byte) (LncSession, error)
 	GetSettledAtByPaymentHash(ctx context.Context, paymentHash []byte) (sql.NullTime, error)
+	IncrementFreebieCount(ctx context.Context, arg IncrementFreebieCountParams) (int32, error)
+	IncrementSecretUses(ctx context.Context, arg IncrementSecretUsesParams) (int32, error)
 	InsertSecret(ctx context.Context, arg InsertSecretParams) (int32, error)
+	InsertSecretRevocation(ctx context.Context, arg InsertSecretRevocationParams) error
 	InsertSession(ctx context.Context, arg InsertSessionParams) error
+	ListSecretRevocations(ctx context.Context, arg ListSecretRevocationsParams) ([]SecretRevocation, error)
+	ListSecrets(ctx context.Context, arg ListSecretsParams) ([]ListSecretsRow, error)
 	SelectOnionPrivateKey(ctx context.Context) ([]byte, error)
 	SetExpiry(ctx context.Context, arg SetExpiryParams) error
 	SetRemotePubKey(ctx context.Context, arg SetRemotePubKeyParams) error
+	SetSecretExpiresAt(ctx context.Context, arg SetSecretExpiresAtParams) error
 	SetSettledAtByPaymentHash(ctx context.Context, arg SetSettledAtByPaymentHashParams) error
+	UpsertInvoiceIndices(ctx context.Context, arg UpsertInvoiceIndicesParams) error
 	UpsertOnion(ctx context.Context, arg UpsertOnionParams) error
 }
 
@@ -0,0 +1,28 @@
+-- name: IncrementFreebieCount :one
+INSERT INTO freebies (
+    service, ip_key, window_start, window_end, count
+) VALUES (
+    $1, $2, $3, $4, 1
+) ON CONFLICT (
+    service, ip_key, window_start
+) DO UPDATE SET count = freebies.count + 1
+RETURNING count;
+
+-- name: GetFreebieCount :one
+SELECT count
+FROM freebies
+WHERE service = $1 AND ip_key = $2 AND window_start = $3;
+
+-- name: DeleteFreebiesBefore :execrows
+DELETE FROM freebies
+WHERE service = $1 AND ip_key = $2 AND window_start < $3;
+
+-- name: DeleteExpiredFreebiesBefore :execrows
+DELETE FROM freebies
+WHERE (service, ip_key, window_start) IN (
+    SELECT service, ip_key, window_start
+    FROM freebies
+    WHERE window_end < $1
+    ORDER BY window_end
+    LIMIT $2
+);
@@ -0,0 +1,15 @@
+-- name: UpsertInvoiceIndices :exec
+INSERT INTO invoice_indices (
+    id, add_index, settle_index, updated_at
+) VALUES (
+    1, $1, $2, $3
+) ON CONFLICT (
+    id
+) DO UPDATE SET add_index = excluded.add_index,
+    settle_index = excluded.settle_index,
+    updated_at = excluded.updated_at;
+
+-- name: GetInvoiceIndices :one
+SELECT add_index, settle_index
+FROM invoice_indices
+WHERE id = 1;
@@ -0,0 +1,19 @@
+-- name: InsertSecretRevocation :exec
+INSERT INTO secret_revocations (
+    macaroon_id_hash, payment_hash, token_id, service, created_at,
+    settled_at, uses, revoked_at, reason
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9
+);
+
+-- name: GetSecretRevocationByIdHash :one
+SELECT revoked_at, reason
+FROM secret_revocations
+WHERE macaroon_id_hash = $1;
+
+-- name: ListSecretRevocations :many
+SELECT id, macaroon_id_hash, payment_hash, token_id, service, created_at,
+    settled_at, uses, revoked_at, reason
+FROM secret_revocations
+ORDER BY id
+LIMIT $1 OFFSET $2;
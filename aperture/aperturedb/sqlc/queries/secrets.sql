@@ -1,8 +1,9 @@
 -- name: InsertSecret :one
 INSERT INTO secrets (
-    macaroon_id_hash, payment_hash, secret, created_at
+    macaroon_id_hash, payment_hash, token_id, service, secret, created_at,
+    lifetime_seconds
 ) VALUES (
-    $1, $2, $3, $4
+    $1, $2, $3, $4, $5, $6, $7
 ) RETURNING id;
 
 -- name: GetSecretByIdHash :one
@@ -10,6 +11,10 @@ SELECT secret
 FROM secrets
 WHERE macaroon_id_hash = $1;
 
+-- name: GetSecretLifetimeByIdHash :one
+SELECT service, lifetime_seconds
+FROM secrets
+WHERE macaroon_id_hash = $1;
 
 -- name: GetSettledAtByPaymentHash :one
 SELECT settled_at
@@ -21,6 +26,67 @@ UPDATE secrets
 SET settled_at = $2
 WHERE payment_hash = $1;
 
+-- name: GetSecretLifetimesByPaymentHash :many
+SELECT id, lifetime_seconds
+FROM secrets
+WHERE payment_hash = $1;
+
+-- name: SetSecretExpiresAt :exec
+UPDATE secrets
+SET expires_at = $2
+WHERE id = $1;
+
 -- name: DeleteSecretByIdHash :execrows
 DELETE FROM secrets
 WHERE macaroon_id_hash = $1;
+
+-- name: IncrementSecretUses :one
+UPDATE secrets
+SET uses = uses + 1
+WHERE macaroon_id_hash = $1 AND uses < $2
+RETURNING uses;
+
+-- name: ListSecrets :many
+SELECT id, macaroon_id_hash, payment_hash, token_id, service, settled_at,
+    created_at, uses
+FROM secrets
+WHERE macaroon_id_hash = COALESCE(sqlc.narg('macaroon_id_hash'), macaroon_id_hash)
+    AND payment_hash = COALESCE(sqlc.narg('payment_hash'), payment_hash)
+    AND (sqlc.narg('token_id') IS NULL OR token_id = sqlc.narg('token_id'))
+    AND service = COALESCE(sqlc.narg('service'), service)
+    AND (sqlc.narg('created_after') IS NULL OR created_at >= sqlc.narg('created_after'))
+    AND (sqlc.narg('created_before') IS NULL OR created_at < sqlc.narg('created_before'))
+    AND (sqlc.narg('settled_after') IS NULL OR settled_at >= sqlc.narg('settled_after'))
+    AND (sqlc.narg('settled_before') IS NULL OR settled_at < sqlc.narg('settled_before'))
+ORDER BY id
+LIMIT @num_limit OFFSET @num_offset;
+
+-- name: DeleteUnsettledSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE settled_at IS NULL AND created_at < $1
+    ORDER BY id
+    LIMIT $2
+);
+
+-- name: DeleteSettledSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE settled_at < $1 AND lifetime_seconds IS NULL
+    ORDER BY id
+    LIMIT $2
+);
+
+-- name: DeleteExpiredSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE expires_at < $1
+    ORDER BY id
+    LIMIT $2
+);
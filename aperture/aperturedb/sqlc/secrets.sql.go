@@ -11,6 +11,30 @@ import (
 	"time"
 )
 
+const deleteExpiredSecretsBefore = `-- name: DeleteExpiredSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE expires_at < $1
+    ORDER BY id
+    LIMIT $2
+)
+`
+
+type DeleteExpiredSecretsBeforeParams struct {
+	ExpiresAt sql.NullTime
+	Limit     int32
+}
+
+func (q *Queries) DeleteExpiredSecretsBefore(ctx context.Context, arg DeleteExpiredSecretsBeforeParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredSecretsBefore, arg.ExpiresAt, arg.Limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const deleteSecretByIdHash = `-- name: DeleteSecretByIdHash :execrows
 DELETE FROM secrets
 WHERE macaroon_id_hash = $1
@@ -24,6 +48,54 @@ func (q *Queries) DeleteSecretByIdHash(ctx context.Context, macaroonIDHash []byt
 	return result.RowsAffected()
 }
 
+const deleteSettledSecretsBefore = `-- name: DeleteSettledSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE settled_at < $1 AND lifetime_seconds IS NULL
+    ORDER BY id
+    LIMIT $2
+)
+`
+
+type DeleteSettledSecretsBeforeParams struct {
+	SettledAt sql.NullTime
+	Limit     int32
+}
+
+func (q *Queries) DeleteSettledSecretsBefore(ctx context.Context, arg DeleteSettledSecretsBeforeParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteSettledSecretsBefore, arg.SettledAt, arg.Limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteUnsettledSecretsBefore = `-- name: DeleteUnsettledSecretsBefore :execrows
+DELETE FROM secrets
+WHERE id IN (
+    SELECT id
+    FROM secrets
+    WHERE settled_at IS NULL AND created_at < $1
+    ORDER BY id
+    LIMIT $2
+)
+`
+
+type DeleteUnsettledSecretsBeforeParams struct {
+	CreatedAt time.Time
+	Limit     int32
+}
+
+func (q *Queries) DeleteUnsettledSecretsBefore(ctx context.Context, arg DeleteUnsettledSecretsBeforeParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteUnsettledSecretsBefore, arg.CreatedAt, arg.Limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getSecretByIdHash = `-- name: GetSecretByIdHash :one
 SELECT secret
 FROM secrets
@@ -37,6 +109,58 @@ func (q *Queries) GetSecretByIdHash(ctx context.Context, macaroonIDHash []byte)
 	return secret, err
 }
 
+const getSecretLifetimeByIdHash = `-- name: GetSecretLifetimeByIdHash :one
+SELECT service, lifetime_seconds
+FROM secrets
+WHERE macaroon_id_hash = $1
+`
+
+type GetSecretLifetimeByIdHashRow struct {
+	Service         string
+	LifetimeSeconds sql.NullInt64
+}
+
+func (q *Queries) GetSecretLifetimeByIdHash(ctx context.Context, macaroonIDHash []byte) (GetSecretLifetimeByIdHashRow, error) {
+	row := q.db.QueryRowContext(ctx, getSecretLifetimeByIdHash, macaroonIDHash)
+	var i GetSecretLifetimeByIdHashRow
+	err := row.Scan(&i.Service, &i.LifetimeSeconds)
+	return i, err
+}
+
+const getSecretLifetimesByPaymentHash = `-- name: GetSecretLifetimesByPaymentHash :many
+SELECT id, lifetime_seconds
+FROM secrets
+WHERE payment_hash = $1
+`
+
+type GetSecretLifetimesByPaymentHashRow struct {
+	ID              int32
+	LifetimeSeconds sql.NullInt64
+}
+
+func (q *Queries) GetSecretLifetimesByPaymentHash(ctx context.Context, paymentHash []byte) ([]GetSecretLifetimesByPaymentHashRow, error) {
+	rows, err := q.db.QueryContext(ctx, getSecretLifetimesByPaymentHash, paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSecretLifetimesByPaymentHashRow
+	for rows.Next() {
+		var i GetSecretLifetimesByPaymentHashRow
+		if err := rows.Scan(&i.ID, &i.LifetimeSeconds); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getSettledAtByPaymentHash = `-- name: GetSettledAtByPaymentHash :one
 SELECT settled_at
 FROM secrets
@@ -50,33 +174,158 @@ func (q *Queries) GetSettledAtByPaymentHash(ctx context.Context, paymentHash []b
 	return settled_at, err
 }
 
+const incrementSecretUses = `-- name: IncrementSecretUses :one
+UPDATE secrets
+SET uses = uses + 1
+WHERE macaroon_id_hash = $1 AND uses < $2
+RETURNING uses
+`
+
+type IncrementSecretUsesParams struct {
+	MacaroonIDHash []byte
+	Uses           int32
+}
+
+func (q *Queries) IncrementSecretUses(ctx context.Context, arg IncrementSecretUsesParams) (int32, error) {
+	row := q.db.QueryRowContext(ctx, incrementSecretUses, arg.MacaroonIDHash, arg.Uses)
+	var uses int32
+	err := row.Scan(&uses)
+	return uses, err
+}
+
 const insertSecret = `-- name: InsertSecret :one
 INSERT INTO secrets (
-    macaroon_id_hash, payment_hash, secret, created_at
+    macaroon_id_hash, payment_hash, token_id, service, secret, created_at,
+    lifetime_seconds
 ) VALUES (
-    $1, $2, $3, $4
+    $1, $2, $3, $4, $5, $6, $7
 ) RETURNING id
 `
 
 type InsertSecretParams struct {
-	MacaroonIDHash []byte
-	PaymentHash    []byte
-	Secret         []byte
-	CreatedAt      time.Time
+	MacaroonIDHash  []byte
+	PaymentHash     []byte
+	TokenID         []byte
+	Service         string
+	Secret          []byte
+	CreatedAt       time.Time
+	LifetimeSeconds sql.NullInt64
 }
 
 func (q *Queries) InsertSecret(ctx context.Context, arg InsertSecretParams) (int32, error) {
 	row := q.db.QueryRowContext(ctx, insertSecret,
 		arg.MacaroonIDHash,
 		arg.PaymentHash,
+		arg.TokenID,
+		arg.Service,
 		arg.Secret,
 		arg.CreatedAt,
+		arg.LifetimeSeconds,
 	)
 	var id int32
 	err := row.Scan(&id)
 	return id, err
 }
 
+const listSecrets = `-- name: ListSecrets :many
+SELECT id, macaroon_id_hash, payment_hash, token_id, service, settled_at,
+    created_at, uses
+FROM secrets
+WHERE macaroon_id_hash = COALESCE($1, macaroon_id_hash)
+    AND payment_hash = COALESCE($2, payment_hash)
+    AND ($3 IS NULL OR token_id = $3)
+    AND service = COALESCE($4, service)
+    AND ($5 IS NULL OR created_at >= $5)
+    AND ($6 IS NULL OR created_at < $6)
+    AND ($7 IS NULL OR settled_at >= $7)
+    AND ($8 IS NULL OR settled_at < $8)
+ORDER BY id
+LIMIT $9 OFFSET $10
+`
+
+type ListSecretsParams struct {
+	MacaroonIDHash []byte
+	PaymentHash    []byte
+	TokenID        []byte
+	Service        sql.NullString
+	CreatedAfter   sql.NullTime
+	CreatedBefore  sql.NullTime
+	SettledAfter   sql.NullTime
+	SettledBefore  sql.NullTime
+	NumLimit       int32
+	NumOffset      int32
+}
+
+type ListSecretsRow struct {
+	ID             int32
+	MacaroonIDHash []byte
+	PaymentHash    []byte
+	TokenID        []byte
+	Service        string
+	SettledAt      sql.NullTime
+	CreatedAt      time.Time
+	Uses           int32
+}
+
+func (q *Queries) ListSecrets(ctx context.Context, arg ListSecretsParams) ([]ListSecretsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listSecrets,
+		arg.MacaroonIDHash,
+		arg.PaymentHash,
+		arg.TokenID,
+		arg.Service,
+		arg.CreatedAfter,
+		arg.CreatedBefore,
+		arg.SettledAfter,
+		arg.SettledBefore,
+		arg.NumLimit,
+		arg.NumOffset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListSecretsRow
+	for rows.Next() {
+		var i ListSecretsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.MacaroonIDHash,
+			&i.PaymentHash,
+			&i.TokenID,
+			&i.Service,
+			&i.SettledAt,
+			&i.CreatedAt,
+			&i.Uses,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const setSecretExpiresAt = `-- name: SetSecretExpiresAt :exec
+UPDATE secrets
+SET expires_at = $2
+WHERE id = $1
+`
+
+type SetSecretExpiresAtParams struct {
+	ID        int32
+	ExpiresAt sql.NullTime
+}
+
+func (q *Queries) SetSecretExpiresAt(ctx context.Context, arg SetSecretExpiresAtParams) error {
+	_, err := q.db.ExecContext(ctx, setSecretExpiresAt, arg.ID, arg.ExpiresAt)
+	return err
+}
+
 const setSettledAtByPaymentHash = `-- name: SetSettledAtByPaymentHash :exec
 UPDATE secrets
 SET settled_at = $2
@@ -6,6 +6,8 @@ import (
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 var (
@@ -17,6 +19,12 @@ var (
 // MapSQLError attempts to interpret a given error as a database agnostic SQL
 // error.
 func MapSQLError(err error) error {
+	// Attempt to interpret the error as a sqlite error.
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return parseSqliteError(sqliteErr)
+	}
+
 	// Attempt to interpret the error as a postgres error.
 	var pqErr *pgconn.PgError
 	if errors.As(err, &pqErr) {
@@ -28,6 +36,30 @@ func MapSQLError(err error) error {
 	return err
 }
 
+// parseSqliteError attempts to parse a sqlite error as a database agnostic
+// SQL error.
+func parseSqliteError(sqliteErr *sqlite.Error) error {
+	switch sqliteErr.Code() {
+	// Handle unique constraint violation error.
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE,
+		sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+
+		return &ErrSQLUniqueConstraintViolation{
+			DBError: sqliteErr,
+		}
+
+	// The database is locked by another connection, even after waiting
+	// for the busy timeout, so we'll need to try again.
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_BUSY_SNAPSHOT:
+		return &ErrSerializationError{
+			DBError: sqliteErr,
+		}
+
+	default:
+		return fmt.Errorf("unknown sqlite error: %w", sqliteErr)
+	}
+}
+
 // parsePostgresError attempts to parse a postgres error as a database agnostic
 // SQL error.
 func parsePostgresError(pqErr *pgconn.PgError) error {
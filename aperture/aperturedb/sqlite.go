@@ -0,0 +1,172 @@
+package aperturedb
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sqlite_migrate "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb/sqlc"
+	"github.com/stretchr/testify/require"
+
+	// Import the sqlite driver.
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// sqliteOptionPrefix is the string prefix sqlite uses to set various
+	// options. This is used in the following format:
+	//   * sqliteOptionPrefix || option_name = option_value.
+	sqliteOptionPrefix = "_pragma"
+
+	// sqliteBusyTimeout is the number of milliseconds sqlite waits for a
+	// lock held by another connection before giving up.
+	sqliteBusyTimeout = 5000
+)
+
+// SqliteConfig holds all the config arguments needed to interact with our
+// sqlite DB.
+type SqliteConfig struct {
+	// SkipMigrations if true, then all the tables will be created on start
+	// up if they don't already exist.
+	SkipMigrations bool `long:"skipmigrations" description:"Skip applying migrations on startup."`
+
+	// DatabaseFileName is the full file path where the database file can
+	// be found.
+	DatabaseFileName string `long:"dbfile" description:"The full path to the database."`
+}
+
+// SqliteStore is a database store implementation that uses a single sqlite
+// file as its backend.
+type SqliteStore struct {
+	cfg *SqliteConfig
+
+	*BaseDB
+}
+
+// NewSqliteStore attempts to open a new sqlite database based on the passed
+// config.
+func NewSqliteStore(cfg *SqliteConfig) (*SqliteStore, error) {
+	log.Infof("Using SQLite database '%s'", cfg.DatabaseFileName)
+
+	// Sqlite creates the database file on its first use, but not the
+	// directory it is located in.
+	dbDir := filepath.Dir(cfg.DatabaseFileName)
+	if err := os.MkdirAll(dbDir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create database directory "+
+			"%v: %w", dbDir, err)
+	}
+
+	// The set of pragma options are accepted using query options. Foreign
+	// keys are enforced, the write-ahead log allows readers to proceed
+	// while a transaction writes and the busy timeout makes concurrent
+	// writers wait for each other instead of failing right away.
+	pragmaOptions := []struct {
+		name  string
+		value string
+	}{
+		{
+			name:  "foreign_keys",
+			value: "on",
+		},
+		{
+			name:  "journal_mode",
+			value: "WAL",
+		},
+		{
+			name:  "busy_timeout",
+			value: fmt.Sprintf("%d", sqliteBusyTimeout),
+		},
+		{
+			// With the WAL mode, this ensures that we also do an
+			// extra WAL sync after each transaction. The normal
+			// sync mode skips this and gives better performance,
+			// but risks durability.
+			name:  "synchronous",
+			value: "full",
+		},
+		{
+			// This is used to ensure proper durability for users
+			// running on Mac OS. It uses the correct fsync system
+			// call to ensure items are fully flushed to disk.
+			name:  "fullfsync",
+			value: "true",
+		},
+	}
+	sqliteOptions := make(url.Values)
+	for _, option := range pragmaOptions {
+		sqliteOptions.Add(
+			sqliteOptionPrefix,
+			fmt.Sprintf("%v=%v", option.name, option.value),
+		)
+	}
+
+	// Construct the DSN which is just the database file name, appended
+	// with the series of pragma options as a query URL string. For more
+	// details on the formatting here, see the modernc.org/sqlite docs:
+	// https://pkg.go.dev/modernc.org/sqlite#Driver.Open.
+	dsn := fmt.Sprintf(
+		"%v?%v", cfg.DatabaseFileName, sqliteOptions.Encode(),
+	)
+	rawDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	rawDB.SetMaxOpenConns(defaultMaxConns)
+	rawDB.SetMaxIdleConns(defaultMaxConns)
+	rawDB.SetConnMaxLifetime(connIdleLifetime)
+
+	if !cfg.SkipMigrations {
+		// Now that the database is open, populate the database with
+		// our set of schemas based on our embedded in-memory file
+		// system. The migrations are written in sqlite flavored SQL,
+		// so they are applied as they are.
+		driver, err := sqlite_migrate.WithInstance(
+			rawDB, &sqlite_migrate.Config{},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = applyMigrations(
+			sqlSchemas, driver, "sqlc/migrations", "sqlc",
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queries := sqlc.New(rawDB)
+
+	return &SqliteStore{
+		cfg: cfg,
+		BaseDB: &BaseDB{
+			DB:      rawDB,
+			Queries: queries,
+		},
+	}, nil
+}
+
+// NewTestSqliteDB is a helper function that creates an SQLite database for
+// testing.
+func NewTestSqliteDB(t *testing.T) *SqliteStore {
+	t.Helper()
+
+	t.Logf("Creating new SQLite DB for testing")
+
+	dbFileName := filepath.Join(t.TempDir(), "tmp.db")
+	store, err := NewSqliteStore(&SqliteConfig{
+		DatabaseFileName: dbFileName,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, store.DB.Close())
+	})
+
+	return store
+}
@@ -3,9 +3,10 @@ package auth
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/motxx/aperture-lnproxy/aperture/lsat"
@@ -23,7 +24,10 @@ type LsatAuthenticator struct {
 // Authenticator interface.
 var _ Authenticator = (*LsatAuthenticator)(nil)
 
-const L402RightExpiryDuration = time.Hour
+// L402RightExpiryDuration is how long an L402 grants access after its invoice
+// was settled if the L402 has no lifetime caveat for the service. L402s are
+// minted with a lifetime caveat, so this only applies to older ones.
+const L402RightExpiryDuration = lsat.DefaultLifetimeDuration
 
 // NewLsatAuthenticator creates a new authenticator that authenticates requests
 // based on L402 tokens.
@@ -37,17 +41,20 @@ func NewLsatAuthenticator(minter Minter,
 }
 
 // Accept returns whether or not the header successfully authenticates the user
-// to a given backend service.
+// to a given backend service. For usage counted L402s, one use is consumed
+// and the number of remaining uses is returned as a response header.
 //
 // NOTE: This is part of the Authenticator interface.
-func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool {
+func (l *LsatAuthenticator) Accept(header *http.Header,
+	serviceName string) (bool, http.Header) {
+
 	// Try reading the macaroon and preimage from the HTTP header. This can
 	// be in different header fields depending on the implementation and/or
 	// protocol.
 	mac, preimage, err := lsat.FromHeader(header)
 	if err != nil {
 		log.Debugf("Deny: %v", err)
-		return false
+		return false, nil
 	}
 
 	verificationParams := &mint.VerificationParams{
@@ -56,9 +63,21 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 		TargetService: serviceName,
 	}
 	err = l.minter.VerifyL402(context.Background(), verificationParams)
-	if err != nil {
+	switch {
+	case errors.Is(err, mint.ErrSecretRevoked):
+		// Revocations are rare and deliberate, so any attempt to use
+		// a revoked L402 is worth noting. The client is told the
+		// reason, so it doesn't mistake the 402 for an unpaid L402.
+		log.Infof("Deny: L402 was revoked: %v", err)
+
+		respHeader := make(http.Header)
+		respHeader.Set(lsat.HeaderDenyReason, lsat.DenyReasonRevoked)
+
+		return false, respHeader
+
+	case err != nil:
 		log.Debugf("Deny: L402 settlement validation failed: %v", err)
-		return false
+		return false, nil
 	}
 
 	// Make sure the backend has the invoice recorded as settled.
@@ -68,19 +87,56 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 	)
 	if err != nil {
 		log.Debugf("Deny: Invoice status mismatch: %v", err)
-		return false
+		return false, nil
+	}
+
+	// Make sure the rights are still valid. The lifetime and usage count
+	// caveats were already checked for increasing restrictiveness and
+	// against the lifetime the L402 was minted with by the minter, so the
+	// last ones are the ones that apply.
+	lifetime, ok, err := lsat.LifetimeFromMacaroon(mac, serviceName)
+	switch {
+	case err != nil:
+		log.Debugf("Deny: Invalid L402 lifetime: %v", err)
+		return false, nil
+
+	case !ok:
+		lifetime.Duration = L402RightExpiryDuration
 	}
 
-	// Make sure the rights are still valid.
-	err = l.checker.VerifyRightsWithinExpiry(
-		preimage.Hash(), L402RightExpiryDuration,
+	if lifetime.Duration != 0 {
+		err = l.checker.VerifyRightsWithinExpiry(
+			preimage.Hash(), lifetime.Duration,
+		)
+		if err != nil {
+			log.Debugf("Deny: L402 right validation failed: %v",
+				err)
+			return false, nil
+		}
+	}
+
+	// Consume one use last, so requests that are denied for any other
+	// reason don't count.
+	if lifetime.Uses == 0 {
+		return true, nil
+	}
+
+	remaining, err := l.minter.UseL402(
+		context.Background(), mac, lifetime.Uses,
 	)
 	if err != nil {
-		log.Debugf("Deny: L402 right validation failed: %v", err)
-		return false
+		log.Debugf("Deny: L402 usage count exceeded: %v", err)
+		return false, nil
 	}
 
-	return true
+	respHeader := make(http.Header)
+	respHeader.Set(
+		lsat.HeaderUsesRemaining, strconv.FormatUint(
+			uint64(remaining), 10,
+		),
+	)
+
+	return true, respHeader
 }
 
 // FreshChallengeHeader returns a header containing a challenge for the user to
@@ -88,14 +144,9 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 //
 // NOTE: This is part of the Authenticator interface.
 func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
-	serviceName string, serviceRecipientLud16 string, servicePrice int64) (http.Header, error) {
+	service lsat.Service) (http.Header, error) {
 
-	service := lsat.Service{
-		Name:           serviceName,
-		Tier:           lsat.BaseTier,
-		RecipientLud16: serviceRecipientLud16,
-		Price:          servicePrice,
-	}
+	service.Tier = lsat.BaseTier
 	mac, paymentRequest, err := l.minter.MintL402(
 		context.Background(), service,
 	)
@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
 	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/macaroon.v2"
 )
 
 // createDummyMacHex creates a valid macaroon with dummy content for our tests.
-func createDummyMacHex(preimage string) string {
+func createDummyMacHex(preimage string, caveats ...lsat.Caveat) string {
 	dummyMac, err := macaroon.New(
 		[]byte("aabbccddeeff00112233445566778899"), []byte("AA=="),
 		"aperture", macaroon.LatestVersion,
@@ -22,7 +25,9 @@ func createDummyMacHex(preimage string) string {
 		panic(err)
 	}
 	preimageCaveat := lsat.Caveat{Condition: lsat.PreimageKey, Value: preimage}
-	err = lsat.AddFirstPartyCaveats(dummyMac, preimageCaveat)
+	err = lsat.AddFirstPartyCaveats(
+		dummyMac, append([]lsat.Caveat{preimageCaveat}, caveats...)...,
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -143,10 +148,164 @@ func TestLsatAuthenticator(t *testing.T) {
 	a := auth.NewLsatAuthenticator(&mockMint{}, c)
 	for _, testCase := range headerTests {
 		c.err = testCase.checkErr
-		result := a.Accept(testCase.header, "test")
+		result, _ := a.Accept(testCase.header, "test")
 		if result != testCase.result {
 			t.Fatalf("test case %s failed. got %v expected %v",
 				testCase.id, result, testCase.result)
 		}
 	}
 }
+
+// TestLsatAuthenticatorLifetime tests that the authenticator enforces the
+// lifetime embedded in an L402.
+func TestLsatAuthenticatorLifetime(t *testing.T) {
+	const testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+
+	testCases := []struct {
+		name      string
+		caveats   []lsat.Caveat
+		expiryErr error
+		expiries  []time.Duration
+		result    bool
+	}{{
+		name:     "no lifetime caveat",
+		expiries: []time.Duration{auth.L402RightExpiryDuration},
+		result:   true,
+	}, {
+		name: "forever",
+		caveats: []lsat.Caveat{
+			lsat.NewLifetimeCaveat("test", lsat.Lifetime{}),
+		},
+		result: true,
+	}, {
+		name: "hours after settlement",
+		caveats: []lsat.Caveat{
+			lsat.NewLifetimeCaveat("test", lsat.Lifetime{
+				Duration: 24 * time.Hour,
+			}),
+		},
+		expiries: []time.Duration{24 * time.Hour},
+		result:   true,
+	}, {
+		name: "attenuated lifetime",
+		caveats: []lsat.Caveat{
+			lsat.NewLifetimeCaveat("test", lsat.Lifetime{
+				Duration: 24 * time.Hour,
+			}),
+			lsat.NewLifetimeCaveat("test", lsat.Lifetime{
+				Duration: time.Hour,
+			}),
+		},
+		expiries: []time.Duration{time.Hour},
+		result:   true,
+	}, {
+		name: "expired",
+		caveats: []lsat.Caveat{
+			lsat.NewLifetimeCaveat("test", lsat.Lifetime{
+				Duration: 24 * time.Hour,
+			}),
+		},
+		expiryErr: fmt.Errorf("expired"),
+		expiries:  []time.Duration{24 * time.Hour},
+		result:    false,
+	}, {
+		name: "lifetime of other service",
+		caveats: []lsat.Caveat{
+			lsat.NewLifetimeCaveat("other", lsat.Lifetime{}),
+		},
+		expiries: []time.Duration{auth.L402RightExpiryDuration},
+		result:   true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := &mockChecker{expiryErr: tc.expiryErr}
+			a := auth.NewLsatAuthenticator(&mockMint{}, c)
+
+			header := &http.Header{
+				lsat.HeaderMacaroon: []string{
+					createDummyMacHex(
+						testPreimage, tc.caveats...,
+					),
+				},
+			}
+			result, _ := a.Accept(header, "test")
+			require.Equal(t, tc.result, result)
+			require.Equal(t, tc.expiries, c.expiries)
+		})
+	}
+}
+
+// TestLsatAuthenticatorUses tests that the authenticator consumes one use of a
+// usage counted L402 per accepted request and reports the remaining uses.
+func TestLsatAuthenticatorUses(t *testing.T) {
+	const testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+
+	m := &mockMint{}
+	c := &mockChecker{}
+	a := auth.NewLsatAuthenticator(m, c)
+
+	header := &http.Header{
+		lsat.HeaderMacaroon: []string{
+			createDummyMacHex(
+				testPreimage, lsat.NewLifetimeCaveats(
+					"test", lsat.Lifetime{Uses: 2},
+				)...,
+			),
+		},
+	}
+
+	for _, remaining := range []string{"1", "0"} {
+		result, respHeader := a.Accept(header, "test")
+		require.True(t, result)
+		require.Equal(
+			t, remaining, respHeader.Get(lsat.HeaderUsesRemaining),
+		)
+	}
+
+	// All uses are used up now.
+	result, respHeader := a.Accept(header, "test")
+	require.False(t, result)
+	require.Empty(t, respHeader)
+
+	// A usage counted L402 without a time limit is never checked for
+	// expiry.
+	require.Empty(t, c.expiries)
+
+	// A denied request doesn't use up any use.
+	m.uses = 0
+	c.err = fmt.Errorf("not settled")
+	result, _ = a.Accept(header, "test")
+	require.False(t, result)
+	require.Zero(t, m.uses)
+}
+
+// TestLsatAuthenticatorRevoked tests that a revoked L402 is denied with a
+// reason the client can tell apart from an unpaid L402.
+func TestLsatAuthenticatorRevoked(t *testing.T) {
+	const testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+
+	m := &mockMint{}
+	a := auth.NewLsatAuthenticator(m, &mockChecker{})
+	header := &http.Header{
+		lsat.HeaderMacaroon: []string{createDummyMacHex(testPreimage)},
+	}
+
+	m.verifyErr = fmt.Errorf("%w: abuse", mint.ErrSecretRevoked)
+	result, respHeader := a.Accept(header, "test")
+	require.False(t, result)
+	require.Equal(
+		t, lsat.DenyReasonRevoked,
+		respHeader.Get(lsat.HeaderDenyReason),
+	)
+
+	// Other verification failures don't have a reason.
+	m.verifyErr = fmt.Errorf("invalid preimage")
+	result, respHeader = a.Accept(header, "test")
+	require.False(t, result)
+	require.Empty(t, respHeader)
+}
@@ -22,12 +22,14 @@ const (
 // returning new challenge headers.
 type Authenticator interface {
 	// Accept returns whether or not the header successfully authenticates
-	// the user to a given backend service.
-	Accept(*http.Header, string) bool
+	// the user to a given backend service. If it does, any header fields
+	// that should be added to the response, like the number of remaining
+	// uses of the L402, are returned as well.
+	Accept(*http.Header, string) (bool, http.Header)
 
 	// FreshChallengeHeader returns a header containing a challenge for the
-	// user to complete.
-	FreshChallengeHeader(*http.Request, string, string, int64) (http.Header, error)
+	// user to complete in order to access the given service.
+	FreshChallengeHeader(*http.Request, lsat.Service) (http.Header, error)
 }
 
 // Minter is an entity that is able to mint and verify L402s for a set of
@@ -38,6 +40,11 @@ type Minter interface {
 
 	// VerifyL402 attempts to verify an L402 with the given parameters.
 	VerifyL402(context.Context, *mint.VerificationParams) error
+
+	// UseL402 records one use of a verified, usage counted L402 that
+	// allows the given maximum number of uses and returns how many uses
+	// remain.
+	UseL402(context.Context, *macaroon.Macaroon, uint32) (uint32, error)
 }
 
 // InvoiceChecker is an entity that is able to check the status of an invoice,
@@ -1,6 +1,10 @@
 package auth
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+)
 
 // MockAuthenticator is a mock implementation of the authenticator.
 type MockAuthenticator struct{}
@@ -16,23 +20,25 @@ func NewMockAuthenticator() *MockAuthenticator {
 
 // Accept returns whether or not the header successfully authenticates the user
 // to a given backend service.
-func (a MockAuthenticator) Accept(header *http.Header, _ string) bool {
+func (a MockAuthenticator) Accept(header *http.Header,
+	_ string) (bool, http.Header) {
+
 	if header.Get("Authorization") != "" {
-		return true
+		return true, nil
 	}
 	if header.Get("Grpc-Metadata-macaroon") != "" {
-		return true
+		return true, nil
 	}
 	if header.Get("Macaroon") != "" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // FreshChallengeHeader returns a header containing a challenge for the user to
 // complete.
 func (a MockAuthenticator) FreshChallengeHeader(r *http.Request,
-	_ string, _ string, _ int64) (http.Header, error) {
+	_ lsat.Service) (http.Header, error) {
 
 	header := r.Header
 	header.Set(
@@ -13,6 +13,11 @@ import (
 )
 
 type mockMint struct {
+	// uses is the number of times UseL402 was called.
+	uses uint32
+
+	// verifyErr is returned by VerifyL402, if set.
+	verifyErr error
 }
 
 var _ auth.Minter = (*mockMint)(nil)
@@ -24,11 +29,28 @@ func (m *mockMint) MintL402(_ context.Context,
 }
 
 func (m *mockMint) VerifyL402(_ context.Context, p *mint.VerificationParams) error {
-	return nil
+	return m.verifyErr
+}
+
+func (m *mockMint) UseL402(_ context.Context, _ *macaroon.Macaroon,
+	maxUses uint32) (uint32, error) {
+
+	if m.uses >= maxUses {
+		return 0, mint.ErrUsesExhausted
+	}
+	m.uses++
+	return maxUses - m.uses, nil
 }
 
 type mockChecker struct {
 	err error
+
+	// expiryErr is returned by VerifyRightsWithinExpiry.
+	expiryErr error
+
+	// expiries records the durations VerifyRightsWithinExpiry was
+	// called with.
+	expiries []time.Duration
 }
 
 var _ auth.InvoiceChecker = (*mockChecker)(nil)
@@ -38,3 +60,10 @@ func (m *mockChecker) VerifyInvoiceStatus(lntypes.Hash,
 
 	return m.err
 }
+
+func (m *mockChecker) VerifyRightsWithinExpiry(_ lntypes.Hash,
+	duration time.Duration) error {
+
+	m.expiries = append(m.expiries, duration)
+	return m.expiryErr
+}
@@ -0,0 +1,271 @@
+package challenger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
+)
+
+const (
+	// defaultDialTimeout is the default maximum time establishing a
+	// connection to a relay or LNURL server may take. This is on the
+	// higher end to leave room for connections through Tor.
+	defaultDialTimeout = 30 * time.Second
+
+	// defaultTLSHandshakeTimeout is the default maximum time a TLS
+	// handshake may take.
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	// defaultNetwork is the network used if none is configured.
+	defaultNetwork = "mainnet"
+)
+
+// LnproxyConfig is the configuration of the lnproxy relays used to wrap creator
+// invoices and the HTTP client used to talk to them.
+type LnproxyConfig struct {
+	// URL is the base URL of a single relay. It is a shorthand for a
+	// relay pool with one relay and is ignored if Relays is set.
+	URL string `long:"url" description:"Base URL of a single lnproxy relay, ignored if relays are configured"`
+
+	// Relays is the list of relays in the pool.
+	Relays []*RelayConfig `long:"relay" description:"The lnproxy relays to wrap creator invoices with"`
+
+	// HealthCheckInterval is the interval in which relays that failed are
+	// checked for availability again.
+	HealthCheckInterval time.Duration `long:"healthcheckinterval" description:"Interval in which failed relays are checked again"`
+
+	// Timeout is the maximum time a request may take, for relays that
+	// don't configure their own timeout and for LNURL requests.
+	Timeout time.Duration `long:"timeout" description:"Default maximum time a request to a relay or LNURL server may take"`
+
+	// DialTimeout is the maximum time establishing a connection may take.
+	DialTimeout time.Duration `long:"dialtimeout" description:"Maximum time establishing a connection may take"`
+
+	// TLSHandshakeTimeout is the maximum time a TLS handshake may take.
+	TLSHandshakeTimeout time.Duration `long:"tlshandshaketimeout" description:"Maximum time a TLS handshake may take"`
+
+	// TLSRootCAs is the optional path to a PEM file with additional root
+	// certificates to trust, e.g. for relays with self-signed
+	// certificates.
+	TLSRootCAs string `long:"tlsrootcas" description:"Path to a PEM file with additional root certificates to trust"`
+
+	// Proxy is the optional URL of a proxy all requests are sent through,
+	// e.g. socks5://127.0.0.1:9050 to reach relays over Tor.
+	Proxy string `long:"proxy" description:"URL of a socks5, http or https proxy to send requests through, e.g. socks5://127.0.0.1:9050 for Tor"`
+
+	// Network is the network the creator and wrapped invoices must be
+	// encoded for.
+	Network string `long:"network" description:"The network invoices must be encoded for" choice:"regtest" choice:"simnet" choice:"testnet" choice:"signet" choice:"mainnet"`
+
+	// NodePubKey is the hex encoded public key of the operator's lnd
+	// node. Wrapped invoices are only accepted if they are payable to it,
+	// so every relay must be backed by that node. If unset, it is looked
+	// up from lnd.
+	NodePubKey string `long:"nodepubkey" description:"Public key of the operator's lnd node that backs the relays, looked up from lnd if unset"`
+
+	// OperatorFee is the global operator fee policy. It is used for all
+	// services that don't define their own policy.
+	OperatorFee *fee.Policy `group:"operatorfee" namespace:"operatorfee"`
+}
+
+// Validate checks the lnproxy configuration for invalid values.
+func (c *LnproxyConfig) Validate() error {
+	if c.URL != "" {
+		if err := validateRelayURL(c.URL); err != nil {
+			return err
+		}
+	}
+
+	for _, relayCfg := range c.Relays {
+		if err := validateRelayURL(relayCfg.URL); err != nil {
+			return err
+		}
+		if relayCfg.Timeout < 0 {
+			return fmt.Errorf("negative timeout for lnproxy relay "+
+				"%q", relayCfg.URL)
+		}
+	}
+
+	switch {
+	case c.HealthCheckInterval < 0:
+		return errors.New("negative lnproxy health check interval")
+
+	case c.Timeout < 0, c.DialTimeout < 0, c.TLSHandshakeTimeout < 0:
+		return errors.New("negative lnproxy timeout")
+	}
+
+	if _, err := c.chainParams(); err != nil {
+		return err
+	}
+
+	if _, err := c.nodeKey(); err != nil {
+		return err
+	}
+
+	// Building the transport loads the root certificates and parses the
+	// proxy URL, so any error there is reported on startup.
+	if _, err := c.newTransport(); err != nil {
+		return err
+	}
+
+	if c.OperatorFee != nil {
+		if err := c.OperatorFee.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeKey returns the configured public key of the operator's node, or nil if
+// it isn't set.
+func (c *LnproxyConfig) nodeKey() (*btcec.PublicKey, error) {
+	if c.NodePubKey == "" {
+		return nil, nil
+	}
+
+	keyBytes, err := hex.DecodeString(c.NodePubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lnproxy node pubkey: %w", err)
+	}
+
+	key, err := btcec.ParsePubKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lnproxy node pubkey: %w", err)
+	}
+
+	return key, nil
+}
+
+// Enabled returns true if at least one relay is configured.
+func (c *LnproxyConfig) Enabled() bool {
+	return len(c.relays()) > 0
+}
+
+// relays returns the configured relays, falling back to the single relay URL.
+func (c *LnproxyConfig) relays() []*RelayConfig {
+	if len(c.Relays) == 0 && c.URL != "" {
+		return []*RelayConfig{{URL: c.URL}}
+	}
+
+	return c.Relays
+}
+
+// timeout returns the default request timeout.
+func (c *LnproxyConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultRelayTimeout
+	}
+
+	return c.Timeout
+}
+
+// chainParams returns the parameters of the configured network.
+func (c *LnproxyConfig) chainParams() (*chaincfg.Params, error) {
+	switch c.Network {
+	case "", defaultNetwork:
+		return &chaincfg.MainNetParams, nil
+
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+
+	default:
+		return nil, fmt.Errorf("unknown lnproxy network %q", c.Network)
+	}
+}
+
+// newTransport creates the HTTP transport for requests to relays and LNURL
+// servers from the configured timeouts, root certificates and proxy.
+func (c *LnproxyConfig) newTransport() (*http.Transport, error) {
+	dialTimeout := c.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	tlsHandshakeTimeout := c.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+
+	if c.TLSRootCAs != "" {
+		pem, err := os.ReadFile(c.TLSRootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read lnproxy tls root "+
+				"certificates: %v", err)
+		}
+
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v",
+				c.TLSRootCAs)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lnproxy proxy url %q: %v",
+				c.Proxy, err)
+		}
+
+		switch proxyURL.Scheme {
+		case "socks5", "http", "https":
+		default:
+			return nil, fmt.Errorf("invalid lnproxy proxy url %q: "+
+				"scheme must be socks5, http or https", c.Proxy)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return transport, nil
+}
+
+// validateRelayURL makes sure the given relay URL can be used.
+func validateRelayURL(relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return fmt.Errorf("invalid lnproxy relay url %q: %v", relayURL,
+			err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid lnproxy relay url %q: scheme must "+
+			"be http or https", relayURL)
+	}
+
+	return nil
+}
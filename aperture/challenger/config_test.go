@@ -0,0 +1,142 @@
+package challenger
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/motxx/aperture-lnproxy/aperture/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLnproxyConfigValidate makes sure invalid lnproxy configurations are
+// rejected on startup.
+func TestLnproxyConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  LnproxyConfig
+		err  string
+	}{{
+		name: "single relay url",
+		cfg:  LnproxyConfig{URL: "http://lnproxy:4747"},
+	}, {
+		name: "tor relay through socks proxy",
+		cfg: LnproxyConfig{
+			URL:   "http://relay.onion",
+			Proxy: "socks5://127.0.0.1:9050",
+		},
+	}, {
+		name: "invalid relay scheme",
+		cfg:  LnproxyConfig{URL: "ftp://lnproxy"},
+		err:  "scheme must be http or https",
+	}, {
+		name: "invalid proxy scheme",
+		cfg:  LnproxyConfig{Proxy: "socks4://127.0.0.1:9050"},
+		err:  "scheme must be socks5, http or https",
+	}, {
+		name: "missing root certificates",
+		cfg: LnproxyConfig{
+			TLSRootCAs: filepath.Join(t.TempDir(), "missing.pem"),
+		},
+		err: "unable to read lnproxy tls root certificates",
+	}, {
+		name: "unknown network",
+		cfg:  LnproxyConfig{Network: "litecoin"},
+		err:  "unknown lnproxy network",
+	}, {
+		name: "negative timeout",
+		cfg:  LnproxyConfig{DialTimeout: -1},
+		err:  "negative lnproxy timeout",
+	}, {
+		name: "node pubkey",
+		cfg: LnproxyConfig{
+			NodePubKey: "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce" +
+				"28d959f2815b16f81798",
+		},
+	}, {
+		name: "invalid node pubkey",
+		cfg:  LnproxyConfig{NodePubKey: "02abcd"},
+		err:  "invalid lnproxy node pubkey",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+// TestRelayProxy makes sure requests to relays are sent through the
+// configured proxy.
+func TestRelayProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			proxiedHost = r.Host
+		},
+	))
+	defer proxy.Close()
+
+	pool, err := NewRelayPool(&LnproxyConfig{
+		URL:   "http://relay.onion",
+		Proxy: proxy.URL,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, probeRelay(pool.relays[0]))
+	require.Equal(t, "relay.onion", proxiedHost)
+}
+
+// TestUpdateConfig makes sure the relay configuration can be swapped at
+// runtime and that an invalid configuration keeps the current one.
+func TestUpdateConfig(t *testing.T) {
+	settings, err := newLnproxySettings(&LnproxyConfig{
+		URL: "http://old",
+	})
+	require.NoError(t, err)
+	settings.relays.Start()
+
+	l := &LnproxyChallenger{settings: settings}
+
+	err = l.UpdateConfig(&LnproxyConfig{URL: "ftp://invalid"})
+	require.Error(t, err)
+	require.Equal(t, settings, l.currentSettings())
+
+	err = l.UpdateConfig(&LnproxyConfig{
+		Relays: []*RelayConfig{{URL: "http://a"}, {URL: "http://b"}},
+	})
+	require.NoError(t, err)
+
+	status := l.currentSettings().relays.Status()
+	require.Len(t, status, 2)
+	require.Equal(t, "http://a", status[0].URL)
+
+	// The node key looked up on startup is kept, unless a new one is
+	// configured.
+	require.Nil(t, l.currentSettings().nodeKey)
+	l.currentSettings().nodeKey = testNodePubKey
+	err = l.UpdateConfig(&LnproxyConfig{URL: "http://c"})
+	require.NoError(t, err)
+	require.Equal(t, testNodePubKey, l.currentSettings().nodeKey)
+
+	_, otherKey := test.CreateKey(2)
+	err = l.UpdateConfig(&LnproxyConfig{
+		URL: "http://d",
+		NodePubKey: hex.EncodeToString(
+			otherKey.SerializeCompressed(),
+		),
+	})
+	require.NoError(t, err)
+	require.True(t, otherKey.IsEqual(l.currentSettings().nodeKey))
+
+	l.currentSettings().relays.Stop()
+}
@@ -36,3 +36,17 @@ type Challenger interface {
 	mint.Challenger
 	auth.InvoiceChecker
 }
+
+// InvoiceIndexStore is an interface for persisting the indices of the latest
+// invoice updates the challenger processed, so it doesn't need to go through
+// all invoices again after a restart.
+type InvoiceIndexStore interface {
+	// InvoiceIndices returns the add and settle index of the latest
+	// processed invoice updates. Both are zero if none were stored yet.
+	InvoiceIndices(ctx context.Context) (uint64, uint64, error)
+
+	// SetInvoiceIndices stores the add and settle index of the latest
+	// processed invoice updates.
+	SetInvoiceIndices(ctx context.Context, addIndex,
+		settleIndex uint64) error
+}
@@ -0,0 +1,1114 @@
+package challenger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+)
+
+const (
+	// DefaultOutageBudget is the default time the invoice subscription may
+	// stay down before the challenger gives up and signals the error.
+	DefaultOutageBudget = 5 * time.Minute
+
+	// DefaultResubscribeDelay is the default time the challenger waits
+	// before it subscribes to invoice updates again after the subscription
+	// failed. The delay is doubled after each failed attempt.
+	DefaultResubscribeDelay = time.Second
+
+	// maxResubscribeDelay is the maximum time between two attempts to
+	// subscribe to invoice updates.
+	maxResubscribeDelay = 30 * time.Second
+
+	// DefaultInvoicePageSize is the default number of invoices fetched from
+	// lnd with a single call.
+	DefaultInvoicePageSize = 1000
+
+	// DefaultSettledInvoiceAge is the default time a settled invoice is
+	// kept in the cache after its settlement. Older settlements are looked
+	// up in the secret store.
+	DefaultSettledInvoiceAge = 24 * time.Hour
+
+	// DefaultSettlementPollInterval is the default time between two
+	// lookups of an invoice's settlement in the secret store while we wait
+	// for it to be settled.
+	DefaultSettlementPollInterval = 250 * time.Millisecond
+
+	// cacheMaintenanceInterval is the time between two evictions of the
+	// invoices that don't need to be cached anymore.
+	cacheMaintenanceInterval = time.Minute
+
+	// settlementWriteTimeout is the maximum time recording a settlement in
+	// the secret store may take.
+	settlementWriteTimeout = 10 * time.Second
+)
+
+var (
+	// ErrCreatorPaidService is returned if the lnd challenger is asked to
+	// create a challenge for a service that is paid to a creator. The
+	// operator's node must never collect the creator's price.
+	ErrCreatorPaidService = errors.New("service is paid to a creator " +
+		"and not to the operator")
+)
+
+// cachedInvoice is what we keep in memory about an invoice.
+type cachedInvoice struct {
+	// state is the latest known state of the invoice.
+	state lnrpc.Invoice_InvoiceState
+
+	// addIndex is the add index of the invoice. It tells us where to start
+	// listing the invoices that may have been settled during an outage.
+	addIndex uint64
+
+	// evictAt is the time the invoice is removed from the cache. It is the
+	// expiry of an open invoice or the end of the settled invoice age of a
+	// settled one.
+	evictAt time.Time
+}
+
+// LndChallenger is a challenger that uses an lnd backend to create new L402
+// payment challenges. The invoices are created on the operator's own node, so
+// it is used for services that are paid to the operator directly.
+type LndChallenger struct {
+	client        InvoiceClient
+	clientCtx     func() context.Context
+	genInvoiceReq InvoiceRequestGenerator
+
+	invoiceStates  map[lntypes.Hash]cachedInvoice
+	invoicesMtx    *sync.Mutex
+	invoicesCancel func()
+	invoicesCond   *sync.Cond
+
+	// addIndex and settleIndex are the indices of the latest invoice
+	// updates we know of. A new subscription resumes after them. They are
+	// guarded by invoicesMtx.
+	addIndex    uint64
+	settleIndex uint64
+
+	// indexStore persists the indices, so we don't need to list all
+	// invoices again after a restart. It may be nil.
+	indexStore InvoiceIndexStore
+
+	// persistedAddIndex and persistedSettleIndex are the indices we last
+	// stored in the index store.
+	persistedAddIndex    uint64
+	persistedSettleIndex uint64
+
+	// unrecorded are the settled invoices whose settlement couldn't be
+	// recorded in the secret store yet. They are retried periodically and
+	// the persisted settle index is held back before them, so lnd replays
+	// their settlement after a restart. They are guarded by invoicesMtx.
+	unrecorded map[lntypes.Hash]*lnrpc.Invoice
+
+	// invoicePageSize is the number of invoices fetched from lnd with a
+	// single call.
+	invoicePageSize uint64
+
+	// settledInvoiceAge is how long a settled invoice is kept in the cache
+	// after its settlement.
+	settledInvoiceAge time.Duration
+
+	// settlementPollInterval is the time between two lookups of an
+	// invoice's settlement in the secret store. The store is shared by
+	// all replicas of aperture, so it also knows the settlements another
+	// replica recorded.
+	settlementPollInterval time.Duration
+
+	secrets mint.SecretStore
+
+	// outageBudget is how long the invoice subscription may stay down
+	// before the error is signaled on errChan.
+	outageBudget time.Duration
+
+	// resubscribeDelay is the time we wait before the first attempt to
+	// subscribe again after the subscription failed.
+	resubscribeDelay time.Duration
+
+	errChan chan<- error
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// A compile time flag to ensure the LndChallenger satisfies the Challenger
+// interface.
+var _ Challenger = (*LndChallenger)(nil)
+
+// LndChallengerOption is a functional option that allows us to pass in
+// optional arguments when creating the challenger.
+type LndChallengerOption func(*LndChallenger)
+
+// WithOutageBudget is a functional option that allows us to specify how long
+// the invoice subscription may stay down before the challenger signals the
+// error. A budget of zero signals the first error right away.
+func WithOutageBudget(budget time.Duration) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.outageBudget = budget
+	}
+}
+
+// WithResubscribeDelay is a functional option that allows us to specify the
+// delay before the first attempt to subscribe to invoice updates again.
+func WithResubscribeDelay(delay time.Duration) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.resubscribeDelay = delay
+	}
+}
+
+// WithInvoiceIndexStore is a functional option that allows us to persist the
+// indices of the latest invoice updates, so the challenger resumes after them
+// on startup instead of listing all invoices again.
+func WithInvoiceIndexStore(store InvoiceIndexStore) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.indexStore = store
+	}
+}
+
+// WithInvoicePageSize is a functional option that allows us to specify the
+// number of invoices fetched from lnd with a single call.
+func WithInvoicePageSize(size uint64) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.invoicePageSize = size
+	}
+}
+
+// WithSettledInvoiceAge is a functional option that allows us to specify how
+// long a settled invoice is kept in the cache after its settlement.
+func WithSettledInvoiceAge(age time.Duration) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.settledInvoiceAge = age
+	}
+}
+
+// WithSettlementPollInterval is a functional option that allows us to specify
+// the time between two lookups of an invoice's settlement in the secret store.
+// An interval of zero only waits for the invoice updates from lnd.
+func WithSettlementPollInterval(interval time.Duration) LndChallengerOption {
+	return func(l *LndChallenger) {
+		l.settlementPollInterval = interval
+	}
+}
+
+// NewLndChallenger creates a new challenger that uses the given connection to
+// an lnd backend to create payment challenges.
+func NewLndChallenger(client InvoiceClient,
+	genInvoiceReq InvoiceRequestGenerator,
+	store mint.SecretStore,
+	ctxFunc func() context.Context,
+	errChan chan<- error,
+	opts ...LndChallengerOption) (*LndChallenger, error) {
+
+	// Make sure we have a valid context function. This will be called to
+	// create a new context for each call to the lnd client.
+	if ctxFunc == nil {
+		ctxFunc = context.Background
+	}
+
+	if genInvoiceReq == nil {
+		return nil, fmt.Errorf("genInvoiceReq cannot be nil")
+	}
+
+	invoicesMtx := &sync.Mutex{}
+	challenger := &LndChallenger{
+		client:                 client,
+		clientCtx:              ctxFunc,
+		genInvoiceReq:          genInvoiceReq,
+		invoiceStates:          make(map[lntypes.Hash]cachedInvoice),
+		unrecorded:             make(map[lntypes.Hash]*lnrpc.Invoice),
+		invoicesMtx:            invoicesMtx,
+		invoicesCond:           sync.NewCond(invoicesMtx),
+		invoicePageSize:        DefaultInvoicePageSize,
+		settledInvoiceAge:      DefaultSettledInvoiceAge,
+		settlementPollInterval: DefaultSettlementPollInterval,
+		secrets:                store,
+		outageBudget:           DefaultOutageBudget,
+		resubscribeDelay:       DefaultResubscribeDelay,
+		quit:                   make(chan struct{}),
+		errChan:                errChan,
+	}
+	for _, opt := range opts {
+		opt(challenger)
+	}
+
+	err := challenger.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start challenger: %w", err)
+	}
+
+	return challenger, nil
+}
+
+// Start starts the challenger's main work which is to keep track of the
+// invoices and their states. For that the backing lnd node is queried for the
+// invoices added after the persisted indices on startup and a subscription to
+// all subsequent invoice updates is created. If the subscription fails, the
+// challenger subscribes again until the outage budget is used up.
+func (l *LndChallenger) Start() error {
+	var offset uint64
+	if l.indexStore != nil {
+		addIndex, settleIndex, err := l.indexStore.InvoiceIndices(
+			context.Background(),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to load invoice indices: %w",
+				err)
+		}
+
+		if addIndex > 0 || settleIndex > 0 {
+			log.Infof("Resuming invoice updates after add index "+
+				"%d and settle index %d", addIndex, settleIndex)
+		}
+
+		l.invoicesMtx.Lock()
+		l.addIndex, l.settleIndex = addIndex, settleIndex
+		l.invoicesMtx.Unlock()
+
+		l.persistedAddIndex = addIndex
+		l.persistedSettleIndex = settleIndex
+		offset = addIndex
+	}
+
+	// Get the invoices we don't know of yet on startup and add them to our
+	// cache. To save space we only keep track of an invoice's state while
+	// it is open or recently settled. Older settlements are looked up in
+	// the secret store.
+	ctx := l.clientCtx()
+	if err := l.syncInvoices(ctx, offset, false); err != nil {
+		return err
+	}
+
+	stream, err := l.subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.wg.Add(2)
+	go l.watchInvoices(stream)
+	go l.maintainCache()
+
+	return nil
+}
+
+// syncInvoices pages through the invoices added after the given add index to
+// update our cache and advance our add index, so we'll only receive updates
+// for new invoices. The settle index is only advanced if we went through all
+// invoices, otherwise lnd replays the settlements we might not have seen yet.
+// If reconcile is set, the invoices that were settled since we last knew their
+// state are recorded as settled in the secret store, as we missed their update
+// while we weren't subscribed.
+func (l *LndChallenger) syncInvoices(ctx context.Context, offset uint64,
+	reconcile bool) error {
+
+	advanceSettleIndex := offset == 0
+
+	for {
+		invoiceResp, err := l.client.ListInvoices(
+			ctx, &lnrpc.ListInvoiceRequest{
+				IndexOffset:    offset,
+				NumMaxInvoices: l.invoicePageSize,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = l.cacheInvoices(
+			invoiceResp.Invoices, advanceSettleIndex, reconcile,
+		)
+		if err != nil {
+			return err
+		}
+
+		// A page that isn't full means we've reached the latest
+		// invoice.
+		numInvoices := uint64(len(invoiceResp.Invoices))
+		if numInvoices < l.invoicePageSize ||
+			invoiceResp.LastIndexOffset <= offset {
+
+			return nil
+		}
+		offset = invoiceResp.LastIndexOffset
+	}
+}
+
+// cacheInvoices updates our cache and add index with a page of invoices listed
+// by lnd and notifies anyone waiting for an invoice that was updated in the
+// meantime.
+func (l *LndChallenger) cacheInvoices(invoices []*lnrpc.Invoice,
+	advanceSettleIndex, reconcile bool) error {
+
+	// The settlements we missed are recorded before anyone waiting for
+	// the invoices is notified.
+	if reconcile {
+		for hash, invoice := range l.missedSettlements(invoices) {
+			log.Infof("Reconciled invoice %v that was settled "+
+				"while the invoice subscription was down", hash)
+
+			l.markSettled(hash, invoice)
+		}
+	}
+
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+	defer l.invoicesCond.Broadcast()
+
+	for _, invoice := range invoices {
+		// Some invoices like AMP invoices may not have a payment hash
+		// populated.
+		if invoice.RHash == nil {
+			continue
+		}
+
+		if invoice.AddIndex > l.addIndex {
+			l.addIndex = invoice.AddIndex
+		}
+		if advanceSettleIndex && invoice.SettleIndex > l.settleIndex {
+			l.settleIndex = invoice.SettleIndex
+		}
+		hash, err := lntypes.MakeHash(invoice.RHash)
+		if err != nil {
+			return fmt.Errorf("error parsing invoice hash: %v", err)
+		}
+
+		// Canceled, expired and long settled invoices aren't cached.
+		l.cacheInvoice(hash, invoice)
+	}
+
+	return nil
+}
+
+// missedSettlements returns the settled invoices among the given ones that
+// aren't cached as settled yet, so we missed their settlement while we weren't
+// subscribed. Invoices that are too old to be cached are skipped, as they
+// weren't open when the subscription went down.
+func (l *LndChallenger) missedSettlements(
+	invoices []*lnrpc.Invoice) map[lntypes.Hash]*lnrpc.Invoice {
+
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	missed := make(map[lntypes.Hash]*lnrpc.Invoice)
+	for _, invoice := range invoices {
+		if invoice.RHash == nil ||
+			invoice.State != lnrpc.Invoice_SETTLED ||
+			invoiceIrrelevant(invoice) {
+
+			continue
+		}
+
+		hash, err := lntypes.MakeHash(invoice.RHash)
+		if err != nil {
+			continue
+		}
+
+		cached, ok := l.invoiceStates[hash]
+		if ok && cached.state == lnrpc.Invoice_SETTLED {
+			continue
+		}
+
+		settleDate := time.Unix(invoice.SettleDate, 0)
+		if !time.Now().Before(settleDate.Add(l.settledInvoiceAge)) {
+			continue
+		}
+
+		missed[hash] = invoice
+	}
+
+	return missed
+}
+
+// reconcileOffset returns the add index to start listing the invoices from
+// after an outage. Only the invoices we know as open may have been settled
+// in the meantime, so we start right before the oldest of them.
+func (l *LndChallenger) reconcileOffset() uint64 {
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	offset := l.addIndex
+	for _, invoice := range l.invoiceStates {
+		if invoice.state == lnrpc.Invoice_SETTLED {
+			continue
+		}
+
+		if invoice.addIndex > 0 && invoice.addIndex-1 < offset {
+			offset = invoice.addIndex - 1
+		}
+	}
+
+	return offset
+}
+
+// subscribe creates a subscription to the invoice updates after the latest
+// ones we know of. The given context only bounds the time to establish the
+// subscription, the subscription itself lasts until it is canceled.
+func (l *LndChallenger) subscribe(ctx context.Context) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	l.invoicesMtx.Lock()
+	req := &lnrpc.InvoiceSubscription{
+		AddIndex:    l.addIndex,
+		SettleIndex: l.settleIndex,
+	}
+	l.invoicesMtx.Unlock()
+
+	// We need to be able to cancel any subscription we make.
+	ctxc, cancel := context.WithCancel(l.clientCtx())
+
+	// Give up on the subscription if it isn't established before the
+	// given context is done.
+	established := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-established:
+		}
+	}()
+
+	stream, err := l.client.SubscribeInvoices(ctxc, req)
+	close(established)
+	<-watcherDone
+
+	// If the given context is done, the call was canceled because of it.
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	l.invoicesMtx.Lock()
+	l.invoicesCancel = cancel
+	l.invoicesMtx.Unlock()
+
+	return stream, nil
+}
+
+// watchInvoices reads the invoice updates of the given subscription and
+// subscribes again whenever the subscription fails, until the challenger is
+// shutting down. If we can't subscribe again within the outage budget, the
+// error is signaled to the main goroutine.
+//
+// NOTE: This must be run as a goroutine.
+func (l *LndChallenger) watchInvoices(
+	stream lnrpc.Lightning_SubscribeInvoicesClient) {
+
+	defer l.wg.Done()
+
+	for {
+		err := l.readInvoiceStream(stream)
+		if err == nil {
+			return
+		}
+
+		stream, err = l.resubscribe(err)
+		switch {
+		case err != nil:
+			// We can't continue to function properly. Signal the
+			// error to the main goroutine to force a
+			// shutdown/restart.
+			log.Errorf("Giving up on the invoice subscription: %v",
+				err)
+
+			select {
+			case l.errChan <- err:
+			case <-l.quit:
+			default:
+			}
+
+			return
+
+		// We're shutting down.
+		case stream == nil:
+			return
+		}
+	}
+}
+
+// resubscribe subscribes to the invoice updates again after the subscription
+// failed with the given error, waiting longer after each failed attempt.
+// Before resuming the updates, the invoices that were settled in the meantime
+// are reconciled. An error is returned once the outage budget is used up, and
+// no subscription if the challenger is shutting down.
+func (l *LndChallenger) resubscribe(
+	err error) (lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	outageStart := time.Now()
+	deadline := outageStart.Add(l.outageBudget)
+	delay := l.resubscribeDelay
+	for attempt := 1; ; attempt++ {
+		outage := time.Since(outageStart)
+		if outage >= l.outageBudget {
+			return nil, fmt.Errorf("invoice subscription down for "+
+				"%v: %w", outage.Round(time.Millisecond), err)
+		}
+
+		// We don't wait past the outage budget, the error of the last
+		// attempt is signaled then.
+		wait := delay
+		if left := time.Until(deadline); wait > left {
+			wait = left
+		}
+
+		log.Warnf("Invoice subscription failed, subscribing again in "+
+			"%v: %v", wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-l.quit:
+			return nil, nil
+		}
+
+		delay *= 2
+		if delay > maxResubscribeDelay {
+			delay = maxResubscribeDelay
+		}
+
+		if !time.Now().Before(deadline) {
+			continue
+		}
+
+		var stream lnrpc.Lightning_SubscribeInvoicesClient
+		stream, err = l.resubscribeAttempt(deadline)
+		if err != nil {
+			continue
+		}
+
+		log.Infof("Subscribed to invoice updates again after %d "+
+			"attempt(s)", attempt)
+
+		return stream, nil
+	}
+}
+
+// resubscribeAttempt reconciles the invoices and subscribes to the invoice
+// updates again. The attempt is given up at the deadline, so a node that
+// doesn't respond can't hold us past the outage budget, or once the challenger
+// is shutting down.
+func (l *LndChallenger) resubscribeAttempt(deadline time.Time) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	ctxt, cancel := context.WithDeadline(l.clientCtx(), deadline)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-l.quit:
+			cancel()
+		case <-ctxt.Done():
+		}
+	}()
+
+	err := l.syncInvoices(ctxt, l.reconcileOffset(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.subscribe(ctxt)
+}
+
+// readInvoiceStream reads the invoice update messages sent on the stream until
+// the stream is aborted or the challenger is shutting down. The error the
+// stream failed with is returned, or nil if we're shutting down.
+func (l *LndChallenger) readInvoiceStream(
+	stream lnrpc.Lightning_SubscribeInvoicesClient) error {
+
+	for {
+		// In case we receive the shutdown signal right after receiving
+		// an update, we can exit early.
+		select {
+		case <-l.quit:
+			return nil
+		default:
+		}
+
+		// Wait for an update to arrive. This will block until either a
+		// message receives, an error occurs or the underlying context
+		// is canceled (which will also result in an error).
+		invoice, err := stream.Recv()
+		switch {
+		case err == io.EOF:
+			// The connection is shutting down, for example because
+			// lnd is restarting.
+			return err
+
+		case err != nil && strings.Contains(
+			err.Error(), context.Canceled.Error(),
+		):
+
+			// The context has been canceled, we are shutting down.
+			// So no need to subscribe again.
+			return nil
+
+		case err != nil:
+			log.Errorf("Received error from invoice subscription: "+
+				"%v", err)
+
+			return err
+
+		default:
+		}
+
+		// Some invoices like AMP invoices may not have a payment hash
+		// populated.
+		if invoice.RHash == nil {
+			continue
+		}
+
+		paymentHash, err := lntypes.MakeHash(invoice.RHash)
+		if err != nil {
+			log.Errorf("Error parsing invoice hash: %v", err)
+			continue
+		}
+
+		// A settlement is recorded even if it is too old to be cached,
+		// which happens if lnd replays the settlements after a long
+		// downtime. It is recorded before anyone waiting for the
+		// invoice is notified.
+		if invoice.State == lnrpc.Invoice_SETTLED {
+			l.markSettled(paymentHash, invoice)
+		}
+
+		l.invoicesMtx.Lock()
+		if invoice.AddIndex > l.addIndex {
+			l.addIndex = invoice.AddIndex
+		}
+		if invoice.SettleIndex > l.settleIndex {
+			l.settleIndex = invoice.SettleIndex
+		}
+		l.cacheInvoice(paymentHash, invoice)
+
+		// Before releasing the lock, notify our conditions that listen
+		// for updates on the invoice state.
+		l.invoicesCond.Broadcast()
+		l.invoicesMtx.Unlock()
+	}
+}
+
+// markSettled records the settlement time of the given invoice in the secret
+// store. If that fails, the invoice is kept to be retried by maintainCache.
+// The caller must not hold invoicesMtx.
+func (l *LndChallenger) markSettled(paymentHash lntypes.Hash,
+	invoice *lnrpc.Invoice) {
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), settlementWriteTimeout,
+	)
+	defer cancel()
+
+	err := l.secrets.SetSettledAtByPaymentHash(
+		ctx, paymentHash, sql.NullTime{
+			Time:  time.Unix(invoice.SettleDate, 0),
+			Valid: true,
+		},
+	)
+
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	if err != nil {
+		log.Errorf("Unable to record settlement of invoice %v, "+
+			"retrying later: %v", paymentHash, err)
+
+		l.unrecorded[paymentHash] = invoice
+		return
+	}
+
+	delete(l.unrecorded, paymentHash)
+}
+
+// recordSettlements retries recording the settlements that couldn't be
+// recorded before.
+func (l *LndChallenger) recordSettlements() {
+	l.invoicesMtx.Lock()
+	unrecorded := make(map[lntypes.Hash]*lnrpc.Invoice, len(l.unrecorded))
+	for hash, invoice := range l.unrecorded {
+		unrecorded[hash] = invoice
+	}
+	l.invoicesMtx.Unlock()
+
+	for hash, invoice := range unrecorded {
+		l.markSettled(hash, invoice)
+	}
+}
+
+// cacheInvoice updates the cached state of the given invoice and returns true
+// if the invoice is still cached. Canceled invoices, open invoices past their
+// expiry and invoices settled longer ago than the settled invoice age are
+// removed from the cache. The caller must hold invoicesMtx.
+func (l *LndChallenger) cacheInvoice(hash lntypes.Hash,
+	invoice *lnrpc.Invoice) bool {
+
+	if invoiceIrrelevant(invoice) {
+		delete(l.invoiceStates, hash)
+		return false
+	}
+
+	entry := cachedInvoice{
+		state:    invoice.State,
+		addIndex: invoice.AddIndex,
+		evictAt:  invoiceExpiry(invoice),
+	}
+	if invoice.State == lnrpc.Invoice_SETTLED {
+		settleDate := time.Unix(invoice.SettleDate, 0)
+		entry.evictAt = settleDate.Add(l.settledInvoiceAge)
+	}
+
+	if !time.Now().Before(entry.evictAt) {
+		delete(l.invoiceStates, hash)
+		return false
+	}
+
+	l.invoiceStates[hash] = entry
+
+	return true
+}
+
+// maintainCache periodically evicts the invoices that don't need to be cached
+// anymore and persists the latest invoice indices, until the challenger is
+// shutting down.
+//
+// NOTE: This must be run as a goroutine.
+func (l *LndChallenger) maintainCache() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(cacheMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.evictInvoices(time.Now())
+			l.recordSettlements()
+			l.persistIndices()
+
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// evictInvoices removes the invoices whose time in the cache is up at the
+// given time.
+func (l *LndChallenger) evictInvoices(now time.Time) {
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	var evicted int
+	for hash, invoice := range l.invoiceStates {
+		if now.Before(invoice.evictAt) {
+			continue
+		}
+
+		delete(l.invoiceStates, hash)
+		evicted++
+	}
+
+	if evicted > 0 {
+		log.Debugf("Evicted %d invoices from the cache, %d remaining",
+			evicted, len(l.invoiceStates))
+	}
+}
+
+// persistIndices stores the latest invoice indices if they changed since they
+// were last stored. The settle index is held back before the settlements that
+// aren't recorded yet, so lnd replays them after a restart.
+func (l *LndChallenger) persistIndices() {
+	if l.indexStore == nil {
+		return
+	}
+
+	l.invoicesMtx.Lock()
+	addIndex, settleIndex := l.addIndex, l.settleIndex
+	for _, invoice := range l.unrecorded {
+		if invoice.SettleIndex > 0 &&
+			invoice.SettleIndex-1 < settleIndex {
+
+			settleIndex = invoice.SettleIndex - 1
+		}
+	}
+	l.invoicesMtx.Unlock()
+
+	if addIndex == l.persistedAddIndex &&
+		settleIndex == l.persistedSettleIndex {
+
+		return
+	}
+
+	err := l.indexStore.SetInvoiceIndices(
+		context.Background(), addIndex, settleIndex,
+	)
+	if err != nil {
+		log.Errorf("Unable to store invoice indices: %v", err)
+		return
+	}
+
+	l.persistedAddIndex = addIndex
+	l.persistedSettleIndex = settleIndex
+}
+
+// Stop shuts down the challenger.
+func (l *LndChallenger) Stop() {
+	// Once quit is closed, no new subscription is read anymore, so
+	// canceling the current one afterwards unblocks the reader for sure.
+	close(l.quit)
+
+	l.invoicesMtx.Lock()
+	cancel := l.invoicesCancel
+	l.invoicesMtx.Unlock()
+	cancel()
+
+	l.wg.Wait()
+
+	// Store the indices one last time, so we resume right where we
+	// stopped.
+	l.persistIndices()
+}
+
+// NewChallenge creates a new L402 payment challenge, returning a payment
+// request (invoice) and the corresponding payment hash. The invoice is created
+// on the operator's lnd node for the price of the service.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (l *LndChallenger) NewChallenge(service lsat.Service) (string,
+	lntypes.Hash, error) {
+
+	if !service.DirectPay {
+		return "", lntypes.ZeroHash, fmt.Errorf("%w: %v",
+			ErrCreatorPaidService, service.Name)
+	}
+
+	invoice, err := l.genInvoiceReq(service.Price)
+	if err != nil {
+		return "", lntypes.ZeroHash, err
+	}
+
+	ctx := l.clientCtx()
+	response, err := l.client.AddInvoice(ctx, invoice)
+	if err != nil {
+		log.Errorf("Error adding invoice: %v", err)
+		return "", lntypes.ZeroHash, err
+	}
+
+	paymentHash, err := lntypes.MakeHash(response.RHash)
+	if err != nil {
+		log.Errorf("Error parsing payment hash: %v", err)
+		return "", lntypes.ZeroHash, err
+	}
+
+	log.Infof("Created direct invoice for service %v, price %d sat, "+
+		"payment hash %v", service.Name, service.Price, paymentHash)
+
+	return response.PaymentRequest, paymentHash, nil
+}
+
+// VerifyInvoiceStatus checks that an invoice identified by a payment
+// hash has the desired status. To make sure we don't fail while the
+// invoice update is still on its way, we try several times until either
+// the desired status is set or the given timeout is reached. The settlement
+// recorded in the secret store is the source of truth, the invoice updates we
+// received from lnd only serve as a fast path. That way a settlement recorded
+// by another replica of aperture is accepted as well.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (l *LndChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	// Prevent the challenger to be shut down while we're still waiting for
+	// status updates.
+	l.wg.Add(1)
+	defer l.wg.Done()
+
+	var (
+		condWg         sync.WaitGroup
+		doneChan       = make(chan struct{})
+		timeoutReached bool
+		storeSettled   bool
+		hasInvoice     bool
+		invoice        cachedInvoice
+		invoiceState   lnrpc.Invoice_InvoiceState
+	)
+
+	// If we already received the update of the invoice, there's no need to
+	// wait for anything.
+	l.invoicesMtx.Lock()
+	invoice, hasInvoice = l.invoiceStates[hash]
+	l.invoicesMtx.Unlock()
+
+	if hasInvoice && invoice.state == state {
+		return nil
+	}
+
+	// First of all, spawn a goroutine that will signal us on timeout.
+	// Otherwise if a client subscribes to an update on an invoice that
+	// never arrives, and there is no other activity, it would block
+	// forever in the condition.
+	condWg.Add(1)
+	go func() {
+		defer condWg.Done()
+
+		select {
+		case <-doneChan:
+		case <-time.After(timeout):
+		case <-l.quit:
+		}
+
+		l.invoicesCond.L.Lock()
+		timeoutReached = true
+		l.invoicesCond.Broadcast()
+		l.invoicesCond.L.Unlock()
+	}()
+
+	// Settlements are also looked up in the secret store until we're done.
+	// It knows the settlements of invoices that were evicted from our
+	// cache or that only another replica has seen.
+	if state == lnrpc.Invoice_SETTLED && l.secrets != nil &&
+		l.settlementPollInterval > 0 {
+
+		condWg.Add(1)
+		go func() {
+			defer condWg.Done()
+
+			for !l.settledInStore(hash) {
+				select {
+				case <-doneChan:
+					return
+
+				case <-time.After(l.settlementPollInterval):
+				}
+			}
+
+			l.invoicesCond.L.Lock()
+			storeSettled = true
+			l.invoicesCond.Broadcast()
+			l.invoicesCond.L.Unlock()
+		}()
+	}
+
+	// Now create the main goroutine that blocks until an update is received
+	// on the condition.
+	condWg.Add(1)
+	go func() {
+		defer condWg.Done()
+		l.invoicesCond.L.Lock()
+
+		// Block here until our condition is met or the allowed time is
+		// up. The Wait() will return whenever a signal is broadcast.
+		invoice, hasInvoice = l.invoiceStates[hash]
+		invoiceState = invoice.state
+		for !(hasInvoice && invoiceState == state) && !storeSettled &&
+			!timeoutReached {
+
+			l.invoicesCond.Wait()
+
+			// The Wait() above has re-acquired the lock so we can
+			// safely access the states map.
+			invoice, hasInvoice = l.invoiceStates[hash]
+			invoiceState = invoice.state
+		}
+
+		// We're now done.
+		l.invoicesCond.L.Unlock()
+		close(doneChan)
+	}()
+
+	// Wait until we're either done or timed out.
+	condWg.Wait()
+
+	// Interpret the result so we can return a more descriptive error than
+	// just "failed".
+	switch {
+	case storeSettled:
+		return nil
+
+	case !hasInvoice:
+		return fmt.Errorf("no active or settled invoice found for "+
+			"hash=%v", hash)
+
+	case invoiceState != state:
+		return fmt.Errorf("invoice status not correct before timeout, "+
+			"hash=%v, status=%v", hash, invoiceState)
+
+	default:
+		return nil
+	}
+}
+
+// settledInStore returns true if the settlement of the invoice with the given
+// payment hash is recorded in the secret store.
+func (l *LndChallenger) settledInStore(hash lntypes.Hash) bool {
+	if l.secrets == nil {
+		return false
+	}
+
+	settledAt, err := l.secrets.GetSettledAtByPaymentHash(
+		context.Background(), hash,
+	)
+	switch {
+	case errors.Is(err, mint.ErrSecretNotFound):
+		return false
+
+	case err != nil:
+		log.Warnf("Unable to look up settlement of hash(%v): %v", hash,
+			err)
+
+		return false
+	}
+
+	return settledAt.Valid
+}
+
+// VerifyRightsWithinExpiry checks that the rights for a given hash are still
+// valid and within the given expiry duration.
+func (l *LndChallenger) VerifyRightsWithinExpiry(paymentHash lntypes.Hash, duration time.Duration) error {
+	settledAt, err := l.secrets.GetSettledAtByPaymentHash(
+		context.Background(), paymentHash,
+	)
+	if err != nil {
+		return err
+	}
+	if !settledAt.Valid {
+		return fmt.Errorf("no settled time found for paymentHash(%v)", paymentHash)
+	}
+
+	expiryTime := settledAt.Time.Add(duration)
+	if expiryTime.Before(time.Now()) {
+		return fmt.Errorf("L402 right expired at %v", expiryTime)
+	}
+	return nil
+}
+
+// invoiceIrrelevant returns true if an invoice is nil, canceled or non-settled
+// and expired.
+func invoiceIrrelevant(invoice *lnrpc.Invoice) bool {
+	if invoice == nil || invoice.State == lnrpc.Invoice_CANCELED {
+		return true
+	}
+
+	expired := time.Now().After(invoiceExpiry(invoice))
+
+	notSettled := invoice.State == lnrpc.Invoice_OPEN ||
+		invoice.State == lnrpc.Invoice_ACCEPTED
+
+	return expired && notSettled
+}
+
+// invoiceExpiry returns the time the given invoice expires.
+func invoiceExpiry(invoice *lnrpc.Invoice) time.Time {
+	creation := time.Unix(invoice.CreationDate, 0)
+	return creation.Add(time.Duration(invoice.Expiry) * time.Second)
+}
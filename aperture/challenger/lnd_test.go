@@ -0,0 +1,708 @@
+package challenger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/mint"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// invoiceStreamMock is a mock invoice subscription that blocks until its
+// context is canceled or it is failed.
+type invoiceStreamMock struct {
+	grpc.ClientStream
+
+	ctx     context.Context
+	updates chan *lnrpc.Invoice
+	errs    chan error
+}
+
+func (i *invoiceStreamMock) Recv() (*lnrpc.Invoice, error) {
+	select {
+	case <-i.ctx.Done():
+		return nil, i.ctx.Err()
+
+	case invoice := <-i.updates:
+		return invoice, nil
+
+	case err := <-i.errs:
+		return nil, err
+	}
+}
+
+// mockInvoiceClient is an invoice client that records the invoices added and
+// the subscriptions made.
+type mockInvoiceClient struct {
+	added []*lnrpc.Invoice
+
+	// payReq is the payment request of the invoices added, a fixed
+	// direct pay request if empty.
+	payReq string
+
+	mtx           sync.Mutex
+	invoices      []*lnrpc.Invoice
+	listOffsets   []uint64
+	subscriptions []*lnrpc.InvoiceSubscription
+	streams       []*invoiceStreamMock
+	subscribeErr  error
+
+	// blockList and blockSubscribe make the calls block until their
+	// context is done, like a node that doesn't respond.
+	blockList      bool
+	blockSubscribe bool
+}
+
+// blocked blocks until the given context is done if block is set.
+func (m *mockInvoiceClient) blocked(ctx context.Context, block *bool) error {
+	m.mtx.Lock()
+	blocking := *block
+	m.mtx.Unlock()
+
+	if !blocking {
+		return nil
+	}
+
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (m *mockInvoiceClient) ListInvoices(ctx context.Context,
+	in *lnrpc.ListInvoiceRequest, _ ...grpc.CallOption) (
+	*lnrpc.ListInvoiceResponse, error) {
+
+	if err := m.blocked(ctx, &m.blockList); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// Like lnd, return a page of the invoices added after the offset.
+	m.listOffsets = append(m.listOffsets, in.IndexOffset)
+	resp := &lnrpc.ListInvoiceResponse{}
+	for _, invoice := range m.invoices {
+		if invoice.AddIndex <= in.IndexOffset {
+			continue
+		}
+		if uint64(len(resp.Invoices)) == in.NumMaxInvoices {
+			break
+		}
+
+		resp.Invoices = append(resp.Invoices, invoice)
+		resp.LastIndexOffset = invoice.AddIndex
+	}
+
+	return resp, nil
+}
+
+func (m *mockInvoiceClient) SubscribeInvoices(ctx context.Context,
+	in *lnrpc.InvoiceSubscription, _ ...grpc.CallOption) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	if err := m.blocked(ctx, &m.blockSubscribe); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.subscribeErr != nil {
+		return nil, m.subscribeErr
+	}
+
+	stream := &invoiceStreamMock{
+		ctx:     ctx,
+		updates: make(chan *lnrpc.Invoice),
+		errs:    make(chan error, 1),
+	}
+	m.subscriptions = append(m.subscriptions, in)
+	m.streams = append(m.streams, stream)
+
+	return stream, nil
+}
+
+// failStream fails the latest subscription with the given error.
+func (m *mockInvoiceClient) failStream(err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.streams[len(m.streams)-1].errs <- err
+}
+
+// sendUpdate sends the given invoice update on the latest subscription.
+func (m *mockInvoiceClient) sendUpdate(invoice *lnrpc.Invoice) {
+	m.mtx.Lock()
+	stream := m.streams[len(m.streams)-1]
+	m.mtx.Unlock()
+
+	stream.updates <- invoice
+}
+
+// numSubscriptions returns the number of subscriptions made.
+func (m *mockInvoiceClient) numSubscriptions() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return len(m.subscriptions)
+}
+
+func (m *mockInvoiceClient) AddInvoice(_ context.Context, in *lnrpc.Invoice,
+	_ ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+
+	m.added = append(m.added, in)
+	payReq := m.payReq
+	if payReq == "" {
+		payReq = "lnbc1direct"
+	}
+
+	return &lnrpc.AddInvoiceResponse{
+		RHash:          testPaymentHash[:],
+		PaymentRequest: payReq,
+	}, nil
+}
+
+// newTestLndChallenger creates an lnd challenger backed by a mock client.
+func newTestLndChallenger(t *testing.T) (*LndChallenger,
+	*mockInvoiceClient) {
+
+	client := &mockInvoiceClient{}
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+	}
+
+	c, err := NewLndChallenger(
+		client, genInvoiceReq, nil, context.Background, nil,
+	)
+	require.NoError(t, err)
+	t.Cleanup(c.Stop)
+
+	return c, client
+}
+
+// TestLndChallengerDirectPay makes sure the lnd challenger creates invoices on
+// the operator's node for direct pay services only.
+func TestLndChallengerDirectPay(t *testing.T) {
+	c, client := newTestLndChallenger(t)
+
+	payReq, hash, err := c.NewChallenge(lsat.Service{
+		Name:      "house",
+		Price:     100,
+		DirectPay: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "lnbc1direct", payReq)
+	require.Equal(t, testPaymentHash, hash)
+	require.Len(t, client.added, 1)
+	require.EqualValues(t, 100, client.added[0].Value)
+
+	_, _, err = c.NewChallenge(lsat.Service{
+		Name:           "creator",
+		RecipientLud16: "creator@example.com",
+		Price:          100,
+	})
+	require.ErrorIs(t, err, ErrCreatorPaidService)
+	require.Len(t, client.added, 1)
+}
+
+// TestLnproxyChallengerRouting makes sure the lnproxy challenger hands direct
+// pay services to the lnd challenger and rejects creator paid services
+// without a recipient.
+func TestLnproxyChallengerRouting(t *testing.T) {
+	lndChallenger, client := newTestLndChallenger(t)
+	settings, err := newLnproxySettings(&LnproxyConfig{
+		URL: "http://relay",
+	})
+	require.NoError(t, err)
+
+	l := &LnproxyChallenger{
+		LndChallenger: lndChallenger,
+		settings:      settings,
+	}
+
+	payReq, _, err := l.NewChallenge(lsat.Service{
+		Name:      "house",
+		Price:     100,
+		DirectPay: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "lnbc1direct", payReq)
+	require.Len(t, client.added, 1)
+
+	_, _, err = l.NewChallenge(lsat.Service{
+		Name:  "creator",
+		Price: 100,
+	})
+	require.ErrorIs(t, err, ErrNoRecipient)
+	require.Len(t, client.added, 1)
+}
+
+// mockSettledStore is a secret store that records the settled payment hashes.
+type mockSettledStore struct {
+	mint.SecretStore
+
+	mtx     sync.Mutex
+	settled map[lntypes.Hash]time.Time
+
+	// setErr is returned when a settlement is recorded, if set.
+	setErr error
+}
+
+func (m *mockSettledStore) SetSettledAtByPaymentHash(_ context.Context,
+	hash [32]byte, settledAt mint.NullTime) error {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.setErr != nil {
+		return m.setErr
+	}
+
+	m.settled[hash] = settledAt.Time
+	return nil
+}
+
+func (m *mockSettledStore) GetSettledAtByPaymentHash(_ context.Context,
+	hash [32]byte) (mint.NullTime, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	settledAt, ok := m.settled[hash]
+	if !ok {
+		return mint.NullTime{}, mint.ErrSecretNotFound
+	}
+
+	return mint.NullTime{Time: settledAt, Valid: true}, nil
+}
+
+// mockIndexStore is an invoice index store that keeps the indices in memory.
+type mockIndexStore struct {
+	addIndex    uint64
+	settleIndex uint64
+}
+
+func (m *mockIndexStore) InvoiceIndices(context.Context) (uint64, uint64,
+	error) {
+
+	return m.addIndex, m.settleIndex, nil
+}
+
+func (m *mockIndexStore) SetInvoiceIndices(_ context.Context, addIndex,
+	settleIndex uint64) error {
+
+	m.addIndex, m.settleIndex = addIndex, settleIndex
+	return nil
+}
+
+// TestLndChallengerResubscribe makes sure the challenger subscribes to the
+// invoice updates again after the subscription failed, reconciles the
+// settlements it missed and only gives up once the outage budget is used up.
+func TestLndChallengerResubscribe(t *testing.T) {
+	openHash := lntypes.Hash{1}
+	settledHash := lntypes.Hash{2}
+	now := time.Now()
+	client := &mockInvoiceClient{
+		invoices: []*lnrpc.Invoice{{
+			RHash:        openHash[:],
+			State:        lnrpc.Invoice_OPEN,
+			AddIndex:     1,
+			CreationDate: now.Unix(),
+			Expiry:       3600,
+		}, {
+			RHash:        settledHash[:],
+			State:        lnrpc.Invoice_SETTLED,
+			AddIndex:     2,
+			SettleIndex:  1,
+			CreationDate: now.Unix(),
+			Expiry:       3600,
+		}},
+	}
+	store := &mockSettledStore{settled: make(map[lntypes.Hash]time.Time)}
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+	}
+	errChan := make(chan error, 1)
+
+	c, err := NewLndChallenger(
+		client, genInvoiceReq, store, context.Background, errChan,
+		WithResubscribeDelay(time.Millisecond),
+		WithOutageBudget(time.Second),
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	// The first subscription resumes after the latest invoices on startup.
+	// Settled invoices known on startup are not reconciled.
+	require.Equal(t, 1, client.numSubscriptions())
+	require.EqualValues(t, 2, client.subscriptions[0].AddIndex)
+	require.EqualValues(t, 1, client.subscriptions[0].SettleIndex)
+	require.Empty(t, store.settled)
+
+	// The open invoice is settled while lnd restarts.
+	client.mtx.Lock()
+	client.invoices[0] = &lnrpc.Invoice{
+		RHash:        openHash[:],
+		State:        lnrpc.Invoice_SETTLED,
+		AddIndex:     1,
+		SettleIndex:  2,
+		SettleDate:   now.Unix(),
+		CreationDate: now.Unix(),
+		Expiry:       3600,
+	}
+	client.mtx.Unlock()
+	client.failStream(io.EOF)
+
+	require.Eventually(t, func() bool {
+		return client.numSubscriptions() == 2
+	}, time.Second, time.Millisecond)
+
+	// We subscribed again after the missed settlement, which was
+	// reconciled.
+	client.mtx.Lock()
+	require.EqualValues(t, 2, client.subscriptions[1].AddIndex)
+	require.EqualValues(t, 2, client.subscriptions[1].SettleIndex)
+	client.mtx.Unlock()
+
+	store.mtx.Lock()
+	require.Equal(t, map[lntypes.Hash]time.Time{
+		openHash: time.Unix(now.Unix(), 0),
+	}, store.settled)
+	store.mtx.Unlock()
+
+	err = c.VerifyInvoiceStatus(
+		openHash, lnrpc.Invoice_SETTLED, time.Second,
+	)
+	require.NoError(t, err)
+
+	// If lnd stays unreachable, the error is signaled once the outage
+	// budget is used up.
+	unavailable := errors.New("lnd unavailable")
+	client.mtx.Lock()
+	client.subscribeErr = unavailable
+	client.mtx.Unlock()
+	client.failStream(unavailable)
+
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, unavailable)
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("outage not signaled")
+	}
+	require.Equal(t, 2, client.numSubscriptions())
+}
+
+// TestLndChallengerResubscribeBlocked makes sure a node that doesn't respond
+// while we subscribe again can't hold us past the outage budget or keep us
+// from shutting down.
+func TestLndChallengerResubscribeBlocked(t *testing.T) {
+	const budget = 200 * time.Millisecond
+
+	tests := []struct {
+		name           string
+		blockList      bool
+		blockSubscribe bool
+	}{{
+		name:      "listing invoices blocks",
+		blockList: true,
+	}, {
+		name:           "subscribing blocks",
+		blockSubscribe: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockInvoiceClient{}
+			genInvoiceReq := func(price int64) (*lnrpc.Invoice,
+				error) {
+
+				return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+			}
+			errChan := make(chan error, 1)
+
+			c, err := NewLndChallenger(
+				client, genInvoiceReq, nil, context.Background,
+				errChan, WithResubscribeDelay(time.Millisecond),
+				WithOutageBudget(budget),
+			)
+			require.NoError(t, err)
+			defer c.Stop()
+
+			client.mtx.Lock()
+			client.blockList = tc.blockList
+			client.blockSubscribe = tc.blockSubscribe
+			client.mtx.Unlock()
+
+			outageStart := time.Now()
+			client.failStream(io.EOF)
+
+			select {
+			case err := <-errChan:
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+				require.Less(
+					t, time.Since(outageStart), budget*5,
+				)
+
+			case <-time.After(5 * time.Second):
+				t.Fatalf("outage not signaled")
+			}
+			require.Equal(t, 1, client.numSubscriptions())
+		})
+	}
+
+	// A blocked attempt doesn't hold up the shutdown, even with budget
+	// left.
+	t.Run("stop", func(t *testing.T) {
+		client := &mockInvoiceClient{}
+		genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+			return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+		}
+
+		c, err := NewLndChallenger(
+			client, genInvoiceReq, nil, context.Background, nil,
+			WithResubscribeDelay(time.Millisecond),
+			WithOutageBudget(time.Hour),
+		)
+		require.NoError(t, err)
+
+		client.mtx.Lock()
+		client.blockList = true
+		client.mtx.Unlock()
+		client.failStream(io.EOF)
+
+		// Give the challenger time to start the attempt.
+		time.Sleep(50 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			c.Stop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("stop blocked by the resubscription")
+		}
+	})
+}
+
+// TestLndChallengerInvoiceCache makes sure the challenger pages through the
+// invoices added after the persisted indices, only caches open and recently
+// settled invoices and looks up older settlements in the secret store.
+func TestLndChallengerInvoiceCache(t *testing.T) {
+	now := time.Now()
+	oldHash := lntypes.Hash{1}
+	expiredHash := lntypes.Hash{2}
+	settledHash := lntypes.Hash{3}
+	openHash := lntypes.Hash{4}
+	canceledHash := lntypes.Hash{5}
+	client := &mockInvoiceClient{
+		invoices: []*lnrpc.Invoice{{
+			RHash:        oldHash[:],
+			State:        lnrpc.Invoice_SETTLED,
+			AddIndex:     1,
+			SettleIndex:  1,
+			SettleDate:   now.Add(-48 * time.Hour).Unix(),
+			CreationDate: now.Add(-48 * time.Hour).Unix(),
+			Expiry:       3600,
+		}, {
+			RHash:        expiredHash[:],
+			State:        lnrpc.Invoice_OPEN,
+			AddIndex:     2,
+			CreationDate: now.Add(-2 * time.Hour).Unix(),
+			Expiry:       3600,
+		}, {
+			RHash:        settledHash[:],
+			State:        lnrpc.Invoice_SETTLED,
+			AddIndex:     3,
+			SettleIndex:  2,
+			SettleDate:   now.Add(-time.Hour).Unix(),
+			CreationDate: now.Add(-time.Hour).Unix(),
+			Expiry:       3600,
+		}, {
+			RHash:        openHash[:],
+			State:        lnrpc.Invoice_OPEN,
+			AddIndex:     4,
+			CreationDate: now.Unix(),
+			Expiry:       3600,
+		}, {
+			RHash:        canceledHash[:],
+			State:        lnrpc.Invoice_CANCELED,
+			AddIndex:     5,
+			CreationDate: now.Unix(),
+			Expiry:       3600,
+		}},
+	}
+	store := &mockSettledStore{settled: map[lntypes.Hash]time.Time{
+		oldHash: now.Add(-48 * time.Hour),
+	}}
+	indexStore := &mockIndexStore{addIndex: 1, settleIndex: 1}
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+	}
+
+	c, err := NewLndChallenger(
+		client, genInvoiceReq, store, context.Background, nil,
+		WithInvoiceIndexStore(indexStore), WithInvoicePageSize(2),
+	)
+	require.NoError(t, err)
+
+	// We paged through the invoices added after the persisted add index.
+	// As we didn't see all invoices, the settle index isn't advanced, so
+	// lnd replays the settlements we might have missed.
+	require.Equal(t, []uint64{1, 3, 5}, client.listOffsets)
+	require.EqualValues(t, 5, client.subscriptions[0].AddIndex)
+	require.EqualValues(t, 1, client.subscriptions[0].SettleIndex)
+
+	// Only the open and the recently settled invoice are cached.
+	c.invoicesMtx.Lock()
+	require.Len(t, c.invoiceStates, 2)
+	require.Contains(t, c.invoiceStates, settledHash)
+	require.Contains(t, c.invoiceStates, openHash)
+	c.invoicesMtx.Unlock()
+
+	// The old settlement is found in the secret store, unknown invoices
+	// still aren't valid.
+	err = c.VerifyInvoiceStatus(oldHash, lnrpc.Invoice_SETTLED, time.Second)
+	require.NoError(t, err)
+	err = c.VerifyInvoiceStatus(
+		canceledHash, lnrpc.Invoice_SETTLED, time.Millisecond,
+	)
+	require.Error(t, err)
+
+	// The open invoice is evicted once it expired, the settled one once
+	// the settled invoice age is over.
+	c.evictInvoices(now.Add(2 * time.Hour))
+	c.invoicesMtx.Lock()
+	require.Len(t, c.invoiceStates, 1)
+	require.Contains(t, c.invoiceStates, settledHash)
+	c.invoicesMtx.Unlock()
+
+	c.evictInvoices(now.Add(DefaultSettledInvoiceAge))
+	c.invoicesMtx.Lock()
+	require.Empty(t, c.invoiceStates)
+	c.invoicesMtx.Unlock()
+
+	// The latest indices are persisted on shutdown.
+	c.Stop()
+	require.EqualValues(t, 5, indexStore.addIndex)
+	require.EqualValues(t, 1, indexStore.settleIndex)
+}
+
+// TestLndChallengerSharedSettlement makes sure a settlement recorded in the
+// secret store by another replica is accepted while we wait for it, even if
+// we never receive an update of the invoice from lnd.
+func TestLndChallengerSharedSettlement(t *testing.T) {
+	client := &mockInvoiceClient{}
+	store := &mockSettledStore{settled: make(map[lntypes.Hash]time.Time)}
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+	}
+
+	c, err := NewLndChallenger(
+		client, genInvoiceReq, store, context.Background, nil,
+		WithSettlementPollInterval(time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	// Without any settlement, we time out.
+	hash := lntypes.Hash{1}
+	err = c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, 10*time.Millisecond,
+	)
+	require.Error(t, err)
+
+	// Another replica records the settlement while we wait for it.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		err := store.SetSettledAtByPaymentHash(
+			context.Background(), hash, mint.NullTime{
+				Time:  time.Now(),
+				Valid: true,
+			},
+		)
+		require.NoError(t, err)
+	}()
+
+	err = c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, 5*time.Second,
+	)
+	require.NoError(t, err)
+
+	// The store is only consulted for settlements.
+	err = c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_OPEN, 10*time.Millisecond,
+	)
+	require.Error(t, err)
+}
+
+// TestLndChallengerSettlementRetry makes sure a settlement that can't be
+// recorded in the secret store is retried and that the persisted settle index
+// isn't advanced past it until it is recorded.
+func TestLndChallengerSettlementRetry(t *testing.T) {
+	hash := lntypes.Hash{1}
+	now := time.Now()
+	client := &mockInvoiceClient{}
+	store := &mockSettledStore{
+		settled: make(map[lntypes.Hash]time.Time),
+		setErr:  errors.New("database unavailable"),
+	}
+	indexStore := &mockIndexStore{addIndex: 1, settleIndex: 1}
+	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{Memo: "L402", Value: price}, nil
+	}
+
+	c, err := NewLndChallenger(
+		client, genInvoiceReq, store, context.Background, nil,
+		WithInvoiceIndexStore(indexStore),
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	client.sendUpdate(&lnrpc.Invoice{
+		RHash:        hash[:],
+		State:        lnrpc.Invoice_SETTLED,
+		AddIndex:     2,
+		SettleIndex:  2,
+		SettleDate:   now.Unix(),
+		CreationDate: now.Unix(),
+		Expiry:       3600,
+	})
+
+	// The settlement is still known from the cache, but the settle index
+	// is held back before it.
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, time.Second)
+	require.NoError(t, err)
+
+	c.persistIndices()
+	require.EqualValues(t, 2, indexStore.addIndex)
+	require.EqualValues(t, 1, indexStore.settleIndex)
+
+	// Once the store is available again, the settlement is recorded and
+	// the settle index advanced.
+	store.mtx.Lock()
+	store.setErr = nil
+	store.mtx.Unlock()
+
+	c.recordSettlements()
+	c.persistIndices()
+	require.EqualValues(t, 2, indexStore.settleIndex)
+
+	store.mtx.Lock()
+	require.Equal(t, map[lntypes.Hash]time.Time{
+		hash: time.Unix(now.Unix(), 0),
+	}, store.settled)
+	store.mtx.Unlock()
+}
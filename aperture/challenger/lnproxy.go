@@ -3,46 +3,40 @@ package challenger
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"net/url"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/caarlos0/env/v6"
-	"github.com/joho/godotenv"
-	"github.com/lightningnetwork/lnd/channeldb/migration_01_to_11/zpay32"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
 	"github.com/motxx/aperture-lnproxy/aperture/lnurl"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/mint"
 )
 
 // LnproxyChallenger is a challenger that uses an lnproxy backend to create new L402
-// payment challenges.
+// payment challenges. Services that are paid to the operator directly are
+// handed to the embedded lnd challenger, which also keeps track of the
+// invoice states.
 type LnproxyChallenger struct {
-	client        InvoiceClient
-	clientCtx     func() context.Context
-	genInvoiceReq InvoiceRequestGenerator
+	*LndChallenger
 
-	invoiceStates  map[lntypes.Hash]lnrpc.Invoice_InvoiceState
-	invoicesMtx    *sync.Mutex
-	invoicesCancel func()
-	invoicesCond   *sync.Cond
-
-	secrets mint.SecretStore
-
-	errChan chan<- error
-
-	quit chan struct{}
-	wg   sync.WaitGroup
+	// settings is derived from the lnproxy configuration and can be
+	// swapped at runtime by UpdateConfig.
+	settings    *lnproxySettings
+	settingsMtx sync.RWMutex
 }
 
 // A compile time flag to ensure the LnproxyChallenger satisfies the Challenger
@@ -54,223 +48,147 @@ var _ Challenger = (*LnproxyChallenger)(nil)
 func NewLnproxyChallenger(client InvoiceClient,
 	genInvoiceReq InvoiceRequestGenerator,
 	store mint.SecretStore,
+	lnproxyCfg *LnproxyConfig,
 	ctxFunc func() context.Context,
-	errChan chan<- error) (*LnproxyChallenger, error) {
+	errChan chan<- error,
+	opts ...LndChallengerOption) (*LnproxyChallenger, error) {
 
-	// Make sure we have a valid context function. This will be called to
-	// create a new context for each call to the lnd client.
-	if ctxFunc == nil {
-		ctxFunc = context.Background
+	if lnproxyCfg == nil {
+		return nil, ErrNoRelays
 	}
-
-	if genInvoiceReq == nil {
-		return nil, fmt.Errorf("genInvoiceReq cannot be nil")
+	settings, err := newLnproxySettings(lnproxyCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	invoicesMtx := &sync.Mutex{}
-	challenger := &LnproxyChallenger{
-		client:        client,
-		clientCtx:     ctxFunc,
-		genInvoiceReq: genInvoiceReq,
-		invoiceStates: make(map[lntypes.Hash]lnrpc.Invoice_InvoiceState),
-		invoicesMtx:   invoicesMtx,
-		invoicesCond:  sync.NewCond(invoicesMtx),
-		secrets:       store,
-		quit:          make(chan struct{}),
-		errChan:       errChan,
+	// Wrapped invoices must be payable to the operator's node, look up
+	// its key if it isn't configured.
+	if settings.nodeKey == nil {
+		settings.nodeKey, err = lookupNodeKey(
+			ctxFunc(), client, settings.net,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up operator "+
+				"node pubkey, set lnproxy.nodepubkey: %w", err)
+		}
 	}
+	log.Infof("Accepting wrapped invoices payable to %x",
+		settings.nodeKey.SerializeCompressed())
 
-	err := challenger.Start()
+	lndChallenger, err := NewLndChallenger(
+		client, genInvoiceReq, store, ctxFunc, errChan, opts...,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to start challenger: %w", err)
+		return nil, err
 	}
+	settings.relays.Start()
 
-	return challenger, nil
+	return &LnproxyChallenger{
+		LndChallenger: lndChallenger,
+		settings:      settings,
+	}, nil
 }
 
-// Start starts the challenger's main work which is to keep track of all
-// invoices and their states. For that the backing lnd node is queried for all
-// invoices on startup and the a subscription to all subsequent invoice updates
-// is created.
-func (l *LnproxyChallenger) Start() error {
-	// These are the default values for the subscription. In case there are
-	// no invoices yet, this will instruct lnd to just send us all updates.
-	// If there are existing invoices, these indices will be updated to
-	// reflect the latest known invoices.
-	addIndex := uint64(0)
-	settleIndex := uint64(0)
-
-	// Get a list of all existing invoices on startup and add them to our
-	// cache. We need to keep track of all invoices, even quite old ones to
-	// make sure tokens are valid. But to save space we only keep track of
-	// an invoice's state.
-	ctx := l.clientCtx()
-	invoiceResp, err := l.client.ListInvoices(
-		ctx, &lnrpc.ListInvoiceRequest{
-			NumMaxInvoices: math.MaxUint64,
-		},
-	)
-	if err != nil {
-		return err
+// lnproxySettings is everything the challenger derives from its lnproxy
+// configuration.
+type lnproxySettings struct {
+	relays      *RelayPool
+	operatorFee *fee.Policy
+	net         *chaincfg.Params
+
+	// nodeKey is the key of the operator's node, the only payee a wrapped
+	// invoice may have.
+	nodeKey *btcec.PublicKey
+
+	// lnurlClient is the HTTP client used to fetch creator invoices.
+	lnurlClient *http.Client
+}
+
+// newLnproxySettings validates the given configuration and creates the
+// settings from it. The relay pool is not started yet.
+func newLnproxySettings(cfg *LnproxyConfig) (*lnproxySettings, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	// Advance our indices to the latest known one so we'll only receive
-	// updates for new invoices and/or newly settled invoices.
-	l.invoicesMtx.Lock()
-	for _, invoice := range invoiceResp.Invoices {
-		// Some invoices like AMP invoices may not have a payment hash
-		// populated.
-		if invoice.RHash == nil {
-			continue
-		}
+	net, err := cfg.chainParams()
+	if err != nil {
+		return nil, err
+	}
 
-		if invoice.AddIndex > addIndex {
-			addIndex = invoice.AddIndex
-		}
-		if invoice.SettleIndex > settleIndex {
-			settleIndex = invoice.SettleIndex
-		}
-		hash, err := lntypes.MakeHash(invoice.RHash)
-		if err != nil {
-			l.invoicesMtx.Unlock()
-			return fmt.Errorf("error parsing invoice hash: %v", err)
-		}
+	nodeKey, err := cfg.nodeKey()
+	if err != nil {
+		return nil, err
+	}
 
-		// Don't track the state of canceled or expired invoices.
-		if invoiceIrrelevant(invoice) {
-			continue
-		}
-		l.invoiceStates[hash] = invoice.State
+	transport, err := cfg.newTransport()
+	if err != nil {
+		return nil, err
 	}
-	l.invoicesMtx.Unlock()
 
-	// We need to be able to cancel any subscription we make.
-	ctxc, cancel := context.WithCancel(l.clientCtx())
-	l.invoicesCancel = cancel
+	relays, err := NewRelayPool(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create lnproxy relay pool: "+
+			"%w", err)
+	}
 
-	subscriptionResp, err := l.client.SubscribeInvoices(
-		ctxc, &lnrpc.InvoiceSubscription{
-			AddIndex:    addIndex,
-			SettleIndex: settleIndex,
+	return &lnproxySettings{
+		relays:      relays,
+		operatorFee: fee.Resolve(cfg.OperatorFee),
+		net:         net,
+		nodeKey:     nodeKey,
+		lnurlClient: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.timeout(),
 		},
-	)
+	}, nil
+}
+
+// UpdateConfig applies a new lnproxy configuration without restarting the
+// challenger. Challenges that are in flight finish with the old settings. If
+// the configuration is invalid, the current settings are kept.
+func (l *LnproxyChallenger) UpdateConfig(cfg *LnproxyConfig) error {
+	settings, err := newLnproxySettings(cfg)
 	if err != nil {
-		cancel()
 		return err
 	}
 
-	l.wg.Add(1)
-	go func() {
-		defer l.wg.Done()
-		defer cancel()
+	// The node key looked up on startup is kept unless a new one is
+	// configured.
+	if settings.nodeKey == nil {
+		settings.nodeKey = l.currentSettings().nodeKey
+	}
+	settings.relays.Start()
+
+	l.settingsMtx.Lock()
+	old := l.settings
+	l.settings = settings
+	l.settingsMtx.Unlock()
 
-		l.readInvoiceStream(subscriptionResp)
-	}()
+	old.relays.Stop()
+	log.Infof("Lnproxy configuration updated, using %d relay(s)",
+		len(settings.relays.relays))
 
 	return nil
 }
 
-// readInvoiceStream reads the invoice update messages sent on the stream until
-// the stream is aborted or the challenger is shutting down.
-func (l *LnproxyChallenger) readInvoiceStream(
-	stream lnrpc.Lightning_SubscribeInvoicesClient) {
-
-	for {
-		// In case we receive the shutdown signal right after receiving
-		// an update, we can exit early.
-		select {
-		case <-l.quit:
-			return
-		default:
-		}
-
-		// Wait for an update to arrive. This will block until either a
-		// message receives, an error occurs or the underlying context
-		// is canceled (which will also result in an error).
-		invoice, err := stream.Recv()
-		switch {
-
-		case err == io.EOF:
-			// The connection is shutting down, we can't continue
-			// to function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
-
-			return
-
-		case err != nil && strings.Contains(
-			err.Error(), context.Canceled.Error(),
-		):
-
-			// The context has been canceled, we are shutting down.
-			// So no need to forward the error to the main
-			// goroutine.
-			return
-
-		case err != nil:
-			log.Errorf("Received error from invoice subscription: "+
-				"%v", err)
-
-			// The connection is faulty, we can't continue to
-			// function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
-
-			return
-
-		default:
-		}
-
-		// Some invoices like AMP invoices may not have a payment hash
-		// populated.
-		if invoice.RHash == nil {
-			continue
-		}
-
-		paymentHash, err := lntypes.MakeHash(invoice.RHash)
-		if err != nil {
-			log.Errorf("Error parsing invoice hash: %v", err)
-			return
-		}
+// currentSettings returns the settings that are currently in use.
+func (l *LnproxyChallenger) currentSettings() *lnproxySettings {
+	l.settingsMtx.RLock()
+	defer l.settingsMtx.RUnlock()
 
-		l.invoicesMtx.Lock()
-		if invoiceIrrelevant(invoice) {
-			// Don't keep the state of canceled or expired invoices.
-			delete(l.invoiceStates, paymentHash)
-		} else {
-			l.invoiceStates[paymentHash] = invoice.State
-			if invoice.State == lnrpc.Invoice_SETTLED {
-				err := l.secrets.SetSettledAtByPaymentHash(context.Background(), paymentHash, sql.NullTime{Time: time.Unix(invoice.SettleDate, 0), Valid: true})
-				if err != nil {
-					log.Criticalf("Error setting settled time for hash(%v): %v", paymentHash, err)
-				}
-			}
-		}
+	return l.settings
+}
 
-		// Before releasing the lock, notify our conditions that listen
-		// for updates on the invoice state.
-		l.invoicesCond.Broadcast()
-		l.invoicesMtx.Unlock()
-	}
+// RelayStatus returns a snapshot of the health of the relays currently in use.
+func (l *LnproxyChallenger) RelayStatus() []RelayStatus {
+	return l.currentSettings().relays.Status()
 }
 
 // Stop shuts down the challenger.
 func (l *LnproxyChallenger) Stop() {
-	l.invoicesCancel()
-	close(l.quit)
-	l.wg.Wait()
-}
-
-type ApertureConfig struct {
-	LnproxyUrl string `env:"LNPROXY_URL"`
+	l.currentSettings().relays.Stop()
+	l.LndChallenger.Stop()
 }
 
 type ProxyParameters struct {
@@ -280,14 +198,8 @@ type ProxyParameters struct {
 	DescriptionHash *string `json:"description_hash"`
 }
 
-func getRoutingMsat(amount_sats int64) *uint64 {
-	routingMsat := uint64(amount_sats * 3 / 100)
-	if routingMsat < 10_000 {
-		minFeeSat := uint64(10_000)
-		return &minFeeSat
-	}
-	return &routingMsat
-}
+// maxRelayResponseSize is the maximum size of a relay response that is read.
+const maxRelayResponseSize = 64 * 1024
 
 type LnproxySpecErrorResponse struct {
 	Status string `json:"status"`
@@ -299,26 +211,85 @@ type LnproxySpecSuccessResponse struct {
 }
 
 // NewChallenge creates a new L402 payment challenge, returning a payment
-// request (invoice) and the corresponding payment hash.
-// The price is given in satoshis.
+// request (invoice) and the corresponding payment hash. The creator invoice
+// for the service price is wrapped by an lnproxy relay, unless the service is
+// paid to the operator directly.
 //
 // NOTE: This is part of the mint.Challenger interface.
-func (l *LnproxyChallenger) NewChallenge(recipientLud16 string, price int64) (string, lntypes.Hash,
-	error) {
+func (l *LnproxyChallenger) NewChallenge(service lsat.Service) (string,
+	lntypes.Hash, error) {
 
-	if err := godotenv.Load(); err != nil {
-		panic(err)
+	if service.DirectPay {
+		return l.LndChallenger.NewChallenge(service)
 	}
+	if service.RecipientLud16 == "" {
+		return "", lntypes.ZeroHash, fmt.Errorf("%w: %v",
+			ErrNoRecipient, service.Name)
+	}
+
+	settings := l.currentSettings()
+	recipientLud16, price := service.RecipientLud16, service.Price
 
-	creatorInvoice, err := getCreatorInvoice(recipientLud16, price)
+	// A creator invoice for the wrong network or amount is not the fault
+	// of any relay, so it is rejected before a relay is asked to wrap it.
+	creatorAmt := lnwire.NewMSatFromSatoshis(btcutil.Amount(price))
+	creatorInvoice, creator, err := getCreatorInvoice(
+		settings.lnurlClient, recipientLud16, creatorAmt, settings.net,
+	)
 	if err != nil {
-		return "", lntypes.ZeroHash, fmt.Errorf("error getting creator invoice: %v", err)
+		return "", lntypes.ZeroHash, fmt.Errorf("error getting creator invoice: %w", err)
+	}
+
+	// The routing fee offered to the relay is the operator's commission,
+	// computed in msat from the most specific policy that is set.
+	policy := fee.Resolve(service.OperatorFee, settings.operatorFee)
+	routingFee := uint64(policy.Fee(creatorAmt))
+	routingMsat := &routingFee
+	log.Infof("Price split for %v: creator %v, operator fee %v (%v)",
+		recipientLud16, creatorAmt, lnwire.MilliSatoshi(routingFee),
+		policy)
+
+	candidates := settings.relays.candidates(
+		uint64(creatorAmt), *routingMsat,
+	)
+	if len(candidates) == 0 {
+		return "", lntypes.ZeroHash, fmt.Errorf("%w: no relay accepts "+
+			"a routing fee of %d msat", ErrAllRelaysFailed,
+			*routingMsat)
+	}
+
+	// Try the relays in order until one of them returns a wrapped invoice
+	// we can verify.
+	var relayErrs []error
+	for _, r := range candidates {
+		wrappedInvoice, paymentHash, err := settings.wrapInvoice(
+			r, creatorInvoice, creator, routingMsat,
+		)
+		settings.relays.markResult(r, err)
+		if err != nil {
+			log.Warnf("Lnproxy relay %v failed: %v", r.url, err)
+			relayErrs = append(relayErrs, fmt.Errorf("%v: %w",
+				r.url, err))
+			continue
+		}
+
+		log.Info("Payment hash: ", paymentHash)
+		recordPriceSplit(creatorAmt, lnwire.MilliSatoshi(routingFee))
+
+		return wrappedInvoice, paymentHash, nil
 	}
 
-	routingMsat := getRoutingMsat(price)
-	log.Infof("Price: %d, RoutingMsat: %d", price, *routingMsat)
+	return "", lntypes.ZeroHash, fmt.Errorf("%w: %v", ErrAllRelaysFailed,
+		errors.Join(relayErrs...))
+}
+
+// wrapInvoice requests a wrapped invoice for the creator invoice from the given
+// relay and verifies it.
+func (s *lnproxySettings) wrapInvoice(r *poolRelay, creatorInvoice string,
+	creator *zpay32.Invoice, routingMsat *uint64) (string, lntypes.Hash,
+	error) {
 
-	wrappedInvoice, err := requestWrappedInvoice(ProxyParameters{
+	wrappedInvoice, err := requestWrappedInvoice(r.client, r.url, ProxyParameters{
 		Invoice:     creatorInvoice,
 		RoutingMsat: routingMsat,
 	})
@@ -326,200 +297,128 @@ func (l *LnproxyChallenger) NewChallenge(recipientLud16 string, price int64) (st
 		return "", lntypes.ZeroHash, fmt.Errorf("error requesting wrapped invoice: %v", err)
 	}
 
-	paymentHash, err := extractPaymentHash(wrappedInvoice)
+	// Never hand out a wrapped invoice we haven't verified to pay the
+	// creator, a malicious relay could otherwise swap the payment hash.
+	paymentHash, err := validateWrappedInvoice(
+		creator, wrappedInvoice, lnwire.MilliSatoshi(*routingMsat),
+		s.nodeKey, s.net, time.Now(),
+	)
 	if err != nil {
-		return "", lntypes.ZeroHash, fmt.Errorf("error extracting payment hash: %v", err)
+		return "", lntypes.ZeroHash, fmt.Errorf("error validating "+
+			"wrapped invoice: %w", err)
 	}
-	log.Info("Payment hash: ", paymentHash)
 
 	return wrappedInvoice, paymentHash, nil
 }
 
-func getCreatorInvoice(lud16 string, price int64) (string, error) {
-	lu, err := lnurl.NewLnurl(lud16)
+// lookupNodeKey looks up the public key of the given lnd node from the payment
+// request of its latest invoice. If the node has no invoice yet, a zero amount
+// invoice that expires right away is added to obtain one. Unlike GetInfo, this
+// works with the invoice macaroon.
+func lookupNodeKey(ctx context.Context, client InvoiceClient,
+	net *chaincfg.Params) (*btcec.PublicKey, error) {
+
+	invoices, err := client.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+		NumMaxInvoices: 1,
+		Reversed:       true,
+	})
 	if err != nil {
-		return "", fmt.Errorf("error creating lnurl: %v", err)
+		return nil, err
 	}
 
-	invoice, err := lu.GetInvoice(price)
-	if err != nil {
-		return "", fmt.Errorf("error getting creator invoice: %v", err)
+	var payReq string
+	if len(invoices.Invoices) > 0 {
+		payReq = invoices.Invoices[0].PaymentRequest
+	}
+	if payReq == "" {
+		resp, err := client.AddInvoice(ctx, &lnrpc.Invoice{
+			Memo:   "aperture node key lookup",
+			Expiry: 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		payReq = resp.PaymentRequest
 	}
-	return invoice, nil
-}
 
-func requestWrappedInvoice(p ProxyParameters) (string, error) {
-	b, err := json.Marshal(p)
+	invoice, err := zpay32.Decode(payReq, net)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal spec parameter: %v", p)
+		return nil, fmt.Errorf("unable to decode invoice of lnd: %w",
+			err)
 	}
 
-	var conf ApertureConfig
-	if err := env.Parse(&conf); err != nil {
-		panic(err)
-	}
+	return invoice.Destination, nil
+}
 
-	u, err := url.Parse(conf.LnproxyUrl)
+// getCreatorInvoice fetches an invoice for the given amount from the creator's
+// LNURL server and makes sure it is valid on the given network.
+func getCreatorInvoice(client *http.Client, lud16 string,
+	amt lnwire.MilliSatoshi, net *chaincfg.Params) (string,
+	*zpay32.Invoice, error) {
+
+	lu, err := lnurl.NewLnurl(lud16)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse lnproxy url: %v", err)
+		return "", nil, fmt.Errorf("error creating lnurl: %v", err)
 	}
-	u.Path = path.Join(u.Path, "spec")
-	res, err := http.Post(u.String(), "application/json", bytes.NewReader(b))
+	lu.Client = client
+
+	invoice, err := lu.GetInvoice(int64(amt.ToSatoshis()))
 	if err != nil {
-		return "", err
+		return "", nil, fmt.Errorf("error getting creator invoice: %v", err)
 	}
-	defer res.Body.Close()
 
-	var rawJSON json.RawMessage
-	err = json.NewDecoder(res.Body).Decode(&rawJSON)
+	decoded, err := validateCreatorInvoice(invoice, amt, net)
 	if err != nil {
-		return "", fmt.Errorf("error unmarshaling response: %v", err)
+		return "", nil, err
 	}
 
-	if bytes.Contains(rawJSON, []byte("ERROR")) {
-		var errResp LnproxySpecErrorResponse
-		err := json.Unmarshal(rawJSON, &errResp)
-		if err != nil {
-			log.Info("TODO: Only Alby response is supported. If you think the response is valid, support the response here.")
-			return "", fmt.Errorf("error decoding error response: %v", err)
-		}
-		return "", fmt.Errorf("error response: %s", errResp.Reason)
-	}
+	return invoice, decoded, nil
+}
+
+func requestWrappedInvoice(client *http.Client, relayURL *url.URL,
+	p ProxyParameters) (string, error) {
 
-	var resp LnproxySpecSuccessResponse
-	err = json.Unmarshal([]byte(rawJSON), &resp)
+	b, err := json.Marshal(p)
 	if err != nil {
-		return "", fmt.Errorf("error decoding success response: %v", err)
+		return "", fmt.Errorf("failed to marshal spec parameter: %v", p)
 	}
-	return resp.WrappedInvoice, nil
-}
 
-func extractPaymentHash(invoice string) (lntypes.Hash, error) {
-	decodedInvoice, err := zpay32.Decode(invoice, &chaincfg.MainNetParams)
+	u := *relayURL
+	u.Path = path.Join(u.Path, "spec")
+	res, err := client.Post(u.String(), "application/json", bytes.NewReader(b))
 	if err != nil {
-		return lntypes.ZeroHash, fmt.Errorf("error decoding invoice: %v", err)
+		return "", err
 	}
-	paymentHash := decodedInvoice.PaymentHash
-	return *paymentHash, nil
-}
-
-// VerifyInvoiceStatus checks that an invoice identified by a payment
-// hash has the desired status. To make sure we don't fail while the
-// invoice update is still on its way, we try several times until either
-// the desired status is set or the given timeout is reached.
-//
-// NOTE: This is part of the auth.InvoiceChecker interface.
-func (l *LnproxyChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
-	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
-
-	// Prevent the challenger to be shut down while we're still waiting for
-	// status updates.
-	l.wg.Add(1)
-	defer l.wg.Done()
-
-	var (
-		condWg         sync.WaitGroup
-		doneChan       = make(chan struct{})
-		timeoutReached bool
-		hasInvoice     bool
-		invoiceState   lnrpc.Invoice_InvoiceState
-	)
-
-	// First of all, spawn a goroutine that will signal us on timeout.
-	// Otherwise if a client subscribes to an update on an invoice that
-	// never arrives, and there is no other activity, it would block
-	// forever in the condition.
-	condWg.Add(1)
-	go func() {
-		defer condWg.Done()
-
-		select {
-		case <-doneChan:
-		case <-time.After(timeout):
-		case <-l.quit:
-		}
-
-		l.invoicesCond.L.Lock()
-		timeoutReached = true
-		l.invoicesCond.Broadcast()
-		l.invoicesCond.L.Unlock()
-	}()
-
-	// Now create the main goroutine that blocks until an update is received
-	// on the condition.
-	condWg.Add(1)
-	go func() {
-		defer condWg.Done()
-		l.invoicesCond.L.Lock()
-
-		// Block here until our condition is met or the allowed time is
-		// up. The Wait() will return whenever a signal is broadcast.
-		invoiceState, hasInvoice = l.invoiceStates[hash]
-		for !(hasInvoice && invoiceState == state) && !timeoutReached {
-			l.invoicesCond.Wait()
-
-			// The Wait() above has re-acquired the lock so we can
-			// safely access the states map.
-			invoiceState, hasInvoice = l.invoiceStates[hash]
-		}
-
-		// We're now done.
-		l.invoicesCond.L.Unlock()
-		close(doneChan)
-	}()
-
-	// Wait until we're either done or timed out.
-	condWg.Wait()
+	defer res.Body.Close()
 
-	// Interpret the result so we can return a more descriptive error than
-	// just "failed".
+	// The relay either answers with the wrapped invoice or with the reason
+	// it could not wrap the invoice, some relays report errors with a 200
+	// status code.
+	var resp struct {
+		LnproxySpecErrorResponse
+		LnproxySpecSuccessResponse
+	}
+	body := io.LimitReader(res.Body, maxRelayResponseSize)
+	err = json.NewDecoder(body).Decode(&resp)
 	switch {
-	case !hasInvoice:
-		return fmt.Errorf("no active or settled invoice found for "+
-			"hash=%v", hash)
+	case res.StatusCode != http.StatusOK && err == nil &&
+		resp.Reason != "":
 
-	case invoiceState != state:
-		return fmt.Errorf("invoice status not correct before timeout, "+
-			"hash=%v, status=%v", hash, invoiceState)
+		return "", fmt.Errorf("error response (%s): %s", res.Status,
+			resp.Reason)
 
-	default:
-		return nil
-	}
-}
+	case res.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("error response: %s", res.Status)
 
-// VerifyRightsWithinExpiry checks that the rights for a given hash are still
-// valid and within the given expiry duration.
-func (l *LnproxyChallenger) VerifyRightsWithinExpiry(paymentHash lntypes.Hash, duration time.Duration) error {
-	settledAt, err := l.secrets.GetSettledAtByPaymentHash(
-		context.Background(), paymentHash,
-	)
-	if err != nil {
-		return err
-	}
-	if !settledAt.Valid {
-		return fmt.Errorf("no settled time found for paymentHash(%v)", paymentHash)
-	}
+	case err != nil:
+		return "", fmt.Errorf("error decoding response: %w", err)
 
-	expiryTime := settledAt.Time.Add(duration)
-	if expiryTime.Before(time.Now()) {
-		return fmt.Errorf("L402 right expired at %v", expiryTime)
-	}
-	return nil
-}
+	case resp.Status == "ERROR":
+		return "", fmt.Errorf("error response: %s", resp.Reason)
 
-// invoiceIrrelevant returns true if an invoice is nil, canceled or non-settled
-// and expired.
-func invoiceIrrelevant(invoice *lnrpc.Invoice) bool {
-	if invoice == nil || invoice.State == lnrpc.Invoice_CANCELED {
-		return true
+	case resp.WrappedInvoice == "":
+		return "", errors.New("empty wrapped invoice in response")
 	}
 
-	creation := time.Unix(invoice.CreationDate, 0)
-	expiration := creation.Add(time.Duration(invoice.Expiry) * time.Second)
-	expired := time.Now().After(expiration)
-
-	notSettled := invoice.State == lnrpc.Invoice_OPEN ||
-		invoice.State == lnrpc.Invoice_ACCEPTED
-
-	return expired && notSettled
+	return resp.WrappedInvoice, nil
 }
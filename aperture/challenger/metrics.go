@@ -0,0 +1,44 @@
+package challenger
+
+import (
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// creatorAmountMsat tracks the total amount in msat of all wrapped
+	// invoices handed out that goes to the creators.
+	creatorAmountMsat = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lnproxy",
+		Name:      "creator_amount_msat_total",
+	})
+
+	// operatorFeeMsat tracks the total operator fee in msat of all
+	// wrapped invoices handed out.
+	operatorFeeMsat = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lnproxy",
+		Name:      "operator_fee_msat_total",
+	})
+
+	// challengeCount counts the wrapped invoices handed out.
+	challengeCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lnproxy",
+		Name:      "challenge_count",
+	})
+)
+
+// Collectors returns the prometheus collectors of the challenger so they can
+// be registered by the exporter.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		creatorAmountMsat, operatorFeeMsat, challengeCount,
+	}
+}
+
+// recordPriceSplit records the split of a challenge's amount between the
+// creator and the operator.
+func recordPriceSplit(creatorAmt, operatorFee lnwire.MilliSatoshi) {
+	creatorAmountMsat.Add(float64(creatorAmt))
+	operatorFeeMsat.Add(float64(operatorFee))
+	challengeCount.Inc()
+}
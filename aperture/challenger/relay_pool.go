@@ -0,0 +1,316 @@
+package challenger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRelayWeight is the weight of a relay that doesn't have one
+	// configured.
+	defaultRelayWeight = 1
+
+	// defaultRelayTimeout is the default maximum time a request to a relay
+	// may take.
+	defaultRelayTimeout = 10 * time.Second
+
+	// defaultHealthCheckInterval is the default interval in which relays
+	// marked as unhealthy are checked again.
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+var (
+	// ErrNoRelays is returned if no lnproxy relay is configured.
+	ErrNoRelays = errors.New("no lnproxy relays configured")
+
+	// ErrAllRelaysFailed is returned if no relay in the pool was able to
+	// return a valid wrapped invoice.
+	ErrAllRelaysFailed = errors.New("all lnproxy relays failed")
+
+	// ErrNoRecipient is returned if a service that is paid to a creator
+	// has no recipient lightning address.
+	ErrNoRecipient = errors.New("no recipient lightning address for " +
+		"creator paid service")
+)
+
+// RelayConfig is the configuration of a single lnproxy relay.
+type RelayConfig struct {
+	// URL is the base URL of the relay's API.
+	URL string `long:"url" description:"Base URL of the lnproxy relay API"`
+
+	// Weight is the relative share of challenges that should be sent to
+	// this relay.
+	Weight uint32 `long:"weight" description:"Relative share of requests sent to this relay"`
+
+	// MaxFeePPM is the maximum routing fee, in parts per million of the
+	// creator amount, we are willing to offer this relay. Zero means no
+	// limit.
+	MaxFeePPM uint64 `long:"maxfeeppm" description:"Maximum routing fee in ppm of the creator amount to offer this relay, 0 for no limit"`
+
+	// Timeout is the maximum time a request to this relay may take.
+	Timeout time.Duration `long:"timeout" description:"Maximum time a request to this relay may take"`
+}
+
+// RelayStatus is a snapshot of the health of a relay in the pool.
+type RelayStatus struct {
+	// URL is the base URL of the relay.
+	URL string
+
+	// Healthy is false if the last request to the relay failed.
+	Healthy bool
+
+	// LastError is the error of the last failed request, if any.
+	LastError error
+
+	// LastChecked is the time of the last request to the relay.
+	LastChecked time.Time
+}
+
+// poolRelay is a relay in the pool together with its health state.
+type poolRelay struct {
+	cfg    *RelayConfig
+	url    *url.URL
+	client *http.Client
+
+	weight        int
+	currentWeight int
+
+	healthy     bool
+	lastErr     error
+	lastChecked time.Time
+}
+
+// RelayPool is a set of lnproxy relays that are used in a weighted round robin
+// fashion. Relays that fail are skipped until a health check finds them to be
+// reachable again.
+type RelayPool struct {
+	relays              []*poolRelay
+	healthCheckInterval time.Duration
+
+	mtx sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRelayPool creates a new relay pool from the given configuration.
+func NewRelayPool(cfg *LnproxyConfig) (*RelayPool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	relayCfgs := cfg.relays()
+	if len(relayCfgs) == 0 {
+		return nil, ErrNoRelays
+	}
+
+	transport, err := cfg.newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &RelayPool{
+		healthCheckInterval: cfg.HealthCheckInterval,
+		quit:                make(chan struct{}),
+	}
+	if pool.healthCheckInterval == 0 {
+		pool.healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	// All relays share the transport so they use the same proxy and root
+	// certificates, only the overall timeout can differ per relay.
+	for _, relayCfg := range relayCfgs {
+		u, err := url.Parse(relayCfg.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := int(relayCfg.Weight)
+		if weight == 0 {
+			weight = defaultRelayWeight
+		}
+		timeout := relayCfg.Timeout
+		if timeout == 0 {
+			timeout = cfg.timeout()
+		}
+
+		pool.relays = append(pool.relays, &poolRelay{
+			cfg: relayCfg,
+			url: u,
+			client: &http.Client{
+				Transport: transport,
+				Timeout:   timeout,
+			},
+			weight:  weight,
+			healthy: true,
+		})
+	}
+
+	return pool, nil
+}
+
+// Start starts the background health checks of the pool.
+func (p *RelayPool) Start() {
+	p.wg.Add(1)
+	go p.healthCheckLoop()
+}
+
+// Stop stops the background health checks of the pool.
+func (p *RelayPool) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// candidates returns the relays that may be used for a challenge with the
+// given creator amount and routing fee, in the order they should be tried.
+// The first relay is picked by smooth weighted round robin among the healthy
+// relays, followed by the remaining healthy relays and then the unhealthy
+// ones as a last resort.
+func (p *RelayPool) candidates(creatorAmtMsat,
+	routingFeeMsat uint64) []*poolRelay {
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var healthy, unhealthy []*poolRelay
+	for _, r := range p.relays {
+		if r.cfg.MaxFeePPM != 0 && creatorAmtMsat != 0 &&
+			routingFeeMsat*1_000_000/creatorAmtMsat > r.cfg.MaxFeePPM {
+
+			continue
+		}
+
+		if r.healthy {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return unhealthy
+	}
+
+	// Smooth weighted round robin: every relay gains its weight, the one
+	// with the highest current weight is picked and loses the total.
+	var (
+		best  int
+		total int
+	)
+	for i, r := range healthy {
+		r.currentWeight += r.weight
+		total += r.weight
+		if r.currentWeight > healthy[best].currentWeight {
+			best = i
+		}
+	}
+	healthy[best].currentWeight -= total
+
+	ordered := make([]*poolRelay, 0, len(healthy)+len(unhealthy))
+	ordered = append(ordered, healthy[best:]...)
+	ordered = append(ordered, healthy[:best]...)
+	return append(ordered, unhealthy...)
+}
+
+// markResult records the outcome of a request to the given relay.
+func (p *RelayPool) markResult(r *poolRelay, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if err != nil && r.healthy {
+		log.Warnf("Marking lnproxy relay %v as unhealthy: %v", r.url,
+			err)
+	} else if err == nil && !r.healthy {
+		log.Infof("Lnproxy relay %v is healthy again", r.url)
+	}
+
+	r.healthy = err == nil
+	r.lastErr = err
+	r.lastChecked = time.Now()
+}
+
+// Status returns a snapshot of the health of all relays in the pool.
+func (p *RelayPool) Status() []RelayStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	status := make([]RelayStatus, 0, len(p.relays))
+	for _, r := range p.relays {
+		status = append(status, RelayStatus{
+			URL:         r.url.String(),
+			Healthy:     r.healthy,
+			LastError:   r.lastErr,
+			LastChecked: r.lastChecked,
+		})
+	}
+
+	return status
+}
+
+// healthCheckLoop periodically checks all unhealthy relays for availability.
+func (p *RelayPool) healthCheckLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkUnhealthy()
+
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// checkUnhealthy probes all unhealthy relays.
+func (p *RelayPool) checkUnhealthy() {
+	p.mtx.Lock()
+	var unhealthy []*poolRelay
+	for _, r := range p.relays {
+		if !r.healthy {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	p.mtx.Unlock()
+
+	for _, r := range unhealthy {
+		p.markResult(r, probeRelay(r))
+	}
+}
+
+// probeRelay checks that the relay answers HTTP requests. The lnproxy API has
+// no dedicated health endpoint, so any response that isn't a server error is
+// treated as the relay being available.
+func probeRelay(r *poolRelay) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), r.client.Timeout,
+	)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, r.url.String(), nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check failed with status %v",
+			resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package challenger
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRelayPoolWeightedRoundRobin makes sure healthy relays are picked first
+// according to their weights.
+func TestRelayPoolWeightedRoundRobin(t *testing.T) {
+	pool, err := NewRelayPool(&LnproxyConfig{
+		Relays: []*RelayConfig{
+			{URL: "http://a", Weight: 3},
+			{URL: "http://b", Weight: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	picks := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		candidates := pool.candidates(1000, 10)
+		require.Len(t, candidates, 2)
+		picks[candidates[0].url.Host]++
+	}
+	require.Equal(t, map[string]int{"a": 6, "b": 2}, picks)
+}
+
+// TestRelayPoolFailover makes sure a relay that failed is only used as a last
+// resort until it is healthy again.
+func TestRelayPoolFailover(t *testing.T) {
+	pool, err := NewRelayPool(&LnproxyConfig{
+		Relays: []*RelayConfig{
+			{URL: "http://a"},
+			{URL: "http://b"},
+		},
+	})
+	require.NoError(t, err)
+
+	a := pool.relays[0]
+	pool.markResult(a, errors.New("connection refused"))
+
+	for i := 0; i < 4; i++ {
+		candidates := pool.candidates(1000, 10)
+		require.Len(t, candidates, 2)
+		require.Equal(t, "b", candidates[0].url.Host)
+		require.Equal(t, a, candidates[1])
+	}
+
+	status := pool.Status()
+	require.False(t, status[0].Healthy)
+	require.True(t, status[1].Healthy)
+
+	pool.markResult(a, nil)
+	picks := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		picks[pool.candidates(1000, 10)[0].url.Host]++
+	}
+	require.Equal(t, map[string]int{"a": 2, "b": 2}, picks)
+}
+
+// TestRelayPoolMaxFee makes sure relays are skipped if the routing fee exceeds
+// their configured maximum.
+func TestRelayPoolMaxFee(t *testing.T) {
+	pool, err := NewRelayPool(&LnproxyConfig{
+		Relays: []*RelayConfig{
+			{URL: "http://cheap", MaxFeePPM: 10_000},
+			{URL: "http://any"},
+		},
+	})
+	require.NoError(t, err)
+
+	// A 1% fee is within both limits.
+	require.Len(t, pool.candidates(100_000, 1_000), 2)
+
+	// A 2% fee is only accepted by the relay without a limit.
+	candidates := pool.candidates(100_000, 2_000)
+	require.Len(t, candidates, 1)
+	require.Equal(t, "any", candidates[0].url.Host)
+}
+
+// TestRelayPoolHealthCheck makes sure the health check revives relays that
+// are reachable again.
+func TestRelayPoolHealthCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer srv.Close()
+
+	pool, err := NewRelayPool(&LnproxyConfig{
+		Relays:              []*RelayConfig{{URL: srv.URL}},
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	pool.markResult(pool.relays[0], errors.New("timeout"))
+	pool.Start()
+	defer pool.Stop()
+
+	require.Eventually(t, func() bool {
+		return pool.Status()[0].Healthy
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestWrapInvoiceFailover makes sure the challenger uses the next relay if the
+// first one returns a tampered invoice.
+func TestWrapInvoiceFailover(t *testing.T) {
+	creatorAmt := testCreatorAmt
+	creatorInvoice := encodeTestInvoice(t, wrappedInvoiceParams{
+		net:    honestWrappedInvoiceParams().net,
+		hash:   testPaymentHash,
+		amt:    &creatorAmt,
+		expiry: time.Hour,
+		cltv:   testCreatorCltv,
+	})
+
+	tampered := honestWrappedInvoiceParams()
+	tampered.hash[0] = 0xff
+	evilURL := newFakeRelay(t, LnproxySpecSuccessResponse{
+		WrappedInvoice: encodeTestInvoice(t, tampered),
+	})
+	honestURL := newFakeRelay(t, LnproxySpecSuccessResponse{
+		WrappedInvoice: encodeTestInvoice(
+			t, honestWrappedInvoiceParams(),
+		),
+	})
+
+	pool, err := NewRelayPool(&LnproxyConfig{
+		Relays: []*RelayConfig{
+			{URL: evilURL.String(), Weight: 2},
+			{URL: honestURL.String(), Weight: 1},
+		},
+	})
+	require.NoError(t, err)
+	s := &lnproxySettings{
+		relays:  pool,
+		net:     &chaincfg.MainNetParams,
+		nodeKey: testNodePubKey,
+	}
+	creator, err := validateCreatorInvoice(
+		creatorInvoice, creatorAmt, s.net,
+	)
+	require.NoError(t, err)
+
+	routingMsat := testRoutingFee
+	candidates := pool.candidates(uint64(creatorAmt), routingMsat)
+	require.Equal(t, evilURL.Host, candidates[0].url.Host)
+
+	_, _, err = s.wrapInvoice(
+		candidates[0], creatorInvoice, creator, &routingMsat,
+	)
+	require.ErrorIs(t, err, ErrPaymentHashMismatch)
+	pool.markResult(candidates[0], err)
+
+	candidates = pool.candidates(uint64(creatorAmt), routingMsat)
+	require.Equal(t, honestURL.Host, candidates[0].url.Host)
+
+	_, hash, err := s.wrapInvoice(
+		candidates[0], creatorInvoice, creator, &routingMsat,
+	)
+	require.NoError(t, err)
+	require.Equal(t, testPaymentHash, hash)
+}
@@ -0,0 +1,212 @@
+package challenger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+const (
+	// minWrappedInvoiceExpiry is the minimum time a wrapped invoice must
+	// still be payable for when we hand it out to a client.
+	minWrappedInvoiceExpiry = time.Minute
+
+	// maxWrappedCltvExpiry is the maximum final CLTV delta we accept on a
+	// wrapped invoice. This corresponds to lnd's default
+	// --max-cltv-expiry, payers would not be able to route a payment with
+	// a larger delta anyway.
+	maxWrappedCltvExpiry = 2016
+)
+
+var (
+	// ErrInvoiceNetworkMismatch is returned if an invoice is not encoded
+	// for the network the challenger is running on.
+	ErrInvoiceNetworkMismatch = errors.New("invoice not for current " +
+		"network")
+
+	// ErrInvalidCreatorInvoice is returned if the creator invoice
+	// obtained through LNURL cannot be decoded or does not request the
+	// expected amount.
+	ErrInvalidCreatorInvoice = errors.New("invalid creator invoice")
+
+	// ErrInvalidWrappedInvoice is returned if the invoice returned by the
+	// lnproxy relay cannot be decoded.
+	ErrInvalidWrappedInvoice = errors.New("invalid wrapped invoice")
+
+	// ErrPaymentHashMismatch is returned if the wrapped invoice doesn't
+	// commit to the same payment hash as the creator invoice. Paying such
+	// an invoice would not pay the creator.
+	ErrPaymentHashMismatch = errors.New("wrapped invoice payment hash " +
+		"does not match creator invoice")
+
+	// ErrWrappedAmountMismatch is returned if the wrapped invoice amount
+	// is not the creator amount plus the requested routing fee.
+	ErrWrappedAmountMismatch = errors.New("wrapped invoice amount " +
+		"mismatch")
+
+	// ErrWrappedInvoiceExpiry is returned if the wrapped invoice expires
+	// too soon or after the creator invoice.
+	ErrWrappedInvoiceExpiry = errors.New("wrapped invoice expiry " +
+		"invalid")
+
+	// ErrWrappedInvoiceCltv is returned if the final CLTV delta of the
+	// wrapped invoice doesn't leave the relay room to pay the creator
+	// invoice or is too large to be routed.
+	ErrWrappedInvoiceCltv = errors.New("wrapped invoice cltv expiry " +
+		"invalid")
+
+	// ErrWrappedInvoicePayee is returned if the wrapped invoice isn't
+	// payable to the operator's node. The challenger only sees the
+	// settlement of invoices created on that node, so a client paying
+	// such an invoice would never be granted access.
+	ErrWrappedInvoicePayee = errors.New("wrapped invoice not payable to " +
+		"operator node")
+)
+
+// decodeInvoiceForNetwork decodes the given invoice and makes sure it is
+// encoded for the given network.
+func decodeInvoiceForNetwork(invoice string,
+	net *chaincfg.Params) (*zpay32.Invoice, error) {
+
+	if !invoiceNetworkMatches(invoice, net) {
+		return nil, fmt.Errorf("%w: expected %v", ErrInvoiceNetworkMismatch,
+			net.Name)
+	}
+
+	return zpay32.Decode(invoice, net)
+}
+
+// invoiceNetworkMatches returns true if the human-readable part of the invoice
+// is exactly the one of the given network, optionally followed by an amount.
+// The zpay32 decoder only does a prefix check, which would for example accept
+// a regtest (lnbcrt) invoice on mainnet (lnbc) and only fail later while
+// parsing the amount.
+func invoiceNetworkMatches(invoice string, net *chaincfg.Params) bool {
+	invoice = strings.ToLower(invoice)
+	sep := strings.LastIndex(invoice, "1")
+	if sep < 0 || !strings.HasPrefix(invoice, "ln") {
+		return false
+	}
+
+	// Signet uses the same segwit HRP as testnet, lnd distinguishes the
+	// two by an additional "s" in the invoice HRP.
+	expectedPrefix := net.Bech32HRPSegwit
+	if net.Name == chaincfg.SigNetParams.Name {
+		expectedPrefix = "tbs"
+	}
+
+	hrp := invoice[2:sep]
+	if !strings.HasPrefix(hrp, expectedPrefix) {
+		return false
+	}
+
+	// Anything after the network prefix must be an amount, which always
+	// starts with a digit.
+	amount := hrp[len(expectedPrefix):]
+	return amount == "" || (amount[0] >= '0' && amount[0] <= '9')
+}
+
+// validateCreatorInvoice makes sure the invoice obtained from the creator's
+// LNURL server is encoded for the given network and requests exactly the
+// given amount. The decoded invoice is returned.
+func validateCreatorInvoice(creatorInvoice string,
+	creatorAmt lnwire.MilliSatoshi,
+	net *chaincfg.Params) (*zpay32.Invoice, error) {
+
+	creator, err := decodeInvoiceForNetwork(creatorInvoice, net)
+	switch {
+	case errors.Is(err, ErrInvoiceNetworkMismatch):
+		return nil, err
+
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCreatorInvoice, err)
+	}
+
+	if creator.PaymentHash == nil || creator.MilliSat == nil ||
+		*creator.MilliSat != creatorAmt {
+
+		return nil, fmt.Errorf("%w: expected amount %v",
+			ErrInvalidCreatorInvoice, creatorAmt)
+	}
+
+	return creator, nil
+}
+
+// validateWrappedInvoice makes sure the wrapped invoice returned by an lnproxy
+// relay can safely be handed out to a client: it must be encoded for the given
+// network, be payable to the given operator node, pay the validated creator
+// invoice (same payment hash), request exactly the creator amount plus the
+// routing fee we offered, expire before the creator invoice does and leave the
+// relay enough CLTV delta to pay the creator invoice. The payment hash of the
+// validated invoice is returned.
+func validateWrappedInvoice(creator *zpay32.Invoice, wrappedInvoice string,
+	routingFee lnwire.MilliSatoshi, nodeKey *btcec.PublicKey,
+	net *chaincfg.Params, now time.Time) (lntypes.Hash, error) {
+
+	wrapped, err := decodeInvoiceForNetwork(wrappedInvoice, net)
+	switch {
+	case errors.Is(err, ErrInvoiceNetworkMismatch):
+		return lntypes.ZeroHash, err
+
+	case err != nil:
+		return lntypes.ZeroHash, fmt.Errorf("%w: %v",
+			ErrInvalidWrappedInvoice, err)
+	}
+
+	// The relay must be backed by the operator's node, as only the
+	// invoices of that node are watched for their settlement.
+	if wrapped.Destination == nil || !wrapped.Destination.IsEqual(nodeKey) {
+		return lntypes.ZeroHash, ErrWrappedInvoicePayee
+	}
+
+	if wrapped.PaymentHash == nil ||
+		*wrapped.PaymentHash != *creator.PaymentHash {
+
+		return lntypes.ZeroHash, ErrPaymentHashMismatch
+	}
+
+	expectedAmt := *creator.MilliSat + routingFee
+	if wrapped.MilliSat == nil {
+		return lntypes.ZeroHash, fmt.Errorf("%w: zero amount invoice",
+			ErrWrappedAmountMismatch)
+	}
+	if *wrapped.MilliSat != expectedAmt {
+		return lntypes.ZeroHash, fmt.Errorf("%w: expected %v, got %v",
+			ErrWrappedAmountMismatch, expectedAmt, *wrapped.MilliSat)
+	}
+
+	wrappedExpiry := wrapped.Timestamp.Add(wrapped.Expiry())
+	creatorExpiry := creator.Timestamp.Add(creator.Expiry())
+	switch {
+	case wrappedExpiry.Before(now.Add(minWrappedInvoiceExpiry)):
+		return lntypes.ZeroHash, fmt.Errorf("%w: expires at %v",
+			ErrWrappedInvoiceExpiry, wrappedExpiry)
+
+	case wrappedExpiry.After(creatorExpiry):
+		return lntypes.ZeroHash, fmt.Errorf("%w: expires at %v after "+
+			"creator invoice at %v", ErrWrappedInvoiceExpiry,
+			wrappedExpiry, creatorExpiry)
+	}
+
+	wrappedCltv := wrapped.MinFinalCLTVExpiry()
+	creatorCltv := creator.MinFinalCLTVExpiry()
+	switch {
+	case wrappedCltv <= creatorCltv:
+		return lntypes.ZeroHash, fmt.Errorf("%w: %d not above creator "+
+			"invoice %d", ErrWrappedInvoiceCltv, wrappedCltv,
+			creatorCltv)
+
+	case wrappedCltv > maxWrappedCltvExpiry:
+		return lntypes.ZeroHash, fmt.Errorf("%w: %d exceeds maximum %d",
+			ErrWrappedInvoiceCltv, wrappedCltv, maxWrappedCltvExpiry)
+	}
+
+	return *wrapped.PaymentHash, nil
+}
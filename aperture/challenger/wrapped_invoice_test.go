@@ -0,0 +1,436 @@
+package challenger
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/motxx/aperture-lnproxy/aperture/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testCreatorAmt  = lnwire.MilliSatoshi(1_000_000)
+	testRoutingFee  = uint64(10_000)
+	testCreatorCltv = 40
+)
+
+var testPaymentHash = lntypes.Hash{1, 2, 3}
+
+// testNodeKey is the key of the operator's node that backs the test relays.
+var testNodeKey, testNodePubKey = test.CreateKey(1)
+
+// wrappedInvoiceParams are the parameters the fake relay uses to build the
+// wrapped invoice. Each test case tampers with a different one.
+type wrappedInvoiceParams struct {
+	net    *chaincfg.Params
+	hash   lntypes.Hash
+	amt    *lnwire.MilliSatoshi
+	expiry time.Duration
+	cltv   uint64
+
+	// key signs the invoice, the test node key if nil.
+	key *btcec.PrivateKey
+}
+
+// honestWrappedInvoiceParams returns the parameters of a wrapped invoice that
+// an honest relay would return for the test creator invoice.
+func honestWrappedInvoiceParams() wrappedInvoiceParams {
+	amt := testCreatorAmt + lnwire.MilliSatoshi(testRoutingFee)
+	return wrappedInvoiceParams{
+		net:    &chaincfg.MainNetParams,
+		hash:   testPaymentHash,
+		amt:    &amt,
+		expiry: 30 * time.Minute,
+		cltv:   200,
+	}
+}
+
+// encodeTestInvoice creates and encodes an invoice for the given parameters.
+func encodeTestInvoice(t *testing.T, p wrappedInvoiceParams) string {
+	t.Helper()
+
+	opts := []func(*zpay32.Invoice){
+		zpay32.Description("test"),
+		zpay32.Expiry(p.expiry),
+		zpay32.CLTVExpiry(p.cltv),
+	}
+	if p.amt != nil {
+		opts = append(opts, zpay32.Amount(*p.amt))
+	}
+
+	invoice, err := zpay32.NewInvoice(p.net, p.hash, time.Now(), opts...)
+	require.NoError(t, err)
+
+	key := p.key
+	if key == nil {
+		key = testNodeKey
+	}
+	payReq, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(
+				key, chainhash.HashB(msg), true,
+			)
+		},
+	})
+	require.NoError(t, err)
+
+	return payReq
+}
+
+// newFakeRelay starts an lnproxy relay that answers every request with the
+// given response and returns its URL.
+func newFakeRelay(t *testing.T, response interface{}) *url.URL {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var p ProxyParameters
+			err := json.NewDecoder(r.Body).Decode(&p)
+			require.NoError(t, err)
+			require.Equal(t, "/spec", r.URL.Path)
+			require.Equal(t, testRoutingFee, *p.RoutingMsat)
+
+			err = json.NewEncoder(w).Encode(response)
+			require.NoError(t, err)
+		},
+	))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	return u
+}
+
+// TestValidateWrappedInvoice makes sure wrapped invoices returned by a relay
+// are only accepted if they commit to the creator invoice.
+func TestValidateWrappedInvoice(t *testing.T) {
+	creatorParams := wrappedInvoiceParams{
+		net:    &chaincfg.MainNetParams,
+		hash:   testPaymentHash,
+		amt:    func() *lnwire.MilliSatoshi { a := testCreatorAmt; return &a }(),
+		expiry: time.Hour,
+		cltv:   testCreatorCltv,
+	}
+
+	testCases := []struct {
+		name   string
+		tamper func(p *wrappedInvoiceParams)
+		err    error
+	}{{
+		name:   "honest relay",
+		tamper: func(p *wrappedInvoiceParams) {},
+	}, {
+		name: "swapped payment hash",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.hash = lntypes.Hash{9, 9, 9}
+		},
+		err: ErrPaymentHashMismatch,
+	}, {
+		name: "amount too high",
+		tamper: func(p *wrappedInvoiceParams) {
+			*p.amt += 1
+		},
+		err: ErrWrappedAmountMismatch,
+	}, {
+		name: "amount too low",
+		tamper: func(p *wrappedInvoiceParams) {
+			*p.amt = testCreatorAmt
+		},
+		err: ErrWrappedAmountMismatch,
+	}, {
+		name: "zero amount",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.amt = nil
+		},
+		err: ErrWrappedAmountMismatch,
+	}, {
+		name: "expires after creator invoice",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.expiry = 2 * time.Hour
+		},
+		err: ErrWrappedInvoiceExpiry,
+	}, {
+		name: "expires too soon",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.expiry = time.Second
+		},
+		err: ErrWrappedInvoiceExpiry,
+	}, {
+		name: "cltv delta not above creator invoice",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.cltv = testCreatorCltv
+		},
+		err: ErrWrappedInvoiceCltv,
+	}, {
+		name: "cltv delta too large",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.cltv = maxWrappedCltvExpiry + 1
+		},
+		err: ErrWrappedInvoiceCltv,
+	}, {
+		name: "not payable to the operator node",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.key, _ = test.CreateKey(2)
+		},
+		err: ErrWrappedInvoicePayee,
+	}, {
+		name: "wrong network",
+		tamper: func(p *wrappedInvoiceParams) {
+			p.net = &chaincfg.RegressionNetParams
+		},
+		err: ErrInvoiceNetworkMismatch,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			creatorInvoice := encodeTestInvoice(t, creatorParams)
+
+			params := honestWrappedInvoiceParams()
+			tc.tamper(&params)
+			relayURL := newFakeRelay(t, LnproxySpecSuccessResponse{
+				WrappedInvoice: encodeTestInvoice(t, params),
+			})
+
+			routingMsat := testRoutingFee
+			wrappedInvoice, err := requestWrappedInvoice(
+				http.DefaultClient, relayURL, ProxyParameters{
+					Invoice:     creatorInvoice,
+					RoutingMsat: &routingMsat,
+				},
+			)
+			require.NoError(t, err)
+
+			creator, err := validateCreatorInvoice(
+				creatorInvoice, testCreatorAmt,
+				&chaincfg.MainNetParams,
+			)
+			require.NoError(t, err)
+
+			hash, err := validateWrappedInvoice(
+				creator, wrappedInvoice,
+				lnwire.MilliSatoshi(testRoutingFee),
+				testNodePubKey, &chaincfg.MainNetParams,
+				time.Now(),
+			)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testPaymentHash, hash)
+		})
+	}
+}
+
+// TestLookupNodeKey makes sure the key of the operator's node is looked up
+// from its invoices, adding one if there is none yet.
+func TestLookupNodeKey(t *testing.T) {
+	payReq := encodeTestInvoice(t, honestWrappedInvoiceParams())
+
+	testCases := []struct {
+		name     string
+		client   *mockInvoiceClient
+		numAdded int
+		err      bool
+	}{{
+		name: "latest invoice",
+		client: &mockInvoiceClient{
+			invoices: []*lnrpc.Invoice{{
+				AddIndex:       1,
+				PaymentRequest: payReq,
+			}},
+		},
+	}, {
+		name:     "no invoice yet",
+		client:   &mockInvoiceClient{payReq: payReq},
+		numAdded: 1,
+	}, {
+		name:     "undecodable invoice",
+		client:   &mockInvoiceClient{},
+		numAdded: 1,
+		err:      true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := lookupNodeKey(
+				context.Background(), tc.client,
+				&chaincfg.MainNetParams,
+			)
+			require.Len(t, tc.client.added, tc.numAdded)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.True(t, testNodePubKey.IsEqual(key))
+		})
+	}
+}
+
+// TestValidateCreatorInvoice makes sure a creator invoice that doesn't request
+// the service price is rejected.
+func TestValidateCreatorInvoice(t *testing.T) {
+	amt := testCreatorAmt + 1
+	creatorInvoice := encodeTestInvoice(t, wrappedInvoiceParams{
+		net:    &chaincfg.MainNetParams,
+		hash:   testPaymentHash,
+		amt:    &amt,
+		expiry: time.Hour,
+		cltv:   testCreatorCltv,
+	})
+
+	_, err := validateCreatorInvoice(
+		creatorInvoice, testCreatorAmt, &chaincfg.MainNetParams,
+	)
+	require.ErrorIs(t, err, ErrInvalidCreatorInvoice)
+}
+
+// TestInvoiceNetwork makes sure invoices are only accepted on the network they
+// are encoded for, including signet which shares its address prefix with
+// testnet.
+func TestInvoiceNetwork(t *testing.T) {
+	nets := []*chaincfg.Params{
+		&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&chaincfg.SigNetParams, &chaincfg.RegressionNetParams,
+		&chaincfg.SimNetParams,
+	}
+
+	for _, invoiceNet := range nets {
+		for _, withAmt := range []bool{false, true} {
+			params := wrappedInvoiceParams{
+				net:    invoiceNet,
+				hash:   testPaymentHash,
+				expiry: time.Hour,
+				cltv:   testCreatorCltv,
+			}
+			if withAmt {
+				a := testCreatorAmt
+				params.amt = &a
+			}
+			invoice := encodeTestInvoice(t, params)
+
+			for _, net := range nets {
+				_, err := decodeInvoiceForNetwork(invoice, net)
+				if net == invoiceNet {
+					require.NoError(t, err, "%v on %v",
+						invoice, net.Name)
+					continue
+				}
+
+				require.ErrorIs(t, err, ErrInvoiceNetworkMismatch,
+					"%v on %v", invoice, net.Name)
+			}
+		}
+	}
+}
+
+// TestCreatorInvoiceNetwork makes sure a creator invoice for another network
+// is rejected.
+func TestCreatorInvoiceNetwork(t *testing.T) {
+	amt := testCreatorAmt
+	creatorInvoice := encodeTestInvoice(t, wrappedInvoiceParams{
+		net:    &chaincfg.SigNetParams,
+		hash:   testPaymentHash,
+		amt:    &amt,
+		expiry: time.Hour,
+		cltv:   testCreatorCltv,
+	})
+
+	_, err := validateCreatorInvoice(
+		creatorInvoice, testCreatorAmt, &chaincfg.TestNet3Params,
+	)
+	require.ErrorIs(t, err, ErrInvoiceNetworkMismatch)
+
+	_, err = validateCreatorInvoice(
+		creatorInvoice, testCreatorAmt, &chaincfg.SigNetParams,
+	)
+	require.NoError(t, err)
+}
+
+// TestRelayErrorResponse makes sure an error returned by the relay is
+// surfaced and that unexpected responses are rejected.
+func TestRelayErrorResponse(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{{
+		name:   "error status",
+		status: http.StatusBadRequest,
+		body:   `{"status": "ERROR", "reason": "could not find route"}`,
+		err:    "error response (400 Bad Request): could not find route",
+	}, {
+		name:   "error with ok status",
+		status: http.StatusOK,
+		body:   `{"status": "ERROR", "reason": "could not find route"}`,
+		err:    "error response: could not find route",
+	}, {
+		name:   "error status without reason",
+		status: http.StatusBadGateway,
+		body:   "<html>bad gateway</html>",
+		err:    "error response: 502 Bad Gateway",
+	}, {
+		name:   "error status with wrapped invoice",
+		status: http.StatusInternalServerError,
+		body:   `{"proxy_invoice": "lnbc1"}`,
+		err:    "error response: 500 Internal Server Error",
+	}, {
+		name:   "empty wrapped invoice",
+		status: http.StatusOK,
+		body:   `{}`,
+		err:    "empty wrapped invoice",
+	}, {
+		name:   "oversized response",
+		status: http.StatusOK,
+		body: `{"proxy_invoice": "lnbc1` +
+			strings.Repeat("q", maxRelayResponseSize) + `"}`,
+		err: "error decoding response",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tc.status)
+					_, _ = io.WriteString(w, tc.body)
+				},
+			))
+			defer srv.Close()
+
+			relayURL, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+
+			routingMsat := testRoutingFee
+			_, err = requestWrappedInvoice(
+				http.DefaultClient, relayURL, ProxyParameters{
+					Invoice:     "lnbc1",
+					RoutingMsat: &routingMsat,
+				},
+			)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
 	"github.com/motxx/aperture-lnproxy/aperture/proxy"
 )
 
@@ -19,6 +20,7 @@ var (
 	defaultLogFilename     = "aperture.log"
 	defaultMaxLogFiles     = 3
 	defaultMaxLogFileSize  = 10
+	defaultSqliteFilename  = "aperture.db"
 )
 
 const (
@@ -34,7 +36,7 @@ type EtcdConfig struct {
 }
 
 type AuthConfig struct {
-	Network string `long:"network" description:"The network LND is connected to." choice:"regtest" choice:"simnet" choice:"testnet" choice:"mainnet"`
+	Network string `long:"network" description:"The network LND is connected to." choice:"regtest" choice:"simnet" choice:"testnet" choice:"signet" choice:"mainnet"`
 
 	Disable bool `long:"disable" description:"Whether to disable auth."`
 
@@ -56,6 +58,18 @@ type AuthConfig struct {
 	// DevServer set to true to skip verification of the mailbox server's
 	// tls cert.
 	DevServer bool `long:"devserver" description:"set to true to skip verification of the server's tls cert."`
+
+	// OutageBudget is how long the subscription to lnd's invoice updates
+	// may stay down before aperture shuts down.
+	OutageBudget time.Duration `long:"outagebudget" description:"How long the subscription to lnd's invoice updates may stay down before aperture shuts down. Set to 0 to shut down on the first error."`
+
+	// SettledCacheAge is how long a settled invoice is kept in memory after
+	// its settlement. Older settlements are looked up in the database.
+	SettledCacheAge time.Duration `long:"settledcacheage" description:"How long settled invoices are kept in memory after their settlement. Older settlements are looked up in the database."`
+
+	// SettlementPollInterval is the time between two lookups of an
+	// invoice's settlement in the database while a client waits for it.
+	SettlementPollInterval time.Duration `long:"settlementpollinterval" description:"How often the database is checked for the settlement of an invoice, so settlements recorded by other replicas are accepted. Set to 0 to only wait for lnd's invoice updates."`
 }
 
 func (a *AuthConfig) validate() error {
@@ -64,6 +78,19 @@ func (a *AuthConfig) validate() error {
 		return nil
 	}
 
+	if a.OutageBudget < 0 {
+		return errors.New("outage budget must not be negative")
+	}
+
+	if a.SettledCacheAge < 0 {
+		return errors.New("settled cache age must not be negative")
+	}
+
+	if a.SettlementPollInterval < 0 {
+		return errors.New("settlement poll interval must not be " +
+			"negative")
+	}
+
 	switch {
 	// If LndHost is set we connect directly to the LND node.
 	case a.LndHost != "":
@@ -133,6 +160,22 @@ type TorConfig struct {
 	V3          bool   `long:"v3" description:"Whether we should listen for client requests through a v3 onion service."`
 }
 
+// AdminConfig is the configuration of the admin API that manages a running
+// aperture instance.
+type AdminConfig struct {
+	// Enabled serves the admin gRPC and REST API on the listen address.
+	Enabled bool `long:"enabled" description:"Serve the admin gRPC and REST API on the listen address."`
+
+	// MacaroonPath is the path of the macaroon that authenticates calls to
+	// the admin API. It is created if it doesn't exist.
+	MacaroonPath string `long:"macaroonpath" description:"Path to the admin macaroon, created if it doesn't exist."`
+
+	// RootKeyPath is the path of the root key the admin macaroon is baked
+	// with. It is created if it doesn't exist, which invalidates all
+	// admin macaroons baked with a previous root key.
+	RootKeyPath string `long:"rootkeypath" description:"Path to the root key of the admin macaroon, created if it doesn't exist."`
+}
+
 type Config struct {
 	// ListenAddr is the listening address that we should use to allow Aperture
 	// to listen for requests.
@@ -158,11 +201,18 @@ type Config struct {
 	ServeStatic bool `long:"servestatic" description:"Flag to enable or disable static content serving."`
 
 	// DatabaseBackend is the database backend to be used by the server.
-	DatabaseBackend string `long:"dbbackend" description:"The database backend to use for storing all asset related data." choice:"postgres" yaml:"dbbackend"`
+	DatabaseBackend string `long:"dbbackend" description:"The database backend to use for storing all asset related data." choice:"postgres" choice:"sqlite" yaml:"dbbackend"`
+
+	// Sqlite is the configuration section for the SQLite database backend.
+	Sqlite *aperturedb.SqliteConfig `group:"sqlite" namespace:"sqlite"`
 
 	// Postgres is the configuration section for the Postgres database backend.
 	Postgres *aperturedb.PostgresConfig `group:"postgres" namespace:"postgres"`
 
+	// SecretsPruner is the configuration section for the background job
+	// that deletes the secrets of unpaid and expired L402s.
+	SecretsPruner *aperturedb.SecretsPrunerConfig `group:"secretspruner" namespace:"secretspruner"`
+
 	// Etcd is the configuration section for the Etcd database backend.
 	Etcd *EtcdConfig `group:"etcd" namespace:"etcd"`
 
@@ -172,6 +222,10 @@ type Config struct {
 
 	Tor *TorConfig `group:"tor" namespace:"tor"`
 
+	// Lnproxy is the configuration section for the pool of lnproxy relays
+	// that wrap creator invoices.
+	Lnproxy *challenger.LnproxyConfig `group:"lnproxy" namespace:"lnproxy"`
+
 	// Services is a list of JSON objects in string format, which specify
 	// each backend service to Aperture.
 	Services []*proxy.Service `long:"service" description:"Configurations for each Aperture backend service."`
@@ -180,6 +234,9 @@ type Config struct {
 	// Node Connect mailbox server.
 	HashMail *HashMailConfig `group:"hashmail" namespace:"hashmail" description:"Configuration for the Lightning Node Connect mailbox server."`
 
+	// Admin is the configuration section for the admin API.
+	Admin *AdminConfig `group:"admin" namespace:"admin" description:"Configuration for the admin API."`
+
 	// Prometheus is the config for setting up an endpoint for a Prometheus
 	// server to scrape metrics from.
 	Prometheus *PrometheusConfig `group:"prometheus" namespace:"prometheus" description:"Configuration setting up an endpoint that a Prometheus server can scrape."`
@@ -207,6 +264,10 @@ type Config struct {
 	// WriteTimeout is the maximum amount of time to wait for a response to
 	// be fully written.
 	WriteTimeout time.Duration `long:"writetimeout" description:"The maximum amount of time to wait for a response to be fully written."`
+
+	// configFile is the path of the config file that was read, if any. It
+	// is watched for changes while aperture is running.
+	configFile string
 }
 
 func (c *Config) validate() error {
@@ -220,6 +281,23 @@ func (c *Config) validate() error {
 		return fmt.Errorf("missing listen address for server")
 	}
 
+	if err := c.SecretsPruner.Validate(); err != nil {
+		return err
+	}
+	err := c.SecretsPruner.ValidateLifetimes(serviceLifetimes(c.Services))
+	if err != nil {
+		return err
+	}
+
+	// Invoices are expected on the network lnd is connected to unless
+	// configured otherwise.
+	if c.Lnproxy.Network == "" {
+		c.Lnproxy.Network = c.Authenticator.Network
+	}
+	if err := c.Lnproxy.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -228,13 +306,25 @@ func NewConfig() *Config {
 	return &Config{
 		DatabaseBackend: "etcd",
 		Etcd:            &EtcdConfig{},
+		Sqlite:          &aperturedb.SqliteConfig{},
 		Postgres:        &aperturedb.PostgresConfig{},
-		Authenticator:   &AuthConfig{},
 		Tor:             &TorConfig{},
+		Lnproxy:         &challenger.LnproxyConfig{},
 		HashMail:        &HashMailConfig{},
+		Admin:           &AdminConfig{},
 		Prometheus:      &PrometheusConfig{},
 		IdleTimeout:     defaultIdleTimeout,
 		ReadTimeout:     defaultReadTimeout,
 		WriteTimeout:    defaultWriteTimeout,
+		Authenticator: &AuthConfig{
+			OutageBudget:           challenger.DefaultOutageBudget,
+			SettledCacheAge:        challenger.DefaultSettledInvoiceAge,
+			SettlementPollInterval: challenger.DefaultSettlementPollInterval,
+		},
+		SecretsPruner: &aperturedb.SecretsPrunerConfig{
+			Interval:     aperturedb.DefaultPruneInterval,
+			BatchSize:    aperturedb.DefaultPruneBatchSize,
+			UnsettledAge: aperturedb.DefaultUnsettledSecretAge,
+		},
 	}
 }
@@ -0,0 +1,320 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+	"github.com/motxx/aperture-lnproxy/aperture/proxy"
+)
+
+const (
+	// configPollInterval is how often the config file is checked for
+	// changes.
+	configPollInterval = 5 * time.Second
+)
+
+// configService is a backend service as it was loaded from the config file.
+type configService struct {
+	// fields holds the JSON encoding of each configured field of the
+	// service, taken before the proxy prepared the service.
+	fields map[string]json.RawMessage
+
+	// service is the service that was handed to the proxy.
+	service *proxy.Service
+}
+
+// newConfigServices remembers the configuration of the given services. It
+// must be called before the services are handed to the proxy, as preparing a
+// service changes some of its fields.
+func newConfigServices(
+	services []*proxy.Service) (map[string]configService, error) {
+
+	configServices := make(map[string]configService, len(services))
+	for _, service := range services {
+		fields, err := serviceFields(service)
+		if err != nil {
+			return nil, err
+		}
+
+		configServices[service.Name] = configService{
+			fields:  fields,
+			service: service,
+		}
+	}
+
+	return configServices, nil
+}
+
+// serviceFields returns the JSON encoding of each exported field of the given
+// service.
+func serviceFields(service *proxy.Service) (map[string]json.RawMessage,
+	error) {
+
+	b, err := json.Marshal(service)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode service %v: %w",
+			service.Name, err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("unable to decode service %v: %w",
+			service.Name, err)
+	}
+
+	return fields, nil
+}
+
+// changedFields returns the names of the fields that differ between the two
+// service configurations, sorted by name.
+func changedFields(old, new map[string]json.RawMessage) []string {
+	var changed []string
+	for name, value := range new {
+		if !bytes.Equal(old[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// serviceChanges is the result of comparing the services that are in use with
+// the ones loaded from the config file.
+type serviceChanges struct {
+	// services is the new list of services for the proxy. Services that
+	// didn't change are kept as they are, so their pricers and freebie
+	// counts are not reset.
+	services []*proxy.Service
+
+	// configServices are the loaded services to compare the next reload
+	// with.
+	configServices map[string]configService
+
+	added, removed, unchanged []string
+
+	// changed maps the name of each changed service to the names of the
+	// fields that changed, or nil if the service was changed through the
+	// admin API since it was loaded.
+	changed map[string][]string
+}
+
+// diffServices compares the services that are currently in use with the
+// services loaded from the config file. The services that were loaded from the
+// file before are given by their configuration at that time.
+func diffServices(current []*proxy.Service,
+	loaded map[string]configService,
+	fresh []*proxy.Service) (*serviceChanges, error) {
+
+	inUse := make(map[string]*proxy.Service, len(current))
+	for _, service := range current {
+		inUse[service.Name] = service
+	}
+
+	changes := &serviceChanges{
+		services:       make([]*proxy.Service, 0, len(fresh)),
+		configServices: make(map[string]configService, len(fresh)),
+		changed:        make(map[string][]string),
+	}
+	for _, service := range fresh {
+		if _, ok := changes.configServices[service.Name]; ok {
+			return nil, fmt.Errorf("duplicate service name %v",
+				service.Name)
+		}
+
+		fields, err := serviceFields(service)
+		if err != nil {
+			return nil, err
+		}
+		cfgService := configService{fields: fields, service: service}
+
+		running, isRunning := inUse[service.Name]
+		last, wasLoaded := loaded[service.Name]
+		switch {
+		case !isRunning:
+			changes.added = append(changes.added, service.Name)
+
+		// A service that was replaced through the admin API is not the
+		// one loaded from the file anymore, so we can't tell what
+		// changed.
+		case !wasLoaded || last.service != running:
+			changes.changed[service.Name] = nil
+
+		default:
+			diff := changedFields(last.fields, fields)
+			if len(diff) > 0 {
+				changes.changed[service.Name] = diff
+				break
+			}
+
+			changes.unchanged = append(
+				changes.unchanged, service.Name,
+			)
+			cfgService.service = running
+		}
+
+		changes.services = append(changes.services, cfgService.service)
+		changes.configServices[service.Name] = cfgService
+	}
+
+	for _, service := range current {
+		if _, ok := changes.configServices[service.Name]; !ok {
+			changes.removed = append(changes.removed, service.Name)
+		}
+	}
+
+	return changes, nil
+}
+
+// logServiceChanges logs how the services were changed by a reload.
+func logServiceChanges(changes *serviceChanges) {
+	for _, name := range changes.added {
+		log.Infof("Config reload added service %v", name)
+	}
+	for _, name := range changes.removed {
+		log.Infof("Config reload removed service %v", name)
+	}
+
+	names := make([]string, 0, len(changes.changed))
+	for name := range changes.changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields := changes.changed[name]
+		if fields == nil {
+			log.Infof("Config reload replaced service %v", name)
+			continue
+		}
+
+		log.Infof("Config reload changed %v of service %v",
+			strings.Join(fields, ", "), name)
+	}
+
+	if len(changes.added) == 0 && len(changes.removed) == 0 &&
+		len(changes.changed) == 0 {
+
+		log.Infof("Config reload didn't change any service")
+	}
+}
+
+// reloadConfig reads the config file again and applies the changes that can be
+// made while aperture is running, which are the changes to the services and to
+// the lnproxy relays. An invalid configuration is rejected as a whole and the
+// current one is kept.
+func (a *Aperture) reloadConfig() error {
+	cfg := NewConfig()
+	if _, err := flags.Parse(cfg); err != nil {
+		return err
+	}
+	if err := loadConfig(cfg, a.cfg.configFile, true); err != nil {
+		return fmt.Errorf("invalid config, keeping the current "+
+			"one: %w", err)
+	}
+
+	var changes *serviceChanges
+	err := a.ModifyServices(func(
+		current []*proxy.Service) ([]*proxy.Service, error) {
+
+		var err error
+		changes, err = diffServices(
+			current, a.configServices, cfg.Services,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return changes.services, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update services, keeping "+
+			"the current ones: %w", err)
+	}
+	a.configServices = changes.configServices
+	logServiceChanges(changes)
+
+	if reflect.DeepEqual(a.cfg.Lnproxy, cfg.Lnproxy) {
+		return nil
+	}
+
+	lnproxyChallenger, ok := a.challenger.(*challenger.LnproxyChallenger)
+	if !ok || !cfg.Lnproxy.Enabled() {
+		log.Warnf("Config reload can't enable or disable lnproxy, " +
+			"restart aperture to apply the lnproxy changes")
+		return nil
+	}
+	if err := lnproxyChallenger.UpdateConfig(cfg.Lnproxy); err != nil {
+		return fmt.Errorf("unable to update lnproxy, the services "+
+			"were updated: %w", err)
+	}
+	a.cfg.Lnproxy = cfg.Lnproxy
+
+	return nil
+}
+
+// watchConfig reloads the given config file whenever aperture receives a
+// SIGHUP or the file is modified, until aperture is stopped.
+//
+// NOTE: This must be run as a goroutine.
+func (a *Aperture) watchConfig(configFile string) {
+	defer a.wg.Done()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastModified := modTime(configFile)
+	for {
+		select {
+		case <-sighup:
+			log.Infof("Received SIGHUP, reloading config file %v",
+				configFile)
+
+		case <-ticker.C:
+			if modTime(configFile).Equal(lastModified) {
+				continue
+			}
+
+			log.Infof("Config file %v changed, reloading it",
+				configFile)
+
+		case <-a.quit:
+			return
+		}
+
+		lastModified = modTime(configFile)
+		if err := a.reloadConfig(); err != nil {
+			log.Errorf("Unable to reload config file %v: %v",
+				configFile, err)
+		}
+	}
+}
+
+// modTime returns the modification time of the given file, or the zero time if
+// it can't be determined.
+func modTime(name string) time.Time {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
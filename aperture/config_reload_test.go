@@ -0,0 +1,80 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/motxx/aperture-lnproxy/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDiffServices makes sure a config reload keeps the services that didn't
+// change and reports exactly what changed for the others.
+func TestDiffServices(t *testing.T) {
+	newService := func(name string, price int64) *proxy.Service {
+		return &proxy.Service{
+			Name:       name,
+			Address:    "127.0.0.1:8080",
+			Protocol:   "http",
+			HostRegexp: name + ".example.com",
+			Price:      price,
+		}
+	}
+
+	initial := []*proxy.Service{
+		newService("same", 1), newService("changed", 1),
+		newService("removed", 1), newService("admin", 1),
+	}
+	loaded, err := newConfigServices(initial)
+	require.NoError(t, err)
+
+	// The service "admin" was replaced through the admin API since the
+	// config was loaded.
+	current := append([]*proxy.Service(nil), initial...)
+	current[3] = newService("admin", 5)
+
+	fresh := []*proxy.Service{
+		newService("same", 1), newService("changed", 2),
+		newService("admin", 1), newService("added", 1),
+	}
+	fresh[1].Timeout = 60
+
+	changes, err := diffServices(current, loaded, fresh)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"added"}, changes.added)
+	require.Equal(t, []string{"removed"}, changes.removed)
+	require.Equal(t, []string{"same"}, changes.unchanged)
+	require.Equal(t, map[string][]string{
+		"changed": {"Price", "Timeout"},
+		"admin":   nil,
+	}, changes.changed)
+
+	// The unchanged service is kept as it is, all others are taken from the
+	// reloaded config.
+	require.Equal(t, []*proxy.Service{
+		initial[0], fresh[1], fresh[2], fresh[3],
+	}, changes.services)
+	require.Same(t, initial[0], changes.configServices["same"].service)
+	require.Same(t, fresh[1], changes.configServices["changed"].service)
+
+	// A reload of the same config doesn't change anything.
+	changes, err = diffServices(
+		changes.services, changes.configServices, []*proxy.Service{
+			newService("same", 1), newService("changed", 2),
+			newService("admin", 1), newService("added", 1),
+		},
+	)
+	require.NoError(t, err)
+	require.Empty(t, changes.added)
+	require.Empty(t, changes.removed)
+	require.Len(t, changes.unchanged, 3)
+	require.Equal(t, map[string][]string{
+		"changed": {"Timeout"},
+	}, changes.changed)
+
+	// Duplicate service names are rejected.
+	_, err = diffServices(current, loaded, []*proxy.Service{
+		newService("same", 1), newService("same", 2),
+	})
+	require.ErrorContains(t, err, "duplicate service name")
+}
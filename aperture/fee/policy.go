@@ -0,0 +1,102 @@
+package fee
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+const (
+	// ppmDenominator is the denominator of a proportional fee rate.
+	ppmDenominator = 1_000_000
+
+	// DefaultPPM is the default proportional operator fee, 3% of the
+	// price.
+	DefaultPPM = 30_000
+
+	// DefaultMinMsat is the default minimum operator fee in millisatoshis.
+	DefaultMinMsat = 10_000
+)
+
+var (
+	// ErrInvalidPolicy is returned if a fee policy contains conflicting
+	// values.
+	ErrInvalidPolicy = errors.New("invalid operator fee policy")
+)
+
+// Policy describes the operator fee that is offered to the lnproxy relay as
+// routing fee on top of the price paid to the creator.
+type Policy struct {
+	// BaseMsat is the fixed part of the fee in millisatoshis.
+	BaseMsat uint64 `long:"basemsat" description:"Fixed part of the operator fee in millisatoshis"`
+
+	// PPM is the proportional part of the fee in parts per million of
+	// the price.
+	PPM uint64 `long:"ppm" description:"Proportional part of the operator fee in parts per million of the price"`
+
+	// MinMsat is the minimum fee in millisatoshis.
+	MinMsat uint64 `long:"minmsat" description:"Minimum operator fee in millisatoshis"`
+
+	// MaxMsat is the maximum fee in millisatoshis. Zero means no maximum.
+	MaxMsat uint64 `long:"maxmsat" description:"Maximum operator fee in millisatoshis, 0 for no maximum"`
+}
+
+// DefaultPolicy returns the fee policy used if none is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		PPM:     DefaultPPM,
+		MinMsat: DefaultMinMsat,
+	}
+}
+
+// Validate checks the fee policy for conflicting values.
+func (p *Policy) Validate() error {
+	if p.PPM > ppmDenominator {
+		return fmt.Errorf("%w: ppm %d exceeds %d", ErrInvalidPolicy,
+			p.PPM, ppmDenominator)
+	}
+	if p.MaxMsat != 0 && p.MinMsat > p.MaxMsat {
+		return fmt.Errorf("%w: min %d msat above max %d msat",
+			ErrInvalidPolicy, p.MinMsat, p.MaxMsat)
+	}
+	if p.MaxMsat != 0 && p.BaseMsat > p.MaxMsat {
+		return fmt.Errorf("%w: base %d msat above max %d msat",
+			ErrInvalidPolicy, p.BaseMsat, p.MaxMsat)
+	}
+
+	return nil
+}
+
+// Fee returns the operator fee for the given price.
+func (p *Policy) Fee(price lnwire.MilliSatoshi) lnwire.MilliSatoshi {
+	fee := p.BaseMsat + uint64(price)*p.PPM/ppmDenominator
+
+	if fee < p.MinMsat {
+		fee = p.MinMsat
+	}
+	if p.MaxMsat != 0 && fee > p.MaxMsat {
+		fee = p.MaxMsat
+	}
+
+	return lnwire.MilliSatoshi(fee)
+}
+
+// String returns a human readable representation of the policy.
+func (p *Policy) String() string {
+	return fmt.Sprintf("base=%d msat, ppm=%d, min=%d msat, max=%d msat",
+		p.BaseMsat, p.PPM, p.MinMsat, p.MaxMsat)
+}
+
+// Resolve returns the first of the given policies that is set. Policies are
+// passed from the most to the least specific one, e.g. resource, service and
+// global policy.
+func Resolve(policies ...*Policy) *Policy {
+	for _, p := range policies {
+		if p != nil {
+			return p
+		}
+	}
+
+	return DefaultPolicy()
+}
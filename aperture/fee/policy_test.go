@@ -0,0 +1,75 @@
+package fee
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPolicyFee tests the fee computation of a policy.
+func TestPolicyFee(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy Policy
+		price  lnwire.MilliSatoshi
+		fee    lnwire.MilliSatoshi
+	}{{
+		name:   "default policy above minimum",
+		policy: *DefaultPolicy(),
+		price:  1_000_000,
+		fee:    30_000,
+	}, {
+		name:   "default policy below minimum",
+		policy: *DefaultPolicy(),
+		price:  100_000,
+		fee:    10_000,
+	}, {
+		name:   "base and ppm",
+		policy: Policy{BaseMsat: 1_000, PPM: 10_000},
+		price:  1_000_000,
+		fee:    11_000,
+	}, {
+		name:   "capped at maximum",
+		policy: Policy{PPM: 10_000, MaxMsat: 5_000},
+		price:  1_000_000,
+		fee:    5_000,
+	}, {
+		name:   "no fee",
+		policy: Policy{},
+		price:  1_000_000,
+		fee:    0,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.policy.Validate())
+			require.Equal(t, tc.fee, tc.policy.Fee(tc.price))
+		})
+	}
+}
+
+// TestPolicyValidate makes sure conflicting policies are rejected.
+func TestPolicyValidate(t *testing.T) {
+	invalid := []Policy{
+		{PPM: ppmDenominator + 1},
+		{MinMsat: 2, MaxMsat: 1},
+		{BaseMsat: 2, MaxMsat: 1},
+	}
+	for _, p := range invalid {
+		require.ErrorIs(t, p.Validate(), ErrInvalidPolicy)
+	}
+}
+
+// TestResolve makes sure the most specific policy that is set is used.
+func TestResolve(t *testing.T) {
+	resource := &Policy{PPM: 1}
+	service := &Policy{PPM: 2}
+	global := &Policy{PPM: 3}
+
+	require.Equal(t, resource, Resolve(resource, service, global))
+	require.Equal(t, service, Resolve(nil, service, global))
+	require.Equal(t, global, Resolve(nil, nil, global))
+	require.Equal(t, DefaultPolicy(), Resolve(nil, nil, nil))
+}
@@ -0,0 +1,146 @@
+package freebie
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// StoreMemory keeps the freebie counts in memory. Counts are lost when
+	// aperture restarts.
+	StoreMemory = "memory"
+
+	// StoreDB keeps the freebie counts in the configured database backend
+	// so they survive restarts and can be shared between instances.
+	StoreDB = "db"
+
+	// DefaultIPv4Mask is the default prefix length IPv4 addresses are
+	// masked with. Users with a whole /24 at their disposal only get the
+	// free requests once.
+	DefaultIPv4Mask = 24
+
+	// DefaultIPv6Mask is the default prefix length IPv6 addresses are
+	// masked with. Residential customers are usually assigned a /56 or
+	// larger prefix.
+	DefaultIPv6Mask = 56
+)
+
+var (
+	// ErrInvalidConfig is returned if a freebie configuration contains
+	// invalid values.
+	ErrInvalidConfig = errors.New("invalid freebie config")
+)
+
+// Config is the configuration of the freebie store of a service.
+type Config struct {
+	// Store is the kind of store the freebie counts are kept in.
+	Store string `long:"store" description:"Where to keep the freebie counts" choice:"memory" choice:"db"`
+
+	// Window is the length of the time window the free requests are
+	// granted for, e.g. 24h for N free requests per day. The windows are
+	// aligned to the unix epoch. If zero, the free requests are granted
+	// only once.
+	Window time.Duration `long:"window" description:"Length of the time window the free requests are granted for, e.g. 24h. If zero, the free requests are only granted once"`
+
+	// IPv4Mask is the prefix length IPv4 addresses are masked with before
+	// counting the free requests. If zero, DefaultIPv4Mask is used.
+	IPv4Mask int `long:"ipv4mask" description:"Prefix length IPv4 addresses are masked with before counting free requests, between 1 and 32. If unset, 24 is used"`
+
+	// IPv6Mask is the prefix length IPv6 addresses are masked with before
+	// counting the free requests. If zero, DefaultIPv6Mask is used.
+	IPv6Mask int `long:"ipv6mask" description:"Prefix length IPv6 addresses are masked with before counting free requests, between 1 and 128. If unset, 56 is used"`
+}
+
+// DefaultConfig returns the configuration used for services that don't
+// configure their freebie store.
+func DefaultConfig() *Config {
+	return &Config{
+		Store:    StoreMemory,
+		IPv4Mask: DefaultIPv4Mask,
+		IPv6Mask: DefaultIPv6Mask,
+	}
+}
+
+// Validate checks the configuration for invalid values.
+func (c *Config) Validate() error {
+	switch c.Store {
+	case "", StoreMemory, StoreDB:
+	default:
+		return fmt.Errorf("%w: unknown store %q", ErrInvalidConfig,
+			c.Store)
+	}
+
+	switch {
+	case c.Window < 0:
+		return fmt.Errorf("%w: negative window", ErrInvalidConfig)
+
+	// A zero mask means the default is used, a mask of zero bits would
+	// count the requests of all clients together.
+	case c.IPv4Mask < 0 || c.IPv4Mask > 8*net.IPv4len:
+		return fmt.Errorf("%w: ipv4 mask must be between 1 and %d",
+			ErrInvalidConfig, 8*net.IPv4len)
+
+	case c.IPv6Mask < 0 || c.IPv6Mask > 8*net.IPv6len:
+		return fmt.Errorf("%w: ipv6 mask must be between 1 and %d",
+			ErrInvalidConfig, 8*net.IPv6len)
+	}
+
+	return nil
+}
+
+// withDefaults returns a copy of the configuration with all unset values
+// replaced by their defaults.
+func (c *Config) withDefaults() *Config {
+	cfg := DefaultConfig()
+	if c == nil {
+		return cfg
+	}
+
+	if c.Store != "" {
+		cfg.Store = c.Store
+	}
+	cfg.Window = c.Window
+	if c.IPv4Mask != 0 {
+		cfg.IPv4Mask = c.IPv4Mask
+	}
+	if c.IPv6Mask != 0 {
+		cfg.IPv6Mask = c.IPv6Mask
+	}
+
+	return cfg
+}
+
+// ipKey returns the masked network of the given IP address that free requests
+// are counted for.
+func (c *Config) ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(c.IPv4Mask, 8*net.IPv4len)
+		return fmt.Sprintf("%v/%d", ip4.Mask(mask), c.IPv4Mask)
+	}
+
+	mask := net.CIDRMask(c.IPv6Mask, 8*net.IPv6len)
+	return fmt.Sprintf("%v/%d", ip.To16().Mask(mask), c.IPv6Mask)
+}
+
+// windowStart returns the start of the time window the given time falls in.
+// Without a window, the zero time is returned so all requests are counted
+// together.
+func (c *Config) windowStart(now time.Time) time.Time {
+	if c.Window == 0 {
+		return time.Time{}
+	}
+
+	return now.UTC().Truncate(c.Window)
+}
+
+// windowEnd returns the end of the time window the given time falls in.
+// Without a window, the zero time is returned as the counts never expire.
+func (c *Config) windowEnd(now time.Time) time.Time {
+	if c.Window == 0 {
+		return time.Time{}
+	}
+
+	return c.windowStart(now).Add(c.Window)
+}
@@ -0,0 +1,79 @@
+package freebie
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CountStore is a persistent store of freebie counts. The counts of all
+// services are kept in the same store, keyed by the service name, the masked
+// network and the start of the time window.
+type CountStore interface {
+	// FreebieCount returns the number of free requests made to the given
+	// service from the given network in the window starting at the given
+	// time.
+	FreebieCount(ctx context.Context, service, ipKey string,
+		windowStart time.Time) (Count, error)
+
+	// IncrementFreebieCount atomically increments the number of free
+	// requests made to the given service from the given network in the
+	// window starting at the given time and returns the new count. Counts
+	// of earlier windows for the same network may be removed. The count may
+	// be removed after the given end of the window, a zero end means the
+	// count must be kept forever.
+	IncrementFreebieCount(ctx context.Context, service, ipKey string,
+		windowStart, windowEnd time.Time) (Count, error)
+}
+
+// dbStore is a freebie store of a single service that keeps its counts in a
+// persistent CountStore.
+type dbStore struct {
+	store       CountStore
+	service     string
+	numFreebies Count
+	cfg         *Config
+	now         func() time.Time
+}
+
+func (d *dbStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	count, err := d.store.FreebieCount(
+		r.Context(), d.service, d.cfg.ipKey(ip),
+		d.cfg.windowStart(d.now()),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return count < d.numFreebies, nil
+}
+
+func (d *dbStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
+	now := d.now()
+	_, err := d.store.IncrementFreebieCount(
+		r.Context(), d.service, d.cfg.ipKey(ip), d.cfg.windowStart(now),
+		d.cfg.windowEnd(now),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// NewDBStore creates a new freebie store for the given service that keeps its
+// counts in the given persistent store. IP addresses are masked and requests
+// are counted per time window as defined by the given configuration. If the
+// configuration is nil, the defaults are used.
+func NewDBStore(store CountStore, service string, numFreebies Count,
+	cfg *Config) DB {
+
+	return &dbStore{
+		store:       store,
+		service:     service,
+		numFreebies: numFreebies,
+		cfg:         cfg.withDefaults(),
+		now:         time.Now,
+	}
+}
@@ -3,48 +3,97 @@ package freebie
 import (
 	"net"
 	"net/http"
-)
-
-var (
-	defaultIPMask = net.IPv4Mask(0xff, 0xff, 0xff, 0x00)
+	"sync"
+	"time"
 )
 
 type Count uint16
 
-type memStore struct {
-	numFreebies    Count
-	freebieCounter map[string]Count
+// memCounter is the number of free requests made from a network within a
+// time window.
+type memCounter struct {
+	windowStart time.Time
+	count       Count
 }
 
-func (m *memStore) getKey(ip net.IP) string {
-	return ip.Mask(defaultIPMask).String()
+type memStore struct {
+	numFreebies Count
+	cfg         *Config
+	now         func() time.Time
+
+	// lastWindow is the start of the most recent window a request was
+	// counted in. Once a new window begins, all counters of older windows
+	// are pruned.
+	lastWindow time.Time
+
+	freebieCounter map[string]memCounter
+	mtx            sync.Mutex
 }
 
-func (m *memStore) currentCount(ip net.IP) Count {
-	counter, ok := m.freebieCounter[m.getKey(ip)]
-	if !ok {
+// currentCount returns the number of free requests made from the network of
+// the given IP in the current window. The caller must hold the mutex.
+func (m *memStore) currentCount(key string, windowStart time.Time) Count {
+	counter, ok := m.freebieCounter[key]
+	if !ok || !counter.windowStart.Equal(windowStart) {
 		return 0
 	}
-	return counter
+	return counter.count
 }
 
 func (m *memStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
-	return m.currentCount(ip) < m.numFreebies, nil
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	windowStart := m.cfg.windowStart(m.now())
+	return m.currentCount(m.cfg.ipKey(ip), windowStart) < m.numFreebies,
+		nil
 }
 
 func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
-	counter := m.currentCount(ip) + 1
-	m.freebieCounter[m.getKey(ip)] = counter
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	windowStart := m.cfg.windowStart(m.now())
+	if windowStart.After(m.lastWindow) {
+		m.prune(windowStart)
+		m.lastWindow = windowStart
+	}
+
+	key := m.cfg.ipKey(ip)
+	m.freebieCounter[key] = memCounter{
+		windowStart: windowStart,
+		count:       m.currentCount(key, windowStart) + 1,
+	}
 	return true, nil
 }
 
+// prune removes all counters of windows before the given one. The caller must
+// hold the mutex.
+func (m *memStore) prune(windowStart time.Time) {
+	for key, counter := range m.freebieCounter {
+		if counter.windowStart.Before(windowStart) {
+			delete(m.freebieCounter, key)
+		}
+	}
+}
+
 // NewMemIPMaskStore creates a new in-memory freebie store that masks the last
 // byte of an IP address to keep track of free requests. The last byte of the
 // address is discarded for the mapping to reduce risk of abuse by users that
 // have a whole range of IPs at their disposal.
 func NewMemIPMaskStore(numFreebies Count) DB {
+	return NewMemStore(numFreebies, nil)
+}
+
+// NewMemStore creates a new in-memory freebie store that is safe for
+// concurrent use. IP addresses are masked and requests are counted per time
+// window as defined by the given configuration. If the configuration is nil,
+// the defaults are used.
+func NewMemStore(numFreebies Count, cfg *Config) DB {
 	return &memStore{
 		numFreebies:    numFreebies,
-		freebieCounter: make(map[string]Count),
+		cfg:            cfg.withDefaults(),
+		now:            time.Now,
+		freebieCounter: make(map[string]memCounter),
 	}
 }
@@ -0,0 +1,223 @@
+package freebie
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockCountStore is an in-memory CountStore.
+type mockCountStore struct {
+	counts map[string]Count
+	mtx    sync.Mutex
+}
+
+func (m *mockCountStore) key(service, ipKey string,
+	windowStart time.Time) string {
+
+	return service + "|" + ipKey + "|" + windowStart.String()
+}
+
+func (m *mockCountStore) FreebieCount(_ context.Context, service,
+	ipKey string, windowStart time.Time) (Count, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.counts[m.key(service, ipKey, windowStart)], nil
+}
+
+func (m *mockCountStore) IncrementFreebieCount(_ context.Context, service,
+	ipKey string, windowStart, _ time.Time) (Count, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := m.key(service, ipKey, windowStart)
+	m.counts[key]++
+
+	return m.counts[key], nil
+}
+
+// testClock is a settable time source.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// newTestStores creates a memory and a database backed store with the given
+// configuration that both use the given clock.
+func newTestStores(numFreebies Count, cfg *Config,
+	clock *testClock) map[string]DB {
+
+	mem := NewMemStore(numFreebies, cfg).(*memStore)
+	mem.now = clock.Now
+
+	db := NewDBStore(
+		&mockCountStore{counts: make(map[string]Count)}, "service",
+		numFreebies, cfg,
+	).(*dbStore)
+	db.now = clock.Now
+
+	return map[string]DB{
+		StoreMemory: mem,
+		StoreDB:     db,
+	}
+}
+
+// tally uses up a free request for the given IP if it can pass.
+func tally(t *testing.T, store DB, ip string) bool {
+	r := httptest.NewRequest("GET", "/", nil)
+	ok, err := store.CanPass(r, net.ParseIP(ip))
+	require.NoError(t, err)
+	if !ok {
+		return false
+	}
+
+	_, err = store.TallyFreebie(r, net.ParseIP(ip))
+	require.NoError(t, err)
+
+	return true
+}
+
+// TestStoreWindow makes sure free requests are granted again once a new time
+// window begins and never again without a window.
+func TestStoreWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name  string
+		cfg   *Config
+		renew bool
+	}{{
+		name: "no window",
+	}, {
+		name:  "daily window",
+		cfg:   &Config{Window: 24 * time.Hour},
+		renew: true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &testClock{now: start}
+			for name, store := range newTestStores(2, tc.cfg, clock) {
+				clock.now = start
+
+				require.True(t, tally(t, store, "1.2.3.4"), name)
+				require.True(t, tally(t, store, "1.2.3.4"), name)
+				require.False(t, tally(t, store, "1.2.3.4"), name)
+
+				clock.now = start.Add(2 * time.Hour)
+				require.Equal(
+					t, tc.renew, tally(t, store, "1.2.3.4"),
+					name,
+				)
+			}
+		})
+	}
+}
+
+// TestStoreMask makes sure addresses are counted per masked network.
+func TestStoreMask(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	cfg := &Config{IPv4Mask: 16, IPv6Mask: 64}
+
+	for name, store := range newTestStores(1, cfg, clock) {
+		require.True(t, tally(t, store, "10.1.2.3"), name)
+		require.False(t, tally(t, store, "10.1.200.3"), name)
+		require.True(t, tally(t, store, "10.2.2.3"), name)
+
+		// IPv4 mapped IPv6 addresses count as IPv4.
+		require.False(t, tally(t, store, "::ffff:10.1.0.1"), name)
+
+		require.True(t, tally(t, store, "2001:db8:0:1::1"), name)
+		require.False(t, tally(t, store, "2001:db8:0:1::2"), name)
+		require.True(t, tally(t, store, "2001:db8:0:2::1"), name)
+	}
+}
+
+// TestMemStoreConcurrent makes sure the memory store can be used from
+// concurrent requests.
+func TestMemStoreConcurrent(t *testing.T) {
+	const numRequests = 100
+	store := NewMemStore(numRequests, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			_, err := store.TallyFreebie(r, net.ParseIP("1.2.3.4"))
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	ok, err := store.CanPass(r, net.ParseIP("1.2.3.4"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+// TestMemStorePrune makes sure counters of past windows are removed.
+func TestMemStorePrune(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	store := NewMemStore(1, &Config{Window: time.Hour}).(*memStore)
+	store.now = clock.Now
+
+	require.True(t, tally(t, store, "1.2.3.4"))
+	require.True(t, tally(t, store, "5.6.7.8"))
+	require.Len(t, store.freebieCounter, 2)
+
+	clock.now = clock.now.Add(time.Hour)
+	require.True(t, tally(t, store, "1.2.3.4"))
+	require.Len(t, store.freebieCounter, 1)
+}
+
+// TestConfigValidate makes sure invalid configurations are rejected.
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, DefaultConfig().Validate())
+	require.NoError(t, (&Config{}).Validate())
+
+	invalid := []Config{
+		{Store: "redis"},
+		{Window: -time.Second},
+		{IPv4Mask: 33},
+		{IPv6Mask: 129},
+		{IPv4Mask: -1},
+	}
+	for _, cfg := range invalid {
+		require.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+	}
+
+	// Zero masks are unset and replaced by the defaults, they never mask
+	// all addresses into the same network.
+	cfg := (&Config{}).withDefaults()
+	require.Equal(t, "1.2.3.0/24", cfg.ipKey(net.ParseIP("1.2.3.4")))
+	require.Equal(t, "2001:db8:0:ff00::/56",
+		cfg.ipKey(net.ParseIP("2001:db8:0:ffaa::1")))
+}
+
+// TestConfigWindowEnd makes sure the windows end where the next one starts
+// and counts without a window never end.
+func TestConfigWindowEnd(t *testing.T) {
+	now := time.Date(2024, 1, 1, 13, 30, 0, 0, time.UTC)
+
+	cfg := &Config{Window: 24 * time.Hour}
+	end := cfg.windowEnd(now)
+	require.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), end)
+	require.Equal(t, end, cfg.windowStart(end))
+
+	require.True(t, (&Config{}).windowEnd(now).IsZero())
+}
@@ -7,6 +7,8 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,10 +16,13 @@ import (
 	"github.com/lightningnetwork/lnd/build"
 	"github.com/lightningnetwork/lnd/lntest/wait"
 	"github.com/lightningnetwork/lnd/signal"
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -29,6 +34,13 @@ var (
 	}
 	testMessage          = []byte("I'm a message!")
 	apertureStartTimeout = 3 * time.Second
+
+	// testReadTimeout is how long we wait for a message on a stream.
+	testReadTimeout = 5 * time.Second
+
+	// testNoMsgTimeout is how long we wait on a stream that has no
+	// message for us.
+	testNoMsgTimeout = 200 * time.Millisecond
 )
 
 func init() {
@@ -49,6 +61,9 @@ func TestHashMailServerReturnStream(t *testing.T) {
 		),
 	)
 	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
 	client := hashmailrpc.NewHashMailClient(conn)
 
 	// We'll create a new cipher box that we're going to subscribe to
@@ -73,21 +88,17 @@ func TestHashMailServerReturnStream(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	// We need to wait a bit to make sure the message is really sent.
-	time.Sleep(100 * time.Millisecond)
-
-	// Connect, wait for the stream to be ready, read something, then
-	// disconnect immediately.
-	msg, err := readMsgFromStream(t, client)
+	// Connect, wait for the message to arrive, read it, then disconnect
+	// immediately.
+	msg, err := readMsgFromStream(t, client, testReadTimeout)
 	require.NoError(t, err)
 	require.Equal(t, testMessage, msg.Msg)
 
-	// Make sure we can connect again immediately and try to read something.
-	// There is no message to read before we cancel the request so we expect
-	// an EOF error to be returned upon connection close/context cancel.
-	_, err = readMsgFromStream(t, client)
-	require.Error(t, err)
-	require.Contains(t, err.Error(), "context canceled")
+	// Make sure we can connect again and try to read something. There is
+	// no message to read before we give up, so we expect the deadline of
+	// the request to be returned.
+	_, err = readMsgFromStream(t, client, testNoMsgTimeout)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
 
 	// Send then receive yet another message to make sure the stream is
 	// still operational.
@@ -98,10 +109,7 @@ func TestHashMailServerReturnStream(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	// We need to wait a bit to make sure the message is really sent.
-	time.Sleep(100 * time.Millisecond)
-
-	msg, err = readMsgFromStream(t, client)
+	msg, err = readMsgFromStream(t, client, testReadTimeout)
 	require.NoError(t, err)
 	require.Equal(t, testMessage2, msg.Msg)
 
@@ -125,6 +133,9 @@ func TestHashMailServerLargeMessage(t *testing.T) {
 		),
 	)
 	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
 	client := hashmailrpc.NewHashMailClient(conn)
 
 	// We'll create a new cipher box that we're going to subscribe to
@@ -152,12 +163,9 @@ func TestHashMailServerLargeMessage(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	// We need to wait a bit to make sure the message is really sent.
-	time.Sleep(100 * time.Millisecond)
-
-	// Connect, wait for the stream to be ready, read something, then
-	// disconnect immediately.
-	msg, err := readMsgFromStream(t, client)
+	// Connect, wait for the message to arrive, read it, then disconnect
+	// immediately.
+	msg, err := readMsgFromStream(t, client, testReadTimeout)
 	require.NoError(t, err)
 	require.Equal(t, largeMessage[:], msg.Msg)
 }
@@ -169,13 +177,21 @@ func setupAperture(t *testing.T) {
 		Authenticator: &AuthConfig{
 			Disable: true,
 		},
-		DatabaseBackend: "etcd",
-		Etcd:            &EtcdConfig{},
+		DatabaseBackend: "sqlite",
+		Sqlite: &aperturedb.SqliteConfig{
+			DatabaseFileName: filepath.Join(
+				t.TempDir(), "aperture.db",
+			),
+		},
 		HashMail: &HashMailConfig{
 			Enabled:               true,
 			MessageRate:           time.Millisecond,
 			MessageBurstAllowance: math.MaxUint32,
 		},
+		SecretsPruner: &aperturedb.SecretsPrunerConfig{
+			Disable: true,
+		},
+		Admin:      &AdminConfig{},
 		Prometheus: &PrometheusConfig{},
 		Tor:        &TorConfig{},
 	}
@@ -183,6 +199,12 @@ func setupAperture(t *testing.T) {
 	errChan := make(chan error)
 	require.NoError(t, aperture.Start(errChan))
 
+	// All tests listen on the same address, so the server must be gone
+	// before the next test starts its own.
+	t.Cleanup(func() {
+		require.NoError(t, aperture.Stop())
+	})
+
 	// Any error while starting?
 	select {
 	case err := <-errChan:
@@ -208,52 +230,33 @@ func setupAperture(t *testing.T) {
 	require.NoError(t, err)
 }
 
-func readMsgFromStream(t *testing.T,
-	client hashmailrpc.HashMailClient) (*hashmailrpc.CipherBox, error) {
+// readMsgFromStream reads a message from the test stream, giving up after the
+// given timeout. A previous reader releases the read stream only after it
+// disconnected, so we try again while the read stream is still occupied.
+func readMsgFromStream(t *testing.T, client hashmailrpc.HashMailClient,
+	timeout time.Duration) (*hashmailrpc.CipherBox, error) {
 
-	ctxc, cancel := context.WithCancel(context.Background())
-	readStream, err := client.RecvStream(ctxc, testStreamDesc)
-	require.NoError(t, err)
-
-	// Wait a bit again to make sure the request is actually sent before our
-	// context is canceled already again.
-	time.Sleep(100 * time.Millisecond)
-
-	// We'll start a read on the stream in the background.
 	var (
-		goroutineStarted = make(chan struct{})
-		resultChan       = make(chan *hashmailrpc.CipherBox)
-		errChan          = make(chan error)
+		box *hashmailrpc.CipherBox
+		err error
 	)
-	go func() {
-		close(goroutineStarted)
-		box, err := readStream.Recv()
-		if err != nil {
-			errChan <- err
-			return
-		}
-		resultChan <- box
-	}()
-
-	// Give the goroutine a chance to actually run, so block the main thread
-	// until it did.
-	<-goroutineStarted
+	waitErr := wait.Predicate(func() bool {
+		ctxt, cancel := context.WithTimeout(
+			context.Background(), timeout,
+		)
+		defer cancel()
 
-	time.Sleep(200 * time.Millisecond)
+		readStream, streamErr := client.RecvStream(ctxt, testStreamDesc)
+		require.NoError(t, streamErr)
 
-	// Now close and cancel the stream to make sure the server can clean it
-	// up and release it.
-	require.NoError(t, readStream.CloseSend())
-	cancel()
+		box, err = readStream.Recv()
 
-	// Interpret the result.
-	select {
-	case err := <-errChan:
-		return nil, err
+		return err == nil ||
+			!strings.Contains(err.Error(), "read stream occupied")
+	}, apertureStartTimeout+timeout)
+	require.NoError(t, waitErr)
 
-	case box := <-resultChan:
-		return box, nil
-	}
+	return box, err
 }
 
 type statusState struct {
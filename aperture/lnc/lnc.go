@@ -16,6 +16,7 @@ import (
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/mwitkow/grpc-proxy/proxy"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
@@ -29,16 +30,43 @@ var (
 
 	// DefaultStoreTimetout is the default timeout for a db transaction.
 	DefaultStoreTimetout = time.Second * 10
+
+	// DefaultReconnectDelay is the time we wait before the first attempt
+	// to reconnect to the remote node after the connection was lost. The
+	// delay is doubled after each failed attempt.
+	DefaultReconnectDelay = time.Second
+
+	// DefaultMaxReconnectDelay is the maximum time between two attempts to
+	// reconnect to the remote node.
+	DefaultMaxReconnectDelay = time.Minute
+
+	// DefaultExpiryWarning is how long before the expiry of the session we
+	// start warning that a new session needs to be paired.
+	DefaultExpiryWarning = time.Hour * 24
+
+	// ErrSessionExpired is returned when the session can't be used anymore
+	// because it expired. A new session needs to be paired with the
+	// remote node.
+	ErrSessionExpired = errors.New("lnc session expired")
 )
 
 // HeaderMacaroon is the HTTP header field name that is used to send
 // the macaroon.
 const HeaderMacaroon = "Macaroon"
 
+// grpcConn is the part of a gRPC client connection that is used to watch its
+// state.
+type grpcConn interface {
+	GetState() connectivity.State
+	WaitForStateChange(ctx context.Context,
+		sourceState connectivity.State) bool
+	Close() error
+}
+
 // conn is a connection to a remote LND node.
 type conn struct {
 	client     lnrpc.LightningClient
-	grpcClient *grpc.ClientConn
+	grpcClient grpcConn
 	creds      credentials.PerRPCCredentials
 	cancel     func()
 
@@ -56,7 +84,9 @@ func (c *conn) Close() error {
 	return err
 }
 
-// NodeConn handles all the connection logic to a remote LND node using LNC.
+// NodeConn handles all the connection logic to a remote LND node using LNC. If
+// the connection through the mailbox is lost, it is reestablished in the
+// background with the same session.
 type NodeConn struct {
 	// store is the session store.
 	store Store
@@ -70,10 +100,30 @@ type NodeConn struct {
 	// macStr is the macaroon is used to authenticate the connection encoded
 	// as a hex string.
 	macStr string
+
+	// mtx guards conn, macStr and the remote key and expiry of the
+	// session, which change whenever we reconnect.
+	mtx sync.RWMutex
+
+	// dial creates a new connection with the session, the given context
+	// bounds the time to establish it.
+	dial func(ctx context.Context, session *Session) (*conn, error)
+
+	// errChan is used to signal that the session expired and the
+	// connection can't be used anymore.
+	errChan chan<- error
+
+	quit chan struct{}
+	wg   sync.WaitGroup
 }
 
-// NewNodeConn creates a new NodeConn instance.
-func NewNodeConn(session *Session, store Store) (*NodeConn, error) {
+// NewNodeConn creates a new NodeConn instance. The session is loaded from the
+// store if it was used before, so the remote node doesn't need to be paired
+// again. An expired session is refused. Once the session expires while the
+// connection is in use, ErrSessionExpired is sent on the error channel.
+func NewNodeConn(session *Session, store Store,
+	errChan chan<- error) (*NodeConn, error) {
+
 	ctxt, cancel := context.WithTimeout(
 		context.Background(), DefaultStoreTimetout,
 	)
@@ -104,23 +154,62 @@ func NewNodeConn(session *Session, store Store) (*NodeConn, error) {
 		session = dbSession
 	}
 
+	if err := checkExpiry(session); err != nil {
+		return nil, err
+	}
+
 	nodeConn := &NodeConn{
 		store:   store,
 		session: session,
+		errChan: errChan,
+		quit:    make(chan struct{}),
 	}
+	nodeConn.dial = func(ctx context.Context, session *Session) (*conn,
+		error) {
 
-	conn, err := nodeConn.newConn(session)
+		return nodeConn.newConn(ctx, session)
+	}
+
+	conn, err := nodeConn.dial(context.Background(), session)
 	if err != nil {
 		return nil, err
 	}
 
+	nodeConn.mtx.Lock()
 	nodeConn.conn = conn
+	expiry := session.Expiry
+	nodeConn.mtx.Unlock()
+
+	// The expiry of a new session is only known once the remote node sent
+	// its macaroon during the handshake, so we start watching it now.
+	if expiry != nil {
+		log.Infof("LNC session expires at %v", *expiry)
+
+		nodeConn.wg.Add(1)
+		go nodeConn.watchExpiry(*expiry)
+	}
+
+	nodeConn.wg.Add(1)
+	go nodeConn.monitorConn()
 
 	return nodeConn, nil
 }
 
+// checkExpiry returns ErrSessionExpired if the given session expired.
+func checkExpiry(session *Session) error {
+	if session.Expiry == nil || time.Now().Before(*session.Expiry) {
+		return nil
+	}
+
+	return fmt.Errorf("%w at %v, a new session needs to be paired",
+		ErrSessionExpired, *session.Expiry)
+}
+
 // CloseConn closes the connection with the remote node.
 func (n *NodeConn) CloseConn() error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
 	if n.conn == nil {
 		return fmt.Errorf("connection not open")
 	}
@@ -133,17 +222,29 @@ func (n *NodeConn) CloseConn() error {
 	return nil
 }
 
-// Stop closes the connection with the remote node if it is open.
+// Stop stops reconnecting and closes the connection with the remote node if it
+// is open.
 func (n *NodeConn) Stop() error {
-	if n.conn != nil {
+	close(n.quit)
+	n.wg.Wait()
+
+	n.mtx.RLock()
+	open := n.conn != nil
+	n.mtx.RUnlock()
+
+	if open {
 		return n.CloseConn()
 	}
 
 	return nil
 }
 
-// Client returns the gRPC client to the remote node.
+// Client returns the gRPC client to the remote node. The client must not be
+// kept, as it is replaced whenever we reconnect.
 func (n *NodeConn) Client() (lnrpc.LightningClient, error) {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+
 	if n.conn == nil {
 		return nil, fmt.Errorf("connection not open")
 	}
@@ -154,8 +255,213 @@ func (n *NodeConn) Client() (lnrpc.LightningClient, error) {
 // CtxFunc returns the context that needs to be used whenever the internal
 // Client is used.
 func (n *NodeConn) CtxFunc() context.Context {
+	n.mtx.RLock()
+	macStr := n.macStr
+	n.mtx.RUnlock()
+
 	ctx := context.Background()
-	return metadata.AppendToOutgoingContext(ctx, HeaderMacaroon, n.macStr)
+	return metadata.AppendToOutgoingContext(ctx, HeaderMacaroon, macStr)
+}
+
+// ListInvoices returns a paginated list of the invoices of the remote node.
+func (n *NodeConn) ListInvoices(ctx context.Context,
+	in *lnrpc.ListInvoiceRequest,
+	opts ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
+
+	client, err := n.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.ListInvoices(ctx, in, opts...)
+}
+
+// SubscribeInvoices subscribes to the invoice updates of the remote node. The
+// subscription ends if the connection is lost.
+func (n *NodeConn) SubscribeInvoices(ctx context.Context,
+	in *lnrpc.InvoiceSubscription, opts ...grpc.CallOption) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
+
+	client, err := n.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.SubscribeInvoices(ctx, in, opts...)
+}
+
+// AddInvoice adds a new invoice to the remote node.
+func (n *NodeConn) AddInvoice(ctx context.Context, in *lnrpc.Invoice,
+	opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+
+	client, err := n.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.AddInvoice(ctx, in, opts...)
+}
+
+// monitorConn waits for the connection to the remote node to fail and then
+// replaces it with a new one, until the NodeConn is stopped.
+//
+// NOTE: This must be run as a goroutine.
+func (n *NodeConn) monitorConn() {
+	defer n.wg.Done()
+
+	for {
+		n.mtx.RLock()
+		conn := n.conn
+		n.mtx.RUnlock()
+
+		if !n.waitForFailure(conn) {
+			return
+		}
+
+		log.Warnf("LNC connection to the remote node lost, " +
+			"reconnecting")
+
+		if !n.reconnect() {
+			return
+		}
+	}
+}
+
+// waitForFailure blocks until the given connection failed and gRPC gave up on
+// it. False is returned if the NodeConn is stopped before.
+func (n *NodeConn) waitForFailure(c *conn) bool {
+	ctxc, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctxc.Done():
+		}
+	}()
+
+	for {
+		state := c.grpcClient.GetState()
+		switch state {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return true
+		}
+
+		// WaitForStateChange only returns false once the context is
+		// canceled, which means we're shutting down.
+		if !c.grpcClient.WaitForStateChange(ctxc, state) {
+			return false
+		}
+	}
+}
+
+// reconnect creates a new connection with the session, waiting longer after
+// each failed attempt. The new connection replaces the failed one. False is
+// returned if the NodeConn is stopped or the session expired before a new
+// connection could be established.
+func (n *NodeConn) reconnect() bool {
+	delay := DefaultReconnectDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-n.quit:
+			return false
+		}
+
+		// There's no point in trying to reconnect with an expired
+		// session, the expiry watcher reports it.
+		n.mtx.RLock()
+		err := checkExpiry(n.session)
+		n.mtx.RUnlock()
+		if err != nil {
+			return false
+		}
+
+		conn, err := n.dialWithTimeout()
+		if err == nil {
+			n.mtx.Lock()
+			oldConn := n.conn
+			n.conn = conn
+			n.mtx.Unlock()
+
+			if err := oldConn.Close(); err != nil {
+				log.Debugf("Unable to close lost LNC "+
+					"connection: %v", err)
+			}
+
+			log.Infof("Reconnected to the remote node over LNC "+
+				"after %d attempt(s)", attempt)
+
+			return true
+		}
+
+		delay *= 2
+		if delay > DefaultMaxReconnectDelay {
+			delay = DefaultMaxReconnectDelay
+		}
+
+		log.Errorf("Unable to reconnect to the remote node over "+
+			"LNC, retrying in %v: %v", delay, err)
+	}
+}
+
+// dialWithTimeout creates a new connection with the session, giving up after
+// the connection timeout or once the NodeConn is stopped.
+func (n *NodeConn) dialWithTimeout() (*conn, error) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), DefaultConnectionTimetout,
+	)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctxt.Done():
+		}
+	}()
+
+	n.mtx.RLock()
+	session := n.session
+	n.mtx.RUnlock()
+
+	return n.dial(ctxt, session)
+}
+
+// watchExpiry warns ahead of the expiry of the session and signals the error
+// once it expired.
+//
+// NOTE: This must be run as a goroutine.
+func (n *NodeConn) watchExpiry(expiry time.Time) {
+	defer n.wg.Done()
+
+	warnAt := expiry.Add(-DefaultExpiryWarning)
+	if time.Now().Before(warnAt) {
+		select {
+		case <-time.After(time.Until(warnAt)):
+		case <-n.quit:
+			return
+		}
+	}
+
+	log.Warnf("LNC session expires at %v, pair a new session with the "+
+		"remote node before that", expiry)
+
+	select {
+	case <-time.After(time.Until(expiry)):
+	case <-n.quit:
+		return
+	}
+
+	err := fmt.Errorf("%w at %v, a new session needs to be paired",
+		ErrSessionExpired, expiry)
+	log.Errorf("Unable to use the remote node anymore: %v", err)
+
+	select {
+	case n.errChan <- err:
+	case <-n.quit:
+	}
 }
 
 // onRemoteStatic is called when the remote static key is received.
@@ -168,6 +474,11 @@ func (n *NodeConn) onRemoteStatic(key *btcec.PublicKey) error {
 	)
 	defer cancel()
 
+	// Remember the key so we can reconnect without pairing again.
+	n.mtx.Lock()
+	n.session.RemoteStaticPubKey = key
+	n.mtx.Unlock()
+
 	remoteKey := key.SerializeCompressed()
 
 	err := n.store.SetRemotePubKey(
@@ -204,11 +515,16 @@ func (n *NodeConn) onAuthData(data []byte) error {
 
 	// TODO(positiveblue): check that the macaroon has all the needed
 	// permissions.
+	n.mtx.Lock()
 	n.macStr = hex.EncodeToString(macBytes)
+	n.mtx.Unlock()
 
 	// If we already know the expiry time for this session there is no need
 	// to parse the macaroon to obtain it.
-	if n.session.Expiry != nil {
+	n.mtx.RLock()
+	known := n.session.Expiry != nil
+	n.mtx.RUnlock()
+	if known {
 		return nil
 	}
 
@@ -224,7 +540,9 @@ func (n *NodeConn) onAuthData(data []byte) error {
 
 	// When we store the expiry time in the db we lose the precision to
 	// microseconds, but we can store the correct one here.
+	n.mtx.Lock()
 	n.session.Expiry = &expiry
+	n.mtx.Unlock()
 
 	ctxb := context.Background()
 	err = n.store.SetExpiry(ctxb, n.session.PassphraseEntropy, expiry)
@@ -236,14 +554,17 @@ func (n *NodeConn) onAuthData(data []byte) error {
 	return nil
 }
 
-// newConn creates an LNC connection.
-func (n *NodeConn) newConn(session *Session, opts ...grpc.DialOption) (*conn,
-	error) {
+// newConn creates an LNC connection. The given context bounds the time to
+// establish the connection.
+func (n *NodeConn) newConn(ctx context.Context, session *Session,
+	opts ...grpc.DialOption) (*conn, error) {
 
 	localKey := &keychain.PrivKeyECDH{PrivKey: session.LocalStaticPrivKey}
 
 	// remoteKey can be nil if this is the first time the session is used.
+	n.mtx.RLock()
 	remoteKey := session.RemoteStaticPubKey
+	n.mtx.RUnlock()
 	entropy := session.PassphraseEntropy
 
 	connData := mailbox.NewConnData(
@@ -281,8 +602,10 @@ func (n *NodeConn) newConn(session *Session, opts ...grpc.DialOption) (*conn,
 	}
 	dialOpts = append(dialOpts, opts...)
 
+	// The dial is bounded by the given context, while the transport lives
+	// until the connection is closed.
 	grpcClient, err := grpc.DialContext(
-		ctxc, session.MailboxAddr, dialOpts...,
+		ctx, session.MailboxAddr, dialOpts...,
 	)
 	if err != nil {
 		cancel()
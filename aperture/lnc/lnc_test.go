@@ -0,0 +1,421 @@
+package lnc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btclog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/connectivity"
+)
+
+// mockGrpcConn is a gRPC connection whose state is set by the test.
+type mockGrpcConn struct {
+	mtx     sync.Mutex
+	state   connectivity.State
+	changed chan struct{}
+	closed  bool
+}
+
+func newMockGrpcConn() *mockGrpcConn {
+	return &mockGrpcConn{
+		state:   connectivity.Ready,
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *mockGrpcConn) GetState() connectivity.State {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.state
+}
+
+func (m *mockGrpcConn) WaitForStateChange(ctx context.Context,
+	sourceState connectivity.State) bool {
+
+	m.mtx.Lock()
+	state, changed := m.state, m.changed
+	m.mtx.Unlock()
+
+	if state != sourceState {
+		return true
+	}
+
+	select {
+	case <-changed:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *mockGrpcConn) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.closed = true
+
+	return nil
+}
+
+func (m *mockGrpcConn) setState(state connectivity.State) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.state = state
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *mockGrpcConn) isClosed() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.closed
+}
+
+// newMockConn returns a connection backed by a mock gRPC connection.
+func newMockConn() (*conn, *mockGrpcConn) {
+	grpcClient := newMockGrpcConn()
+
+	return &conn{grpcClient: grpcClient, cancel: func() {}}, grpcClient
+}
+
+// logBuffer collects the log output of the package.
+type logBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) contains(s string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return strings.Contains(l.buf.String(), s)
+}
+
+// captureLogs makes the package log warnings and errors to the returned
+// buffer for the duration of the test.
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	logger := btclog.NewBackend(logs).Logger(Subsystem)
+	logger.SetLevel(btclog.LevelWarn)
+
+	prevLog := log
+	UseLogger(logger)
+	t.Cleanup(func() {
+		UseLogger(prevLog)
+	})
+
+	return logs
+}
+
+// setVar sets a package variable for the duration of the test.
+func setVar[T any](t *testing.T, v *T, value T) {
+	prev := *v
+	*v = value
+	t.Cleanup(func() {
+		*v = prev
+	})
+}
+
+// TestWatchExpiry tests that the expiry of the session is warned about ahead
+// of time and signaled once it is reached.
+func TestWatchExpiry(t *testing.T) {
+	setVar(t, &DefaultExpiryWarning, 500*time.Millisecond)
+
+	tests := []struct {
+		name string
+
+		// expiresIn is the time left until the session expires.
+		expiresIn time.Duration
+
+		// warned is whether the expiry is warned about right away.
+		warned bool
+	}{
+		{
+			name:      "before the warning",
+			expiresIn: 800 * time.Millisecond,
+		},
+		{
+			name:      "at the warning",
+			expiresIn: 500 * time.Millisecond,
+			warned:    true,
+		},
+		{
+			name:      "within the warning",
+			expiresIn: 200 * time.Millisecond,
+			warned:    true,
+		},
+		{
+			name:      "after the expiry",
+			expiresIn: -time.Minute,
+			warned:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			errChan := make(chan error, 1)
+			n := &NodeConn{
+				errChan: errChan,
+				quit:    make(chan struct{}),
+			}
+
+			expiry := time.Now().Add(tc.expiresIn)
+			n.wg.Add(1)
+			go n.watchExpiry(expiry)
+
+			const warning = "pair a new session"
+			if tc.warned {
+				require.Eventually(t, func() bool {
+					return logs.contains(warning)
+				}, time.Second, 5*time.Millisecond)
+			} else {
+				// Give the watcher some time to warn too early.
+				time.Sleep(50 * time.Millisecond)
+				require.False(t, logs.contains(warning))
+
+				require.Eventually(t, func() bool {
+					return logs.contains(warning)
+				}, time.Second, 5*time.Millisecond)
+				require.False(
+					t, time.Now().Before(
+						expiry.Add(-DefaultExpiryWarning),
+					),
+				)
+			}
+
+			select {
+			case err := <-errChan:
+				require.ErrorIs(t, err, ErrSessionExpired)
+				require.False(t, time.Now().Before(expiry))
+
+			case <-time.After(2 * time.Second):
+				t.Fatal("expiry not signaled")
+			}
+
+			close(n.quit)
+			n.wg.Wait()
+		})
+	}
+}
+
+// TestWatchExpiryStop tests that stopping the connection stops waiting for
+// the expiry of the session.
+func TestWatchExpiryStop(t *testing.T) {
+	errChan := make(chan error, 1)
+	n := &NodeConn{
+		errChan: errChan,
+		quit:    make(chan struct{}),
+	}
+
+	n.wg.Add(1)
+	go n.watchExpiry(time.Now().Add(DefaultExpiryWarning + time.Hour))
+
+	close(n.quit)
+	n.wg.Wait()
+	require.Empty(t, errChan)
+}
+
+// TestReconnect tests that a lost connection is replaced with a new one.
+func TestReconnect(t *testing.T) {
+	setVar(t, &DefaultReconnectDelay, 10*time.Millisecond)
+
+	expired := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name string
+
+		// expiry is the expiry of the session, if any.
+		expiry *time.Time
+
+		// dialErrs are the errors of the attempts to reconnect before
+		// one succeeds.
+		dialErrs []error
+
+		// reconnected is whether the lost connection is replaced.
+		reconnected bool
+	}{
+		{
+			name:        "reconnected at the first attempt",
+			reconnected: true,
+		},
+		{
+			name: "reconnected after failed attempts",
+			dialErrs: []error{
+				errors.New("mailbox unreachable"),
+				errors.New("mailbox unreachable"),
+			},
+			reconnected: true,
+		},
+		{
+			name:   "expired session",
+			expiry: &expired,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			oldConn, oldGrpcConn := newMockConn()
+			newConn, newGrpcConn := newMockConn()
+
+			var (
+				mtx   sync.Mutex
+				dials int
+			)
+			n := &NodeConn{
+				session: &Session{Expiry: tc.expiry},
+				conn:    oldConn,
+				quit:    make(chan struct{}),
+			}
+			n.dial = func(context.Context, *Session) (*conn, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				dials++
+				if dials <= len(tc.dialErrs) {
+					return nil, tc.dialErrs[dials-1]
+				}
+
+				return newConn, nil
+			}
+
+			n.wg.Add(1)
+			go n.monitorConn()
+
+			oldGrpcConn.setState(connectivity.Connecting)
+			oldGrpcConn.setState(connectivity.TransientFailure)
+
+			if tc.reconnected {
+				require.Eventually(t, func() bool {
+					n.mtx.RLock()
+					defer n.mtx.RUnlock()
+
+					return n.conn == newConn
+				}, time.Second, 5*time.Millisecond)
+				require.True(t, oldGrpcConn.isClosed())
+
+				mtx.Lock()
+				require.Equal(t, len(tc.dialErrs)+1, dials)
+				mtx.Unlock()
+			} else {
+				// The monitor gives up on an expired session.
+				n.wg.Wait()
+				require.Equal(t, 0, dials)
+				require.Same(t, oldConn, n.conn)
+			}
+
+			require.NoError(t, n.Stop())
+			require.Equal(t, tc.reconnected, newGrpcConn.isClosed())
+		})
+	}
+}
+
+// TestReconnectStop tests that stopping the connection stops reconnecting,
+// while waiting before the next attempt or while dialing.
+func TestReconnectStop(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// delay is the time to wait before the first attempt.
+		delay time.Duration
+
+		// blockDial is whether the dial blocks until it is canceled.
+		blockDial bool
+
+		dials int
+	}{
+		{
+			name:  "waiting before the next attempt",
+			delay: time.Hour,
+		},
+		{
+			name:      "dialing",
+			delay:     time.Millisecond,
+			blockDial: true,
+			dials:     1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setVar(t, &DefaultReconnectDelay, tc.delay)
+
+			oldConn, oldGrpcConn := newMockConn()
+			dialing := make(chan struct{})
+
+			var (
+				mtx   sync.Mutex
+				dials int
+			)
+			n := &NodeConn{
+				session: &Session{},
+				conn:    oldConn,
+				quit:    make(chan struct{}),
+			}
+			n.dial = func(ctx context.Context, _ *Session) (*conn,
+				error) {
+
+				mtx.Lock()
+				dials++
+				mtx.Unlock()
+
+				if !tc.blockDial {
+					return nil, errors.New("mailbox " +
+						"unreachable")
+				}
+
+				close(dialing)
+				<-ctx.Done()
+
+				return nil, ctx.Err()
+			}
+
+			n.wg.Add(1)
+			go n.monitorConn()
+
+			oldGrpcConn.setState(connectivity.TransientFailure)
+
+			if tc.blockDial {
+				<-dialing
+			} else {
+				// Give the monitor time to notice the failure.
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- n.Stop()
+			}()
+
+			select {
+			case err := <-stopped:
+				require.NoError(t, err)
+
+			case <-time.After(time.Second):
+				t.Fatal("stop blocked by reconnecting")
+			}
+
+			mtx.Lock()
+			require.Equal(t, tc.dials, dials)
+			mtx.Unlock()
+			require.Same(t, oldConn, n.conn)
+			require.True(t, oldGrpcConn.isClosed())
+		})
+	}
+}
@@ -11,6 +11,9 @@ import (
 type Lnurl struct {
 	Lud16 string
 	Lnurl string
+
+	// Client is the HTTP client used for requests to the LNURL server.
+	Client *http.Client
 }
 
 // {"status":"OK","tag":"payRequest","commentAllowed":255,"callback":"https://getalby.com/lnurlp/moti/callback","metadata":"[[\"text/identifier\",\"moti@getalby.com\"],[\"text/plain\",\"Sats for moti\"]]","minSendable":1000,"maxSendable":500000000,"payerData":{"name":{"mandatory":false},"email":{"mandatory":false},"pubkey":{"mandatory":false}},"nostrPubkey":"79f00d3f5a19ec806189fcab03c1be4ff81d18ee4f653c88fac41fe03570f432","allowsNostr":true}%
@@ -60,13 +63,14 @@ func NewLnurl(lud16 string) (*Lnurl, error) {
 	}
 	name, domain := parts[0], parts[1]
 	return &Lnurl{
-		Lud16: lud16,
-		Lnurl: fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, name),
+		Lud16:  lud16,
+		Lnurl:  fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, name),
+		Client: http.DefaultClient,
 	}, nil
 }
 
 func (l *Lnurl) GetInvoice(amount_sats int64) (string, error) {
-	resp, err := http.Get(l.Lnurl)
+	resp, err := l.Client.Get(l.Lnurl)
 	if err != nil {
 		return "", err
 	}
@@ -94,7 +98,7 @@ func (l *Lnurl) GetInvoice(amount_sats int64) (string, error) {
 	q.Set("amount", fmt.Sprintf("%d", amount_sats*1000))
 	u.RawQuery = q.Encode()
 
-	resp, err = http.Get(u.String())
+	resp, err = l.Client.Get(u.String())
 	if err != nil {
 		return "", err
 	}
@@ -9,6 +9,7 @@ import (
 	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
 	"github.com/motxx/aperture-lnproxy/aperture/challenger"
+	"github.com/motxx/aperture-lnproxy/aperture/lnc"
 	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/proxy"
 )
@@ -33,6 +34,7 @@ func SetupLoggers(root *build.RotatingLogWriter, intercept signal.Interceptor) {
 	lnd.AddSubLogger(root, proxy.Subsystem, intercept, proxy.UseLogger)
 	lnd.AddSubLogger(root, challenger.Subsystem, intercept, challenger.UseLogger)
 	lnd.AddSubLogger(root, aperturedb.Subsystem, intercept, aperturedb.UseLogger)
+	lnd.AddSubLogger(root, lnc.Subsystem, intercept, lnc.UseLogger)
 	lnd.AddSubLogger(root, "LNDC", intercept, lndclient.UseLogger)
 }
 
@@ -24,6 +24,20 @@ const (
 	// HeaderMacaroon is the HTTP header field name that is used to send the
 	// L402 by our own gRPC clients.
 	HeaderMacaroon = "Macaroon"
+
+	// HeaderUsesRemaining is the HTTP header field name that is used to
+	// tell clients how many more requests their usage counted L402 can be
+	// used for.
+	HeaderUsesRemaining = "L402-Uses-Remaining"
+
+	// HeaderDenyReason is the HTTP header field name that is used to tell
+	// clients why their L402 was denied, if the reason isn't just a missing
+	// or unpaid L402.
+	HeaderDenyReason = "L402-Deny-Reason"
+
+	// DenyReasonRevoked is the deny reason of an L402 that was revoked by
+	// the operator.
+	DenyReasonRevoked = "revoked"
 )
 
 var (
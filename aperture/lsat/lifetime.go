@@ -0,0 +1,161 @@
+package lsat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// lifetimeForever is the value of a lifetime that never ends.
+	lifetimeForever = "forever"
+
+	// lifetimeUsesSuffix is the suffix of the number of uses in the value
+	// of a lifetime.
+	lifetimeUsesSuffix = "uses"
+
+	// DefaultLifetimeDuration is how long an L402 grants access after its
+	// invoice was settled if its service has no lifetime configured.
+	DefaultLifetimeDuration = time.Hour
+)
+
+var (
+	// DefaultLifetime is the lifetime of L402s for services that have no
+	// lifetime configured.
+	DefaultLifetime = Lifetime{Duration: DefaultLifetimeDuration}
+
+	// ErrInvalidLifetime is returned if a lifetime can't be parsed.
+	ErrInvalidLifetime = errors.New("lifetime must be \"forever\" or a " +
+		"comma separated duration like \"24h\" and/or number of uses " +
+		"like \"10 uses\"")
+)
+
+// Lifetime determines how long an L402 grants access to a service once its
+// invoice was settled. The zero value grants access forever.
+type Lifetime struct {
+	// Duration is the time access is granted for after the invoice was
+	// settled. Zero means there is no time limit.
+	Duration time.Duration
+
+	// Uses is the number of requests the L402 can be used for. Zero means
+	// there is no limit on the number of requests.
+	Uses uint32
+}
+
+// IsForever returns true if the lifetime never ends.
+func (l Lifetime) IsForever() bool {
+	return l.Duration == 0 && l.Uses == 0
+}
+
+// ExceedsDuration returns true if the duration of the lifetime is longer than
+// the one of the given lifetime. No time limit is longer than any duration.
+func (l Lifetime) ExceedsDuration(other Lifetime) bool {
+	if other.Duration == 0 {
+		return false
+	}
+
+	return l.Duration == 0 || l.Duration > other.Duration
+}
+
+// String returns the lifetime in the format understood by ParseLifetime.
+func (l Lifetime) String() string {
+	if l.IsForever() {
+		return lifetimeForever
+	}
+
+	var parts []string
+	if l.Duration != 0 {
+		parts = append(parts, l.Duration.String())
+	}
+	if l.Uses != 0 {
+		parts = append(parts, fmt.Sprintf("%d %s", l.Uses,
+			lifetimeUsesSuffix))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ParseLifetime parses a lifetime. Valid values are "forever", a duration like
+// "24h", a number of uses like "10 uses", or a duration and a number of uses
+// separated by a comma.
+func ParseLifetime(s string) (Lifetime, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == lifetimeForever {
+		return Lifetime{}, nil
+	}
+
+	var l Lifetime
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+
+		if strings.HasSuffix(part, lifetimeUsesSuffix) {
+			usesStr := strings.TrimSpace(
+				strings.TrimSuffix(part, lifetimeUsesSuffix),
+			)
+			uses, err := strconv.ParseUint(usesStr, 10, 32)
+			if err != nil || uses == 0 || l.Uses != 0 {
+				return Lifetime{}, fmt.Errorf("%w: %q",
+					ErrInvalidLifetime, s)
+			}
+			l.Uses = uint32(uses)
+
+			continue
+		}
+
+		duration, err := time.ParseDuration(part)
+		if err != nil || duration <= 0 || l.Duration != 0 {
+			return Lifetime{}, fmt.Errorf("%w: %q", ErrInvalidLifetime,
+				s)
+		}
+		l.Duration = duration
+	}
+
+	return l, nil
+}
+
+// LifetimeFromMacaroon returns the lifetime of the given service from the
+// lifetime and usage count caveats of the macaroon. If there are multiple
+// caveats of a kind for the service, the last one is used, which is the most
+// restrictive one if the macaroon was verified with the lifetime and uses
+// satisfiers. The boolean is false if the macaroon has no lifetime caveat for
+// the service, in which case the returned duration should not be relied on.
+func LifetimeFromMacaroon(mac *macaroon.Macaroon,
+	serviceName string) (Lifetime, bool, error) {
+
+	var lifetime Lifetime
+	if value, ok := HasCaveat(mac, serviceName+CondUsesSuffix); ok {
+		uses, err := parseUses(value)
+		if err != nil {
+			return Lifetime{}, false, err
+		}
+		lifetime.Uses = uses
+	}
+
+	value, ok := HasCaveat(mac, serviceName+CondLifetimeSuffix)
+	if !ok {
+		return lifetime, false, nil
+	}
+
+	parsed, err := ParseLifetime(value)
+	if err != nil {
+		return Lifetime{}, false, err
+	}
+	lifetime.Duration = parsed.Duration
+
+	return lifetime, true, nil
+}
+
+// parseUses parses the value of a usage count caveat.
+func parseUses(value string) (uint32, error) {
+	uses, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number of uses %q: %w", value,
+			err)
+	}
+
+	return uint32(uses), nil
+}
@@ -0,0 +1,61 @@
+package lsat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseLifetime tests that lifetimes can be parsed and encoded again.
+func TestParseLifetime(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		value    string
+		lifetime Lifetime
+		encoded  string
+	}{
+		{
+			value:   "forever",
+			encoded: "forever",
+		},
+		{
+			value:    "24h",
+			lifetime: Lifetime{Duration: 24 * time.Hour},
+			encoded:  "24h0m0s",
+		},
+		{
+			value:    "10 uses",
+			lifetime: Lifetime{Uses: 10},
+			encoded:  "10 uses",
+		},
+		{
+			value: "1h30m, 5uses",
+			lifetime: Lifetime{
+				Duration: 90 * time.Minute, Uses: 5,
+			},
+			encoded: "1h30m0s,5 uses",
+		},
+	}
+
+	for _, test := range tests {
+		lifetime, err := ParseLifetime(test.value)
+		require.NoError(t, err)
+		require.Equal(t, test.lifetime, lifetime)
+		require.Equal(t, test.encoded, lifetime.String())
+
+		decoded, err := ParseLifetime(lifetime.String())
+		require.NoError(t, err)
+		require.Equal(t, lifetime, decoded)
+	}
+
+	invalid := []string{
+		"", "never", "-1h", "0 uses", "ten uses", "1h,2h",
+		"1 uses,2 uses",
+	}
+	for _, value := range invalid {
+		_, err := ParseLifetime(value)
+		require.ErrorIs(t, err, ErrInvalidLifetime, value)
+	}
+}
@@ -178,3 +178,93 @@ func NewTimeoutSatisfier(service string, now func() time.Time) Satisfier {
 		},
 	}
 }
+
+// NewLifetimeSatisfier makes sure each lifetime caveat of the given service is
+// at least as restrictive as the previous one, so a lifetime can be shortened
+// but never extended by the holder of an L402. The final lifetime must not be
+// longer than the given maximum, which is the lifetime the L402 was minted
+// with, so a lifetime caveat added by the holder can't grant more than was
+// paid for either. The lifetime itself is enforced by the authenticator since
+// it depends on when the invoice was settled.
+func NewLifetimeSatisfier(service string, maxLifetime Lifetime) Satisfier {
+	return Satisfier{
+		Condition: service + CondLifetimeSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevLifetime, err := ParseLifetime(prev.Value)
+			if err != nil {
+				return fmt.Errorf("error parsing previous "+
+					"caveat value: %w", err)
+			}
+			curLifetime, err := ParseLifetime(cur.Value)
+			if err != nil {
+				return fmt.Errorf("error parsing caveat "+
+					"value: %w", err)
+			}
+
+			if curLifetime.ExceedsDuration(prevLifetime) {
+				return fmt.Errorf("%s caveat violates "+
+					"increasing restrictiveness",
+					service+CondLifetimeSuffix)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			lifetime, err := ParseLifetime(c.Value)
+			if err != nil {
+				return err
+			}
+
+			if lifetime.ExceedsDuration(maxLifetime) {
+				return fmt.Errorf("%s caveat exceeds the "+
+					"lifetime of %v the L402 was minted "+
+					"with", service+CondLifetimeSuffix,
+					maxLifetime.Duration)
+			}
+
+			return nil
+		},
+	}
+}
+
+// NewUsesSatisfier makes sure each usage count caveat of the given service
+// allows at most as many uses as the previous one. The number of uses itself
+// is enforced by the authenticator since it depends on how often the L402 was
+// used before.
+func NewUsesSatisfier(service string) Satisfier {
+	return Satisfier{
+		Condition: service + CondUsesSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevUses, err := parseUses(prev.Value)
+			if err != nil {
+				return fmt.Errorf("error parsing previous "+
+					"caveat value: %w", err)
+			}
+			curUses, err := parseUses(cur.Value)
+			if err != nil {
+				return fmt.Errorf("error parsing caveat "+
+					"value: %w", err)
+			}
+
+			if curUses > prevUses {
+				return fmt.Errorf("%s caveat violates "+
+					"increasing restrictiveness",
+					service+CondUsesSuffix)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			uses, err := parseUses(c.Value)
+			if err != nil {
+				return err
+			}
+			if uses == 0 {
+				return fmt.Errorf("not authorized to access " +
+					"service. L402 has no uses left")
+			}
+
+			return nil
+		},
+	}
+}
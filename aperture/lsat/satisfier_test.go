@@ -85,3 +85,203 @@ func TestTimeoutSatisfier(t *testing.T) {
 		})
 	}
 }
+
+// TestLifetimeSatisfier tests that the lifetime of an L402 can be shortened
+// but never extended.
+func TestLifetimeSatisfier(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name          string
+		lifetimes     []Lifetime
+		expectPrevErr bool
+	}{
+		{
+			name:      "single lifetime",
+			lifetimes: []Lifetime{{Duration: time.Hour}},
+		},
+		{
+			name:      "forever can be limited",
+			lifetimes: []Lifetime{{}, {Duration: time.Hour}},
+		},
+		{
+			name: "shorter duration",
+			lifetimes: []Lifetime{
+				{Duration: time.Hour}, {Duration: time.Minute},
+			},
+		},
+		{
+			name:          "limited lifetime can't become forever",
+			lifetimes:     []Lifetime{{Duration: time.Hour}, {}},
+			expectPrevErr: true,
+		},
+		{
+			name: "longer duration",
+			lifetimes: []Lifetime{
+				{Duration: time.Hour}, {Duration: 2 * time.Hour},
+			},
+			expectPrevErr: true,
+		},
+	}
+
+	service := "restricted"
+	satisfier := NewLifetimeSatisfier(service, Lifetime{})
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var prev *Caveat
+			for _, lifetime := range test.lifetimes {
+				caveat := NewLifetimeCaveat(service, lifetime)
+
+				if prev != nil {
+					err := satisfier.SatisfyPrevious(
+						*prev, caveat,
+					)
+					if test.expectPrevErr {
+						require.Error(t, err)
+					} else {
+						require.NoError(t, err)
+					}
+				}
+
+				require.NoError(t, satisfier.SatisfyFinal(caveat))
+
+				prev = &caveat
+			}
+		})
+	}
+}
+
+// TestLifetimeSatisfierMaxLifetime tests that the final lifetime of an L402
+// can't be longer than the one it was minted with, even if the L402 has no
+// lifetime caveat to compare against.
+func TestLifetimeSatisfierMaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name           string
+		maxLifetime    Lifetime
+		lifetime       Lifetime
+		expectFinalErr bool
+	}{
+		{
+			name:        "same duration",
+			maxLifetime: Lifetime{Duration: time.Hour},
+			lifetime:    Lifetime{Duration: time.Hour},
+		},
+		{
+			name:        "shorter duration",
+			maxLifetime: Lifetime{Duration: time.Hour},
+			lifetime:    Lifetime{Duration: time.Minute},
+		},
+		{
+			name:           "longer duration",
+			maxLifetime:    Lifetime{Duration: time.Hour},
+			lifetime:       Lifetime{Duration: 8760 * time.Hour},
+			expectFinalErr: true,
+		},
+		{
+			name:           "forever",
+			maxLifetime:    Lifetime{Duration: time.Hour},
+			lifetime:       Lifetime{},
+			expectFinalErr: true,
+		},
+		{
+			name:        "forever when minted forever",
+			maxLifetime: Lifetime{},
+			lifetime:    Lifetime{},
+		},
+	}
+
+	service := "restricted"
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			satisfier := NewLifetimeSatisfier(
+				service, test.maxLifetime,
+			)
+			err := satisfier.SatisfyFinal(
+				NewLifetimeCaveat(service, test.lifetime),
+			)
+			if test.expectFinalErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestUsesSatisfier tests that the number of uses of an L402 can be lowered but
+// never raised.
+func TestUsesSatisfier(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name           string
+		uses           []string
+		expectFinalErr bool
+		expectPrevErr  bool
+	}{
+		{
+			name: "single usage count",
+			uses: []string{"10"},
+		},
+		{
+			name: "fewer uses",
+			uses: []string{"10", "5"},
+		},
+		{
+			name:          "more uses",
+			uses:          []string{"5", "10"},
+			expectPrevErr: true,
+		},
+		{
+			name:           "no uses",
+			uses:           []string{"0"},
+			expectFinalErr: true,
+		},
+		{
+			name:           "invalid usage count",
+			uses:           []string{"-1"},
+			expectFinalErr: true,
+		},
+	}
+
+	var (
+		service   = "restricted"
+		condition = service + CondUsesSuffix
+		satisfier = NewUsesSatisfier(service)
+	)
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var prev *Caveat
+			for _, uses := range test.uses {
+				caveat := NewCaveat(condition, uses)
+
+				if prev != nil {
+					err := satisfier.SatisfyPrevious(
+						*prev, caveat,
+					)
+					if test.expectPrevErr {
+						require.Error(t, err)
+					} else {
+						require.NoError(t, err)
+					}
+				}
+
+				err := satisfier.SatisfyFinal(caveat)
+				if test.expectFinalErr {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+
+				prev = &caveat
+			}
+		})
+	}
+}
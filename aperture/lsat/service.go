@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
 )
 
 const (
@@ -20,6 +22,14 @@ const (
 	// CondTimeoutSuffix is the condition suffix used for a service's
 	// timeout caveat.
 	CondTimeoutSuffix = "_valid_until"
+
+	// CondLifetimeSuffix is the condition suffix used for a service's
+	// lifetime caveat.
+	CondLifetimeSuffix = "_lifetime"
+
+	// CondUsesSuffix is the condition suffix used for a service's usage
+	// count caveat.
+	CondUsesSuffix = "_uses"
 )
 
 var (
@@ -57,6 +67,19 @@ type Service struct {
 
 	// Price of service L402 in satoshis.
 	Price int64
+
+	// OperatorFee is the operator fee policy for the service. If nil, the
+	// global policy of the challenger is used.
+	OperatorFee *fee.Policy
+
+	// DirectPay is true if the price is paid to the operator's own node
+	// instead of to the creator through an lnproxy relay.
+	DirectPay bool
+
+	// Lifetime is how long an L402 for the service grants access once it
+	// was paid. If nil, the minter adds a lifetime caveat of
+	// DefaultLifetime.
+	Lifetime *Lifetime
 }
 
 // NewServicesCaveat creates a new services caveat with the provided caveats.
@@ -153,3 +176,36 @@ func NewTimeoutCaveat(serviceName string, numSeconds int64,
 		Value:     strconv.FormatInt(requestTimeout.Unix(), 10),
 	}
 }
+
+// NewLifetimeCaveat creates a new caveat that limits how long an L402 grants
+// access to the given service once it was paid. Only the duration of the
+// lifetime is part of the caveat, a limit on the number of uses is expressed
+// with a usage count caveat.
+func NewLifetimeCaveat(serviceName string, lifetime Lifetime) Caveat {
+	return Caveat{
+		Condition: serviceName + CondLifetimeSuffix,
+		Value:     Lifetime{Duration: lifetime.Duration}.String(),
+	}
+}
+
+// NewUsesCaveat creates a new caveat that limits the number of requests an
+// L402 can be used for to access the given service.
+func NewUsesCaveat(serviceName string, uses uint32) Caveat {
+	return Caveat{
+		Condition: serviceName + CondUsesSuffix,
+		Value:     strconv.FormatUint(uint64(uses), 10),
+	}
+}
+
+// NewLifetimeCaveats creates the caveats that enforce the given lifetime for
+// the given service.
+func NewLifetimeCaveats(serviceName string, lifetime Lifetime) []Caveat {
+	caveats := []Caveat{NewLifetimeCaveat(serviceName, lifetime)}
+	if lifetime.Uses != 0 {
+		caveats = append(caveats, NewUsesCaveat(
+			serviceName, lifetime.Uses,
+		))
+	}
+
+	return caveats
+}
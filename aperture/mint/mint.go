@@ -19,6 +19,14 @@ var (
 	// ErrSecretNotFound is an error returned when we attempt to retrieve a
 	// secret by its key but it is not found.
 	ErrSecretNotFound = errors.New("secret not found")
+
+	// ErrUsesExhausted is an error returned when a usage counted L402 is
+	// used more often than it allows.
+	ErrUsesExhausted = errors.New("all uses of the L402 are used up")
+
+	// ErrSecretRevoked is an error returned when we attempt to retrieve a
+	// secret of an L402 that was revoked by the operator.
+	ErrSecretRevoked = errors.New("L402 was revoked")
 )
 
 // Challenger is an interface used to present requesters of L402s with a
@@ -26,10 +34,10 @@ var (
 // challenge takes the form of a Lightning payment request.
 type Challenger interface {
 	// NewChallenge returns a new challenge in the form of a Lightning
-	// payment request. The payment hash is also returned as a convenience
-	// to avoid having to decode the payment request in order to retrieve
-	// its payment hash.
-	NewChallenge(recipientLud16 string, price int64) (string, lntypes.Hash, error)
+	// payment request for the price of the given service. The payment
+	// hash is also returned as a convenience to avoid having to decode the
+	// payment request in order to retrieve its payment hash.
+	NewChallenge(service lsat.Service) (string, lntypes.Hash, error)
 
 	// Stop shuts down the challenger.
 	Stop()
@@ -41,13 +49,23 @@ type NullTime = sql.NullTime
 // are required for proper verification of each minted L402.
 type SecretStore interface {
 	// NewSecret creates a new cryptographically random secret which is
-	// keyed by the given hash.
-	NewSecret(context.Context, [sha256.Size]byte, [sha256.Size]byte) ([lsat.SecretSize]byte,
-		error)
+	// keyed by the given hash of the L402's identifier. The name and the
+	// lifetime of the service the L402 is priced for are recorded along
+	// with it.
+	NewSecret(context.Context, [sha256.Size]byte, *lsat.Identifier,
+		lsat.Service) ([lsat.SecretSize]byte, error)
+
+	// GetSecretLifetime returns the name and the lifetime of the service
+	// that were recorded along with the secret that corresponds to the
+	// given hash. The lifetime is nil if the secret was created before
+	// lifetimes were recorded.
+	GetSecretLifetime(context.Context, [sha256.Size]byte) (string,
+		*lsat.Lifetime, error)
 
 	// GetSecret returns the cryptographically random secret that
 	// corresponds to the given hash. If there is no secret, then
-	// ErrSecretNotFound is returned.
+	// ErrSecretNotFound is returned, or ErrSecretRevoked if the L402 was
+	// revoked by the operator.
 	GetSecret(context.Context, [sha256.Size]byte) ([lsat.SecretSize]byte,
 		error)
 
@@ -61,6 +79,13 @@ type SecretStore interface {
 
 	// GetSettledAtByPaymentHash returns the time the secret was settled.
 	GetSettledAtByPaymentHash(context.Context, [sha256.Size]byte) (NullTime, error)
+
+	// IncrementSecretUses atomically increments the number of times the
+	// L402 of the secret that corresponds to the given hash was used and
+	// returns the new number of uses. If the L402 was already used the
+	// given maximum number of times, ErrUsesExhausted is returned.
+	IncrementSecretUses(context.Context, [sha256.Size]byte, uint32) (uint32,
+		error)
 }
 
 // ServiceLimiter abstracts the source of caveats that should be applied to an
@@ -101,6 +126,12 @@ type Config struct {
 
 	// Now returns the current time.
 	Now func() time.Time
+
+	// ServiceLifetime optionally returns the configured lifetime of the
+	// service with the given name, or nil if it has none. It caps the
+	// lifetime of L402s minted before lifetimes were recorded, which are
+	// otherwise capped to the default lifetime.
+	ServiceLifetime func(string) *lsat.Lifetime
 }
 
 // Mint is an entity that is able to mint and verify L402s for a set of
@@ -118,13 +149,20 @@ func New(cfg *Config) *Mint {
 func (m *Mint) MintL402(ctx context.Context,
 	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
 
+	// Every L402 is minted with an explicit lifetime, so its holder can't
+	// add a lifetime caveat of their own that grants more than was paid
+	// for.
+	services = withLifetimes(services)
+
 	// Let the L402 value as the price of the most expensive of the
 	// services.
-	recipientLud16, price := paymentDetailsForMaxPrice(services)
+	service := serviceForMaxPrice(services)
 
 	// We'll start by retrieving a new challenge in the form of a Lightning
 	// payment request to present the requester of the L402 with.
-	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(recipientLud16, price)
+	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(
+		service,
+	)
 	if err != nil {
 		return nil, "", err
 	}
@@ -133,17 +171,17 @@ func (m *Mint) MintL402(ctx context.Context,
 
 	// We can then proceed to mint the L402 with a unique identifier that is
 	// mapped to a unique secret.
-	id, err := createUniqueIdentifier(paymentHash)
+	id, rawID, err := createUniqueIdentifier(paymentHash)
 	if err != nil {
 		return nil, "", err
 	}
-	idHash := sha256.Sum256(id)
-	secret, err := m.cfg.Secrets.NewSecret(ctx, idHash, paymentHash)
+	idHash := sha256.Sum256(rawID)
+	secret, err := m.cfg.Secrets.NewSecret(ctx, idHash, id, service)
 	if err != nil {
 		return nil, "", err
 	}
 	mac, err := macaroon.New(
-		secret[:], id, "lsat", macaroon.LatestVersion,
+		secret[:], rawID, "lsat", macaroon.LatestVersion,
 	)
 	if err != nil {
 		// Attempt to revoke the secret to save space.
@@ -172,28 +210,46 @@ func (m *Mint) MintL402(ctx context.Context,
 	return mac, paymentRequest, nil
 }
 
-// paymentDetailsForMaxPrice determines the necessary payment details to use for a collection
-// of services.
-func paymentDetailsForMaxPrice(services []lsat.Service) (string, int64) {
-	var recipientLud16 string
-	var maxPrice int64
-
+// withLifetimes returns a copy of the given services where the ones without a
+// lifetime have the default lifetime.
+func withLifetimes(services []lsat.Service) []lsat.Service {
+	res := make([]lsat.Service, 0, len(services))
 	for _, service := range services {
-		if service.Price > maxPrice {
-			recipientLud16 = service.RecipientLud16
-			maxPrice = service.Price
+		if service.Lifetime == nil {
+			lifetime := lsat.DefaultLifetime
+			service.Lifetime = &lifetime
+		}
+		res = append(res, service)
+	}
+
+	return res
+}
+
+// serviceForMaxPrice determines the service whose payment details to use for a
+// collection of services, which is the most expensive one.
+func serviceForMaxPrice(services []lsat.Service) lsat.Service {
+	var maxService lsat.Service
+
+	for i, service := range services {
+		// The first service is used if all of them are free, so its
+		// name and lifetime are recorded with the secret.
+		if i == 0 || service.Price > maxService.Price {
+			maxService = service
 		}
 	}
 
-	return recipientLud16, maxPrice
+	return maxService
 }
 
 // createUniqueIdentifier creates a new L402 identifier bound to a payment hash
-// and a randomly generated ID.
-func createUniqueIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
+// and a randomly generated ID. The identifier is returned along with its
+// encoding.
+func createUniqueIdentifier(paymentHash lntypes.Hash) (*lsat.Identifier,
+	[]byte, error) {
+
 	tokenID, err := generateTokenID()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	id := &lsat.Identifier{
@@ -204,9 +260,9 @@ func createUniqueIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
 
 	var buf bytes.Buffer
 	if err := lsat.EncodeIdentifier(&buf, id); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return buf.Bytes(), nil
+	return id, buf.Bytes(), nil
 }
 
 // generateTokenID generates a new random L402 ID.
@@ -246,6 +302,16 @@ func (m *Mint) caveatsForServices(ctx context.Context,
 	caveats = append(caveats, capabilities...)
 	caveats = append(caveats, constraints...)
 	caveats = append(caveats, timeouts...)
+
+	// The lifetime is embedded so clients can tell when they'll have to
+	// pay again, and so it can only be shortened by the holder of the
+	// L402.
+	for _, service := range withLifetimes(services) {
+		caveats = append(caveats, lsat.NewLifetimeCaveats(
+			service.Name, *service.Lifetime,
+		)...)
+	}
+
 	return caveats, nil
 }
 
@@ -263,7 +329,8 @@ type VerificationParams struct {
 	TargetService string
 }
 
-// VerifyL402 attempts to verify an L402 with the given parameters.
+// VerifyL402 attempts to verify an L402 with the given parameters. If the L402
+// was revoked by the operator, ErrSecretRevoked is returned.
 func (m *Mint) VerifyL402(ctx context.Context,
 	params *VerificationParams) error {
 
@@ -289,6 +356,12 @@ func (m *Mint) VerifyL402(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	maxLifetime, err := m.maxLifetime(
+		ctx, sha256.Sum256(params.Macaroon.Id()), params.TargetService,
+	)
+	if err != nil {
+		return err
+	}
 
 	// With the L402 verified, we'll now inspect its caveats to ensure the
 	// target service is authorized.
@@ -306,5 +379,47 @@ func (m *Mint) VerifyL402(ctx context.Context,
 		caveats,
 		lsat.NewServicesSatisfier(params.TargetService),
 		lsat.NewTimeoutSatisfier(params.TargetService, m.cfg.Now),
+		lsat.NewLifetimeSatisfier(params.TargetService, maxLifetime),
+		lsat.NewUsesSatisfier(params.TargetService),
 	)
 }
+
+// maxLifetime returns the longest lifetime an L402 may grant for the target
+// service. That's the lifetime it was minted with, or the configured lifetime
+// of the service if the L402 was minted before lifetimes were recorded or for
+// multiple services.
+func (m *Mint) maxLifetime(ctx context.Context, idHash [sha256.Size]byte,
+	targetService string) (lsat.Lifetime, error) {
+
+	service, lifetime, err := m.cfg.Secrets.GetSecretLifetime(ctx, idHash)
+	if err != nil {
+		return lsat.Lifetime{}, err
+	}
+	if lifetime != nil && service == targetService {
+		return *lifetime, nil
+	}
+
+	if m.cfg.ServiceLifetime != nil {
+		if lifetime := m.cfg.ServiceLifetime(targetService); lifetime != nil {
+			return *lifetime, nil
+		}
+	}
+
+	return lsat.DefaultLifetime, nil
+}
+
+// UseL402 records one use of a usage counted L402 that allows the given
+// maximum number of uses and returns how many uses remain. If the L402 is
+// used up, ErrUsesExhausted is returned. The L402 must be verified first.
+func (m *Mint) UseL402(ctx context.Context, mac *macaroon.Macaroon,
+	maxUses uint32) (uint32, error) {
+
+	uses, err := m.cfg.Secrets.IncrementSecretUses(
+		ctx, sha256.Sum256(mac.Id()), maxUses,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return maxUses - uses, nil
+}
@@ -123,6 +123,36 @@ func TestRevokedL402(t *testing.T) {
 	}
 }
 
+// TestOperatorRevokedL402 ensures that verifying an L402 that was revoked by the
+// operator tells it was revoked.
+func TestOperatorRevokedL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	secrets := newMockSecretStore()
+	mint := New(&Config{
+		Secrets:        secrets,
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	lsat, _, err := mint.MintL402(ctx)
+	if err != nil {
+		t.Fatalf("unable to mint L402: %v", err)
+	}
+	params := &VerificationParams{
+		Macaroon:      lsat,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+
+	secrets.revoked[sha256.Sum256(lsat.Id())] = true
+	if err := mint.VerifyL402(ctx, params); err != ErrSecretRevoked {
+		t.Fatalf("expected ErrSecretRevoked, got %v", err)
+	}
+}
+
 // TestTamperedL402 ensures that an L402 that has been tampered with by
 // modifying its signature results in its verification failing.
 func TestTamperedL402(t *testing.T) {
@@ -278,6 +308,229 @@ func TestExpiredServicesL402(t *testing.T) {
 	require.Contains(t, err.Error(), "not authorized")
 }
 
+// TestLifetimeL402 asserts that the lifetime of a service is embedded in the
+// L402 and can't be extended by its holder.
+func TestLifetimeL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	service := testService
+	service.Lifetime = &lsat.Lifetime{Duration: 24 * time.Hour}
+	mac, _, err := mint.MintL402(ctx, service)
+	require.NoError(t, err)
+
+	lifetime, ok, err := lsat.LifetimeFromMacaroon(mac, service.Name)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, *service.Lifetime, lifetime)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: service.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// Shortening the lifetime is allowed.
+	shorter := mac.Clone()
+	require.NoError(t, lsat.AddFirstPartyCaveats(
+		shorter, lsat.NewLifetimeCaveat(service.Name, lsat.Lifetime{
+			Duration: time.Hour,
+		}),
+	))
+	shorterParams := params
+	shorterParams.Macaroon = shorter
+	require.NoError(t, mint.VerifyL402(ctx, &shorterParams))
+
+	// Extending it to forever is not.
+	require.NoError(t, lsat.AddFirstPartyCaveats(
+		mac, lsat.NewLifetimeCaveat(service.Name, lsat.Lifetime{}),
+	))
+	err = mint.VerifyL402(ctx, &params)
+	require.ErrorContains(t, err, "increasing restrictiveness")
+}
+
+// TestDefaultLifetimeL402 asserts that an L402 of a service without a lifetime
+// is minted with the default lifetime, so its holder can't attenuate it to a
+// longer one.
+func TestDefaultLifetimeL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	lifetime, ok, err := lsat.LifetimeFromMacaroon(mac, testService.Name)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, lsat.DefaultLifetime, lifetime)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	for _, extended := range []lsat.Lifetime{
+		{}, {Duration: 8760 * time.Hour},
+	} {
+		attenuated := mac.Clone()
+		require.NoError(t, lsat.AddFirstPartyCaveats(
+			attenuated, lsat.NewLifetimeCaveat(
+				testService.Name, extended,
+			),
+		))
+		attenuatedParams := params
+		attenuatedParams.Macaroon = attenuated
+		err := mint.VerifyL402(ctx, &attenuatedParams)
+		require.ErrorContains(t, err, "increasing restrictiveness")
+	}
+}
+
+// TestLegacyLifetimeL402 asserts that the holder of an L402 that was minted
+// without a lifetime caveat can't add one that is longer than the configured
+// lifetime of the service.
+func TestLegacyLifetimeL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := newMockSecretStore()
+	configured := &lsat.Lifetime{Duration: 24 * time.Hour}
+	mint := New(&Config{
+		Secrets:        store,
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+		ServiceLifetime: func(name string) *lsat.Lifetime {
+			if name == testService.Name {
+				return configured
+			}
+			return nil
+		},
+	})
+
+	// Mint an L402 the way it was done before lifetimes were recorded,
+	// without a lifetime caveat.
+	id, rawID, err := createUniqueIdentifier(testHash)
+	require.NoError(t, err)
+	idHash := sha256.Sum256(rawID)
+	secret, err := store.NewSecret(
+		ctx, idHash, id, lsat.Service{Name: testService.Name},
+	)
+	require.NoError(t, err)
+	mac, err := macaroon.New(
+		secret[:], rawID, "lsat", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	servicesCaveat, err := lsat.NewServicesCaveat(testService)
+	require.NoError(t, err)
+	require.NoError(t, lsat.AddFirstPartyCaveats(mac, servicesCaveat))
+
+	tests := []struct {
+		name      string
+		lifetime  lsat.Lifetime
+		expectErr bool
+	}{
+		{
+			name:     "within configured lifetime",
+			lifetime: lsat.Lifetime{Duration: 12 * time.Hour},
+		},
+		{
+			name:      "forever",
+			lifetime:  lsat.Lifetime{},
+			expectErr: true,
+		},
+		{
+			name:      "longer than configured lifetime",
+			lifetime:  lsat.Lifetime{Duration: 8760 * time.Hour},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		attenuated := mac.Clone()
+		require.NoError(t, lsat.AddFirstPartyCaveats(
+			attenuated, lsat.NewLifetimeCaveat(
+				testService.Name, test.lifetime,
+			),
+		))
+		err := mint.VerifyL402(ctx, &VerificationParams{
+			Macaroon:      attenuated,
+			Preimage:      testPreimage,
+			TargetService: testService.Name,
+		})
+		if test.expectErr {
+			require.ErrorContains(t, err, "exceeds", test.name)
+		} else {
+			require.NoError(t, err, test.name)
+		}
+	}
+}
+
+// TestUsesL402 asserts that a usage counted L402 can only be used the number
+// of times it allows.
+func TestUsesL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	service := testService
+	service.Lifetime = &lsat.Lifetime{Uses: 2}
+	mac, _, err := mint.MintL402(ctx, service)
+	require.NoError(t, err)
+
+	lifetime, ok, err := lsat.LifetimeFromMacaroon(mac, service.Name)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, *service.Lifetime, lifetime)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: service.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// Raising the number of uses is not allowed.
+	raised := mac.Clone()
+	require.NoError(t, lsat.AddFirstPartyCaveats(
+		raised, lsat.NewUsesCaveat(service.Name, 3),
+	))
+	raisedParams := params
+	raisedParams.Macaroon = raised
+	err = mint.VerifyL402(ctx, &raisedParams)
+	require.ErrorContains(t, err, "increasing restrictiveness")
+
+	for _, remaining := range []uint32{1, 0} {
+		left, err := mint.UseL402(ctx, mac, lifetime.Uses)
+		require.NoError(t, err)
+		require.Equal(t, remaining, left)
+	}
+
+	_, err = mint.UseL402(ctx, mac, lifetime.Uses)
+	require.ErrorIs(t, err, ErrUsesExhausted)
+}
+
 type mockTime struct {
 	time time.Time
 }
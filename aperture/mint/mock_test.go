@@ -34,34 +34,54 @@ func (d *mockChallenger) Stop() {
 	// Nothing to do here.
 }
 
-func (d *mockChallenger) NewChallenge(recipientLud16 string, price int64) (string, lntypes.Hash,
+func (d *mockChallenger) NewChallenge(_ lsat.Service) (string, lntypes.Hash,
 	error) {
 
 	return testPayReq, testHash, nil
 }
 
 type mockSecretStore struct {
-	secrets map[[sha256.Size]byte][lsat.SecretSize]byte
+	secrets   map[[sha256.Size]byte][lsat.SecretSize]byte
+	revoked   map[[sha256.Size]byte]bool
+	settledAt map[[sha256.Size]byte]NullTime
+	uses      map[[sha256.Size]byte]uint32
+	services  map[[sha256.Size]byte]lsat.Service
 }
 
 var _ SecretStore = (*mockSecretStore)(nil)
 
 func (s *mockSecretStore) NewSecret(ctx context.Context,
-	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+	id [sha256.Size]byte, _ *lsat.Identifier,
+	service lsat.Service) ([lsat.SecretSize]byte, error) {
 
 	var secret [lsat.SecretSize]byte
 	if _, err := rand.Read(secret[:]); err != nil {
 		return secret, err
 	}
 	s.secrets[id] = secret
+	s.services[id] = service
 	return secret, nil
 }
 
+func (s *mockSecretStore) GetSecretLifetime(ctx context.Context,
+	id [sha256.Size]byte) (string, *lsat.Lifetime, error) {
+
+	service, ok := s.services[id]
+	if !ok {
+		return "", nil, ErrSecretNotFound
+	}
+	return service.Name, service.Lifetime, nil
+}
+
 func (s *mockSecretStore) GetSecret(ctx context.Context,
 	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
 
 	secret, ok := s.secrets[id]
-	if !ok {
+	switch {
+	case s.revoked[id]:
+		return secret, ErrSecretRevoked
+
+	case !ok:
 		return secret, ErrSecretNotFound
 	}
 	return secret, nil
@@ -74,9 +94,43 @@ func (s *mockSecretStore) RevokeSecret(ctx context.Context,
 	return nil
 }
 
+func (s *mockSecretStore) SetSettledAtByPaymentHash(ctx context.Context,
+	paymentHash [sha256.Size]byte, settledAt NullTime) error {
+
+	s.settledAt[paymentHash] = settledAt
+	return nil
+}
+
+func (s *mockSecretStore) GetSettledAtByPaymentHash(ctx context.Context,
+	paymentHash [sha256.Size]byte) (NullTime, error) {
+
+	settledAt, ok := s.settledAt[paymentHash]
+	if !ok {
+		return NullTime{}, ErrSecretNotFound
+	}
+	return settledAt, nil
+}
+
+func (s *mockSecretStore) IncrementSecretUses(ctx context.Context,
+	id [sha256.Size]byte, maxUses uint32) (uint32, error) {
+
+	if _, ok := s.secrets[id]; !ok {
+		return 0, ErrSecretNotFound
+	}
+	if s.uses[id] >= maxUses {
+		return 0, ErrUsesExhausted
+	}
+	s.uses[id]++
+	return s.uses[id], nil
+}
+
 func newMockSecretStore() *mockSecretStore {
 	return &mockSecretStore{
-		secrets: make(map[[sha256.Size]byte][lsat.SecretSize]byte),
+		secrets:   make(map[[sha256.Size]byte][lsat.SecretSize]byte),
+		revoked:   make(map[[sha256.Size]byte]bool),
+		settledAt: make(map[[sha256.Size]byte]NullTime),
+		uses:      make(map[[sha256.Size]byte]uint32),
+		services:  make(map[[sha256.Size]byte]lsat.Service),
 	}
 }
 
@@ -23,7 +23,10 @@ func NewDefaultPricer(price int64) *DefaultPricer {
 func (d *DefaultPricer) GetPaymentDetails(_ context.Context,
 	_ *http.Request) (GetPaymentDetailsResponse, error) {
 
-	return GetPaymentDetailsResponse{d.RecipientLud16, d.Price}, nil
+	return GetPaymentDetailsResponse{
+		RecipientLud16: d.RecipientLud16,
+		Price:          d.Price,
+	}, nil
 }
 
 // Close is part of the Pricer interface. For the DefaultPricer, the method does
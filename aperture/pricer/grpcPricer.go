@@ -5,7 +5,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/pricesrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -87,10 +90,29 @@ func (c GRPCPricer) GetPaymentDetails(ctx context.Context,
 		return GetPaymentDetailsResponse{}, err
 	}
 
-	return GetPaymentDetailsResponse{
+	details := GetPaymentDetailsResponse{
 		RecipientLud16: resp.RecipientLud16,
 		Price:          resp.PriceSats,
-	}, nil
+	}
+	if f := resp.OperatorFee; f != nil {
+		details.OperatorFee = &fee.Policy{
+			BaseMsat: f.BaseMsat,
+			PPM:      f.Ppm,
+			MinMsat:  f.MinMsat,
+			MaxMsat:  f.MaxMsat,
+		}
+		if err := details.OperatorFee.Validate(); err != nil {
+			return GetPaymentDetailsResponse{}, err
+		}
+	}
+	if l := resp.Lifetime; l != nil {
+		details.Lifetime = &lsat.Lifetime{
+			Duration: time.Duration(l.DurationSecs) * time.Second,
+			Uses:     l.Uses,
+		}
+	}
+
+	return details, nil
 }
 
 // Close closes the gRPC connection. It is part of the Pricer interface.
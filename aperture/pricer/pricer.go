@@ -3,11 +3,22 @@ package pricer
 import (
 	"context"
 	"net/http"
+
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 )
 
 type GetPaymentDetailsResponse struct {
 	RecipientLud16 string
 	Price          int64
+
+	// OperatorFee is an optional operator fee policy for the resource. If
+	// set, it overrides the policy of the service.
+	OperatorFee *fee.Policy
+
+	// Lifetime is an optional lifetime of the L402 for the resource. If
+	// set, it overrides the lifetime of the service.
+	Lifetime *lsat.Lifetime
 }
 
 // Pricer is an interface used to query price data from a price provider.
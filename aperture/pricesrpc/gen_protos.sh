@@ -2,11 +2,12 @@
 
 set -e
 
-# generate compiles the *.pb.go stubs from the *.proto files.
+# generate compiles the *.pb.go stubs from the *.proto files in the current
+# directory.
 function generate() {
   echo "Generating root gRPC server protos"
 
-  PROTOS="prices.proto"
+  PROTOS=$(find . -name "*.proto")
 
   # For each of the sub-servers, we then generate their protos, but a restricted
   # set as they don't yet require REST proxies, or swagger docs.
@@ -37,7 +38,10 @@ function generate() {
       --openapiv2_opt json_names_for_fields=false \
       "${file}"
   done
+}
 
+# generate_js compiles the JSON/WASM client stubs of the prices.proto file.
+function generate_js() {
   # Generate the JSON/WASM client stubs.
   falafel=$(which falafel)
   pkg="pricesrpc"
@@ -71,6 +75,14 @@ function format() {
 pushd pricesrpc
 format
 generate
+generate_js
+popd
+
+# Compile and format the adminrpc package. The admin API isn't meant to be
+# used from a browser, so it doesn't get any JSON/WASM client stubs.
+pushd adminrpc
+format
+generate
 popd
 
 if [[ "$COMPILE_MOBILE" == "1" ]]; then
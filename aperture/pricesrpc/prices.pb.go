@@ -82,6 +82,14 @@ type GetPaymentDetailsResponse struct {
 
 	RecipientLud16 string `protobuf:"bytes,1,opt,name=recipient_lud16,json=recipientLud16,proto3" json:"recipient_lud16,omitempty"`
 	PriceSats      int64  `protobuf:"varint,2,opt,name=price_sats,json=priceSats,proto3" json:"price_sats,omitempty"`
+	//
+	//Optional operator fee policy for this resource. If set, it overrides the
+	//operator fee policy of the service.
+	OperatorFee *OperatorFee `protobuf:"bytes,3,opt,name=operator_fee,json=operatorFee,proto3" json:"operator_fee,omitempty"`
+	//
+	//Optional lifetime of the L402 for this resource. If set, it overrides the
+	//lifetime of the service.
+	Lifetime *Lifetime `protobuf:"bytes,4,opt,name=lifetime,proto3" json:"lifetime,omitempty"`
 }
 
 func (x *GetPaymentDetailsResponse) Reset() {
@@ -130,6 +138,157 @@ func (x *GetPaymentDetailsResponse) GetPriceSats() int64 {
 	return 0
 }
 
+func (x *GetPaymentDetailsResponse) GetOperatorFee() *OperatorFee {
+	if x != nil {
+		return x.OperatorFee
+	}
+	return nil
+}
+
+func (x *GetPaymentDetailsResponse) GetLifetime() *Lifetime {
+	if x != nil {
+		return x.Lifetime
+	}
+	return nil
+}
+
+// OperatorFee is the fee policy used to compute the routing fee that is paid
+// to the lnproxy relay operator on top of the price.
+type OperatorFee struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Fixed part of the fee in millisatoshis.
+	BaseMsat uint64 `protobuf:"varint,1,opt,name=base_msat,json=baseMsat,proto3" json:"base_msat,omitempty"`
+	// Proportional part of the fee in parts per million of the price.
+	Ppm uint64 `protobuf:"varint,2,opt,name=ppm,proto3" json:"ppm,omitempty"`
+	// Minimum fee in millisatoshis.
+	MinMsat uint64 `protobuf:"varint,3,opt,name=min_msat,json=minMsat,proto3" json:"min_msat,omitempty"`
+	// Maximum fee in millisatoshis, 0 means no maximum.
+	MaxMsat uint64 `protobuf:"varint,4,opt,name=max_msat,json=maxMsat,proto3" json:"max_msat,omitempty"`
+}
+
+func (x *OperatorFee) Reset() {
+	*x = OperatorFee{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_prices_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *OperatorFee) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperatorFee) ProtoMessage() {}
+
+func (x *OperatorFee) ProtoReflect() protoreflect.Message {
+	mi := &file_prices_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperatorFee.ProtoReflect.Descriptor instead.
+func (*OperatorFee) Descriptor() ([]byte, []int) {
+	return file_prices_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *OperatorFee) GetBaseMsat() uint64 {
+	if x != nil {
+		return x.BaseMsat
+	}
+	return 0
+}
+
+func (x *OperatorFee) GetPpm() uint64 {
+	if x != nil {
+		return x.Ppm
+	}
+	return 0
+}
+
+func (x *OperatorFee) GetMinMsat() uint64 {
+	if x != nil {
+		return x.MinMsat
+	}
+	return 0
+}
+
+func (x *OperatorFee) GetMaxMsat() uint64 {
+	if x != nil {
+		return x.MaxMsat
+	}
+	return 0
+}
+
+// Lifetime determines how long a paid L402 grants access. If both fields are
+// zero, access is granted forever.
+type Lifetime struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Seconds access is granted for after the invoice was settled, 0 means
+	// no time limit.
+	DurationSecs uint64 `protobuf:"varint,1,opt,name=duration_secs,json=durationSecs,proto3" json:"duration_secs,omitempty"`
+	// Number of requests the L402 can be used for, 0 means no limit.
+	Uses uint32 `protobuf:"varint,2,opt,name=uses,proto3" json:"uses,omitempty"`
+}
+
+func (x *Lifetime) Reset() {
+	*x = Lifetime{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_prices_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Lifetime) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Lifetime) ProtoMessage() {}
+
+func (x *Lifetime) ProtoReflect() protoreflect.Message {
+	mi := &file_prices_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Lifetime.ProtoReflect.Descriptor instead.
+func (*Lifetime) Descriptor() ([]byte, []int) {
+	return file_prices_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Lifetime) GetDurationSecs() uint64 {
+	if x != nil {
+		return x.DurationSecs
+	}
+	return 0
+}
+
+func (x *Lifetime) GetUses() uint32 {
+	if x != nil {
+		return x.Uses
+	}
+	return 0
+}
+
 var File_prices_proto protoreflect.FileDescriptor
 
 var file_prices_proto_rawDesc = []byte{
@@ -140,24 +299,42 @@ var file_prices_proto_rawDesc = []byte{
 	0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x74, 0x68, 0x12, 0x2a, 0x0a, 0x11, 0x68, 0x74, 0x74,
 	0x70, 0x5f, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x18, 0x02,
 	0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x54, 0x65, 0x78, 0x74, 0x22, 0x63, 0x0a, 0x19, 0x47, 0x65, 0x74, 0x50, 0x61, 0x79, 0x6d,
-	0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
-	0x73, 0x65, 0x12, 0x27, 0x0a, 0x0f, 0x72, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x5f,
-	0x6c, 0x75, 0x64, 0x31, 0x36, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x72, 0x65, 0x63,
-	0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x4c, 0x75, 0x64, 0x31, 0x36, 0x12, 0x1d, 0x0a, 0x0a, 0x70,
-	0x72, 0x69, 0x63, 0x65, 0x5f, 0x73, 0x61, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52,
-	0x09, 0x70, 0x72, 0x69, 0x63, 0x65, 0x53, 0x61, 0x74, 0x73, 0x32, 0x68, 0x0a, 0x06, 0x50, 0x72,
-	0x69, 0x63, 0x65, 0x73, 0x12, 0x5e, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x50, 0x61, 0x79, 0x6d, 0x65,
-	0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x12, 0x23, 0x2e, 0x70, 0x72, 0x69, 0x63,
-	0x65, 0x73, 0x72, 0x70, 0x63, 0x2e, 0x47, 0x65, 0x74, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74,
-	0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x24,
-	0x2e, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72, 0x70, 0x63, 0x2e, 0x47, 0x65, 0x74, 0x50, 0x61,
-	0x79, 0x6d, 0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x42, 0x36, 0x5a, 0x34, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
-	0x6f, 0x6d, 0x2f, 0x6d, 0x6f, 0x74, 0x78, 0x78, 0x2f, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72,
-	0x65, 0x2d, 0x6c, 0x6e, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75,
-	0x72, 0x65, 0x2f, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x33,
+	0x74, 0x54, 0x65, 0x78, 0x74, 0x22, 0xcf, 0x01, 0x0a, 0x19, 0x47, 0x65, 0x74, 0x50, 0x61, 0x79,
+	0x6d, 0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x27, 0x0a, 0x0f, 0x72, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74,
+	0x5f, 0x6c, 0x75, 0x64, 0x31, 0x36, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x72, 0x65,
+	0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x4c, 0x75, 0x64, 0x31, 0x36, 0x12, 0x1d, 0x0a, 0x0a,
+	0x70, 0x72, 0x69, 0x63, 0x65, 0x5f, 0x73, 0x61, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x09, 0x70, 0x72, 0x69, 0x63, 0x65, 0x53, 0x61, 0x74, 0x73, 0x12, 0x39, 0x0a, 0x0c, 0x6f,
+	0x70, 0x65, 0x72, 0x61, 0x74, 0x6f, 0x72, 0x5f, 0x66, 0x65, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x16, 0x2e, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72, 0x70, 0x63, 0x2e, 0x4f, 0x70,
+	0x65, 0x72, 0x61, 0x74, 0x6f, 0x72, 0x46, 0x65, 0x65, 0x52, 0x0b, 0x6f, 0x70, 0x65, 0x72, 0x61,
+	0x74, 0x6f, 0x72, 0x46, 0x65, 0x65, 0x12, 0x2f, 0x0a, 0x08, 0x6c, 0x69, 0x66, 0x65, 0x74, 0x69,
+	0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x70, 0x72, 0x69, 0x63, 0x65,
+	0x73, 0x72, 0x70, 0x63, 0x2e, 0x4c, 0x69, 0x66, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x52, 0x08, 0x6c,
+	0x69, 0x66, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x22, 0x72, 0x0a, 0x0b, 0x4f, 0x70, 0x65, 0x72, 0x61,
+	0x74, 0x6f, 0x72, 0x46, 0x65, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x62, 0x61, 0x73, 0x65, 0x5f, 0x6d,
+	0x73, 0x61, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x62, 0x61, 0x73, 0x65, 0x4d,
+	0x73, 0x61, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x70, 0x70, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x03, 0x70, 0x70, 0x6d, 0x12, 0x19, 0x0a, 0x08, 0x6d, 0x69, 0x6e, 0x5f, 0x6d, 0x73, 0x61,
+	0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x6d, 0x69, 0x6e, 0x4d, 0x73, 0x61, 0x74,
+	0x12, 0x19, 0x0a, 0x08, 0x6d, 0x61, 0x78, 0x5f, 0x6d, 0x73, 0x61, 0x74, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x07, 0x6d, 0x61, 0x78, 0x4d, 0x73, 0x61, 0x74, 0x22, 0x43, 0x0a, 0x08, 0x4c,
+	0x69, 0x66, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x64, 0x75, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x5f, 0x73, 0x65, 0x63, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c,
+	0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x63, 0x73, 0x12, 0x12, 0x0a, 0x04,
+	0x75, 0x73, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x75, 0x73, 0x65, 0x73,
+	0x32, 0x68, 0x0a, 0x06, 0x50, 0x72, 0x69, 0x63, 0x65, 0x73, 0x12, 0x5e, 0x0a, 0x11, 0x47, 0x65,
+	0x74, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x12,
+	0x23, 0x2e, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72, 0x70, 0x63, 0x2e, 0x47, 0x65, 0x74, 0x50,
+	0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x73, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x24, 0x2e, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72, 0x70, 0x63,
+	0x2e, 0x47, 0x65, 0x74, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69,
+	0x6c, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x36, 0x5a, 0x34, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x6f, 0x74, 0x78, 0x78, 0x2f, 0x61,
+	0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x2d, 0x6c, 0x6e, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f,
+	0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x2f, 0x70, 0x72, 0x69, 0x63, 0x65, 0x73, 0x72,
+	0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -172,19 +349,23 @@ func file_prices_proto_rawDescGZIP() []byte {
 	return file_prices_proto_rawDescData
 }
 
-var file_prices_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_prices_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_prices_proto_goTypes = []interface{}{
 	(*GetPaymentDetailsRequest)(nil),  // 0: pricesrpc.GetPaymentDetailsRequest
 	(*GetPaymentDetailsResponse)(nil), // 1: pricesrpc.GetPaymentDetailsResponse
+	(*OperatorFee)(nil),               // 2: pricesrpc.OperatorFee
+	(*Lifetime)(nil),                  // 3: pricesrpc.Lifetime
 }
 var file_prices_proto_depIdxs = []int32{
-	0, // 0: pricesrpc.Prices.GetPaymentDetails:input_type -> pricesrpc.GetPaymentDetailsRequest
-	1, // 1: pricesrpc.Prices.GetPaymentDetails:output_type -> pricesrpc.GetPaymentDetailsResponse
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2, // 0: pricesrpc.GetPaymentDetailsResponse.operator_fee:type_name -> pricesrpc.OperatorFee
+	3, // 1: pricesrpc.GetPaymentDetailsResponse.lifetime:type_name -> pricesrpc.Lifetime
+	0, // 2: pricesrpc.Prices.GetPaymentDetails:input_type -> pricesrpc.GetPaymentDetailsRequest
+	1, // 3: pricesrpc.Prices.GetPaymentDetails:output_type -> pricesrpc.GetPaymentDetailsResponse
+	3, // [3:4] is the sub-list for method output_type
+	2, // [2:3] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_prices_proto_init() }
@@ -217,6 +398,30 @@ func file_prices_proto_init() {
 				return nil
 			}
 		}
+		file_prices_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*OperatorFee); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_prices_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Lifetime); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -224,7 +429,7 @@ func file_prices_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_prices_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/motxx/aperture-lnproxy/aperture/aperturedb"
+	"github.com/motxx/aperture-lnproxy/aperture/challenger"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -56,6 +58,8 @@ func StartPrometheusExporter(cfg *PrometheusConfig) error {
 	// Next, we'll register all our metrics.
 	prometheus.MustRegister(mailboxCount)
 	prometheus.MustRegister(mailboxReadCount)
+	prometheus.MustRegister(challenger.Collectors()...)
+	prometheus.MustRegister(aperturedb.Collectors()...)
 
 	// Finally, we'll launch the HTTP server that Prometheus will use to
 	// scape our metrics.
@@ -0,0 +1,8 @@
+package proxy
+
+import "github.com/motxx/aperture-lnproxy/aperture/pricer"
+
+// SetPricer replaces the pricer of a prepared service.
+func SetPricer(s *Service, p pricer.Pricer) {
+	s.pricer = p
+}
@@ -10,8 +10,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
+	"github.com/motxx/aperture-lnproxy/aperture/freebie"
 	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"google.golang.org/grpc/codes"
 )
@@ -69,22 +71,41 @@ func (l *localService) IsHandling(r *http.Request) bool {
 // a challenge to the client or forwards the request to another server and
 // proxies the response back to the client.
 type Proxy struct {
-	proxyBackend  *httputil.ReverseProxy
 	localServices []LocalService
 	authenticator auth.Authenticator
-	services      []*Service
+	freebieCounts freebie.CountStore
+
+	// current is replaced by UpdateServices while requests are being
+	// served.
+	current     *serviceGeneration
+	servicesMtx sync.RWMutex
+}
+
+// serviceGeneration is a set of backend services together with the reverse
+// proxy that belongs to them. It keeps track of the requests that are served
+// with it, so the pricers of services that were removed or replaced are only
+// closed once no request uses them anymore.
+type serviceGeneration struct {
+	services     []*Service
+	proxyBackend *httputil.ReverseProxy
+
+	// requests is the number of requests that are being served with the
+	// generation.
+	requests sync.WaitGroup
 }
 
 // New returns a new Proxy instance that proxies between the services specified,
 // using the auth to validate each request's headers and get new challenge
-// headers if necessary.
+// headers if necessary. Services that keep their freebie counts in the
+// database use the given count store, which may be nil if there is none.
 func New(auth auth.Authenticator, services []*Service,
+	freebieCounts freebie.CountStore,
 	localServices ...LocalService) (*Proxy, error) {
 
 	proxy := &Proxy{
 		localServices: localServices,
 		authenticator: auth,
-		services:      services,
+		freebieCounts: freebieCounts,
 	}
 	err := proxy.UpdateServices(services)
 	if err != nil {
@@ -106,6 +127,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer logRequest()
 
+	gen := p.acquireServices()
+	defer gen.requests.Done()
+	services, proxyBackend := gen.services, gen.proxyBackend
+
 	// For OPTIONS requests we only need to set the CORS headers, not serve
 	// any content;
 	if r.Method == "OPTIONS" {
@@ -118,7 +143,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// dispatched to the static file server. If the file exists in the
 	// static file folder it will be served, otherwise the static server
 	// will return a 404 for us.
-	target, ok := matchService(r, p.services)
+	target, ok := matchService(r, services)
 	if !ok {
 		// This isn't a request for any configured remote backend that
 		// we are proxying for. So we give it to the local service that
@@ -153,7 +178,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// called in each case body rather than outside the switch so
 		// as to avoid calling this possibly expensive call for static
 		// resources.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth, respHeader := p.authenticator.Accept(
+			&r.Header, resourceName,
+		)
+		addHeaders(w.Header(), respHeader)
 		if !acceptAuth {
 			paymentDetails, err := target.pricer.GetPaymentDetails(r.Context(), r)
 			if err != nil {
@@ -174,14 +202,19 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			prefixLog.Infof("Authentication failed. Sending 402.")
-			p.handlePaymentRequired(w, r, resourceName, paymentDetails.RecipientLud16, paymentDetails.Price)
+			p.handlePaymentRequired(
+				w, r, target.l402Service(resourceName, paymentDetails),
+			)
 			return
 		}
 
 	case authLevel.IsFreebie():
 		// We only need to respect the freebie counter if the user
 		// is not authenticated at all.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth, respHeader := p.authenticator.Accept(
+			&r.Header, resourceName,
+		)
+		addHeaders(w.Header(), respHeader)
 		if !acceptAuth {
 			ok, err := target.freebieDB.CanPass(r, remoteIP)
 			if err != nil {
@@ -216,7 +249,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 
 				p.handlePaymentRequired(
-					w, r, resourceName, paymentDetails.RecipientLud16, target.Price,
+					w, r, target.l402Service(
+						resourceName, paymentDetails,
+					),
 				)
 				return
 			}
@@ -235,12 +270,29 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If we got here, it means everything is OK to pass the request to the
 	// service backend via the reverse proxy.
-	p.proxyBackend.ServeHTTP(w, r)
+	proxyBackend.ServeHTTP(w, r)
 }
 
 // UpdateServices re-configures the proxy to use a new set of backend services.
+// Services that are already in use by the proxy are kept as they are, together
+// with their pricer and freebie counts, only the new ones are prepared.
+// Requests that are in flight finish with the previous set of services, the
+// pricers of services that were removed or replaced are closed once they did.
+// If any of the new services is invalid, the current set is kept.
 func (p *Proxy) UpdateServices(services []*Service) error {
-	err := prepareServices(services)
+	current := p.currentServices()
+	inUse := make(map[*Service]bool, len(current))
+	for _, service := range current {
+		inUse[service] = true
+	}
+
+	var newServices []*Service
+	for _, service := range services {
+		if !inUse[service] {
+			newServices = append(newServices, service)
+		}
+	}
+	err := prepareServices(newServices, p.freebieCounts)
 	if err != nil {
 		return err
 	}
@@ -257,8 +309,10 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 		},
 	}
 
-	p.proxyBackend = &httputil.ReverseProxy{
-		Director:  p.director,
+	proxyBackend := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			p.director(req, services)
+		},
 		Transport: &trailerFixingTransport{next: transport},
 		ModifyResponse: func(res *http.Response) error {
 			addCorsHeaders(res.Header)
@@ -270,13 +324,45 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 		FlushInterval: -1,
 	}
 
+	p.servicesMtx.Lock()
+	prev := p.current
+	p.current = &serviceGeneration{
+		services:     services,
+		proxyBackend: proxyBackend,
+	}
+	p.servicesMtx.Unlock()
+
+	// The pricers of the services that were removed or replaced aren't
+	// needed anymore once the requests that were served with them
+	// finished.
+	stillInUse := make(map[*Service]bool, len(services))
+	for _, service := range services {
+		stillInUse[service] = true
+	}
+	if prev == nil {
+		return nil
+	}
+	var removed []*Service
+	for _, service := range prev.services {
+		if !stillInUse[service] {
+			removed = append(removed, service)
+		}
+	}
+	if len(removed) > 0 {
+		go func() {
+			prev.requests.Wait()
+			closePricers(removed)
+		}()
+	}
+
 	return nil
 }
 
-// Close cleans up the Proxy by closing any remaining open connections.
-func (p *Proxy) Close() error {
+// closePricers closes the pricers of the given services and returns the last
+// error that occurred.
+func closePricers(services []*Service) error {
 	var returnErr error
-	for _, s := range p.services {
+	for _, s := range services {
 		if err := s.pricer.Close(); err != nil {
 			log.Errorf("error while closing the pricer of "+
 				"service %s: %v", s.Name, err)
@@ -287,10 +373,47 @@ func (p *Proxy) Close() error {
 	return returnErr
 }
 
-// director is a method that rewrites an incoming request to be forwarded to a
-// backend service.
-func (p *Proxy) director(req *http.Request) {
-	target, ok := matchService(req, p.services)
+// Services returns the backend services the proxy currently uses. The
+// services must not be modified, a modified copy can be passed to
+// UpdateServices instead.
+func (p *Proxy) Services() []*Service {
+	return append([]*Service(nil), p.currentServices()...)
+}
+
+// currentServices returns the backend services the proxy currently uses.
+func (p *Proxy) currentServices() []*Service {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	if p.current == nil {
+		return nil
+	}
+
+	return p.current.services
+}
+
+// acquireServices returns the current generation of services for serving a
+// request. The caller must call Done on its requests once the request was
+// served. The request is counted while the lock is held, so it is never
+// counted after the generation was replaced and its requests are waited for.
+func (p *Proxy) acquireServices() *serviceGeneration {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	p.current.requests.Add(1)
+
+	return p.current
+}
+
+// Close cleans up the Proxy by closing any remaining open connections.
+func (p *Proxy) Close() error {
+	return closePricers(p.currentServices())
+}
+
+// director is a method that rewrites an incoming request to be forwarded to
+// one of the given backend services.
+func (p *Proxy) director(req *http.Request, services []*Service) {
+	target, ok := matchService(req, services)
 	if ok {
 		// Rewrite address and protocol in the request so the
 		// real service is called instead.
@@ -386,23 +509,34 @@ func addCorsHeaders(header http.Header) {
 
 	header.Add("Access-Control-Allow-Origin", "*")
 	header.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	header.Add("Access-Control-Expose-Headers", "WWW-Authenticate")
+	header.Add(
+		"Access-Control-Expose-Headers",
+		"WWW-Authenticate, "+lsat.HeaderUsesRemaining+", "+
+			lsat.HeaderDenyReason,
+	)
 	header.Add(
 		"Access-Control-Allow-Headers",
 		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate",
 	)
 }
 
+// addHeaders adds all fields of the extra header to the given header.
+func addHeaders(header, extra http.Header) {
+	for key, values := range extra {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+}
+
 // handlePaymentRequired returns fresh challenge header fields and status code
 // to the client signaling that a payment is required to fulfil the request.
 func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
-	serviceName string, serviceRecipientLud16 string, servicePrice int64) {
+	service lsat.Service) {
 
 	addCorsHeaders(r.Header)
 
-	header, err := p.authenticator.FreshChallengeHeader(
-		r, serviceName, serviceRecipientLud16, servicePrice,
-	)
+	header, err := p.authenticator.FreshChallengeHeader(r, service)
 	if err != nil {
 		log.Errorf("Error creating new challenge header: %v", err)
 		sendDirectResponse(
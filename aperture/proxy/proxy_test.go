@@ -8,9 +8,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 	"github.com/lightningnetwork/lnd/macaroons"
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
 	"github.com/motxx/aperture-lnproxy/aperture/lsat"
+	"github.com/motxx/aperture-lnproxy/aperture/pricer"
 	"github.com/motxx/aperture-lnproxy/aperture/proxy"
 	proxytest "github.com/motxx/aperture-lnproxy/aperture/proxy/testdata"
 	"github.com/stretchr/testify/require"
@@ -121,7 +124,7 @@ func runHTTPTest(t *testing.T, tc *testCase) {
 	}}
 
 	mockAuth := auth.NewMockAuthenticator()
-	p, err := proxy.New(mockAuth, services)
+	p, err := proxy.New(mockAuth, services, nil)
 	require.NoError(t, err)
 
 	// Start server that gives requests to the proxy.
@@ -195,6 +198,134 @@ func runHTTPTest(t *testing.T, tc *testCase) {
 	require.Equal(t, testHTTPResponseBody, string(bodyBytes))
 }
 
+// TestProxyUpdateServices makes sure the services of a proxy can be replaced
+// while it is running and that an invalid set of services is rejected.
+func TestProxyUpdateServices(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(testHTTPResponseBody))
+		},
+	))
+	defer backend.Close()
+
+	newService := func(level auth.Level) *proxy.Service {
+		return &proxy.Service{
+			Name:       "test",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			HostRegexp: ".*",
+			PathRegexp: testPathRegexpHTTP,
+			Protocol:   "http",
+			Auth:       level,
+		}
+	}
+
+	paid := newService("on")
+	p, err := proxy.New(
+		auth.NewMockAuthenticator(), []*proxy.Service{paid}, nil,
+	)
+	require.NoError(t, err)
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/http/test", nil))
+
+		return rec.Code
+	}
+	require.Equal(t, http.StatusPaymentRequired, serve())
+
+	// Replacing the service with a free one grants access right away.
+	free := newService("off")
+	require.NoError(t, p.UpdateServices([]*proxy.Service{free}))
+	require.Equal(t, []*proxy.Service{free}, p.Services())
+	require.Equal(t, http.StatusOK, serve())
+
+	// An invalid service is rejected and the current ones are kept.
+	invalid := newService("on")
+	invalid.AuthWhitelistPaths = []string{"("}
+	err = p.UpdateServices([]*proxy.Service{free, invalid})
+	require.Error(t, err)
+	require.Equal(t, []*proxy.Service{free}, p.Services())
+	require.Equal(t, http.StatusOK, serve())
+
+	// Without any service, the request is handled by no one.
+	require.NoError(t, p.UpdateServices(nil))
+	require.Empty(t, p.Services())
+	require.Equal(t, http.StatusInternalServerError, serve())
+}
+
+// closeTrackingPricer is a pricer that grants free access and records whether
+// it was closed.
+type closeTrackingPricer struct {
+	closed atomic.Bool
+}
+
+func (p *closeTrackingPricer) GetPaymentDetails(context.Context,
+	*http.Request) (pricer.GetPaymentDetailsResponse, error) {
+
+	if p.closed.Load() {
+		return pricer.GetPaymentDetailsResponse{},
+			fmt.Errorf("pricer closed")
+	}
+
+	return pricer.GetPaymentDetailsResponse{}, nil
+}
+
+func (p *closeTrackingPricer) Close() error {
+	p.closed.Store(true)
+	return nil
+}
+
+// TestProxyUpdateServicesInFlight makes sure the pricer of a removed service is
+// only closed once the requests that were served with it finished.
+func TestProxyUpdateServicesInFlight(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			close(entered)
+			<-release
+			_, _ = w.Write([]byte(testHTTPResponseBody))
+		},
+	))
+	defer backend.Close()
+
+	service := &proxy.Service{
+		Name:       "test",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		PathRegexp: testPathRegexpHTTP,
+		Protocol:   "http",
+		Auth:       "on",
+	}
+	p, err := proxy.New(
+		auth.NewMockAuthenticator(), []*proxy.Service{service}, nil,
+	)
+	require.NoError(t, err)
+	servicePricer := &closeTrackingPricer{}
+	proxy.SetPricer(service, servicePricer)
+
+	// Serve a request that prices the resource and then blocks in the
+	// backend.
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/http/test", nil))
+		done <- rec.Code
+	}()
+	<-entered
+
+	// Removing the service while the request is in flight keeps its
+	// pricer open until the request finished.
+	require.NoError(t, p.UpdateServices(nil))
+	require.Never(t, servicePricer.closed.Load, 100*time.Millisecond,
+		10*time.Millisecond)
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-done)
+	require.Eventually(t, servicePricer.closed.Load, time.Second,
+		10*time.Millisecond)
+}
+
 // TestProxyHTTP tests that the proxy can forward gRPC requests to a backend
 // service and handle L402 authentication correctly.
 func TestProxyGRPC(t *testing.T) {
@@ -270,7 +401,7 @@ func runGRPCTest(t *testing.T, tc *testCase) {
 
 	// Create the proxy server and start serving on TLS.
 	mockAuth := auth.NewMockAuthenticator()
-	p, err := proxy.New(mockAuth, services)
+	p, err := proxy.New(mockAuth, services, nil)
 	require.NoError(t, err)
 	server := &http.Server{
 		Addr:      testProxyAddr,
@@ -315,7 +446,7 @@ func runGRPCTest(t *testing.T, tc *testCase) {
 	// auth response.
 	expectedHeaderContent, _ := mockAuth.FreshChallengeHeader(&http.Request{
 		Header: map[string][]string{},
-	}, "", "", 0)
+	}, lsat.Service{})
 	capturedHeader := captureMetadata.Get("WWW-Authenticate")
 	require.Len(t, capturedHeader, 1)
 	require.Equal(
@@ -11,7 +11,9 @@ import (
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/motxx/aperture-lnproxy/aperture/auth"
+	"github.com/motxx/aperture-lnproxy/aperture/fee"
 	"github.com/motxx/aperture-lnproxy/aperture/freebie"
+	"github.com/motxx/aperture-lnproxy/aperture/lsat"
 	"github.com/motxx/aperture-lnproxy/aperture/pricer"
 )
 
@@ -103,8 +105,75 @@ type Service struct {
 	// /package_name.ServiceName/MethodName
 	AuthWhitelistPaths []string `long:"authwhitelistpaths" description:"List of regular expressions for paths that don't require authentication'"`
 
+	// DirectPay, if set, makes the service's price payable to the
+	// operator's own lnd node instead of wrapping an invoice of the
+	// creator through lnproxy. This is meant for content the operator
+	// owns, no recipient lightning address is needed.
+	DirectPay bool `long:"directpay" description:"Create invoices on the operator's lnd node instead of paying a creator through lnproxy"`
+
+	// OperatorFee is an optional operator fee policy for the service. If
+	// set, it overrides the global lnproxy operator fee policy and can
+	// itself be overridden per resource by the dynamic pricer.
+	OperatorFee *fee.Policy `group:"operatorfee" namespace:"operatorfee"`
+
+	// Lifetime is how long a paid L402 grants access to the service. Valid
+	// values are "forever", a duration after the invoice was settled like
+	// "24h", a number of requests like "10 uses", or a duration and a
+	// number of requests separated by a comma. The dynamic pricer can
+	// override it per resource. If empty, access is granted for one hour.
+	Lifetime string `long:"lifetime" description:"How long a paid L402 grants access: \"forever\", a duration after settlement like \"24h\" and/or a number of requests like \"10 uses\""`
+
+	// Freebie is the optional configuration of the store that keeps track
+	// of the free requests if Auth is set to "freebie X". By default, the
+	// free requests are counted in memory per /24 IPv4 and /56 IPv6
+	// network and are granted only once.
+	Freebie *freebie.Config `group:"freebie" namespace:"freebie"`
+
 	freebieDB freebie.DB
 	pricer    pricer.Pricer
+	lifetime  *lsat.Lifetime
+}
+
+// l402Service returns the L402 service a challenge is created for when the
+// given resource with the given payment details is requested. An operator fee
+// policy returned by the pricer takes precedence over the one of the service.
+// If neither is set, the global policy of the challenger applies. The same goes
+// for the lifetime of the L402.
+func (s *Service) l402Service(resourceName string,
+	details pricer.GetPaymentDetailsResponse) lsat.Service {
+
+	operatorFee := details.OperatorFee
+	if operatorFee == nil {
+		operatorFee = s.OperatorFee
+	}
+	lifetime := details.Lifetime
+	if lifetime == nil {
+		lifetime = s.lifetime
+	}
+
+	return lsat.Service{
+		Name:           resourceName,
+		RecipientLud16: details.RecipientLud16,
+		Price:          details.Price,
+		OperatorFee:    operatorFee,
+		DirectPay:      s.DirectPay,
+		Lifetime:       lifetime,
+	}
+}
+
+// LifetimeOf returns the configured lifetime of the service the given resource
+// name belongs to, or nil if there's no such service or it has no lifetime
+// configured.
+func LifetimeOf(services []*Service, resourceName string) *lsat.Lifetime {
+	for _, s := range services {
+		if resourceName == s.Name || (s.DynamicPrice.Enabled &&
+			strings.HasPrefix(resourceName, s.Name+"/")) {
+
+			return s.lifetime
+		}
+	}
+
+	return nil
 }
 
 // ResourceName returns the string to be used to identify which resource a
@@ -136,15 +205,47 @@ func (s *Service) AuthRequired(r *http.Request) auth.Level {
 	return s.Auth
 }
 
+// newFreebieDB creates the freebie store of the given service as configured.
+func newFreebieDB(service *Service,
+	freebieCounts freebie.CountStore) (freebie.DB, error) {
+
+	cfg := service.Freebie
+	if cfg == nil {
+		cfg = freebie.DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("service %s: %w", service.Name, err)
+	}
+
+	numFreebies := service.Auth.FreebieCount()
+	if cfg.Store != freebie.StoreDB {
+		return freebie.NewMemStore(numFreebies, cfg), nil
+	}
+
+	if freebieCounts == nil {
+		return nil, fmt.Errorf("service %s: no database available to "+
+			"store freebie counts", service.Name)
+	}
+
+	return freebie.NewDBStore(
+		freebieCounts, service.Name, numFreebies, cfg,
+	), nil
+}
+
 // prepareServices prepares the backend service configurations to be used by the
-// proxy.
-func prepareServices(services []*Service) error {
+// proxy. The given count store is used for services that keep their freebie
+// counts in the database, it may be nil if there is none.
+func prepareServices(services []*Service,
+	freebieCounts freebie.CountStore) error {
+
 	for _, service := range services {
 		// Each freebie enabled service gets its own store.
 		if service.Auth.IsFreebie() {
-			service.freebieDB = freebie.NewMemIPMaskStore(
-				service.Auth.FreebieCount(),
-			)
+			freebieDB, err := newFreebieDB(service, freebieCounts)
+			if err != nil {
+				return err
+			}
+			service.freebieDB = freebieDB
 		}
 
 		// Replace placeholders/directives in the header fields with the
@@ -195,6 +296,23 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
+		service.lifetime = nil
+		if service.Lifetime != "" {
+			lifetime, err := lsat.ParseLifetime(service.Lifetime)
+			if err != nil {
+				return fmt.Errorf("service %s: %w", service.Name,
+					err)
+			}
+			service.lifetime = &lifetime
+		}
+
+		if service.OperatorFee != nil {
+			if err := service.OperatorFee.Validate(); err != nil {
+				return fmt.Errorf("service %s: %w", service.Name,
+					err)
+			}
+		}
+
 		// If dynamic prices are enabled then use the provided
 		// DynamicPrice options to initialise a gRPC backed
 		// pricer client.
@@ -228,6 +346,14 @@ func prepareServices(services []*Service) error {
 				"service %s", service.Name)
 		}
 
+		// A static price has no recipient lightning address, so it
+		// can only be paid to the operator.
+		if !service.DirectPay && !service.Auth.IsOff() {
+			log.Warnf("Service %s has a static price but is not "+
+				"direct pay, challenges will fail for lack of a "+
+				"recipient", service.Name)
+		}
+
 		// Initialise a default pricer where all resources in a server
 		// are given the same price.
 		service.pricer = pricer.NewDefaultPricer(service.Price)
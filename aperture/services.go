@@ -112,3 +112,24 @@ func (l *staticServiceLimiter) ServiceTimeouts(ctx context.Context,
 
 	return res, nil
 }
+
+// serviceLifetimes returns the configured lifetimes of the given services by
+// name, nil for services without one. Lifetimes that can't be parsed are left
+// out, the proxy rejects them when the services are prepared.
+func serviceLifetimes(services []*proxy.Service) map[string]*lsat.Lifetime {
+	lifetimes := make(map[string]*lsat.Lifetime, len(services))
+	for _, service := range services {
+		if service.Lifetime == "" {
+			lifetimes[service.Name] = nil
+			continue
+		}
+
+		lifetime, err := lsat.ParseLifetime(service.Lifetime)
+		if err != nil {
+			continue
+		}
+		lifetimes[service.Name] = &lifetime
+	}
+
+	return lifetimes
+}
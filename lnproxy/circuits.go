@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var CircuitNotFound = errors.New("circuit not found")
+
+type CircuitState string
+
+const (
+	// The wrapped invoice has been issued, waiting for the payer's htlc
+	CircuitOpen CircuitState = "OPEN"
+	// The payer's htlc was accepted and we are paying the original invoice
+	CircuitPaying CircuitState = "PAYING"
+	// The outcome of the payment to the original invoice is unknown,
+	// the payer's htlc is held until the payment is resolved
+	CircuitUnknown  CircuitState = "UNKNOWN"
+	CircuitSettled  CircuitState = "SETTLED"
+	CircuitCanceled CircuitState = "CANCELED"
+)
+
+// Terminal circuits need no further action after a restart
+func (s CircuitState) Terminal() bool {
+	return s == CircuitSettled || s == CircuitCanceled
+}
+
+// A journal entry for a single wrapped invoice,
+// Destination and OriginalAmountMsat describe the original invoice
+type Circuit struct {
+	Hash               string       `json:"hash"`
+	Invoice            string       `json:"invoice"`
+	Destination        string       `json:"destination"`
+	AmountMsat         uint64       `json:"amount_msat"`
+	OriginalAmountMsat uint64       `json:"original_amount_msat"`
+	FeeBudgetMsat      uint64       `json:"fee_budget_msat"`
+	State              CircuitState `json:"state"`
+	CreatedAt          time.Time    `json:"created_at"`
+	UpdatedAt          time.Time    `json:"updated_at"`
+	// When the payment to the original invoice was first attempted
+	PaymentStartedAt time.Time `json:"payment_started_at,omitempty"`
+	// Ip address of the client that opened the circuit, it is not journaled
+	// so recovered circuits only count against the limits of the whole relay
+	Client string `json:"-"`
+}
+
+// Durable storage for circuits, entries must be persisted before Put returns
+type CircuitStore interface {
+	Put(Circuit) error
+	Get(hash []byte) (Circuit, error)
+	// Returns all circuits that are not in a terminal state
+	ListOpen() ([]Circuit, error)
+	// Returns all settled circuits
+	ListSettled() ([]Circuit, error)
+}
+
+// Stores each circuit as a json file named after its payment hash
+type FileCircuitStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func NewFileCircuitStore(dir string) (*FileCircuitStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCircuitStore{Dir: dir}, nil
+}
+
+func (s *FileCircuitStore) path(hash string) string {
+	return filepath.Join(s.Dir, hash+".json")
+}
+
+func (s *FileCircuitStore) Put(c Circuit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so a crash never leaves a partial entry
+	tmp, err := os.CreateTemp(s.Dir, c.Hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(c.Hash))
+}
+
+func (s *FileCircuitStore) Get(hash []byte) (Circuit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(s.path(hex.EncodeToString(hash)))
+}
+
+func (s *FileCircuitStore) read(path string) (Circuit, error) {
+	c := Circuit{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, CircuitNotFound
+	} else if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+func (s *FileCircuitStore) ListOpen() ([]Circuit, error) {
+	return s.list(func(c Circuit) bool {
+		return !c.State.Terminal()
+	})
+}
+
+func (s *FileCircuitStore) ListSettled() ([]Circuit, error) {
+	return s.list(func(c Circuit) bool {
+		return c.State == CircuitSettled
+	})
+}
+
+// Returns the circuits matching filter, oldest first
+func (s *FileCircuitStore) list(filter func(Circuit) bool) ([]Circuit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	circuits := []Circuit{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		c, err := s.read(filepath.Join(s.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if filter(c) {
+			circuits = append(circuits, c)
+		}
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].CreatedAt.Before(circuits[j].CreatedAt)
+	})
+	return circuits, nil
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+func TestFileCircuitStore(t *testing.T) {
+	store, err := NewFileCircuitStore(filepath.Join(t.TempDir(), "circuits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get(make([]byte, 32))
+	if !errors.Is(err, CircuitNotFound) {
+		t.Fatalf("expected CircuitNotFound, got %v", err)
+	}
+
+	circuits := []Circuit{
+		testCircuit(1, CircuitOpen),
+		testCircuit(2, CircuitPaying),
+		testCircuit(3, CircuitUnknown),
+		testCircuit(4, CircuitSettled),
+		testCircuit(5, CircuitCanceled),
+	}
+	for i := range circuits {
+		// Created in the opposite order of their file names
+		circuits[i].CreatedAt = circuits[i].CreatedAt.Add(-time.Duration(i) * time.Minute)
+		circuits[i].Client = "192.0.2.1"
+		if err := store.Put(circuits[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Updating a circuit replaces its entry
+	circuits[0].State = CircuitPaying
+	if err := store.Put(circuits[0]); err != nil {
+		t.Fatal(err)
+	}
+	got := getCircuit(t, store, circuits[0].Hash)
+	if got.State != CircuitPaying || got.AmountMsat != circuits[0].AmountMsat {
+		t.Fatalf("unexpected circuit: %+v", got)
+	}
+	if got.Client != "" {
+		t.Fatalf("client ip was journaled: %q", got.Client)
+	}
+
+	// A crash can leave temporary files behind, they are not circuits
+	err = os.WriteFile(filepath.Join(store.Dir, circuits[1].Hash+".123.tmp"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		list   func() ([]Circuit, error)
+		hashes []string
+	}{
+		// Oldest first
+		{"open", store.ListOpen, []string{circuits[2].Hash, circuits[1].Hash, circuits[0].Hash}},
+		{"settled", store.ListSettled, []string{circuits[3].Hash}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listed, err := test.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listed) != len(test.hashes) {
+				t.Fatalf("expected %d circuits, got %d", len(test.hashes), len(listed))
+			}
+			for i, hash := range test.hashes {
+				if listed[i].Hash != hash {
+					t.Fatalf("circuit %d: expected %s, got %s", i, hash, listed[i].Hash)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverCircuits(t *testing.T) {
+	preimage := []byte("preimage")
+	tests := []struct {
+		name      string
+		state     CircuitState
+		invoice   lnc.InvoiceState
+		watch_err error
+		pay_err   error
+		payments  []trackResult
+		expected  CircuitState
+		paid      int
+		settled   int
+		canceled  int
+	}{
+		{
+			name:     "accepted open circuit is paid through",
+			state:    CircuitOpen,
+			invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+			expected: CircuitSettled,
+			paid:     1,
+			settled:  1,
+		},
+		{
+			name:     "accepted circuit without enough cltv left is canceled",
+			state:    CircuitOpen,
+			invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 42},
+			expected: CircuitCanceled,
+			canceled: 1,
+		},
+		{
+			name:     "canceled invoice is journaled",
+			state:    CircuitOpen,
+			invoice:  lnc.InvoiceState{State: lnc.Canceled},
+			expected: CircuitCanceled,
+		},
+		{
+			name:      "open circuit whose invoice can't be watched is canceled",
+			state:     CircuitOpen,
+			watch_err: errors.New("invoice expired"),
+			expected:  CircuitCanceled,
+			canceled:  1,
+		},
+		{
+			name:     "settled invoice is journaled without paying again",
+			state:    CircuitPaying,
+			invoice:  lnc.InvoiceState{State: lnc.Settled},
+			expected: CircuitSettled,
+		},
+		{
+			name:     "paying circuit resolves its payment instead of paying again",
+			state:    CircuitPaying,
+			invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+			payments: []trackResult{{state: PaymentState{Status: Succeeded, Preimage: preimage, FeeMsat: 10}}},
+			expected: CircuitSettled,
+			settled:  1,
+		},
+		{
+			name:      "unknown circuit whose invoice can't be watched is resolved by its payment",
+			state:     CircuitUnknown,
+			watch_err: errors.New("lnd unreachable"),
+			payments:  []trackResult{{state: PaymentState{Status: Failed}}},
+			expected:  CircuitCanceled,
+			canceled:  1,
+		},
+		{
+			name:     "failed payment cancels the circuit",
+			state:    CircuitOpen,
+			invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+			pay_err:  lnc.PaymentFailed,
+			expected: CircuitCanceled,
+			paid:     1,
+			canceled: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{
+				invoice:   test.invoice,
+				watch_err: test.watch_err,
+				preimage:  preimage,
+				pay_err:   test.pay_err,
+			}
+			relay, store := newTestRelay(t, ln)
+			if test.payments != nil {
+				relay.Payments = &fakeTracker{results: test.payments}
+			}
+			circuit := testCircuit(1, test.state)
+			circuit.PaymentStartedAt = circuit.CreatedAt
+			if err := store.Put(circuit); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := relay.RecoverCircuits(); err != nil {
+				t.Fatal(err)
+			}
+			relay.Wait()
+
+			got := getCircuit(t, store, circuit.Hash)
+			if got.State != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, got.State)
+			}
+			paid, settled, canceled := ln.calls()
+			if paid != test.paid || settled != test.settled || canceled != test.canceled {
+				t.Fatalf("expected %d payments, %d settlements and %d cancellations, got %d, %d and %d",
+					test.paid, test.settled, test.canceled, paid, settled, canceled)
+			}
+			if circuits, outstanding_msat, outbound_msat := relay.Admitted(); circuits != 0 || outstanding_msat != 0 || outbound_msat != 0 {
+				t.Fatalf("recovered circuit was not released: %d %d %d", circuits, outstanding_msat, outbound_msat)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	relay "lnproxy"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A relay parameter that can be set in the config file, the environment and with a flag,
+// exactly one of the pointers is set
+type parameter struct {
+	name    string
+	usage   string
+	uint64  *uint64
+	float64 *float64
+}
+
+// Flag name of the parameter, e.g. min-amount-msat
+func (p parameter) flagName() string {
+	return strings.ReplaceAll(p.name, "_", "-")
+}
+
+// Environment variable of the parameter, e.g. LNPROXY_MIN_AMOUNT_MSAT
+func (p parameter) envName() string {
+	return "LNPROXY_" + strings.ToUpper(p.name)
+}
+
+func (p parameter) set(value string) error {
+	if p.uint64 != nil {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p.uint64 = v
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*p.float64 = v
+	return nil
+}
+
+// Names match the json keys of relay.RelayParameters
+func relayParameters(x *relay.RelayParameters) []parameter {
+	return []parameter{
+		{name: "min_amount_msat", usage: "smallest invoice amount that is relayed", uint64: &x.MinAmountMsat},
+		{name: "max_amount_msat", usage: "largest invoice amount that is relayed", uint64: &x.MaxAmountMsat},
+		{name: "min_fee_budget_msat", usage: "smallest routing fee budget accepted from clients", uint64: &x.MinFeeBudgetMsat},
+		{name: "routing_fee_base_msat", usage: "base fee charged for relaying", uint64: &x.RoutingFeeBaseMsat},
+		{name: "routing_fee_ppm", usage: "proportional fee charged for relaying in parts per million", uint64: &x.RoutingFeePPM},
+		{name: "expiry_buffer", usage: "seconds the wrapped invoice expires before the original invoice", uint64: &x.ExpiryBuffer},
+		{name: "max_expiry", usage: "longest expiry of a wrapped invoice in seconds", uint64: &x.MaxExpiry},
+		{name: "cltv_delta_alpha", usage: "blocks left to settle the wrapped invoice after paying the original invoice", uint64: &x.CltvDeltaAlpha},
+		{name: "cltv_delta_beta", usage: "blocks added to the estimated cltv delta of the route to the original invoice", uint64: &x.CltvDeltaBeta},
+		{name: "routing_budget_alpha", usage: "msat added to the estimated routing fee budget", uint64: &x.RoutingBudgetAlpha},
+		{name: "routing_budget_beta", usage: "parts per million of the estimated routing fee added to the budget", uint64: &x.RoutingBudgetBeta},
+		{name: "max_cltv_expiry", usage: "largest cltv expiry of a wrapped invoice, at most the node's --max-cltv-expiry", uint64: &x.MaxCltvExpiry},
+		{name: "min_cltv_expiry", usage: "smallest cltv expiry of a wrapped invoice", uint64: &x.MinCltvExpiry},
+		{name: "payment_timeout", usage: "seconds to pay the original invoice", uint64: &x.PaymentTimeout},
+		{name: "payment_time_preference", usage: "preference of payment time over fees between 0 and 1", float64: &x.PaymentTimePreference},
+		{name: "max_open_circuits", usage: "most circuits open at the same time, 0 for no limit", uint64: &x.MaxOpenCircuits},
+		{name: "max_outstanding_msat", usage: "largest sum of the wrapped amounts of open circuits, 0 for no limit", uint64: &x.MaxOutstandingMsat},
+		{name: "max_client_open_circuits", usage: "most circuits open at the same time for a single ip, 0 for no limit", uint64: &x.MaxClientOpenCircuits},
+		{name: "max_client_outstanding_msat", usage: "largest sum of the wrapped amounts of open circuits for a single ip, 0 for no limit", uint64: &x.MaxClientOutstandingMsat},
+	}
+}
+
+// Registers a flag for every relay parameter,
+// the flags are bound to their own copy so that only the flags set on the command line override other sources
+func relayParameterFlags(fs *flag.FlagSet) *relay.RelayParameters {
+	x := relay.DefaultRelayParameters()
+	for _, p := range relayParameters(&x) {
+		usage := fmt.Sprintf("%s (env %s)", p.usage, p.envName())
+		if p.uint64 != nil {
+			fs.Uint64Var(p.uint64, p.flagName(), *p.uint64, usage)
+		} else {
+			fs.Float64Var(p.float64, p.flagName(), *p.float64, usage)
+		}
+	}
+	return &x
+}
+
+// Loads the relay parameters from the defaults, overridden by the json config file if set,
+// the LNPROXY_ environment variables and finally the flags set on the command line
+func loadRelayParameters(fs *flag.FlagSet, configPath string, flags *relay.RelayParameters) (relay.RelayParameters, error) {
+	x := relay.DefaultRelayParameters()
+
+	if configPath != "" {
+		f, err := os.Open(configPath)
+		if err != nil {
+			return x, fmt.Errorf("unable to open config file: %w", err)
+		}
+		defer f.Close()
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&x)
+		if err != nil {
+			return x, fmt.Errorf("unable to parse config file %s: %w", configPath, err)
+		}
+	}
+
+	params := relayParameters(&x)
+	for _, p := range params {
+		value, ok := os.LookupEnv(p.envName())
+		if !ok {
+			continue
+		}
+		err := p.set(value)
+		if err != nil {
+			return x, fmt.Errorf("invalid %s: %w", p.envName(), err)
+		}
+	}
+
+	flagParams := relayParameters(flags)
+	fs.Visit(func(f *flag.Flag) {
+		for i, p := range params {
+			if p.flagName() != f.Name {
+				continue
+			}
+			// Already parsed by the flag package
+			if p.uint64 != nil {
+				*p.uint64 = *flagParams[i].uint64
+			} else {
+				*p.float64 = *flagParams[i].float64
+			}
+		}
+	})
+
+	return x, x.Validate()
+}
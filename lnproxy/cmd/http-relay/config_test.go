@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRelayParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		args   []string
+		// Expected routing fee ppm, min amount and time preference
+		routing_fee_ppm         uint64
+		min_amount_msat         uint64
+		payment_time_preference float64
+		err                     string
+	}{
+		{
+			name:                    "defaults",
+			routing_fee_ppm:         1000,
+			min_amount_msat:         10_000,
+			payment_time_preference: 0.9,
+		},
+		{
+			name:                    "config file overrides defaults",
+			config:                  `{"routing_fee_ppm": 2000, "payment_time_preference": 0.5}`,
+			routing_fee_ppm:         2000,
+			min_amount_msat:         10_000,
+			payment_time_preference: 0.5,
+		},
+		{
+			name:                    "environment overrides config file",
+			config:                  `{"routing_fee_ppm": 2000, "min_amount_msat": 20000}`,
+			env:                     map[string]string{"LNPROXY_ROUTING_FEE_PPM": "3000", "LNPROXY_PAYMENT_TIME_PREFERENCE": "0.7"},
+			routing_fee_ppm:         3000,
+			min_amount_msat:         20_000,
+			payment_time_preference: 0.7,
+		},
+		{
+			name:                    "flags override environment",
+			config:                  `{"routing_fee_ppm": 2000}`,
+			env:                     map[string]string{"LNPROXY_ROUTING_FEE_PPM": "3000", "LNPROXY_MIN_AMOUNT_MSAT": "30000"},
+			args:                    []string{"-routing-fee-ppm", "4000"},
+			routing_fee_ppm:         4000,
+			min_amount_msat:         30_000,
+			payment_time_preference: 0.9,
+		},
+		{
+			name:                    "flags set to their default still override",
+			env:                     map[string]string{"LNPROXY_ROUTING_FEE_PPM": "3000"},
+			args:                    []string{"-routing-fee-ppm", "1000"},
+			routing_fee_ppm:         1000,
+			min_amount_msat:         10_000,
+			payment_time_preference: 0.9,
+		},
+		{
+			name:   "unknown field in config file",
+			config: `{"routing_fee": 2000}`,
+			err:    `json: unknown field "routing_fee"`,
+		},
+		{
+			name: "invalid environment variable",
+			env:  map[string]string{"LNPROXY_MIN_AMOUNT_MSAT": "-1"},
+			err:  "invalid LNPROXY_MIN_AMOUNT_MSAT",
+		},
+		{
+			name: "invalid combination",
+			args: []string{"-min-amount-msat", "2000000000"},
+			err:  "min_amount_msat",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config_path := ""
+			if test.config != "" {
+				config_path = filepath.Join(t.TempDir(), "relay.json")
+				if err := os.WriteFile(config_path, []byte(test.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("http-relay", flag.ContinueOnError)
+			flags := relayParameterFlags(fs)
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			x, err := loadRelayParameters(fs, config_path, flags)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x.RoutingFeePPM != test.routing_fee_ppm || x.MinAmountMsat != test.min_amount_msat ||
+				x.PaymentTimePreference != test.payment_time_preference {
+				t.Fatalf("expected %d ppm, %d msat and preference %v, got %d, %d and %v",
+					test.routing_fee_ppm, test.min_amount_msat, test.payment_time_preference,
+					x.RoutingFeePPM, x.MinAmountMsat, x.PaymentTimePreference)
+			}
+		})
+	}
+}
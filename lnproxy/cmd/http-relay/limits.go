@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token buckets per client ip, refilled with rate tokens per second up to burst
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	mu     sync.Mutex
+	pruned time.Time
+	// Clients without a bucket have a full one
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst uint64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		pruned:  time.Now(),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Takes a token from the client's bucket, returns false if it is empty
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget the clients whose buckets are full again, so idle clients don't use memory
+	if now.Sub(l.pruned) > time.Minute {
+		for client, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Ip address of the client, behind a trusted reverse proxy the address it reports
+func clientIp(r *http.Request, trust_proxy bool) string {
+	if trust_proxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		// The last address is the one our proxy added, earlier ones can be spoofed
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Answers with 429 once a client used up its requests
+func (l *rateLimiter) limit(trust_proxy bool, next http.HandlerFunc) http.HandlerFunc {
+	retry_after := strconv.Itoa(int(math.Ceil(1 / l.rate)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && !l.allow(clientIp(r, trust_proxy), time.Now()) {
+			relay_metrics.rate_limited.Add(1)
+			setCorsHeaders(w)
+			w.Header().Set("Retry-After", retry_after)
+			writeJson(w, http.StatusTooManyRequests, makeJsonError("rate limited"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+type metrics struct {
+	circuits_opened             atomic.Uint64
+	rate_limited                atomic.Uint64
+	too_many_circuits           atomic.Uint64
+	too_much_outstanding        atomic.Uint64
+	too_many_client_circuits    atomic.Uint64
+	too_much_client_outstanding atomic.Uint64
+	insufficient_inbound        atomic.Uint64
+	insufficient_outbound       atomic.Uint64
+}
+
+var relay_metrics metrics
+
+// Reports the metrics in the prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	circuits, outstanding_msat, outbound_msat := lnproxy_relay.Admitted()
+	clients := lnproxy_relay.AdmittedClients()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	lines := []string{
+		"# HELP lnproxy_circuits_opened_total Circuits opened for wrapped invoices.",
+		"# TYPE lnproxy_circuits_opened_total counter",
+		fmt.Sprintf("lnproxy_circuits_opened_total %d", relay_metrics.circuits_opened.Load()),
+		"# HELP lnproxy_requests_rejected_total Requests rejected because of a limit.",
+		"# TYPE lnproxy_requests_rejected_total counter",
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="rate_limited"} %d`, relay_metrics.rate_limited.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="max_open_circuits"} %d`, relay_metrics.too_many_circuits.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="max_outstanding_msat"} %d`, relay_metrics.too_much_outstanding.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="max_client_open_circuits"} %d`, relay_metrics.too_many_client_circuits.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="max_client_outstanding_msat"} %d`, relay_metrics.too_much_client_outstanding.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="insufficient_inbound"} %d`, relay_metrics.insufficient_inbound.Load()),
+		fmt.Sprintf(`lnproxy_requests_rejected_total{reason="insufficient_outbound"} %d`, relay_metrics.insufficient_outbound.Load()),
+		"# HELP lnproxy_open_circuits Circuits currently open.",
+		"# TYPE lnproxy_open_circuits gauge",
+		fmt.Sprintf("lnproxy_open_circuits %d", circuits),
+		"# HELP lnproxy_clients_with_open_circuits Client ips with circuits currently open.",
+		"# TYPE lnproxy_clients_with_open_circuits gauge",
+		fmt.Sprintf("lnproxy_clients_with_open_circuits %d", clients),
+		"# HELP lnproxy_outstanding_msat Sum of the wrapped amounts of the open circuits.",
+		"# TYPE lnproxy_outstanding_msat gauge",
+		fmt.Sprintf("lnproxy_outstanding_msat %d", outstanding_msat),
+		"# HELP lnproxy_outbound_msat Sum of the original amounts and fee budgets of the open circuits.",
+		"# TYPE lnproxy_outbound_msat gauge",
+		fmt.Sprintf("lnproxy_outbound_msat %d", outbound_msat),
+		"# HELP lnproxy_max_open_circuits Limit of circuits open at the same time, 0 for none.",
+		"# TYPE lnproxy_max_open_circuits gauge",
+		fmt.Sprintf("lnproxy_max_open_circuits %d", lnproxy_relay.MaxOpenCircuits),
+		"# HELP lnproxy_max_outstanding_msat Limit of the sum of the wrapped amounts, 0 for none.",
+		"# TYPE lnproxy_max_outstanding_msat gauge",
+		fmt.Sprintf("lnproxy_max_outstanding_msat %d", lnproxy_relay.MaxOutstandingMsat),
+		"# HELP lnproxy_max_client_open_circuits Limit of circuits open at the same time for a single ip, 0 for none.",
+		"# TYPE lnproxy_max_client_open_circuits gauge",
+		fmt.Sprintf("lnproxy_max_client_open_circuits %d", lnproxy_relay.MaxClientOpenCircuits),
+		"# HELP lnproxy_max_client_outstanding_msat Limit of the sum of the wrapped amounts for a single ip, 0 for none.",
+		"# TYPE lnproxy_max_client_outstanding_msat gauge",
+		fmt.Sprintf("lnproxy_max_client_outstanding_msat %d", lnproxy_relay.MaxClientOutstandingMsat),
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	if err != nil {
+		log.Println("error writing metrics:", err)
+	}
+}
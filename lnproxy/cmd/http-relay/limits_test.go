@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	type request struct {
+		client  string
+		after   time.Duration
+		allowed bool
+	}
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    uint64
+		requests []request
+	}{
+		{
+			name:  "burst then rate",
+			rate:  1,
+			burst: 2,
+			requests: []request{
+				{"a", 0, true},
+				{"a", 0, true},
+				{"a", 0, false},
+				{"a", 500 * time.Millisecond, false},
+				{"a", time.Second, true},
+				{"a", time.Second, false},
+			},
+		},
+		{
+			name:  "buckets per client",
+			rate:  1,
+			burst: 1,
+			requests: []request{
+				{"a", 0, true},
+				{"a", 0, false},
+				{"b", 0, true},
+				{"b", 0, false},
+			},
+		},
+		{
+			name:  "refilled up to burst",
+			rate:  10,
+			burst: 2,
+			requests: []request{
+				{"a", 0, true},
+				{"a", 0, true},
+				{"a", time.Hour, true},
+				{"a", time.Hour, true},
+				{"a", time.Hour, false},
+			},
+		},
+		{
+			name:  "slower than a request per second",
+			rate:  0.5,
+			burst: 1,
+			requests: []request{
+				{"a", 0, true},
+				{"a", time.Second, false},
+				{"a", 2 * time.Second, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(test.rate, test.burst)
+			limiter.pruned = start
+			for i, r := range test.requests {
+				if allowed := limiter.allow(r.client, start.Add(r.after)); allowed != r.allowed {
+					t.Fatalf("request %d: expected allowed %v, got %v", i, r.allowed, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(1, 10)
+	limiter.pruned = start
+	limiter.allow("idle", start)
+	for i := 0; i < 10; i++ {
+		limiter.allow("busy", start.Add(55*time.Second))
+	}
+
+	// Buckets that are full again are forgotten after a minute
+	limiter.allow("new", start.Add(61*time.Second))
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Fatal("full bucket was not pruned")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Fatal("bucket that is not full was pruned")
+	}
+	// 6 tokens refilled since, not the whole burst
+	for i := 0; i < 6; i++ {
+		if !limiter.allow("busy", start.Add(61*time.Second)) {
+			t.Fatalf("request %d was not allowed", i)
+		}
+	}
+	if limiter.allow("busy", start.Add(61*time.Second)) {
+		t.Fatal("pruning refilled a bucket")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		method      string
+		status      int
+		retry_after string
+	}{
+		{name: "rate limited", rate: 1, method: http.MethodGet, status: http.StatusTooManyRequests, retry_after: "1"},
+		{name: "retry after rounded up", rate: 0.4, method: http.MethodPost, status: http.StatusTooManyRequests, retry_after: "3"},
+		{name: "preflight requests are not limited", rate: 1, method: http.MethodOptions, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(test.rate, 1)
+			handler := limiter.limit(false, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			rate_limited := relay_metrics.rate_limited.Load()
+
+			request := func(remote string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(test.method, "/spec", nil)
+				r.RemoteAddr = remote
+				w := httptest.NewRecorder()
+				handler(w, r)
+				return w
+			}
+			if w := request("192.0.2.1:1234"); w.Code != http.StatusOK {
+				t.Fatalf("first request: expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			w := request("192.0.2.1:5678")
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != test.retry_after {
+				t.Fatalf("expected Retry-After %q, got %q", test.retry_after, got)
+			}
+			if test.status == http.StatusTooManyRequests {
+				if !strings.Contains(w.Body.String(), "rate limited") {
+					t.Fatalf("unexpected body: %s", w.Body)
+				}
+				if relay_metrics.rate_limited.Load() != rate_limited+1 {
+					t.Fatal("rate limited request was not counted")
+				}
+			}
+			// Other clients have their own bucket
+			if w := request("192.0.2.2:1234"); w.Code != http.StatusOK {
+				t.Fatalf("other client: expected status %d, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      string
+		headers     map[string]string
+		trust_proxy bool
+		ip          string
+	}{
+		{name: "remote address", remote: "192.0.2.1:1234", ip: "192.0.2.1"},
+		{name: "ipv6 remote address", remote: "[2001:db8::1]:1234", ip: "2001:db8::1"},
+		{name: "remote address without port", remote: "192.0.2.1", ip: "192.0.2.1"},
+		{
+			name:    "headers of untrusted proxies are ignored",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"X-Real-IP": "198.51.100.1", "X-Forwarded-For": "198.51.100.2"},
+			ip:      "192.0.2.1",
+		},
+		{
+			name:        "real ip of trusted proxy",
+			remote:      "127.0.0.1:1234",
+			headers:     map[string]string{"X-Real-IP": " 198.51.100.1 ", "X-Forwarded-For": "198.51.100.2"},
+			trust_proxy: true,
+			ip:          "198.51.100.1",
+		},
+		{
+			name:        "last forwarded address of trusted proxy",
+			remote:      "127.0.0.1:1234",
+			headers:     map[string]string{"X-Forwarded-For": "203.0.113.1, 198.51.100.2"},
+			trust_proxy: true,
+			ip:          "198.51.100.2",
+		},
+		{
+			name:        "trusted proxy without headers",
+			remote:      "127.0.0.1:1234",
+			trust_proxy: true,
+			ip:          "127.0.0.1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+			r.RemoteAddr = test.remote
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			if ip := clientIp(r, test.trust_proxy); ip != test.ip {
+				t.Fatalf("expected %s, got %s", test.ip, ip)
+			}
+		})
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	newTestRelay(t, &fakeLN{})
+	lnproxy_relay.MaxClientOpenCircuits = 2
+	too_many_client_circuits := relay_metrics.too_many_client_circuits.Load()
+
+	requests := []struct {
+		invoice string
+		remote  string
+		status  int
+	}{
+		{"lnbc1", "192.0.2.1:1000", http.StatusOK},
+		{"lnbc2", "192.0.2.1:1001", http.StatusOK},
+		{"lnbc3", "192.0.2.1:1002", http.StatusTooManyRequests},
+		{"lnbc4", "192.0.2.2:1000", http.StatusOK},
+	}
+	for _, request := range requests {
+		r := httptest.NewRequest(http.MethodGet, "/api/"+request.invoice, nil)
+		r.RemoteAddr = request.remote
+		w := httptest.NewRecorder()
+		apiHandler(w, r)
+		if w.Code != request.status {
+			t.Fatalf("%s from %s: expected status %d, got %d: %s", request.invoice, request.remote,
+				request.status, w.Code, w.Body)
+		}
+	}
+	if relay_metrics.too_many_client_circuits.Load() != too_many_client_circuits+1 {
+		t.Fatal("rejected request was not counted")
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"lnproxy_open_circuits 3",
+		"lnproxy_clients_with_open_circuits 2",
+		"lnproxy_max_client_open_circuits 2",
+		"lnproxy_max_client_outstanding_msat 2000000000",
+		`lnproxy_requests_rejected_total{reason="max_client_open_circuits"} `,
+		`lnproxy_requests_rejected_total{reason="max_client_outstanding_msat"} `,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Fatalf("metrics are missing %q:\n%s", line, w.Body)
+		}
+	}
+}
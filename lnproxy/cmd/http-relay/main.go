@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,13 +25,80 @@ import (
 
 var lnproxy_relay *relay.Relay
 
-func specApiHandler(w http.ResponseWriter, r *http.Request) {
+// Whether client ips are taken from the headers of a reverse proxy
+var trust_proxy bool
+
+// Largest request body accepted, bolt11 invoices are at most a few kilobytes
+const maxRequestBytes = 64 << 10
+
+func setCorsHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+}
+
+// Handles CORS preflight requests and rejects unexpected methods,
+// returns false if the request was answered.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	setCorsHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method+", OPTIONS")
+		writeJson(w, http.StatusMethodNotAllowed, makeJsonError("method not allowed"))
+		return false
+	}
+	return true
+}
+
+// Opens a circuit and maps errors to a status code and a reason for the client,
+// internal errors are not disclosed.
+func openCircuit(x relay.ProxyParameters) (string, int, string) {
+	proxy_invoice, err := lnproxy_relay.OpenCircuit(x)
+	if errors.Is(err, relay.Overloaded) {
+		switch {
+		case errors.Is(err, relay.TooManyCircuits):
+			relay_metrics.too_many_circuits.Add(1)
+		case errors.Is(err, relay.TooMuchOutstanding):
+			relay_metrics.too_much_outstanding.Add(1)
+		case errors.Is(err, relay.TooManyClientCircuits):
+			relay_metrics.too_many_client_circuits.Add(1)
+		case errors.Is(err, relay.TooMuchClientOutstanding):
+			relay_metrics.too_much_client_outstanding.Add(1)
+		case errors.Is(err, relay.InsufficientInbound):
+			relay_metrics.insufficient_inbound.Add(1)
+		case errors.Is(err, relay.InsufficientOutbound):
+			relay_metrics.insufficient_outbound.Add(1)
+		}
+		log.Println("relay at capacity", strings.TrimSpace(err.Error()), "for", x)
+		return "", http.StatusTooManyRequests, strings.TrimSpace(err.Error())
+	} else if errors.Is(err, relay.ClientFacing) {
+		log.Println("client facing error", strings.TrimSpace(err.Error()), "for", x)
+		return "", http.StatusBadRequest, strings.TrimSpace(err.Error())
+	} else if err != nil {
+		log.Println("internal error", strings.TrimSpace(err.Error()), "for", x)
+		return "", http.StatusInternalServerError, "internal error"
+	}
+	relay_metrics.circuits_opened.Add(1)
+	return proxy_invoice, http.StatusOK, ""
+}
 
+func specApiHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
 	x := relay.ProxyParameters{}
 	err := json.NewDecoder(r.Body).Decode(&x)
-	if err != nil {
+	var max_bytes_err *http.MaxBytesError
+	if errors.As(err, &max_bytes_err) {
+		log.Println("request too large:", err)
+		writeJson(w, http.StatusRequestEntityTooLarge, makeJsonError("request too large"))
+		return
+	} else if err != nil {
 		log.Println("error decoding request:", err)
 		body, err := io.ReadAll(r.Body)
 		if err != nil && err != io.EOF {
@@ -38,28 +106,115 @@ func specApiHandler(w http.ResponseWriter, r *http.Request) {
 		} else if len(body) > 0 {
 			log.Println("request:", string(body))
 		}
-		json.NewEncoder(w).Encode(makeJsonError("bad request"))
+		writeJson(w, http.StatusBadRequest, makeJsonError("bad request"))
 		return
 	}
+	x.Client = clientIp(r, trust_proxy)
 
-	proxy_invoice, err := lnproxy_relay.OpenCircuit(x)
-	if errors.Is(err, relay.ClientFacing) {
-		log.Println("client facing error", strings.TrimSpace(err.Error()), "for", x)
-		json.NewEncoder(w).Encode(makeJsonError(strings.TrimSpace(err.Error())))
-		return
-	} else if err != nil {
-		log.Println("internal error", strings.TrimSpace(err.Error()), "for", x)
-		json.NewEncoder(w).Encode(makeJsonError("internal error"))
+	proxy_invoice, status, reason := openCircuit(x)
+	if status != http.StatusOK {
+		writeJson(w, status, makeJsonError(reason))
 		return
 	}
 
-	json.NewEncoder(w).Encode(struct {
+	writeJson(w, http.StatusOK, struct {
 		WrappedInvoice string `json:"proxy_invoice"`
 	}{
 		WrappedInvoice: proxy_invoice,
 	})
 }
 
+// Legacy form of the api: GET /api/{invoice}?routing_msat=&description=&description_hash=
+// answers with the wrapped invoice or the error as plain text.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	x := relay.ProxyParameters{
+		Invoice: strings.TrimPrefix(r.URL.Path, "/api/"),
+		Client:  clientIp(r, trust_proxy),
+	}
+	if x.Invoice == "" || strings.Contains(x.Invoice, "/") {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if routing_msat_string := query.Get("routing_msat"); routing_msat_string != "" {
+		routing_msat, err := strconv.ParseUint(routing_msat_string, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid routing_msat", http.StatusBadRequest)
+			return
+		}
+		x.RoutingMsat = &routing_msat
+	}
+	if query.Has("description") {
+		description := query.Get("description")
+		x.Description = &description
+	}
+	if query.Has("description_hash") {
+		description_hash := query.Get("description_hash")
+		x.DescriptionHash = &description_hash
+	}
+
+	proxy_invoice, status, reason := openCircuit(x)
+	if status != http.StatusOK {
+		http.Error(w, reason, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, proxy_invoice)
+}
+
+// Advertises the relay's parameters, so clients can compute fees before requesting a wrapped invoice
+func parametersHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJson(w, http.StatusOK, lnproxy_relay.Advertised())
+}
+
+// Lists the circuits whose payment to the original invoice has an unknown outcome,
+// their payers' htlcs are held until the payments are resolved.
+func unknownCircuitsHandler(w http.ResponseWriter, r *http.Request) {
+	circuits, err := lnproxy_relay.UnknownCircuits()
+	if err != nil {
+		log.Println("error listing unknown circuits:", err)
+		writeJson(w, http.StatusInternalServerError, makeJsonError("internal error"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, struct {
+		Circuits []relay.Circuit `json:"circuits"`
+	}{
+		Circuits: circuits,
+	})
+}
+
+// Reports the earnings per day and per destination,
+// of the last 30 days unless set by the days query parameter.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n <= 0 {
+			writeJson(w, http.StatusBadRequest, makeJsonError("invalid days"))
+			return
+		}
+		days = n
+	}
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	summary, err := lnproxy_relay.EarningsSince(since)
+	if err != nil {
+		log.Println("error summarizing earnings:", err)
+		writeJson(w, http.StatusInternalServerError, makeJsonError("internal error"))
+		return
+	}
+	writeJson(w, http.StatusOK, summary)
+}
+
 type JsonError struct {
 	Status string `json:"status"`
 	Reason string `json:"reason"`
@@ -72,6 +227,15 @@ func makeJsonError(reason string) JsonError {
 	}
 }
 
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("error writing response:", err)
+	}
+}
+
 func main() {
 	httpPort := flag.String("port", "4747", "http port over which to expose api")
 	lndHostString := flag.String("lnd", "https://127.0.0.1:8080", "host for lnd's REST api")
@@ -80,6 +244,15 @@ func main() {
 		".lnd/tls.cert",
 		"lnd's self-signed cert (set to empty string for no-rest-tls=true)",
 	)
+	circuitsDir := flag.String("circuits", ".lnproxy/circuits", "directory in which open circuits are journaled")
+	earningsPath := flag.String("earnings", ".lnproxy/earnings.jsonl", "file in which the earnings of settled circuits are recorded")
+	configPath := flag.String("config", "", "json file with relay parameters, e.g. {\"max_cltv_expiry\": 1800}")
+	flagParams := relayParameterFlags(flag.CommandLine)
+	rateLimit := flag.Float64("rate-limit", 1, "requests per second allowed from a single ip (set to 0 for no limit)")
+	rateBurst := flag.Uint64("rate-burst", 10, "requests a single ip can make at once before being rate limited")
+	flag.BoolVar(&trust_proxy, "trust-proxy", false, "take client ips from the X-Real-IP and X-Forwarded-For headers of a reverse proxy")
+	checkLiquidity := flag.Bool("check-liquidity", true, "reject requests the node's channel balances can't carry")
+	adminAddr := flag.String("admin", "127.0.0.1:4748", "address of the operator api (set to empty string to disable)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `usage: %s [flags] lnproxy.macaroon
@@ -88,12 +261,14 @@ func main() {
 		lncli bakemacaroon --save_to lnproxy.macaroon \
 			uri:/lnrpc.Lightning/DecodePayReq \
 			uri:/lnrpc.Lightning/LookupInvoice \
+			uri:/lnrpc.Lightning/ChannelBalance \
 			uri:/invoicesrpc.Invoices/AddHoldInvoice \
 			uri:/invoicesrpc.Invoices/SubscribeSingleInvoice \
 			uri:/invoicesrpc.Invoices/CancelInvoice \
 			uri:/invoicesrpc.Invoices/SettleInvoice \
 			uri:/routerrpc.Router/SendPaymentV2 \
 			uri:/routerrpc.Router/EstimateRouteFee \
+			uri:/routerrpc.Router/TrackPaymentV2 \
 			uri:/chainrpc.ChainKit/GetBestBlock
 `, os.Args[0])
 		flag.PrintDefaults()
@@ -106,6 +281,15 @@ func main() {
 		os.Exit(2)
 	}
 
+	if *rateLimit > 0 && *rateBurst == 0 {
+		log.Fatalln("rate-burst must be positive if rate-limit is set")
+	}
+
+	params, err := loadRelayParameters(flag.CommandLine, *configPath, flagParams)
+	if err != nil {
+		log.Fatalln("invalid relay parameters:", err)
+	}
+
 	macaroonBytes, err := os.ReadFile(flag.Args()[0])
 	if err != nil {
 		log.Fatalln("unable to read lnproxy macaroon file:", err)
@@ -145,9 +329,35 @@ func main() {
 		Macaroon:  macaroon,
 	}
 
-	lnproxy_relay = relay.NewRelay(lnd)
+	circuits, err := relay.NewFileCircuitStore(*circuitsDir)
+	if err != nil {
+		log.Fatalln("unable to open circuit journal:", err)
+	}
+
+	lnproxy_relay = relay.NewRelay(lnd, circuits)
+	lnproxy_relay.RelayParameters = params
+	lnproxy_relay.Payments = relay.LndPaymentTracker{Lnd: lnd}
+	if *checkLiquidity {
+		lnproxy_relay.Liquidity = relay.LndLiquiditySource{Lnd: lnd}
+	}
+	lnproxy_relay.Earnings, err = relay.NewFileEarningsLedger(*earningsPath)
+	if err != nil {
+		log.Fatalln("unable to open earnings ledger:", err)
+	}
+	err = lnproxy_relay.RecoverCircuits()
+	if err != nil {
+		log.Fatalln("unable to recover open circuits:", err)
+	}
 
-	http.HandleFunc("/spec", specApiHandler)
+	if *rateLimit > 0 {
+		limiter := newRateLimiter(*rateLimit, *rateBurst)
+		http.HandleFunc("/spec", limiter.limit(trust_proxy, specApiHandler))
+		http.HandleFunc("/api/", limiter.limit(trust_proxy, apiHandler))
+	} else {
+		http.HandleFunc("/spec", specApiHandler)
+		http.HandleFunc("/api/", apiHandler)
+	}
+	http.HandleFunc("/parameters", parametersHandler)
 
 	server := &http.Server{
 		Addr:              "0.0.0.0:" + *httpPort,
@@ -157,6 +367,29 @@ func main() {
 		MaxHeaderBytes:    1 << 20,
 	}
 
+	// The operator api is served separately so it is not exposed with the public api
+	var adminServer *http.Server
+	if *adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/circuits/unknown", unknownCircuitsHandler)
+		adminMux.HandleFunc("/stats", statsHandler)
+		adminMux.HandleFunc("/metrics", metricsHandler)
+		adminServer = &http.Server{
+			Addr:              *adminAddr,
+			Handler:           adminMux,
+			ReadHeaderTimeout: 2 * time.Second,
+			ReadTimeout:       20 * time.Second,
+			WriteTimeout:      20 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+		}
+		go func() {
+			log.Println("operator api listening on:", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Println("operator api ListenAndServe error:", err)
+			}
+		}()
+	}
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -165,6 +398,11 @@ func main() {
 		if err := server.Shutdown(context.Background()); err != nil {
 			log.Println("HTTP server shutdown error:", err)
 		}
+		if adminServer != nil {
+			if err := adminServer.Shutdown(context.Background()); err != nil {
+				log.Println("operator api shutdown error:", err)
+			}
+		}
 		close(idleConnsClosed)
 		log.Println("HTTP server shutdown")
 	}()
@@ -177,6 +415,8 @@ func main() {
 	<-idleConnsClosed
 
 	signal.Reset(os.Interrupt)
+	// Payments in unknown state are resolved again after the restart
+	lnproxy_relay.Shutdown()
 	log.Println("waiting for open circuits...")
 	lnproxy_relay.WaitGroup.Wait()
 }
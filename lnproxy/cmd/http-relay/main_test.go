@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	relay "lnproxy"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+// An LN whose wrapped invoices stay open until hold is closed,
+// every invoice decodes to an invoice of amount_msat with the sha256 of the invoice as hash
+type fakeLN struct {
+	hold        chan struct{}
+	amount_msat uint64
+	add_err     error
+
+	mu    sync.Mutex
+	added []lnc.InvoiceParameters
+}
+
+func (ln *fakeLN) AddInvoice(p lnc.InvoiceParameters) (string, error) {
+	if ln.add_err != nil {
+		return "", ln.add_err
+	}
+	ln.mu.Lock()
+	ln.added = append(ln.added, p)
+	ln.mu.Unlock()
+	return "lnbcwrapped" + hex.EncodeToString(p.Hash), nil
+}
+
+// Parameters of the last invoice added
+func (ln *fakeLN) lastAdded() lnc.InvoiceParameters {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if len(ln.added) == 0 {
+		return lnc.InvoiceParameters{}
+	}
+	return ln.added[len(ln.added)-1]
+}
+
+func (ln *fakeLN) DecodeInvoice(invoice string) (*lnc.DecodedInvoice, error) {
+	hash := sha256.Sum256([]byte(invoice))
+	amount_msat := ln.amount_msat
+	if amount_msat == 0 {
+		amount_msat = 100_000
+	}
+	return &lnc.DecodedInvoice{
+		PaymentHash: hex.EncodeToString(hash[:]),
+		Timestamp:   uint64(time.Now().Unix()),
+		Expiry:      3600,
+		NumMsat:     amount_msat,
+		Destination: "02destination",
+		Description: "original description",
+	}, nil
+}
+
+func (ln *fakeLN) EstimateRoutingFee(lnc.DecodedInvoice, uint64) (uint64, uint64, error) {
+	return 1000, 40, nil
+}
+
+func (ln *fakeLN) WatchInvoice([]byte) (lnc.InvoiceState, error) {
+	<-ln.hold
+	return lnc.InvoiceState{State: lnc.Canceled}, nil
+}
+
+func (ln *fakeLN) CancelInvoice([]byte) error {
+	return nil
+}
+
+func (ln *fakeLN) PayInvoice(lnc.PaymentParameters) ([]byte, error) {
+	return nil, lnc.PaymentFailed
+}
+
+func (ln *fakeLN) SettleInvoice([]byte) error {
+	return nil
+}
+
+// Serves the handlers with a relay on the given LN,
+// the circuits opened are closed at the end of the test
+func newTestRelay(t *testing.T, ln *fakeLN) {
+	t.Helper()
+	circuits, err := relay.NewFileCircuitStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.hold = make(chan struct{})
+	lnproxy_relay = relay.NewRelay(ln, circuits)
+	t.Cleanup(func() {
+		close(ln.hold)
+		lnproxy_relay.Wait()
+	})
+}
+
+func TestApiHandler(t *testing.T) {
+	description_hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		amount_msat uint64
+		add_err     error
+		params      func(*relay.RelayParameters)
+		status      int
+		body        string
+		value_msat  uint64
+		memo        string
+		description []byte
+	}{
+		{
+			name:       "wrapped invoice",
+			path:       "/api/lnbc1",
+			status:     http.StatusOK,
+			value_msat: 104_600,
+			memo:       "original description",
+		},
+		{
+			name:       "custom routing fee",
+			path:       "/api/lnbc2?routing_msat=5000",
+			status:     http.StatusOK,
+			value_msat: 105_000,
+			memo:       "original description",
+		},
+		{
+			name:       "description",
+			path:       "/api/lnbc3?description=wrapped+description",
+			status:     http.StatusOK,
+			value_msat: 104_600,
+			memo:       "wrapped description",
+		},
+		{
+			name:        "description hash",
+			path:        "/api/lnbc4?description_hash=" + description_hash,
+			status:      http.StatusOK,
+			value_msat:  104_600,
+			description: bytes.Repeat([]byte{0xab}, 32),
+		},
+		{
+			name:   "invalid routing fee",
+			path:   "/api/lnbc5?routing_msat=lots",
+			status: http.StatusBadRequest,
+			body:   "invalid routing_msat",
+		},
+		{
+			name:   "routing fee too low",
+			path:   "/api/lnbc6?routing_msat=100",
+			status: http.StatusBadRequest,
+			body:   "custom fee budget too low",
+		},
+		{
+			name:   "description and description hash",
+			path:   "/api/lnbc7?description=x&description_hash=" + description_hash,
+			status: http.StatusBadRequest,
+			body:   "description and description hash cannot both be set",
+		},
+		{
+			name:        "amount too low",
+			path:        "/api/lnbc8",
+			amount_msat: 1000,
+			status:      http.StatusBadRequest,
+			body:        "invoice amount too low",
+		},
+		{
+			name:   "missing invoice",
+			path:   "/api/",
+			status: http.StatusBadRequest,
+			body:   "bad request",
+		},
+		{
+			name:   "relay at capacity",
+			path:   "/api/lnbc9",
+			params: func(p *relay.RelayParameters) { p.MaxOpenCircuits = 1; p.MaxClientOpenCircuits = 0 },
+			status: http.StatusTooManyRequests,
+			body:   "too many open circuits",
+		},
+		{
+			name:    "internal errors are not disclosed",
+			path:    "/api/lnbc10",
+			add_err: errors.New("lnd at 10.0.0.1 unreachable"),
+			status:  http.StatusInternalServerError,
+			body:    "internal error",
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodPost,
+			path:   "/api/lnbc11",
+			status: http.StatusMethodNotAllowed,
+			body:   "method not allowed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{amount_msat: test.amount_msat, add_err: test.add_err}
+			newTestRelay(t, ln)
+			if test.params != nil {
+				// Fill the relay up to its capacity first
+				test.params(&lnproxy_relay.RelayParameters)
+				if _, err := lnproxy_relay.OpenCircuit(relay.ProxyParameters{Invoice: "lnbcfirst"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			apiHandler(w, httptest.NewRequest(method, test.path, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+			if test.status != http.StatusOK {
+				if !strings.Contains(w.Body.String(), test.body) {
+					t.Fatalf("expected %q, got %q", test.body, w.Body)
+				}
+				if strings.Contains(w.Body.String(), "10.0.0.1") {
+					t.Fatalf("internal error disclosed: %s", w.Body)
+				}
+				return
+			}
+
+			added := ln.lastAdded()
+			if w.Body.String() != "lnbcwrapped"+hex.EncodeToString(added.Hash)+"\n" {
+				t.Fatalf("unexpected body: %q", w.Body)
+			}
+			if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+				t.Fatalf("unexpected content type: %s", w.Header().Get("Content-Type"))
+			}
+			if added.ValueMsat != test.value_msat || added.Memo != test.memo || !bytes.Equal(added.DescriptionHash, test.description) {
+				t.Fatalf("expected %d msat, memo %q and description hash %x, got %+v",
+					test.value_msat, test.memo, test.description, added)
+			}
+		})
+	}
+}
+
+func TestSpecApiHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		amount_msat uint64
+		add_err     error
+		status      int
+		reason      string
+		value_msat  uint64
+	}{
+		{
+			name:       "wrapped invoice",
+			body:       `{"invoice": "lnbc1"}`,
+			status:     http.StatusOK,
+			value_msat: 104_600,
+		},
+		{
+			name:       "custom routing fee as string",
+			body:       `{"invoice": "lnbc2", "routing_msat": "5000"}`,
+			status:     http.StatusOK,
+			value_msat: 105_000,
+		},
+		{
+			name:   "invalid json",
+			body:   `{"invoice": `,
+			status: http.StatusBadRequest,
+			reason: "bad request",
+		},
+		{
+			name:   "request too large",
+			body:   `{"invoice": "` + strings.Repeat("a", maxRequestBytes) + `"}`,
+			status: http.StatusRequestEntityTooLarge,
+			reason: "request too large",
+		},
+		{
+			name:        "client facing error",
+			body:        `{"invoice": "lnbc3"}`,
+			amount_msat: 2_000_000_000,
+			status:      http.StatusBadRequest,
+			reason:      "invoice amount too high",
+		},
+		{
+			name:    "internal errors are not disclosed",
+			body:    `{"invoice": "lnbc4"}`,
+			add_err: errors.New("lnd at 10.0.0.1 unreachable"),
+			status:  http.StatusInternalServerError,
+			reason:  "internal error",
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			status: http.StatusMethodNotAllowed,
+			reason: "method not allowed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{amount_msat: test.amount_msat, add_err: test.add_err}
+			newTestRelay(t, ln)
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			w := httptest.NewRecorder()
+			specApiHandler(w, httptest.NewRequest(method, "/spec", strings.NewReader(test.body)))
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+			if test.status != http.StatusOK {
+				response := JsonError{}
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				if response.Status != "ERROR" || response.Reason != test.reason {
+					t.Fatalf("expected reason %q, got %+v", test.reason, response)
+				}
+				return
+			}
+
+			response := struct {
+				WrappedInvoice string `json:"proxy_invoice"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			added := ln.lastAdded()
+			if response.WrappedInvoice != "lnbcwrapped"+hex.EncodeToString(added.Hash) {
+				t.Fatalf("unexpected wrapped invoice: %s", response.WrappedInvoice)
+			}
+			if added.ValueMsat != test.value_msat {
+				t.Fatalf("expected %d msat, got %d", test.value_msat, added.ValueMsat)
+			}
+		})
+	}
+}
+
+// Overloaded relays answer the spec api with 429 too
+func TestSpecApiHandlerOverloaded(t *testing.T) {
+	newTestRelay(t, &fakeLN{})
+	lnproxy_relay.MaxOutstandingMsat = 150_000
+	too_much_outstanding := relay_metrics.too_much_outstanding.Load()
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		body := `{"invoice": "lnbc` + string(rune('a'+i)) + `"}`
+		w := httptest.NewRecorder()
+		specApiHandler(w, httptest.NewRequest(http.MethodPost, "/spec", strings.NewReader(body)))
+		if w.Code != status {
+			t.Fatalf("request %d: expected status %d, got %d: %s", i, status, w.Code, w.Body)
+		}
+	}
+	if relay_metrics.too_much_outstanding.Load() != too_much_outstanding+1 {
+		t.Fatal("rejected request was not counted")
+	}
+}
+
+func TestParametersHandler(t *testing.T) {
+	newTestRelay(t, &fakeLN{})
+	lnproxy_relay.RoutingFeePPM = 2500
+	lnproxy_relay.MaxOpenCircuits = 7
+
+	w := httptest.NewRecorder()
+	parametersHandler(w, httptest.NewRequest(http.MethodGet, "/parameters", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal("missing cors headers")
+	}
+
+	advertised := map[string]any{}
+	if err := json.NewDecoder(w.Body).Decode(&advertised); err != nil {
+		t.Fatal(err)
+	}
+	defaults := relay.DefaultRelayParameters()
+	expected := map[string]any{
+		"min_amount_msat":       float64(defaults.MinAmountMsat),
+		"max_amount_msat":       float64(defaults.MaxAmountMsat),
+		"routing_fee_base_msat": float64(defaults.RoutingFeeBaseMsat),
+		"routing_fee_ppm":       float64(2500),
+		"min_fee_budget_msat":   float64(defaults.MinFeeBudgetMsat),
+		"routing_budget_alpha":  float64(defaults.RoutingBudgetAlpha),
+		"routing_budget_beta":   float64(defaults.RoutingBudgetBeta),
+		"expiry_buffer":         float64(defaults.ExpiryBuffer),
+		"max_expiry":            float64(defaults.MaxExpiry),
+		"min_cltv_expiry":       float64(defaults.MinCltvExpiry),
+		"max_cltv_expiry":       float64(defaults.MaxCltvExpiry),
+	}
+	// Capacity limits are not advertised
+	if len(advertised) != len(expected) {
+		t.Fatalf("expected %d parameters, got %v", len(expected), advertised)
+	}
+	for k, v := range expected {
+		if advertised[k] != v {
+			t.Fatalf("expected %s %v, got %v", k, v, advertised[k])
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	ledger, err := relay.NewFileEarningsLedger(filepath.Join(t.TempDir(), "earnings.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC()
+	for i, settled_at := range []time.Time{today, today.AddDate(0, 0, -1), today.AddDate(0, 0, -2), today.AddDate(0, 0, -30)} {
+		err := ledger.Record(relay.Earning{
+			Hash:        string(rune('a' + i)),
+			Destination: "02destination",
+			SettledAt:   settled_at,
+			MarginMsat:  1000,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		earnings relay.EarningsLedger
+		status   int
+		circuits uint64
+		days     int
+	}{
+		{name: "last 30 days by default", earnings: ledger, status: http.StatusOK, circuits: 3, days: 3},
+		{name: "today", query: "?days=1", earnings: ledger, status: http.StatusOK, circuits: 1, days: 1},
+		{name: "last two days", query: "?days=2", earnings: ledger, status: http.StatusOK, circuits: 2, days: 2},
+		{name: "last 31 days", query: "?days=31", earnings: ledger, status: http.StatusOK, circuits: 4, days: 4},
+		{name: "zero days", query: "?days=0", earnings: ledger, status: http.StatusBadRequest},
+		{name: "invalid days", query: "?days=week", earnings: ledger, status: http.StatusBadRequest},
+		{name: "no ledger", status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lnproxy_relay = relay.NewRelay(nil, nil)
+			if test.earnings != nil {
+				lnproxy_relay.Earnings = test.earnings
+			}
+			w := httptest.NewRecorder()
+			statsHandler(w, httptest.NewRequest(http.MethodGet, "/stats"+test.query, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			summary := relay.EarningsSummary{}
+			if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Total.Circuits != test.circuits || summary.Total.MarginMsat != int64(test.circuits)*1000 {
+				t.Fatalf("expected %d circuits, got %+v", test.circuits, summary.Total)
+			}
+			if len(summary.Days) != test.days {
+				t.Fatalf("expected %d days, got %+v", test.days, summary.Days)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What the operator earned with a settled circuit,
+// the margin is what is left of the wrapped amount after paying the original invoice
+type Earning struct {
+	Hash               string    `json:"hash"`
+	Destination        string    `json:"destination"`
+	SettledAt          time.Time `json:"settled_at"`
+	AmountMsat         uint64    `json:"amount_msat"`
+	OriginalAmountMsat uint64    `json:"original_amount_msat"`
+	RoutingFeeMsat     uint64    `json:"routing_fee_msat"`
+	MarginMsat         int64     `json:"margin_msat"`
+}
+
+// Durable storage for earnings, entries must be persisted before Record returns.
+// Earnings are keyed by payment hash, recording a circuit again has no effect.
+type EarningsLedger interface {
+	Record(Earning) error
+	// Whether the earning of the circuit with the hex encoded hash was recorded
+	Recorded(hash string) (bool, error)
+	// Returns the earnings of circuits settled at or after since
+	List(since time.Time) ([]Earning, error)
+}
+
+// Appends each earning as a json line to a single file
+type FileEarningsLedger struct {
+	Path string
+	mu   sync.Mutex
+	// Hashes of the recorded earnings, loaded from the file on first use
+	recorded map[string]bool
+}
+
+func NewFileEarningsLedger(path string) (*FileEarningsLedger, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileEarningsLedger{Path: path}, nil
+}
+
+func (l *FileEarningsLedger) Record(e Earning) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return err
+	}
+	if l.recorded[e.Hash] {
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	// A crash while recording can leave a partial last line,
+	// the earning must not be appended to it
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err != nil {
+			f.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	l.recorded[e.Hash] = true
+	return nil
+}
+
+func (l *FileEarningsLedger) Recorded(hash string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return false, err
+	}
+	return l.recorded[hash], nil
+}
+
+func (l *FileEarningsLedger) List(since time.Time) ([]Earning, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	all, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	earnings := []Earning{}
+	for _, e := range all {
+		if !e.SettledAt.Before(since) {
+			earnings = append(earnings, e)
+		}
+	}
+	return earnings, nil
+}
+
+func (l *FileEarningsLedger) load() error {
+	if l.recorded != nil {
+		return nil
+	}
+	earnings, err := l.read()
+	if err != nil {
+		return err
+	}
+	l.recorded = map[string]bool{}
+	for _, e := range earnings {
+		l.recorded[e.Hash] = true
+	}
+	return nil
+}
+
+// Returns every earning in the file once, in the order they were recorded
+func (l *FileEarningsLedger) read() ([]Earning, error) {
+	earnings := []Earning{}
+	f, err := os.Open(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return earnings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := Earning{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// A crash while recording can leave a partial last line
+			log.Println("skipping invalid earnings entry:", err)
+			continue
+		}
+		if seen[e.Hash] {
+			continue
+		}
+		seen[e.Hash] = true
+		earnings = append(earnings, e)
+	}
+	return earnings, scanner.Err()
+}
+
+type EarningsTotal struct {
+	Circuits           uint64 `json:"circuits"`
+	AmountMsat         uint64 `json:"amount_msat"`
+	OriginalAmountMsat uint64 `json:"original_amount_msat"`
+	RoutingFeeMsat     uint64 `json:"routing_fee_msat"`
+	MarginMsat         int64  `json:"margin_msat"`
+}
+
+func (t *EarningsTotal) add(e Earning) {
+	t.Circuits++
+	t.AmountMsat += e.AmountMsat
+	t.OriginalAmountMsat += e.OriginalAmountMsat
+	t.RoutingFeeMsat += e.RoutingFeeMsat
+	t.MarginMsat += e.MarginMsat
+}
+
+type DayEarnings struct {
+	// UTC date formatted as YYYY-MM-DD
+	Day string `json:"day"`
+	EarningsTotal
+}
+
+type DestinationEarnings struct {
+	Destination string `json:"destination"`
+	EarningsTotal
+}
+
+type EarningsSummary struct {
+	Total        EarningsTotal         `json:"total"`
+	Days         []DayEarnings         `json:"days"`
+	Destinations []DestinationEarnings `json:"destinations"`
+}
+
+// Totals earnings per day, oldest first,
+// and per destination, highest margin first
+func SummarizeEarnings(earnings []Earning) EarningsSummary {
+	summary := EarningsSummary{
+		Days:         []DayEarnings{},
+		Destinations: []DestinationEarnings{},
+	}
+	days := map[string]*EarningsTotal{}
+	destinations := map[string]*EarningsTotal{}
+	for _, e := range earnings {
+		summary.Total.add(e)
+
+		day := e.SettledAt.UTC().Format("2006-01-02")
+		if days[day] == nil {
+			days[day] = &EarningsTotal{}
+		}
+		days[day].add(e)
+
+		if destinations[e.Destination] == nil {
+			destinations[e.Destination] = &EarningsTotal{}
+		}
+		destinations[e.Destination].add(e)
+	}
+
+	for day, total := range days {
+		summary.Days = append(summary.Days, DayEarnings{Day: day, EarningsTotal: *total})
+	}
+	sort.Slice(summary.Days, func(i, j int) bool {
+		return summary.Days[i].Day < summary.Days[j].Day
+	})
+	for destination, total := range destinations {
+		summary.Destinations = append(summary.Destinations, DestinationEarnings{
+			Destination:   destination,
+			EarningsTotal: *total,
+		})
+	}
+	sort.Slice(summary.Destinations, func(i, j int) bool {
+		if summary.Destinations[i].MarginMsat != summary.Destinations[j].MarginMsat {
+			return summary.Destinations[i].MarginMsat > summary.Destinations[j].MarginMsat
+		}
+		return summary.Destinations[i].Destination < summary.Destinations[j].Destination
+	})
+	return summary
+}
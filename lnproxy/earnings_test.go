@@ -0,0 +1,426 @@
+package relay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+// An EarningsLedger in memory
+type memoryLedger struct {
+	mu       sync.Mutex
+	earnings []Earning
+}
+
+func (l *memoryLedger) Record(e Earning) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, recorded := range l.earnings {
+		if recorded.Hash == e.Hash {
+			return nil
+		}
+	}
+	l.earnings = append(l.earnings, e)
+	return nil
+}
+
+func (l *memoryLedger) Recorded(hash string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, recorded := range l.earnings {
+		if recorded.Hash == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (l *memoryLedger) List(since time.Time) ([]Earning, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	earnings := []Earning{}
+	for _, e := range l.earnings {
+		if !e.SettledAt.Before(since) {
+			earnings = append(earnings, e)
+		}
+	}
+	return earnings, nil
+}
+
+func testEarning(hash string, destination string, settled_at time.Time, margin_msat int64) Earning {
+	return Earning{
+		Hash:               hash,
+		Destination:        destination,
+		SettledAt:          settled_at,
+		AmountMsat:         103_000,
+		OriginalAmountMsat: 100_000,
+		RoutingFeeMsat:     uint64(3_000 - margin_msat),
+		MarginMsat:         margin_msat,
+	}
+}
+
+func listHashes(t *testing.T, ledger EarningsLedger, since time.Time) []string {
+	t.Helper()
+	earnings, err := ledger.List(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{}
+	for _, e := range earnings {
+		hashes = append(hashes, e.Hash)
+	}
+	return hashes
+}
+
+func TestFileEarningsLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger", "earnings.jsonl")
+	ledger, err := NewFileEarningsLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := listHashes(t, ledger, time.Time{}); len(hashes) != 0 {
+		t.Fatalf("expected no earnings, got %v", hashes)
+	}
+
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range []Earning{
+		testEarning("a", "02a", day, 1000),
+		testEarning("b", "02b", day.AddDate(0, 0, 1), 2000),
+		// Recording a circuit again has no effect
+		testEarning("a", "02a", day.AddDate(0, 0, 2), 1000),
+	} {
+		if err := ledger.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		since  time.Time
+		hashes []string
+	}{
+		{"all", time.Time{}, []string{"a", "b"}},
+		{"since settlement", day.AddDate(0, 0, 1), []string{"b"}},
+		{"none", day.AddDate(0, 0, 2), []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hashes := listHashes(t, ledger, test.since)
+			if !reflect.DeepEqual(hashes, test.hashes) {
+				t.Fatalf("expected %v, got %v", test.hashes, hashes)
+			}
+		})
+	}
+
+	// A crash while recording leaves a partial line, and earlier versions could record a circuit twice
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"hash":"b","destination":"02b"}` + "\n" + `{"hash":"c","dest`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded hashes are loaded from the file
+	reopened, err := NewFileEarningsLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash, expected := range map[string]bool{"a": true, "b": true, "c": false} {
+		recorded, err := reopened.Recorded(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recorded != expected {
+			t.Fatalf("%s: expected recorded %v, got %v", hash, expected, recorded)
+		}
+	}
+	for _, e := range []Earning{
+		testEarning("a", "02a", day, 1000),
+		testEarning("c", "02c", day, 3000),
+	} {
+		if err := reopened.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes := listHashes(t, reopened, time.Time{})
+	if !reflect.DeepEqual(hashes, []string{"a", "b", "c"}) {
+		t.Fatalf("expected [a b c], got %v", hashes)
+	}
+	earnings, err := reopened.List(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if earnings[1].MarginMsat != 2000 {
+		t.Fatalf("the first earning of a circuit must be kept, got %+v", earnings[1])
+	}
+}
+
+func TestSummarizeEarnings(t *testing.T) {
+	day := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	total := func(circuits uint64, margin_msat int64) EarningsTotal {
+		return EarningsTotal{
+			Circuits:           circuits,
+			AmountMsat:         circuits * 103_000,
+			OriginalAmountMsat: circuits * 100_000,
+			RoutingFeeMsat:     circuits*3_000 - uint64(margin_msat),
+			MarginMsat:         margin_msat,
+		}
+	}
+	tests := []struct {
+		name     string
+		earnings []Earning
+		expected EarningsSummary
+	}{
+		{
+			name:     "no earnings",
+			earnings: []Earning{},
+			expected: EarningsSummary{Days: []DayEarnings{}, Destinations: []DestinationEarnings{}},
+		},
+		{
+			name: "per day and destination",
+			earnings: []Earning{
+				testEarning("a", "02b", day.Add(2*time.Hour), 500),
+				testEarning("b", "02a", day, 1000),
+				// Settled in another time zone on the same UTC day
+				testEarning("c", "02c", day.In(time.FixedZone("UTC+2", 2*60*60)), 500),
+				// Routing fees can exceed the margin
+				testEarning("d", "02c", day.Add(time.Hour), -200),
+			},
+			expected: EarningsSummary{
+				Total: total(4, 1800),
+				Days: []DayEarnings{
+					{Day: "2024-03-01", EarningsTotal: total(2, 1500)},
+					{Day: "2024-03-02", EarningsTotal: total(2, 300)},
+				},
+				// Highest margin first, ties by destination
+				Destinations: []DestinationEarnings{
+					{Destination: "02a", EarningsTotal: total(1, 1000)},
+					{Destination: "02b", EarningsTotal: total(1, 500)},
+					{Destination: "02c", EarningsTotal: total(2, 300)},
+				},
+			},
+		},
+		{
+			name: "ties by destination",
+			earnings: []Earning{
+				testEarning("a", "02b", day, 500),
+				testEarning("b", "02a", day, 500),
+			},
+			expected: EarningsSummary{
+				Total: total(2, 1000),
+				Days: []DayEarnings{
+					{Day: "2024-03-01", EarningsTotal: total(2, 1000)},
+				},
+				Destinations: []DestinationEarnings{
+					{Destination: "02a", EarningsTotal: total(1, 500)},
+					{Destination: "02b", EarningsTotal: total(1, 500)},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			summary := SummarizeEarnings(test.earnings)
+			if !reflect.DeepEqual(summary, test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, summary)
+			}
+		})
+	}
+}
+
+// A circuit store checking that the earning of a circuit is recorded before it is journaled as settled
+type orderCheckingStore struct {
+	CircuitStore
+	t      *testing.T
+	ledger EarningsLedger
+}
+
+func (s orderCheckingStore) Put(c Circuit) error {
+	if c.State == CircuitSettled {
+		recorded, err := s.ledger.Recorded(c.Hash)
+		if err != nil || !recorded {
+			s.t.Errorf("circuit %s journaled as settled before its earning was recorded: %v", c.Hash, err)
+		}
+	}
+	return s.CircuitStore.Put(c)
+}
+
+// A ledger that fails to record
+type failingLedger struct {
+	memoryLedger
+}
+
+func (l *failingLedger) Record(Earning) error {
+	return errors.New("disk full")
+}
+
+func TestSettledCircuitEarning(t *testing.T) {
+	preimage := []byte("preimage")
+	tests := []struct {
+		name     string
+		payments []trackResult
+		fee_msat uint64
+	}{
+		{
+			name:     "routing fee paid",
+			payments: []trackResult{{state: PaymentState{Status: Succeeded, Preimage: preimage, FeeMsat: 700}}},
+			fee_msat: 700,
+		},
+		{
+			name:     "routing fee unknown",
+			payments: []trackResult{{err: errors.New("lnd unreachable")}},
+			fee_msat: 2_000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{
+				invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+				preimage: preimage,
+			}
+			relay, store := newTestRelay(t, ln)
+			ledger := &memoryLedger{}
+			relay.Earnings = ledger
+			relay.Circuits = orderCheckingStore{CircuitStore: store, t: t, ledger: ledger}
+			relay.Payments = &fakeTracker{results: test.payments}
+			circuit := testCircuit(1, CircuitOpen)
+			if err := store.Put(circuit); err != nil {
+				t.Fatal(err)
+			}
+
+			relay.admit(circuit, true)
+			relay.Add(1)
+			relay.circuitSwitch(circuit)
+
+			if got := getCircuit(t, store, circuit.Hash); got.State != CircuitSettled {
+				t.Fatalf("expected %s, got %s", CircuitSettled, got.State)
+			}
+			earnings, _ := ledger.List(time.Time{})
+			if len(earnings) != 1 {
+				t.Fatalf("expected one earning, got %+v", earnings)
+			}
+			e := earnings[0]
+			margin_msat := int64(circuit.AmountMsat - circuit.OriginalAmountMsat - test.fee_msat)
+			if e.Hash != circuit.Hash || e.RoutingFeeMsat != test.fee_msat || e.MarginMsat != margin_msat {
+				t.Fatalf("unexpected earning: %+v", e)
+			}
+		})
+	}
+
+	// An earning that can't be recorded doesn't keep the circuit from settling
+	ln := &fakeLN{
+		invoice:  lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+		preimage: preimage,
+	}
+	relay, store := newTestRelay(t, ln)
+	relay.Earnings = &failingLedger{}
+	circuit := testCircuit(1, CircuitOpen)
+	relay.admit(circuit, true)
+	relay.Add(1)
+	relay.circuitSwitch(circuit)
+	if got := getCircuit(t, store, circuit.Hash); got.State != CircuitSettled {
+		t.Fatalf("expected %s, got %s", CircuitSettled, got.State)
+	}
+}
+
+func TestRecoverEarnings(t *testing.T) {
+	preimage := []byte("preimage")
+	settled_at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state CircuitState
+		// Recorded before the restart
+		recorded bool
+		invoice  lnc.InvoiceState
+		payments []trackResult
+		fee_msat uint64
+	}{
+		{
+			name:     "missing earning of settled circuit is recorded",
+			state:    CircuitSettled,
+			payments: []trackResult{{state: PaymentState{Status: Succeeded, Preimage: preimage, FeeMsat: 700}}},
+			fee_msat: 700,
+		},
+		{
+			name:     "missing earning without payment tracking assumes the fee budget was spent",
+			state:    CircuitSettled,
+			fee_msat: 2_000,
+		},
+		{
+			name:     "recorded earning of settled circuit is kept",
+			state:    CircuitSettled,
+			recorded: true,
+			fee_msat: 300,
+		},
+		{
+			name:     "earning recorded before a crash is not recorded again",
+			state:    CircuitPaying,
+			recorded: true,
+			invoice:  lnc.InvoiceState{State: lnc.Settled},
+			fee_msat: 300,
+		},
+		{
+			name:     "paying circuit settled before a crash records its earning",
+			state:    CircuitPaying,
+			invoice:  lnc.InvoiceState{State: lnc.Settled},
+			payments: []trackResult{{state: PaymentState{Status: Succeeded, Preimage: preimage, FeeMsat: 700}}},
+			fee_msat: 700,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{invoice: test.invoice}
+			relay, store := newTestRelay(t, ln)
+			ledger := &memoryLedger{}
+			relay.Earnings = ledger
+			tracker := &fakeTracker{results: test.payments}
+			if test.payments != nil {
+				relay.Payments = tracker
+			}
+			circuit := testCircuit(1, test.state)
+			circuit.UpdatedAt = settled_at
+			if err := store.Put(circuit); err != nil {
+				t.Fatal(err)
+			}
+			if test.recorded {
+				e := testEarning(circuit.Hash, circuit.Destination, settled_at.Add(-time.Minute), 2_700)
+				if err := ledger.Record(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := relay.RecoverCircuits(); err != nil {
+				t.Fatal(err)
+			}
+			relay.Wait()
+
+			if got := getCircuit(t, store, circuit.Hash); got.State != CircuitSettled {
+				t.Fatalf("expected %s, got %s", CircuitSettled, got.State)
+			}
+			earnings, _ := ledger.List(time.Time{})
+			if len(earnings) != 1 {
+				t.Fatalf("expected one earning, got %+v", earnings)
+			}
+			e := earnings[0]
+			if e.Hash != circuit.Hash || e.RoutingFeeMsat != test.fee_msat {
+				t.Fatalf("unexpected earning: %+v", e)
+			}
+			// Recovered earnings are settled when the circuit was journaled as settled
+			if test.state == CircuitSettled && !test.recorded && !e.SettledAt.Equal(settled_at) {
+				t.Fatalf("expected earning settled at %v, got %v", settled_at, e.SettledAt)
+			}
+			if test.state == CircuitSettled && test.recorded && tracker.tracked > 0 {
+				t.Fatal("routing fee of a recorded earning was looked up")
+			}
+		})
+	}
+}
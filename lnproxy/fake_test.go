@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+// An LN that answers from its fields and records the calls made to it
+type fakeLN struct {
+	mu sync.Mutex
+
+	decoded      lnc.DecodedInvoice
+	fee_msat     uint64
+	cltv_delta   uint64
+	add_err      error
+	invoice      lnc.InvoiceState
+	watch_err    error
+	preimage     []byte
+	pay_err      error
+	settle_errs  []error
+	cancel_err   error
+	added        []lnc.InvoiceParameters
+	paid         []lnc.PaymentParameters
+	settled      [][]byte
+	canceled     [][]byte
+	watch_called int
+	// Watching invoices blocks until it is closed, if set
+	hold chan struct{}
+}
+
+func (ln *fakeLN) AddInvoice(p lnc.InvoiceParameters) (string, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.add_err != nil {
+		return "", ln.add_err
+	}
+	ln.added = append(ln.added, p)
+	return "lnbcwrapped" + hex.EncodeToString(p.Hash), nil
+}
+
+func (ln *fakeLN) DecodeInvoice(string) (*lnc.DecodedInvoice, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	decoded := ln.decoded
+	return &decoded, nil
+}
+
+func (ln *fakeLN) EstimateRoutingFee(lnc.DecodedInvoice, uint64) (uint64, uint64, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	return ln.fee_msat, ln.cltv_delta, nil
+}
+
+func (ln *fakeLN) WatchInvoice([]byte) (lnc.InvoiceState, error) {
+	if ln.hold != nil {
+		<-ln.hold
+	}
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.watch_called++
+	return ln.invoice, ln.watch_err
+}
+
+func (ln *fakeLN) CancelInvoice(hash []byte) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.cancel_err != nil {
+		return ln.cancel_err
+	}
+	ln.canceled = append(ln.canceled, hash)
+	return nil
+}
+
+func (ln *fakeLN) PayInvoice(p lnc.PaymentParameters) ([]byte, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.paid = append(ln.paid, p)
+	return ln.preimage, ln.pay_err
+}
+
+// Fails with the queued errors first
+func (ln *fakeLN) SettleInvoice(preimage []byte) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if len(ln.settle_errs) > 0 {
+		err := ln.settle_errs[0]
+		ln.settle_errs = ln.settle_errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	ln.settled = append(ln.settled, preimage)
+	return nil
+}
+
+func (ln *fakeLN) calls() (paid int, settled int, canceled int) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	return len(ln.paid), len(ln.settled), len(ln.canceled)
+}
+
+// A PaymentTracker answering with the queued results, the last one is repeated
+type fakeTracker struct {
+	mu      sync.Mutex
+	results []trackResult
+	tracked int
+}
+
+type trackResult struct {
+	state PaymentState
+	err   error
+}
+
+func (tr *fakeTracker) TrackPayment([]byte, time.Duration) (PaymentState, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tracked++
+	if len(tr.results) == 0 {
+		return PaymentState{}, errors.New("no result queued")
+	}
+	result := tr.results[0]
+	if len(tr.results) > 1 {
+		tr.results = tr.results[1:]
+	}
+	return result.state, result.err
+}
+
+// Returns a relay with default parameters journaling to a temporary directory
+func newTestRelay(t *testing.T, ln *fakeLN) (*Relay, *FileCircuitStore) {
+	t.Helper()
+	circuits, err := NewFileCircuitStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRelay(ln, circuits), circuits
+}
+
+// A journaled circuit for the payment hash made of b
+func testCircuit(b byte, state CircuitState) Circuit {
+	hash := make([]byte, 32)
+	for i := range hash {
+		hash[i] = b
+	}
+	now := time.Now()
+	return Circuit{
+		Hash:               hex.EncodeToString(hash),
+		Invoice:            "lnbcoriginal",
+		Destination:        "02destination",
+		AmountMsat:         103_000,
+		OriginalAmountMsat: 100_000,
+		FeeBudgetMsat:      2_000,
+		State:              state,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+}
+
+func getCircuit(t *testing.T, store CircuitStore, hash string) Circuit {
+	t.Helper()
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuit, err := store.Get(b)
+	if err != nil {
+		t.Fatalf("circuit %s: %v", hash, err)
+	}
+	return circuit
+}
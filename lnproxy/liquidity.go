@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+// Requests rejected because the node's channels can't carry the payments of the open circuits
+var InsufficientInbound = errors.New("insufficient inbound liquidity")
+var InsufficientOutbound = errors.New("insufficient outbound liquidity")
+
+const channelBalanceTimeout = 10 * time.Second
+
+// Liquidity of the node's channels, pending htlcs included
+type ChannelBalance struct {
+	// What the node can receive
+	InboundMsat uint64
+	// What the node can send
+	OutboundMsat uint64
+}
+
+// Reports the liquidity of the node's channels
+type LiquiditySource interface {
+	ChannelBalance() (ChannelBalance, error)
+}
+
+// Queries channel balances with lnd's REST api,
+// the macaroon needs the uri:/lnrpc.Lightning/ChannelBalance permission
+type LndLiquiditySource struct {
+	*lnc.Lnd
+}
+
+func (lnd LndLiquiditySource) ChannelBalance() (ChannelBalance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), channelBalanceTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", lnd.Host.JoinPath("v1/balance/channels").String(), nil)
+	if err != nil {
+		return ChannelBalance{}, err
+	}
+	req.Header.Add("Grpc-Metadata-macaroon", lnd.Macaroon)
+	resp, err := lnd.Client.Do(req)
+	if err != nil {
+		return ChannelBalance{}, err
+	}
+	defer resp.Body.Close()
+
+	type amount struct {
+		Msat uint64 `json:"msat,string"`
+	}
+	x := struct {
+		Message                string `json:"message"`
+		LocalBalance           amount `json:"local_balance"`
+		RemoteBalance          amount `json:"remote_balance"`
+		UnsettledLocalBalance  amount `json:"unsettled_local_balance"`
+		UnsettledRemoteBalance amount `json:"unsettled_remote_balance"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&x)
+	if err != nil {
+		return ChannelBalance{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ChannelBalance{}, fmt.Errorf("error querying channel balance: %s", x.Message)
+	}
+
+	// Held htlcs are no longer part of the settled balances but the circuits
+	// they belong to are still reserved, so they are added back:
+	// incoming htlcs are unsettled local balance, outgoing ones unsettled remote balance.
+	return ChannelBalance{
+		InboundMsat:  x.RemoteBalance.Msat + x.UnsettledLocalBalance.Msat,
+		OutboundMsat: x.LocalBalance.Msat + x.UnsettledRemoteBalance.Msat,
+	}, nil
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+func TestLndLiquiditySource(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		balance  ChannelBalance
+		err      string
+	}{
+		{
+			name:   "settled balances",
+			status: http.StatusOK,
+			response: `{"local_balance": {"sat": "1000", "msat": "1000000"},
+				"remote_balance": {"sat": "2000", "msat": "2000000"}}`,
+			balance: ChannelBalance{InboundMsat: 2_000_000, OutboundMsat: 1_000_000},
+		},
+		{
+			// Incoming htlcs are unsettled local balance and can still be received,
+			// outgoing ones unsettled remote balance and can still be sent
+			name:   "held htlcs",
+			status: http.StatusOK,
+			response: `{"local_balance": {"msat": "1000000"}, "remote_balance": {"msat": "2000000"},
+				"unsettled_local_balance": {"msat": "30000"}, "unsettled_remote_balance": {"msat": "4000"}}`,
+			balance: ChannelBalance{InboundMsat: 2_030_000, OutboundMsat: 1_004_000},
+		},
+		{
+			name:     "error response",
+			status:   http.StatusForbidden,
+			response: `{"code": 2, "message": "permission denied"}`,
+			err:      "error querying channel balance: permission denied",
+		},
+		{
+			name:     "invalid response",
+			status:   http.StatusOK,
+			response: `{"local_balance": {"msat": 1000000}}`,
+			err:      "cannot unmarshal",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/balance/channels" {
+					t.Errorf("unexpected path: %s", r.URL.Path)
+				}
+				if r.Header.Get("Grpc-Metadata-macaroon") != "0201abcd" {
+					t.Errorf("missing macaroon")
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.response))
+			}))
+			defer srv.Close()
+			host, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source := LndLiquiditySource{&lnc.Lnd{Host: host, Client: srv.Client(), Macaroon: "0201abcd"}}
+			balance, err := source.ChannelBalance()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != test.balance {
+				t.Fatalf("expected %+v, got %+v", test.balance, balance)
+			}
+		})
+	}
+}
+
+// A LiquiditySource that reports a fixed balance
+type fakeLiquidity struct {
+	balance ChannelBalance
+	err     error
+}
+
+func (l fakeLiquidity) ChannelBalance() (ChannelBalance, error) {
+	return l.balance, l.err
+}
+
+func TestOpenCircuitLiquidity(t *testing.T) {
+	// A 100_000 msat invoice is wrapped for 104_600 msat,
+	// paying it takes up to 103_500 msat including the fee budget
+	tests := []struct {
+		name      string
+		liquidity fakeLiquidity
+		err       error
+	}{
+		{
+			name:      "enough liquidity",
+			liquidity: fakeLiquidity{balance: ChannelBalance{InboundMsat: 104_600, OutboundMsat: 103_500}},
+		},
+		{
+			name:      "insufficient inbound",
+			liquidity: fakeLiquidity{balance: ChannelBalance{InboundMsat: 104_599, OutboundMsat: 1_000_000}},
+			err:       InsufficientInbound,
+		},
+		{
+			name:      "insufficient outbound",
+			liquidity: fakeLiquidity{balance: ChannelBalance{InboundMsat: 1_000_000, OutboundMsat: 103_499}},
+			err:       InsufficientOutbound,
+		},
+		{
+			name:      "balance unavailable",
+			liquidity: fakeLiquidity{err: errors.New("lnd unreachable")},
+			err:       errors.New("lnd unreachable"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{
+				decoded: lnc.DecodedInvoice{
+					PaymentHash: strings.Repeat("01", 32),
+					Timestamp:   uint64(time.Now().Unix()),
+					Expiry:      3600,
+					NumMsat:     100_000,
+					Destination: "02destination",
+				},
+				fee_msat:   1000,
+				cltv_delta: 40,
+				hold:       make(chan struct{}),
+			}
+			relay, _ := newTestRelay(t, ln)
+			relay.Liquidity = test.liquidity
+			defer relay.Wait()
+			defer close(ln.hold)
+
+			_, err := relay.OpenCircuit(ProxyParameters{Invoice: "lnbcoriginal", Client: "192.0.2.1"})
+			ln.mu.Lock()
+			added := len(ln.added)
+			ln.mu.Unlock()
+			if test.err == nil {
+				if err != nil || added != 1 {
+					t.Fatalf("expected an invoice, got %d: %v", added, err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err.Error()) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if errors.Is(test.err, InsufficientInbound) || errors.Is(test.err, InsufficientOutbound) {
+				if !errors.Is(err, test.err) || !errors.Is(err, Overloaded) {
+					t.Fatalf("expected an overloaded %v, got %v", test.err, err)
+				}
+			}
+			// Rejected requests add no invoice and release their capacity
+			if added != 0 {
+				t.Fatalf("expected no invoice, got %d", added)
+			}
+			if circuits, inbound_msat, outbound_msat := relay.Admitted(); circuits != 0 || inbound_msat != 0 ||
+				outbound_msat != 0 || relay.AdmittedClients() != 0 {
+				t.Fatalf("capacity was not released: %d %d %d %d", circuits, inbound_msat, outbound_msat,
+					relay.AdmittedClients())
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+var PaymentNotFound = errors.New("payment not found")
+
+type PaymentStatus string
+
+const (
+	InFlight  PaymentStatus = "IN_FLIGHT"
+	Succeeded PaymentStatus = "SUCCEEDED"
+	Failed    PaymentStatus = "FAILED"
+)
+
+type PaymentState struct {
+	Status PaymentStatus
+	// Only set for succeeded payments
+	Preimage []byte
+	FeeMsat  uint64
+}
+
+// Looks up the outcome of earlier payments
+type PaymentTracker interface {
+	// Blocks until the payment for hash is resolved or the timeout passes,
+	// returns PaymentNotFound if the payment was never initiated
+	TrackPayment(hash []byte, timeout time.Duration) (PaymentState, error)
+}
+
+// Tracks payments with lnd's REST api,
+// the macaroon needs the uri:/routerrpc.Router/TrackPaymentV2 permission
+type LndPaymentTracker struct {
+	*lnc.Lnd
+}
+
+func (lnd LndPaymentTracker) TrackPayment(hash []byte, timeout time.Duration) (PaymentState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u := lnd.Host.JoinPath("v2/router/track", base64.URLEncoding.EncodeToString(hash))
+	u.RawQuery = "no_inflight_updates=true"
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return PaymentState{}, err
+	}
+	req.Header.Add("Grpc-Metadata-macaroon", lnd.Macaroon)
+	resp, err := lnd.Client.Do(req)
+	if err != nil {
+		return PaymentState{}, err
+	}
+	defer resp.Body.Close()
+
+	// The response is a stream of json messages, without in-flight updates
+	// the first one holds the final state of the payment.
+	// Errors before the stream starts are not wrapped in an error field.
+	type lndError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	x := struct {
+		lndError
+		Result *struct {
+			Status          string `json:"status"`
+			PaymentPreimage string `json:"payment_preimage"`
+			FeeMsat         uint64 `json:"fee_msat,string"`
+		} `json:"result"`
+		Error *lndError `json:"error"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&x)
+	if err != nil {
+		return PaymentState{}, err
+	}
+	if x.Error != nil {
+		x.lndError = *x.Error
+	}
+	if x.Message != "" {
+		if strings.Contains(x.Message, "isn't initiated") {
+			return PaymentState{}, PaymentNotFound
+		}
+		return PaymentState{}, fmt.Errorf("error tracking payment: %s", x.Message)
+	}
+	if x.Result == nil {
+		return PaymentState{}, errors.New("empty payment tracking response")
+	}
+
+	switch PaymentStatus(x.Result.Status) {
+	case Succeeded:
+		preimage, err := hex.DecodeString(x.Result.PaymentPreimage)
+		if err != nil {
+			return PaymentState{}, err
+		}
+		return PaymentState{
+			Status:   Succeeded,
+			Preimage: preimage,
+			FeeMsat:  x.Result.FeeMsat,
+		}, nil
+	case Failed:
+		return PaymentState{Status: Failed}, nil
+	default:
+		return PaymentState{Status: InFlight}, nil
+	}
+}
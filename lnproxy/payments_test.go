@@ -0,0 +1,250 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+func TestResolvePayment(t *testing.T) {
+	preimage := []byte("preimage")
+	succeeded := trackResult{state: PaymentState{Status: Succeeded, Preimage: preimage, FeeMsat: 10}}
+	tests := []struct {
+		name string
+		// Payment tracking unavailable if nil
+		payments    []trackResult
+		settle_errs []error
+		cancel_err  error
+		// How long ago the payment was started
+		started_ago time.Duration
+		// Shut the relay down before resolving
+		shutdown bool
+		expected CircuitState
+		settled  int
+		canceled int
+		tracked  int
+	}{
+		{
+			name:     "succeeded payment settles the circuit",
+			payments: []trackResult{succeeded},
+			expected: CircuitSettled,
+			settled:  1,
+			tracked:  1,
+		},
+		{
+			name:     "failed payment cancels the circuit",
+			payments: []trackResult{{state: PaymentState{Status: Failed}}},
+			expected: CircuitCanceled,
+			canceled: 1,
+			tracked:  1,
+		},
+		{
+			name:        "payment never sent is canceled after the payment timeout",
+			payments:    []trackResult{{err: PaymentNotFound}},
+			started_ago: time.Hour,
+			expected:    CircuitCanceled,
+			canceled:    1,
+			tracked:     1,
+		},
+		{
+			name:     "payment not registered yet is held",
+			payments: []trackResult{{err: PaymentNotFound}},
+			shutdown: true,
+			expected: CircuitUnknown,
+			tracked:  1,
+		},
+		{
+			name:     "in flight payment is held",
+			payments: []trackResult{{state: PaymentState{Status: InFlight}}},
+			shutdown: true,
+			expected: CircuitUnknown,
+			tracked:  1,
+		},
+		{
+			name:     "tracking error is held",
+			payments: []trackResult{{err: errors.New("lnd unreachable")}},
+			shutdown: true,
+			expected: CircuitUnknown,
+			tracked:  1,
+		},
+		{
+			name:       "failed cancellation is held",
+			payments:   []trackResult{{state: PaymentState{Status: Failed}}},
+			cancel_err: errors.New("lnd unreachable"),
+			shutdown:   true,
+			expected:   CircuitUnknown,
+			tracked:    1,
+		},
+		{
+			name:        "failed settlement is retried",
+			payments:    []trackResult{succeeded},
+			settle_errs: []error{errors.New("lnd unreachable")},
+			expected:    CircuitSettled,
+			settled:     1,
+			tracked:     2,
+		},
+		{
+			name:     "without payment tracking the circuit is left for manual recovery",
+			expected: CircuitUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln := &fakeLN{settle_errs: test.settle_errs, cancel_err: test.cancel_err}
+			relay, store := newTestRelay(t, ln)
+			tracker := &fakeTracker{results: test.payments}
+			if test.payments != nil {
+				relay.Payments = tracker
+			}
+			if test.shutdown {
+				relay.Shutdown()
+			}
+			circuit := testCircuit(1, CircuitPaying)
+			circuit.PaymentStartedAt = time.Now().Add(-test.started_ago)
+			hash, _ := hex.DecodeString(circuit.Hash)
+
+			relay.resolvePayment(&circuit, hash)
+
+			got := getCircuit(t, store, circuit.Hash)
+			if got.State != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, got.State)
+			}
+			_, settled, canceled := ln.calls()
+			if settled != test.settled || canceled != test.canceled {
+				t.Fatalf("expected %d settlements and %d cancellations, got %d and %d",
+					test.settled, test.canceled, settled, canceled)
+			}
+			if tracker.tracked != test.tracked {
+				t.Fatalf("expected %d tracking calls, got %d", test.tracked, tracker.tracked)
+			}
+		})
+	}
+}
+
+// A payment whose outcome is unknown must hold the payer's htlc, never cancel it
+func TestUnknownPaymentIsNotCanceled(t *testing.T) {
+	ln := &fakeLN{
+		invoice: lnc.InvoiceState{State: lnc.Accepted, CltvExpiryDelta: 200},
+		pay_err: errors.New("connection reset"),
+	}
+	relay, store := newTestRelay(t, ln)
+	relay.Payments = &fakeTracker{results: []trackResult{{state: PaymentState{Status: InFlight}}}}
+	relay.Shutdown()
+	circuit := testCircuit(1, CircuitOpen)
+	if err := store.Put(circuit); err != nil {
+		t.Fatal(err)
+	}
+
+	relay.admit(circuit, true)
+	relay.Add(1)
+	relay.circuitSwitch(circuit)
+
+	got := getCircuit(t, store, circuit.Hash)
+	if got.State != CircuitUnknown {
+		t.Fatalf("expected %s, got %s", CircuitUnknown, got.State)
+	}
+	if got.PaymentStartedAt.IsZero() {
+		t.Fatal("payment start was not journaled")
+	}
+	if _, settled, canceled := ln.calls(); settled != 0 || canceled != 0 {
+		t.Fatalf("unknown payment was resolved: %d settlements, %d cancellations", settled, canceled)
+	}
+	unknown, err := relay.UnknownCircuits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 1 || unknown[0].Hash != circuit.Hash {
+		t.Fatalf("unexpected unknown circuits: %+v", unknown)
+	}
+}
+
+func TestLndPaymentTracker(t *testing.T) {
+	hash := []byte{1, 2, 3}
+	tests := []struct {
+		name     string
+		response string
+		expected PaymentState
+		err      error
+	}{
+		{
+			name:     "succeeded",
+			response: `{"result":{"status":"SUCCEEDED","payment_preimage":"0a0b","fee_msat":"1500"}}`,
+			expected: PaymentState{Status: Succeeded, Preimage: []byte{10, 11}, FeeMsat: 1500},
+		},
+		{
+			name:     "failed",
+			response: `{"result":{"status":"FAILED"}}`,
+			expected: PaymentState{Status: Failed},
+		},
+		{
+			name:     "in flight",
+			response: `{"result":{"status":"IN_FLIGHT"}}`,
+			expected: PaymentState{Status: InFlight},
+		},
+		{
+			name:     "never initiated",
+			response: `{"code":5,"message":"payment isn't initiated"}`,
+			err:      PaymentNotFound,
+		},
+		{
+			name:     "never initiated in stream",
+			response: `{"error":{"code":5,"message":"payment isn't initiated"}}`,
+			err:      PaymentNotFound,
+		},
+		{
+			name:     "other error",
+			response: `{"error":{"code":2,"message":"internal error"}}`,
+			err:      errors.New("error tracking payment: internal error"),
+		},
+		{
+			name:     "empty response",
+			response: `{}`,
+			err:      errors.New("empty payment tracking response"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/router/track/"+base64.URLEncoding.EncodeToString(hash) {
+					t.Errorf("unexpected path: %s", r.URL.Path)
+				}
+				if r.URL.Query().Get("no_inflight_updates") != "true" {
+					t.Errorf("in-flight updates requested: %s", r.URL.RawQuery)
+				}
+				if r.Header.Get("Grpc-Metadata-macaroon") != "macaroon" {
+					t.Errorf("missing macaroon")
+				}
+				w.Write([]byte(test.response + "\n"))
+			}))
+			defer server.Close()
+			host, err := url.Parse(server.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tracker := LndPaymentTracker{Lnd: &lnc.Lnd{
+				Host:     host,
+				Client:   server.Client(),
+				Macaroon: "macaroon",
+			}}
+
+			state, err := tracker.TrackPayment(hash, time.Second)
+			if fmt.Sprint(err) != fmt.Sprint(test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if state.Status != test.expected.Status || state.FeeMsat != test.expected.FeeMsat ||
+				hex.EncodeToString(state.Preimage) != hex.EncodeToString(test.expected.Preimage) {
+				t.Fatalf("expected %+v, got %+v", test.expected, state)
+			}
+		})
+	}
+}
@@ -13,55 +13,189 @@ import (
 
 var ClientFacing = errors.New("")
 
+// Requests rejected because the relay is at capacity, they can be retried later
+var Overloaded = errors.New("")
+var TooManyCircuits = errors.New("too many open circuits")
+var TooMuchOutstanding = errors.New("too much liquidity committed to open circuits")
+var TooManyClientCircuits = errors.New("too many open circuits for this client")
+var TooMuchClientOutstanding = errors.New("too much liquidity committed to open circuits of this client")
+
+const (
+	// Delay between attempts to resolve a payment in unknown state,
+	// doubled after each attempt up to the maximum
+	trackingDelay    = time.Second
+	maxTrackingDelay = time.Minute
+)
+
 type Relay struct {
 	RelayParameters
 	lnc.LN
 	sync.WaitGroup
+	Circuits CircuitStore
+	// Resolves payments in unknown state, without it such circuits
+	// are left journaled for manual recovery
+	Payments PaymentTracker
+	// Records what settled circuits earned, optional
+	Earnings EarningsLedger
+	// Without it circuits are opened whatever the liquidity of the node's channels
+	Liquidity LiquiditySource
+	quit      chan struct{}
+	admitted  admission
+}
+
+// What the open circuits commit, so a spammer can't lock all of the node's liquidity
+// or fill lnd with hold invoices
+type admission struct {
+	sync.Mutex
+	circuits         uint64
+	outstanding_msat uint64
+	// Sum of the original amounts and fee budgets, what paying the open circuits may take
+	outbound_msat uint64
+	// Per client ip, so a single client can't take all of the capacity,
+	// clients without open circuits are removed
+	clients map[string]*clientAdmission
+}
+
+type clientAdmission struct {
+	circuits         uint64
+	outstanding_msat uint64
 }
 
 type RelayParameters struct {
-	MinAmountMsat      uint64
-	MaxAmountMsat      uint64
-	MinFeeBudgetMsat   uint64
-	RoutingFeeBaseMsat uint64
-	RoutingFeePPM      uint64
-	ExpiryBuffer       uint64
-	MaxExpiry          uint64
-	CltvDeltaAlpha     uint64
-	CltvDeltaBeta      uint64
-	RoutingBudgetAlpha uint64
-	RoutingBudgetBeta  uint64
+	MinAmountMsat      uint64 `json:"min_amount_msat"`
+	MaxAmountMsat      uint64 `json:"max_amount_msat"`
+	MinFeeBudgetMsat   uint64 `json:"min_fee_budget_msat"`
+	RoutingFeeBaseMsat uint64 `json:"routing_fee_base_msat"`
+	RoutingFeePPM      uint64 `json:"routing_fee_ppm"`
+	ExpiryBuffer       uint64 `json:"expiry_buffer"`
+	MaxExpiry          uint64 `json:"max_expiry"`
+	CltvDeltaAlpha     uint64 `json:"cltv_delta_alpha"`
+	CltvDeltaBeta      uint64 `json:"cltv_delta_beta"`
+	RoutingBudgetAlpha uint64 `json:"routing_budget_alpha"`
+	RoutingBudgetBeta  uint64 `json:"routing_budget_beta"`
 	// Should be set to the same as the node's `--max-cltv-expiry` setting (default: 2016)
-	MaxCltvExpiry uint64
-	MinCltvExpiry uint64
+	MaxCltvExpiry uint64 `json:"max_cltv_expiry"`
+	MinCltvExpiry uint64 `json:"min_cltv_expiry"`
 	// Should be set so that CltvDeltaAlpha blocks are very unlikely to be added before timeout
-	PaymentTimeout        uint64
-	PaymentTimePreference float64
+	PaymentTimeout        uint64  `json:"payment_timeout"`
+	PaymentTimePreference float64 `json:"payment_time_preference"`
+	// Limits of the circuits open at the same time and the sum of their wrapped amounts, 0 disables the limit
+	MaxOpenCircuits    uint64 `json:"max_open_circuits"`
+	MaxOutstandingMsat uint64 `json:"max_outstanding_msat"`
+	// The same limits for the circuits of a single client ip, 0 disables the limit
+	MaxClientOpenCircuits    uint64 `json:"max_client_open_circuits"`
+	MaxClientOutstandingMsat uint64 `json:"max_client_outstanding_msat"`
+}
+
+// Returns sane defaults for the relay parameters
+func DefaultRelayParameters() RelayParameters {
+	return RelayParameters{
+		MinAmountMsat:      10_000,
+		MaxAmountMsat:      1_000_000_000,
+		ExpiryBuffer:       300,
+		MaxExpiry:          604800, // 60*60*24*7 one week
+		MinFeeBudgetMsat:   1000,
+		RoutingBudgetAlpha: 1000,
+		RoutingBudgetBeta:  1_500_000,
+		RoutingFeeBaseMsat: 1000,
+		RoutingFeePPM:      1000,
+		CltvDeltaAlpha:     42,
+		CltvDeltaBeta:      42,
+		// Should be set to at most the node's `--max-cltv-expiry` setting (default: 2016)
+		MaxCltvExpiry: 1800,
+		MinCltvExpiry: 200,
+		// Should be set so that CltvDeltaAlpha blocks are very unlikely to be added before timeout
+		PaymentTimeout:        600,
+		PaymentTimePreference: 0.9,
+		MaxOpenCircuits:       1000,
+		MaxOutstandingMsat:    10_000_000_000,
+		// A single client can't take more than a fiftieth of the circuits
+		// or a fifth of the outstanding amount
+		MaxClientOpenCircuits:    20,
+		MaxClientOutstandingMsat: 2_000_000_000,
+	}
+}
+
+// Checks the parameters and their inter-dependencies,
+// so that a relay never runs with parameters that make every request fail or lose funds.
+func (p RelayParameters) Validate() error {
+	switch {
+	case p.MinAmountMsat == 0:
+		return errors.New("min_amount_msat must be positive")
+	case p.MinAmountMsat > p.MaxAmountMsat:
+		return errors.New("min_amount_msat must not be greater than max_amount_msat")
+	case p.RoutingFeePPM > 1_000_000:
+		return errors.New("routing_fee_ppm must not be greater than 1000000")
+	case p.ExpiryBuffer >= p.MaxExpiry:
+		return errors.New("expiry_buffer must be less than max_expiry")
+	case p.CltvDeltaAlpha == 0:
+		// Blocks left to settle the wrapped invoice after the original invoice was paid
+		return errors.New("cltv_delta_alpha must be positive")
+	case p.MinCltvExpiry >= p.MaxCltvExpiry:
+		return errors.New("min_cltv_expiry must be less than max_cltv_expiry")
+	case p.CltvDeltaAlpha+p.CltvDeltaBeta >= p.MaxCltvExpiry:
+		// Otherwise no route to the original invoice fits in the wrapped invoice's cltv expiry
+		return errors.New("cltv_delta_alpha + cltv_delta_beta must be less than max_cltv_expiry")
+	case p.PaymentTimeout == 0:
+		return errors.New("payment_timeout must be positive")
+	case p.PaymentTimePreference < 0 || p.PaymentTimePreference > 1:
+		return errors.New("payment_time_preference must be between 0 and 1")
+	case p.MaxOutstandingMsat != 0 && p.MaxOutstandingMsat < p.maxWrappedAmountMsat():
+		// Otherwise the largest invoices are never admitted
+		return errors.New("max_outstanding_msat must not be less than max_amount_msat plus fees")
+	case p.MaxClientOutstandingMsat != 0 && p.MaxClientOutstandingMsat < p.maxWrappedAmountMsat():
+		return errors.New("max_client_outstanding_msat must not be less than max_amount_msat plus fees")
+	}
+	return nil
+}
+
+// Amount of the wrapped invoice of the largest invoice,
+// when routing it costs no more than the minimum fee budget
+func (p RelayParameters) maxWrappedAmountMsat() uint64 {
+	routing_fee_msat := p.RoutingFeeBaseMsat + (p.MaxAmountMsat*p.RoutingFeePPM)/1_000_000
+	fee_budget_msat := p.MinFeeBudgetMsat + p.RoutingBudgetAlpha + (p.MinFeeBudgetMsat*p.RoutingBudgetBeta)/1_000_000
+	return p.MaxAmountMsat + routing_fee_msat + fee_budget_msat
 }
 
 // Returns a Relay with with sane defaults
-func NewRelay(ln lnc.LN) *Relay {
+func NewRelay(ln lnc.LN, circuits CircuitStore) *Relay {
 	return &Relay{
-		RelayParameters: RelayParameters{
-			MinAmountMsat:      10_000,
-			MaxAmountMsat:      1_000_000_000,
-			ExpiryBuffer:       300,
-			MaxExpiry:          604800, // 60*60*24*7 one week
-			MinFeeBudgetMsat:   1000,
-			RoutingBudgetAlpha: 1000,
-			RoutingBudgetBeta:  1_500_000,
-			RoutingFeeBaseMsat: 1000,
-			RoutingFeePPM:      1000,
-			CltvDeltaAlpha:     42,
-			CltvDeltaBeta:      42,
-			// Should be set to at most the node's `--max-cltv-expiry` setting (default: 2016)
-			MaxCltvExpiry: 1800,
-			MinCltvExpiry: 200,
-			// Should be set so that CltvDeltaAlpha blocks are very unlikely to be added before timeout
-			PaymentTimeout:        600,
-			PaymentTimePreference: 0.9,
-		},
-		LN: ln,
+		RelayParameters: DefaultRelayParameters(),
+		LN:              ln,
+		Circuits:        circuits,
+		quit:            make(chan struct{}),
+	}
+}
+
+// Parameters advertised to clients, so they can compute the amount
+// of a wrapped invoice before requesting it
+type AdvertisedParameters struct {
+	MinAmountMsat      uint64 `json:"min_amount_msat"`
+	MaxAmountMsat      uint64 `json:"max_amount_msat"`
+	RoutingFeeBaseMsat uint64 `json:"routing_fee_base_msat"`
+	RoutingFeePPM      uint64 `json:"routing_fee_ppm"`
+	MinFeeBudgetMsat   uint64 `json:"min_fee_budget_msat"`
+	RoutingBudgetAlpha uint64 `json:"routing_budget_alpha"`
+	RoutingBudgetBeta  uint64 `json:"routing_budget_beta"`
+	ExpiryBuffer       uint64 `json:"expiry_buffer"`
+	MaxExpiry          uint64 `json:"max_expiry"`
+	MinCltvExpiry      uint64 `json:"min_cltv_expiry"`
+	MaxCltvExpiry      uint64 `json:"max_cltv_expiry"`
+}
+
+func (relay *Relay) Advertised() AdvertisedParameters {
+	return AdvertisedParameters{
+		MinAmountMsat:      relay.MinAmountMsat,
+		MaxAmountMsat:      relay.MaxAmountMsat,
+		RoutingFeeBaseMsat: relay.RoutingFeeBaseMsat,
+		RoutingFeePPM:      relay.RoutingFeePPM,
+		MinFeeBudgetMsat:   relay.MinFeeBudgetMsat,
+		RoutingBudgetAlpha: relay.RoutingBudgetAlpha,
+		RoutingBudgetBeta:  relay.RoutingBudgetBeta,
+		ExpiryBuffer:       relay.ExpiryBuffer,
+		MaxExpiry:          relay.MaxExpiry,
+		MinCltvExpiry:      relay.MinCltvExpiry,
+		MaxCltvExpiry:      relay.MaxCltvExpiry,
 	}
 }
 
@@ -71,6 +205,8 @@ type ProxyParameters struct {
 	RoutingMsat     *uint64 `json:"routing_msat,string"`
 	Description     *string `json:"description"`
 	DescriptionHash *string `json:"description_hash"`
+	// Ip address of the client, empty if unknown
+	Client string `json:"-"`
 }
 
 func (x ProxyParameters) String() string {
@@ -86,26 +222,26 @@ func (x ProxyParameters) String() string {
 	return result + "}"
 }
 
-func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoiceParameters, fee_budget_msat uint64, err error) {
+func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoiceParameters, original *lnc.DecodedInvoice, fee_budget_msat uint64, err error) {
 	p, err := relay.LN.DecodeInvoice(x.Invoice)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 
 	if p.NumMsat == 0 {
-		return nil, 0, errors.Join(ClientFacing, errors.New("zero amount invoices cannot be relayed trustlessly"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("zero amount invoices cannot be relayed trustlessly"))
 	}
 	if p.NumMsat < relay.MinAmountMsat {
-		return nil, 0, errors.Join(ClientFacing, errors.New("invoice amount too low"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("invoice amount too low"))
 	}
 	if p.NumMsat > relay.MaxAmountMsat {
-		return nil, 0, errors.Join(ClientFacing, errors.New("invoice amount too high"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("invoice amount too high"))
 	}
 
 	min_fee_budget_msat, min_cltv_delta, err := relay.LN.EstimateRoutingFee(*p, 0)
 	if err != nil {
 		log.Println("route estimation error:", err)
-		return nil, 0, errors.Join(ClientFacing, errors.New("could not find route"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("could not find route"))
 	}
 	for flag, _ := range p.Features {
 		switch flag {
@@ -115,31 +251,31 @@ func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoicePa
 			// 148/149 is trampoline routing
 			// 150/151 is electrum's trampoline
 		default:
-			return nil, 0, errors.Join(ClientFacing, fmt.Errorf("unknown feature flag: %s", flag))
+			return nil, nil, 0, errors.Join(ClientFacing, fmt.Errorf("unknown feature flag: %s", flag))
 		}
 	}
 
 	q := lnc.InvoiceParameters{}
 	hash, err := hex.DecodeString(p.PaymentHash)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	q.Hash = hash
 
 	if x.Description != nil && x.DescriptionHash != nil {
-		return nil, 0, errors.Join(ClientFacing, errors.New("description and description hash cannot both be set"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("description and description hash cannot both be set"))
 	} else if x.Description != nil {
 		q.Memo = *x.Description
 	} else if x.DescriptionHash != nil {
 		description_hash, err := hex.DecodeString(*x.DescriptionHash)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, 0, err
 		}
 		q.DescriptionHash = description_hash
 	} else if p.DescriptionHash != "" {
 		description_hash, err := hex.DecodeString(p.DescriptionHash)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, 0, err
 		}
 		q.DescriptionHash = description_hash
 	} else {
@@ -147,7 +283,7 @@ func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoicePa
 	}
 
 	if p.Timestamp+p.Expiry < uint64(time.Now().Unix())+relay.ExpiryBuffer {
-		return nil, 0, errors.Join(ClientFacing, errors.New("payment request expiration is too close."))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("payment request expiration is too close."))
 	}
 	expiry := p.Expiry
 	if expiry > relay.MaxExpiry {
@@ -157,7 +293,7 @@ func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoicePa
 
 	q.CltvExpiry = min_cltv_delta + relay.CltvDeltaBeta + relay.CltvDeltaAlpha
 	if q.CltvExpiry >= relay.MaxCltvExpiry {
-		return nil, 0, errors.Join(ClientFacing, errors.New("cltv_expiry is too long"))
+		return nil, nil, 0, errors.Join(ClientFacing, errors.New("cltv_expiry is too long"))
 	} else if q.CltvExpiry < relay.MinCltvExpiry {
 		q.CltvExpiry = relay.MinCltvExpiry
 	}
@@ -165,73 +301,453 @@ func (relay *Relay) wrap(x ProxyParameters) (proxy_invoice_params *lnc.InvoicePa
 	routing_fee_msat := relay.RoutingFeeBaseMsat + (p.NumMsat*relay.RoutingFeePPM)/1_000_000
 	if x.RoutingMsat != nil {
 		if *x.RoutingMsat < (relay.MinFeeBudgetMsat + routing_fee_msat) {
-			return nil, 0, errors.Join(ClientFacing, errors.New("custom fee budget too low"))
+			return nil, nil, 0, errors.Join(ClientFacing, errors.New("custom fee budget too low"))
 		}
 		q.ValueMsat = p.NumMsat + *x.RoutingMsat
-		return &q, *x.RoutingMsat - routing_fee_msat, nil
+		return &q, p, *x.RoutingMsat - routing_fee_msat, nil
 	}
 	fee_budget_msat = min_fee_budget_msat + relay.RoutingBudgetAlpha + (min_fee_budget_msat*relay.RoutingBudgetBeta)/1_000_000
 	q.ValueMsat = p.NumMsat + fee_budget_msat + routing_fee_msat
-	return &q, fee_budget_msat, nil
+	return &q, p, fee_budget_msat, nil
 }
 
 // Takes an lnproxy request, validates that it can be proxied securely,
 // opens a circuit that will be completed when invoice is successfully relayed,
 // and returns a wrapped invoice.
 func (relay *Relay) OpenCircuit(x ProxyParameters) (string, error) {
-	proxy_invoice_params, fee_budget_msat, err := relay.wrap(x)
+	proxy_invoice_params, original, fee_budget_msat, err := relay.wrap(x)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	circuit := Circuit{
+		Hash:               hex.EncodeToString(proxy_invoice_params.Hash),
+		Invoice:            x.Invoice,
+		Destination:        original.Destination,
+		AmountMsat:         proxy_invoice_params.ValueMsat,
+		OriginalAmountMsat: original.NumMsat,
+		FeeBudgetMsat:      fee_budget_msat,
+		Client:             x.Client,
+		State:              CircuitOpen,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+
+	// Capacity is reserved until the circuit switch returns,
+	// reserving before checking liquidity keeps concurrent requests from overcommitting it
+	err = relay.admit(circuit, false)
+	if err != nil {
+		return "", err
+	}
+	err = relay.checkLiquidity()
 	if err != nil {
+		relay.release(circuit)
 		return "", err
 	}
 
 	proxy_invoice, err := relay.LN.AddInvoice(*proxy_invoice_params)
 	if errors.Is(err, lnc.PaymentHashExists) {
+		relay.release(circuit)
 		return "", errors.Join(ClientFacing, lnc.PaymentHashExists)
 	} else if err != nil {
+		relay.release(circuit)
+		return "", err
+	}
+
+	// The circuit must be journaled before the wrapped invoice is handed out,
+	// otherwise a restart could leave an accepted htlc that nobody resolves.
+	err = relay.Circuits.Put(circuit)
+	if err != nil {
+		log.Println("error while journaling circuit:", circuit.Hash, err)
+		if err := relay.LN.CancelInvoice(proxy_invoice_params.Hash); err != nil {
+			log.Println("error while canceling invoice:", circuit.Hash, err)
+		}
+		relay.release(circuit)
 		return "", err
 	}
 
 	relay.WaitGroup.Add(1)
-	go relay.circuitSwitch(proxy_invoice_params.Hash, x.Invoice, fee_budget_msat)
+	go relay.circuitSwitch(circuit)
 
 	return proxy_invoice, nil
 }
 
-func (relay *Relay) circuitSwitch(hash []byte, invoice string, fee_budget_msat uint64) {
+// Resumes every circuit left open by a previous run
+// and records the earnings of settled circuits that were lost,
+// should be called before accepting new requests.
+func (relay *Relay) RecoverCircuits() error {
+	circuits, err := relay.Circuits.ListOpen()
+	if err != nil {
+		return err
+	}
+	for _, circuit := range circuits {
+		log.Println("recovering circuit:", circuit.Hash, circuit.State)
+		// Recovered circuits are already open, they count against the limits but are never rejected
+		relay.admit(circuit, true)
+		relay.WaitGroup.Add(1)
+		go relay.circuitSwitch(circuit)
+	}
+	return relay.recoverEarnings()
+}
+
+// Records the earnings of settled circuits missing from the ledger,
+// a failure to record an earning does not keep a circuit from being journaled as settled
+func (relay *Relay) recoverEarnings() error {
+	if relay.Earnings == nil {
+		return nil
+	}
+	circuits, err := relay.Circuits.ListSettled()
+	if err != nil {
+		return err
+	}
+	missing := []Circuit{}
+	for _, circuit := range circuits {
+		recorded, err := relay.Earnings.Recorded(circuit.Hash)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			missing = append(missing, circuit)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// Looking up the routing fees may take a while, it must not delay new requests
+	relay.WaitGroup.Add(1)
+	go func() {
+		defer relay.WaitGroup.Done()
+		for _, circuit := range missing {
+			hash, err := hex.DecodeString(circuit.Hash)
+			if err != nil {
+				log.Println("invalid circuit hash:", circuit.Hash, err)
+				continue
+			}
+			log.Println("recording missing earning:", circuit.Hash)
+			relay.recordEarning(&circuit, relay.routingFeePaid(&circuit, hash), circuit.UpdatedAt)
+		}
+	}()
+	return nil
+}
+
+func (relay *Relay) journal(circuit *Circuit, state CircuitState) {
+	circuit.State = state
+	circuit.UpdatedAt = time.Now()
+	err := relay.Circuits.Put(*circuit)
+	if err != nil {
+		log.Println("error while journaling circuit:", circuit.Hash, state, err)
+	}
+}
+
+// Stops resolving payments in unknown state,
+// their circuits stay journaled and are resumed on the next start.
+func (relay *Relay) Shutdown() {
+	close(relay.quit)
+}
+
+// Returns the circuits whose payment to the original invoice has an unknown outcome
+func (relay *Relay) UnknownCircuits() ([]Circuit, error) {
+	circuits, err := relay.Circuits.ListOpen()
+	if err != nil {
+		return nil, err
+	}
+	unknown := []Circuit{}
+	for _, circuit := range circuits {
+		if circuit.State == CircuitUnknown {
+			unknown = append(unknown, circuit)
+		}
+	}
+	return unknown, nil
+}
+
+// Summarizes the earnings of circuits settled at or after since
+func (relay *Relay) EarningsSince(since time.Time) (EarningsSummary, error) {
+	if relay.Earnings == nil {
+		return EarningsSummary{}, errors.New("no earnings ledger configured")
+	}
+	earnings, err := relay.Earnings.List(since)
+	if err != nil {
+		return EarningsSummary{}, err
+	}
+	return SummarizeEarnings(earnings), nil
+}
+
+// Looks up the routing fee actually paid for the original invoice,
+// if it is unknown the whole fee budget is assumed to be spent.
+func (relay *Relay) routingFeePaid(circuit *Circuit, hash []byte) uint64 {
+	if relay.Payments != nil {
+		state, err := relay.Payments.TrackPayment(hash, time.Duration(relay.PaymentTimeout)*time.Second)
+		if err == nil && state.Status == Succeeded {
+			return state.FeeMsat
+		}
+		log.Println("unable to look up routing fee paid:", circuit.Hash, state.Status, err)
+	}
+	return circuit.FeeBudgetMsat
+}
+
+// Records the earning of a circuit whose wrapped invoice was settled, then journals it as settled.
+// A crash in between leaves the circuit open, recovering it records the earning again,
+// which the ledger ignores.
+func (relay *Relay) settleCircuit(circuit *Circuit, routing_fee_msat uint64) {
+	relay.recordEarning(circuit, routing_fee_msat, time.Now())
+	relay.journal(circuit, CircuitSettled)
+}
+
+func (relay *Relay) recordEarning(circuit *Circuit, routing_fee_msat uint64, settled_at time.Time) {
+	if relay.Earnings == nil {
+		return
+	}
+	if circuit.AmountMsat == 0 {
+		log.Println("circuit was journaled without amounts, earning not recorded:", circuit.Hash)
+		return
+	}
+	earning := Earning{
+		Hash:               circuit.Hash,
+		Destination:        circuit.Destination,
+		SettledAt:          settled_at,
+		AmountMsat:         circuit.AmountMsat,
+		OriginalAmountMsat: circuit.OriginalAmountMsat,
+		RoutingFeeMsat:     routing_fee_msat,
+		MarginMsat:         int64(circuit.AmountMsat) - int64(circuit.OriginalAmountMsat) - int64(routing_fee_msat),
+	}
+	err := relay.Earnings.Record(earning)
+	if err != nil {
+		log.Println("error while recording earning:", circuit.Hash, err)
+		return
+	}
+	log.Println("earned:", earning.MarginMsat, "msat", circuit.Hash)
+}
+
+// Reserves capacity for a circuit,
+// unless forced it fails if the relay is at capacity.
+func (relay *Relay) admit(circuit Circuit, force bool) error {
+	relay.admitted.Lock()
+	defer relay.admitted.Unlock()
+	if !force && relay.MaxOpenCircuits != 0 && relay.admitted.circuits >= relay.MaxOpenCircuits {
+		return errors.Join(Overloaded, TooManyCircuits)
+	}
+	if !force && relay.MaxOutstandingMsat != 0 && relay.admitted.outstanding_msat+circuit.AmountMsat > relay.MaxOutstandingMsat {
+		return errors.Join(Overloaded, TooMuchOutstanding)
+	}
+	if relay.admitted.clients == nil {
+		relay.admitted.clients = map[string]*clientAdmission{}
+	}
+	client := relay.admitted.clients[circuit.Client]
+	if circuit.Client != "" && client == nil {
+		client = &clientAdmission{}
+	}
+	if !force && client != nil && relay.MaxClientOpenCircuits != 0 && client.circuits >= relay.MaxClientOpenCircuits {
+		return errors.Join(Overloaded, TooManyClientCircuits)
+	}
+	if !force && client != nil && relay.MaxClientOutstandingMsat != 0 && client.outstanding_msat+circuit.AmountMsat > relay.MaxClientOutstandingMsat {
+		return errors.Join(Overloaded, TooMuchClientOutstanding)
+	}
+	relay.admitted.circuits++
+	relay.admitted.outstanding_msat += circuit.AmountMsat
+	relay.admitted.outbound_msat += circuit.OriginalAmountMsat + circuit.FeeBudgetMsat
+	if client != nil {
+		client.circuits++
+		client.outstanding_msat += circuit.AmountMsat
+		relay.admitted.clients[circuit.Client] = client
+	}
+	return nil
+}
+
+func (relay *Relay) release(circuit Circuit) {
+	relay.admitted.Lock()
+	defer relay.admitted.Unlock()
+	relay.admitted.circuits--
+	relay.admitted.outstanding_msat -= circuit.AmountMsat
+	relay.admitted.outbound_msat -= circuit.OriginalAmountMsat + circuit.FeeBudgetMsat
+	if client := relay.admitted.clients[circuit.Client]; client != nil {
+		client.circuits--
+		client.outstanding_msat -= circuit.AmountMsat
+		if client.circuits == 0 {
+			delete(relay.admitted.clients, circuit.Client)
+		}
+	}
+}
+
+// Returns the number of open circuits, the sum of their wrapped amounts
+// and the sum of what paying their original invoices may take
+func (relay *Relay) Admitted() (circuits uint64, outstanding_msat uint64, outbound_msat uint64) {
+	relay.admitted.Lock()
+	defer relay.admitted.Unlock()
+	return relay.admitted.circuits, relay.admitted.outstanding_msat, relay.admitted.outbound_msat
+}
+
+// Returns the number of clients with open circuits
+func (relay *Relay) AdmittedClients() uint64 {
+	relay.admitted.Lock()
+	defer relay.admitted.Unlock()
+	return uint64(len(relay.admitted.clients))
+}
+
+// Fails if the node's channels can't receive the wrapped invoices
+// or pay the original invoices of every open circuit at once
+func (relay *Relay) checkLiquidity() error {
+	if relay.Liquidity == nil {
+		return nil
+	}
+	balance, err := relay.Liquidity.ChannelBalance()
+	if err != nil {
+		log.Println("error while querying channel balance:", err)
+		return err
+	}
+	_, inbound_msat, outbound_msat := relay.Admitted()
+	if inbound_msat > balance.InboundMsat {
+		log.Println("insufficient inbound liquidity:", inbound_msat, ">", balance.InboundMsat)
+		return errors.Join(Overloaded, InsufficientInbound)
+	}
+	if outbound_msat > balance.OutboundMsat {
+		log.Println("insufficient outbound liquidity:", outbound_msat, ">", balance.OutboundMsat)
+		return errors.Join(Overloaded, InsufficientOutbound)
+	}
+	return nil
+}
+
+func (relay *Relay) cancelCircuit(circuit *Circuit, hash []byte) error {
+	err := relay.LN.CancelInvoice(hash)
+	if err != nil {
+		log.Println("error while canceling invoice:", circuit.Hash, err)
+		return err
+	}
+	relay.journal(circuit, CircuitCanceled)
+	return nil
+}
+
+func (relay *Relay) circuitSwitch(circuit Circuit) {
 	defer relay.WaitGroup.Done()
-	log.Println("opened circuit for:", invoice, hex.EncodeToString(hash))
+	defer relay.release(circuit)
+	hash, err := hex.DecodeString(circuit.Hash)
+	if err != nil {
+		log.Println("invalid circuit hash:", circuit.Hash, err)
+		return
+	}
+	log.Println("opened circuit for:", circuit.Invoice, circuit.Hash)
 	invoice_state, err := relay.LN.WatchInvoice(hash)
+	if err == nil && invoice_state.State == lnc.Settled {
+		// Settled before a restart but the journal was not updated,
+		// the earning may or may not be recorded
+		relay.settleCircuit(&circuit, relay.routingFeePaid(&circuit, hash))
+		return
+	}
+	if err != nil && (circuit.State == CircuitPaying || circuit.State == CircuitUnknown) {
+		// Canceling could refund the payer after the creator was paid
+		log.Println("error while watching wrapped invoice:", circuit.Hash, err)
+		relay.resolvePayment(&circuit, hash)
+		return
+	}
 	if err != nil || invoice_state.State != lnc.Accepted {
-		log.Println("error while watching wrapped invoice:", hex.EncodeToString(hash), invoice_state.State, err)
+		log.Println("error while watching wrapped invoice:", circuit.Hash, invoice_state.State, err)
 		if invoice_state.State != lnc.Canceled {
-			err = relay.LN.CancelInvoice(hash)
-			if err != nil {
-				log.Println("error while canceling invoice:", hash, err)
-			}
+			relay.cancelCircuit(&circuit, hash)
+		} else {
+			relay.journal(&circuit, CircuitCanceled)
 		}
 		return
 	}
+	if circuit.State == CircuitUnknown || (circuit.State == CircuitPaying && relay.Payments != nil) {
+		// The payment may have completed before the restart,
+		// so it must not be canceled or attempted again.
+		log.Println("resuming payment in unknown state:", circuit.Hash, circuit.State)
+		relay.resolvePayment(&circuit, hash)
+		return
+	}
+	if invoice_state.CltvExpiryDelta <= relay.CltvDeltaAlpha {
+		// Not enough blocks left to pay the original invoice safely
+		log.Println("not enough cltv left to complete circuit:", circuit.Hash, invoice_state.CltvExpiryDelta)
+		relay.cancelCircuit(&circuit, hash)
+		return
+	}
+	if circuit.State != CircuitPaying {
+		circuit.PaymentStartedAt = time.Now()
+	}
+	relay.journal(&circuit, CircuitPaying)
 	preimage, err := relay.LN.PayInvoice(lnc.PaymentParameters{
-		Invoice:        invoice,
+		Invoice:        circuit.Invoice,
 		TimeoutSeconds: relay.PaymentTimeout,
-		FeeLimitMsat:   fee_budget_msat,
+		FeeLimitMsat:   circuit.FeeBudgetMsat,
 		CltvLimit:      invoice_state.CltvExpiryDelta - relay.CltvDeltaAlpha,
 	})
 	if errors.Is(err, lnc.PaymentFailed) {
-		log.Println("payment failed", hex.EncodeToString(hash), err)
-		err = relay.LN.CancelInvoice(hash)
-		if err != nil {
-			log.Println("error while canceling invoice:", hash, err)
-		}
+		log.Println("payment failed", circuit.Hash, err)
+		relay.cancelCircuit(&circuit, hash)
 		return
 	} else if err != nil {
-		log.Panicln("payment in unknown state:", hex.EncodeToString(hash), err)
+		log.Println("payment in unknown state:", circuit.Hash, err)
+		relay.resolvePayment(&circuit, hash)
+		return
 	}
-	log.Println("preimage:", hex.EncodeToString(preimage), hex.EncodeToString(hash))
+	log.Println("preimage:", hex.EncodeToString(preimage), circuit.Hash)
 	err = relay.LN.SettleInvoice(preimage)
 	if err != nil {
-		log.Panicln("error while settling original invoice:", hex.EncodeToString(hash), err)
+		// The creator was paid, the preimage can be tracked again
+		log.Println("error while settling wrapped invoice:", circuit.Hash, err)
+		relay.resolvePayment(&circuit, hash)
+		return
 	}
+	relay.settleCircuit(&circuit, relay.routingFeePaid(&circuit, hash))
 	log.Println("circuit settled")
 	return
 }
+
+// Tracks a payment to the original invoice whose outcome is unknown until it is resolved.
+// Meanwhile the payer's htlc is held, so the payer is neither refunded
+// before the payment failed nor charged before it succeeded.
+func (relay *Relay) resolvePayment(circuit *Circuit, hash []byte) {
+	if circuit.State != CircuitUnknown {
+		relay.journal(circuit, CircuitUnknown)
+	}
+	if relay.Payments == nil {
+		log.Println("payment tracking unavailable, circuit needs manual recovery:", circuit.Hash)
+		return
+	}
+
+	// lnd registers a payment before it returns from the payment call,
+	// if it still doesn't know it after the payment timeout it was never sent.
+	started := circuit.PaymentStartedAt
+	if started.IsZero() {
+		started = circuit.CreatedAt
+	}
+	timeout := time.Duration(relay.PaymentTimeout) * time.Second
+
+	delay := trackingDelay
+	for {
+		state, err := relay.Payments.TrackPayment(hash, timeout)
+		switch {
+		case err == nil && state.Status == Succeeded:
+			err = relay.LN.SettleInvoice(state.Preimage)
+			if err == nil {
+				relay.settleCircuit(circuit, state.FeeMsat)
+				log.Println("circuit settled after unknown payment state:", circuit.Hash)
+				return
+			}
+			log.Println("error while settling wrapped invoice:", circuit.Hash, err)
+		case err == nil && state.Status == Failed:
+			log.Println("payment failed after unknown state:", circuit.Hash)
+			if relay.cancelCircuit(circuit, hash) == nil {
+				return
+			}
+		case errors.Is(err, PaymentNotFound) && time.Since(started) > timeout:
+			log.Println("payment was never initiated:", circuit.Hash)
+			if relay.cancelCircuit(circuit, hash) == nil {
+				return
+			}
+		case err != nil:
+			log.Println("error while tracking payment:", circuit.Hash, err)
+		}
+
+		select {
+		case <-relay.quit:
+			log.Println("stopped tracking payment:", circuit.Hash)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxTrackingDelay {
+			delay = maxTrackingDelay
+		}
+	}
+}
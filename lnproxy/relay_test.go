@@ -0,0 +1,280 @@
+package relay
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/motxx/lnc"
+)
+
+func TestAdmit(t *testing.T) {
+	type admission struct {
+		client      string
+		amount_msat uint64
+		force       bool
+		err         error
+	}
+	tests := []struct {
+		name       string
+		params     func(*RelayParameters)
+		admissions []admission
+		circuits   uint64
+		clients    uint64
+	}{
+		{
+			name: "open circuits",
+			params: func(p *RelayParameters) {
+				p.MaxOpenCircuits = 2
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 1000},
+				{client: "b", amount_msat: 1000},
+				{client: "c", amount_msat: 1000, err: TooManyCircuits},
+				// Recovered circuits are never rejected
+				{amount_msat: 1000, force: true},
+			},
+			circuits: 3,
+			clients:  2,
+		},
+		{
+			name: "outstanding amount",
+			params: func(p *RelayParameters) {
+				p.MaxOutstandingMsat = 2500
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 1000},
+				{client: "b", amount_msat: 1000},
+				{client: "c", amount_msat: 1000, err: TooMuchOutstanding},
+				{client: "c", amount_msat: 500},
+			},
+			circuits: 3,
+			clients:  3,
+		},
+		{
+			name: "open circuits of a client",
+			params: func(p *RelayParameters) {
+				p.MaxClientOpenCircuits = 2
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 1000},
+				{client: "a", amount_msat: 1000},
+				{client: "a", amount_msat: 1000, err: TooManyClientCircuits},
+				{client: "b", amount_msat: 1000},
+				// Circuits of unknown clients only count against the limits of the whole relay
+				{amount_msat: 1000},
+				{amount_msat: 1000},
+				{amount_msat: 1000},
+				{client: "a", amount_msat: 1000, force: true},
+			},
+			circuits: 7,
+			clients:  2,
+		},
+		{
+			name: "outstanding amount of a client",
+			params: func(p *RelayParameters) {
+				p.MaxClientOutstandingMsat = 2500
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 2000},
+				{client: "a", amount_msat: 1000, err: TooMuchClientOutstanding},
+				{client: "a", amount_msat: 500},
+				{client: "b", amount_msat: 2500},
+				{amount_msat: 2500},
+			},
+			circuits: 4,
+			clients:  2,
+		},
+		{
+			name: "limits of the relay are checked first",
+			params: func(p *RelayParameters) {
+				p.MaxOpenCircuits = 1
+				p.MaxClientOpenCircuits = 1
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 1000},
+				{client: "a", amount_msat: 1000, err: TooManyCircuits},
+			},
+			circuits: 1,
+			clients:  1,
+		},
+		{
+			name: "no limits",
+			params: func(p *RelayParameters) {
+				p.MaxOpenCircuits = 0
+				p.MaxOutstandingMsat = 0
+				p.MaxClientOpenCircuits = 0
+				p.MaxClientOutstandingMsat = 0
+			},
+			admissions: []admission{
+				{client: "a", amount_msat: 1 << 50},
+				{client: "a", amount_msat: 1 << 50},
+			},
+			circuits: 2,
+			clients:  1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay, _ := newTestRelay(t, &fakeLN{})
+			test.params(&relay.RelayParameters)
+
+			admitted := []Circuit{}
+			var outstanding_msat, outbound_msat uint64
+			for i, a := range test.admissions {
+				circuit := testCircuit(byte(i), CircuitOpen)
+				circuit.Client = a.client
+				circuit.AmountMsat = a.amount_msat
+				circuit.OriginalAmountMsat = a.amount_msat / 2
+				err := relay.admit(circuit, a.force)
+				if a.err == nil && err != nil {
+					t.Fatalf("admission %d: %v", i, err)
+				}
+				if a.err != nil && (!errors.Is(err, a.err) || !errors.Is(err, Overloaded)) {
+					t.Fatalf("admission %d: expected %v, got %v", i, a.err, err)
+				}
+				if err == nil {
+					admitted = append(admitted, circuit)
+					outstanding_msat += circuit.AmountMsat
+					outbound_msat += circuit.OriginalAmountMsat + circuit.FeeBudgetMsat
+				}
+			}
+
+			circuits, got_outstanding_msat, got_outbound_msat := relay.Admitted()
+			if circuits != test.circuits || got_outstanding_msat != outstanding_msat || got_outbound_msat != outbound_msat {
+				t.Fatalf("expected %d circuits, %d and %d msat, got %d, %d and %d", test.circuits, outstanding_msat,
+					outbound_msat, circuits, got_outstanding_msat, got_outbound_msat)
+			}
+			if clients := relay.AdmittedClients(); clients != test.clients {
+				t.Fatalf("expected %d clients, got %d", test.clients, clients)
+			}
+
+			for _, circuit := range admitted {
+				relay.release(circuit)
+			}
+			circuits, got_outstanding_msat, got_outbound_msat = relay.Admitted()
+			if circuits != 0 || got_outstanding_msat != 0 || got_outbound_msat != 0 || relay.AdmittedClients() != 0 {
+				t.Fatalf("capacity was not released: %d %d %d %d", circuits, got_outstanding_msat,
+					got_outbound_msat, relay.AdmittedClients())
+			}
+		})
+	}
+}
+
+func TestOpenCircuitAdmission(t *testing.T) {
+	ln := &fakeLN{
+		decoded: lnc.DecodedInvoice{
+			PaymentHash: strings.Repeat("01", 32),
+			Timestamp:   uint64(time.Now().Unix()),
+			Expiry:      3600,
+			NumMsat:     100_000,
+			Destination: "02destination",
+		},
+		fee_msat:   1000,
+		cltv_delta: 40,
+		hold:       make(chan struct{}),
+	}
+	relay, _ := newTestRelay(t, ln)
+	relay.MaxOpenCircuits = 3
+	relay.MaxClientOpenCircuits = 1
+
+	open := func(client string, expected error) {
+		t.Helper()
+		_, err := relay.OpenCircuit(ProxyParameters{Invoice: "lnbcoriginal", Client: client})
+		if expected == nil && err != nil {
+			t.Fatalf("client %q: %v", client, err)
+		}
+		if expected != nil && !errors.Is(err, expected) {
+			t.Fatalf("client %q: expected %v, got %v", client, expected, err)
+		}
+	}
+	open("192.0.2.1", nil)
+	open("192.0.2.1", TooManyClientCircuits)
+	open("192.0.2.2", nil)
+	open("", nil)
+	open("192.0.2.3", TooManyCircuits)
+
+	// Rejected requests add no invoice
+	ln.mu.Lock()
+	added := len(ln.added)
+	ln.mu.Unlock()
+	if added != 3 {
+		t.Fatalf("expected 3 invoices, got %d", added)
+	}
+	if circuits, _, _ := relay.Admitted(); circuits != 3 || relay.AdmittedClients() != 2 {
+		t.Fatalf("expected 3 circuits of 2 clients, got %d of %d", circuits, relay.AdmittedClients())
+	}
+
+	// A failure to add the invoice releases the capacity
+	ln.mu.Lock()
+	ln.add_err = errors.New("lnd unreachable")
+	ln.mu.Unlock()
+	relay.MaxOpenCircuits = 0
+	open("192.0.2.3", ln.add_err)
+	if circuits, _, _ := relay.Admitted(); circuits != 3 || relay.AdmittedClients() != 2 {
+		t.Fatalf("expected 3 circuits of 2 clients, got %d of %d", circuits, relay.AdmittedClients())
+	}
+
+	// Closed circuits release their capacity
+	close(ln.hold)
+	relay.Wait()
+	circuits, outstanding_msat, outbound_msat := relay.Admitted()
+	if circuits != 0 || outstanding_msat != 0 || outbound_msat != 0 || relay.AdmittedClients() != 0 {
+		t.Fatalf("capacity was not released: %d %d %d %d", circuits, outstanding_msat, outbound_msat,
+			relay.AdmittedClients())
+	}
+}
+
+func TestRelayParametersValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		params func(*RelayParameters)
+		err    string
+	}{
+		{name: "defaults", params: func(p *RelayParameters) {}},
+		{
+			name:   "client outstanding below largest invoice",
+			params: func(p *RelayParameters) { p.MaxClientOutstandingMsat = p.MaxAmountMsat - 1 },
+			err:    "max_client_outstanding_msat must not be less than max_amount_msat plus fees",
+		},
+		{
+			// 1_000_000_000 msat are wrapped for 1_001_004_500 msat
+			name:   "fees push largest invoice over client outstanding",
+			params: func(p *RelayParameters) { p.MaxClientOutstandingMsat = p.MaxAmountMsat },
+			err:    "max_client_outstanding_msat must not be less than max_amount_msat plus fees",
+		},
+		{
+			name:   "client outstanding fits largest wrapped invoice",
+			params: func(p *RelayParameters) { p.MaxClientOutstandingMsat = 1_001_004_500 },
+		},
+		{
+			name:   "no client outstanding limit",
+			params: func(p *RelayParameters) { p.MaxClientOutstandingMsat = 0 },
+		},
+		{
+			name:   "outstanding below largest invoice",
+			params: func(p *RelayParameters) { p.MaxOutstandingMsat = p.MaxAmountMsat - 1 },
+			err:    "max_outstanding_msat must not be less than max_amount_msat plus fees",
+		},
+		{
+			name: "fees push largest invoice over outstanding",
+			params: func(p *RelayParameters) {
+				p.RoutingFeePPM = 10_000
+				p.MaxOutstandingMsat = 1_010_004_000
+			},
+			err: "max_outstanding_msat must not be less than max_amount_msat plus fees",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := DefaultRelayParameters()
+			test.params(&params)
+			err := params.Validate()
+			if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}